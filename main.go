@@ -7,10 +7,39 @@ import (
 	"os/signal"
 	"videostreamer/core"
 	"videostreamer/rtmp"
+	"flag"
+	"fmt"
+	"strings"
+	"videostreamer/relay"
+	"time"
+	"net/http"
+	"videostreamer/httpflv"
+	"videostreamer/fmp4"
+	"videostreamer/dash"
+	"videostreamer/hls"
+	"videostreamer/rtsp"
+	"videostreamer/webrtc"
+	"videostreamer/tsudp"
+	"videostreamer/srt"
+	"videostreamer/tshttp"
+	"videostreamer/source"
+	"net"
+	"path"
 )
 
+type multiFlag []string
+
+func (flags *multiFlag) String() string {
+	return strings.Join(*flags, ",")
+}
+
+func (flags *multiFlag) Set(value string) error {
+	*flags = append(*flags, value)
+	return nil
+}
+
 func sigcatch(sig chan os.Signal, latch *syncutil.SyncLatch) {
-	if latch.Running {
+	if latch.IsRunning() {
 		signal.Notify(sig, os.Interrupt)
 		<-sig
 		logger.Newline()
@@ -18,11 +47,159 @@ func sigcatch(sig chan os.Signal, latch *syncutil.SyncLatch) {
 	}
 }
 
+type extMux map[string]http.Handler
+
+func (mux extMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, ok := mux[path.Ext(r.URL.Path)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+func serveHTTP(latch *syncutil.SyncLatch, addr string, handler http.Handler) {
+	server := &http.Server{Addr: addr, Handler: handler}
+	latch.Handle(func() {
+		server.Close()
+	})
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error(err)
+	}
+	latch.Complete()
+}
+
 func main() {
+	config := rtmp.NewConfig()
+	flag.BoolVar(&config.StrictHandshake, "strict-handshake", config.StrictHandshake, "reject RTMP clients sending invalid C2")
+	flag.DurationVar(&config.AggregateWindow, "aggregate", config.AggregateWindow, "pack media sent to RTMP players into aggregate messages spanning this long, 0 disables")
+	ackWindow := flag.Uint("ack-window", uint(config.AckWindow), "acknowledgement window announced to RTMP peers in bytes")
+	flag.DurationVar(&config.HandshakeTimeout, "handshake-timeout", config.HandshakeTimeout, "drop RTMP clients not completing the handshake in time, 0 disables")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "drop RTMP clients neither playing nor publishing for this long, 0 disables")
+	flag.DurationVar(&config.MediaTimeout, "media-timeout", config.MediaTimeout, "drop RTMP publishers sending no media for this long, 0 disables")
+	flag.DurationVar(&config.PingInterval, "ping-interval", config.PingInterval, "interval between RTMP ping requests, 0 disables")
+	flag.DurationVar(&config.PingTimeout, "ping-timeout", config.PingTimeout, "drop RTMP peers silent for this long, 0 disables")
+	peerBandwidth := flag.Uint("peer-bandwidth", uint(config.PeerBandwidth), "peer bandwidth announced to RTMP peers in bytes")
+	var pushes multiFlag
+	flag.Var(&pushes, "push", "republish streams matching [pattern=]rtmp://host/app/{name}, may be repeated")
+	relayAPI := flag.Bool("relay-api", false, "serve push destination control at /relay/ on the HTTP address, GET lists, PUT /relay/{name} with [pattern=]rtmp://host/app/{name} adds, DELETE removes")
+	stats := flag.Bool("stats", false, "serve RTMP connection statistics with RTT and lag as JSON at /stats on the HTTP address")
+	var pulls multiFlag
+	flag.Var(&pulls, "pull", "pull streams without local publisher matching [pattern=]rtmp://origin/app/{name}, may be repeated")
+	httpAddr := flag.String("http", "127.0.0.1:8080", "address serving HTTP-FLV, MSE, HLS, DASH and WHEP playback and WHIP and MPEG-TS ingest, empty disables")
+	hlsConfig := hls.NewConfig()
+	flag.DurationVar(&hlsConfig.Target, "hls-target", hlsConfig.Target, "target HLS segment duration, segments are cut on the next keyframe")
+	flag.IntVar(&hlsConfig.Window, "hls-window", hlsConfig.Window, "number of segments listed in HLS playlists")
+	flag.DurationVar(&hlsConfig.Idle, "hls-idle", hlsConfig.Idle, "stop segmenting a stream after its HLS playlist was not requested for this long")
+	flag.DurationVar(&hlsConfig.Part, "hls-part", hlsConfig.Part, "target LL-HLS partial segment duration, served at /hls/{app}/{name}/ll.m3u8")
+	dashConfig := dash.NewConfig()
+	flag.DurationVar(&dashConfig.Target, "dash-target", dashConfig.Target, "minimum DASH segment duration, segments are cut on the next keyframe")
+	flag.IntVar(&dashConfig.Window, "dash-window", dashConfig.Window, "number of target durations kept in DASH manifests")
+	flag.DurationVar(&dashConfig.Idle, "dash-idle", dashConfig.Idle, "stop packaging a stream after its DASH manifest was not requested for this long")
+	rtspAddr := flag.String("rtsp", "127.0.0.1:8554", "address serving RTSP playback, empty disables")
+	rtspConfig := rtsp.NewConfig()
+	flag.IntVar(&rtspConfig.RTPPort, "rtsp-rtp-port", rtspConfig.RTPPort, "UDP port sending RTP for RTSP players, the next port sends RTCP, 0 allows only interleaved TCP")
+	flag.DurationVar(&rtspConfig.Timeout, "rtsp-timeout", rtspConfig.Timeout, "drop RTSP sessions over UDP after no keepalive for this long")
+	srtAddr := flag.String("srt", "127.0.0.1:9000", "address accepting SRT publishers sending MPEG-TS, streamid names the stream, empty disables")
+	srtConfig := srt.NewConfig()
+	flag.DurationVar(&srtConfig.Latency, "srt-latency", srtConfig.Latency, "minimum SRT receiver latency, the larger of this and the caller's is used")
+	flag.StringVar(&srtConfig.Passphrase, "srt-passphrase", "", "require SRT publishers to encrypt with this passphrase of 10 to 79 characters")
+	var sources multiFlag
+	flag.Var(&sources, "flv-source", "publish stream from an FLV file looped in real time, name=file.flv, may be repeated")
+	var tsOutputs multiFlag
+	flag.Var(&tsOutputs, "ts-udp", "send stream as MPEG-TS over UDP, name=udp://host:port[?ttl=&iface=&muxrate=&delay=&pmt_pid=&video_pid=&audio_pid=], may be repeated")
+	webrtcHost := flag.String("webrtc-host", "127.0.0.1", "address announced as ICE host candidate to WHEP players and WHIP publishers")
+	fragment := flag.Duration("fragment", 0, "cut fMP4 fragments for MSE playback at most this long, 0 cuts per GOP")
+	idle := flag.Duration("pull-idle", 30*time.Second, "drop upstream connection after last subscriber left for this long")
+	pullFourCCs := flag.String("pull-fourcc", "", "Enhanced RTMP codecs requested from pull origins as comma separated FourCCs like hvc1,av01,vp09, empty pulls legacy codecs only")
+	flag.Parse()
+	config.AckWindow = uint32(*ackWindow)
+	config.PeerBandwidth = uint32(*peerBandwidth)
+
 	logger.Level(logger.LOG_ALL)
 	app := core.NewApplication()
+	relays := relay.NewManager(app)
+	for i, spec := range pushes {
+		dest, err := relay.ParseDestination(fmt.Sprintf("push%d", i), spec)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+		relays.Add(dest)
+	}
+	if len(pulls) > 0 {
+		edge := relay.NewEdge(app, *idle)
+		if *pullFourCCs != "" {
+			edge.FourCCs = strings.Split(*pullFourCCs, ",")
+		}
+		for _, spec := range pulls {
+			rule, err := relay.ParseRule(spec)
+			if err != nil {
+				logger.Error(err)
+				os.Exit(1)
+			}
+			edge.AddOrigin(rule)
+		}
+	}
+	if n := len(srtConfig.Passphrase); n > 0 && (n < srt.MIN_PASSPHRASE || n > srt.MAX_PASSPHRASE) {
+		logger.Errorf("SRT passphrase must have %d to %d characters", srt.MIN_PASSPHRASE, srt.MAX_PASSPHRASE)
+		os.Exit(1)
+	}
+	for _, spec := range sources {
+		sourceConfig, err := source.ParseConfig(spec)
+		if err == nil {
+			_, err = source.Start(app, sourceConfig)
+		}
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
+	for _, spec := range tsOutputs {
+		output, err := tsudp.ParseConfig(spec)
+		if err == nil {
+			_, err = tsudp.Start(app, output)
+		}
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
 	latch := syncutil.NewSyncLatch()
-	go rtmp.Serve(app, latch.SubLatch(), "127.0.0.1:1935")
+	go rtmp.Serve(app, latch.SubLatch(), "127.0.0.1:1935", config)
+	if *rtspAddr != "" {
+		go rtsp.Serve(app, latch.SubLatch(), *rtspAddr, rtspConfig)
+	}
+	if *srtAddr != "" {
+		go srt.Serve(app, latch.SubLatch(), *srtAddr, srtConfig)
+	}
+	if *httpAddr != "" {
+		mse := fmp4.NewHandler(app)
+		mse.FragmentDuration = uint32(*fragment / time.Millisecond)
+		mux := http.NewServeMux()
+		mux.Handle("/hls/", http.StripPrefix("/hls", hls.NewHandler(app, hlsConfig)))
+		mux.Handle("/dash/", http.StripPrefix("/dash", dash.NewHandler(app, dashConfig)))
+		webrtcConfig := webrtc.NewConfig()
+		webrtcConfig.Host = net.ParseIP(*webrtcHost)
+		if webrtcConfig.Host == nil {
+			logger.Errorf("Invalid WebRTC host %q", *webrtcHost)
+			os.Exit(1)
+		}
+		mux.Handle("/whep/", http.StripPrefix("/whep", webrtc.NewHandler(app, webrtcConfig)))
+		mux.Handle("/whip/", http.StripPrefix("/whip", webrtc.NewIngestHandler(app, webrtcConfig)))
+		mux.Handle("/ingest/", http.StripPrefix("/ingest", tshttp.NewHandler(app)))
+		if *stats {
+			mux.HandleFunc("/stats", rtmp.ServeStats)
+		}
+		if *relayAPI {
+			mux.Handle("/relay/", http.StripPrefix("/relay", relay.NewHandler(relays)))
+		}
+		mux.Handle("/", extMux{
+			".flv": httpflv.NewHandler(app),
+			".mp4": mse,
+		})
+		go serveHTTP(latch.SubLatch(), *httpAddr, mux)
+	}
 
 	sig := make(chan os.Signal)
 	go sigcatch(sig, latch)
@@ -0,0 +1,86 @@
+package aac
+
+import (
+	"errors"
+	"fmt"
+)
+
+var SampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+func ParseConfig(data []byte) (*Config, error) {
+	if len(data) < 2 {
+		return nil, errors.New("AudioSpecificConfig truncated")
+	}
+	bits := uint32(data[0])<<8 | uint32(data[1])
+	config := &Config{
+		ObjectType: uint8(bits >> 11),
+		FreqIndex:  uint8(bits >> 7 & 0x0f),
+		Channels:   uint8(bits >> 3 & 0x0f),
+	}
+	if config.ObjectType == 31 || config.FreqIndex == 15 {
+		return nil, errors.New("Unsupported AudioSpecificConfig")
+	}
+	if int(config.FreqIndex) >= len(SampleRates) {
+		return nil, errors.New("Bad AAC sample rate index")
+	}
+	config.SampleRate = SampleRates[config.FreqIndex]
+	return config, nil
+}
+
+func MakeConfig(objectType uint8, sampleRate uint32, channels uint8) []byte {
+	index := uint32(4)
+	for i, rate := range SampleRates {
+		if rate == sampleRate {
+			index = uint32(i)
+		}
+	}
+	bits := uint32(objectType)<<11 | index<<7 | uint32(channels)<<3
+	return []byte{byte(bits >> 8), byte(bits)}
+}
+
+func (config *Config) Codec() string {
+	return fmt.Sprintf("mp4a.40.%d", config.ObjectType)
+}
+
+// ADTS builds a frame header. Its 2-bit profile only covers object types 1 to
+// 4, so HE-AAC (5, 29) and anything else is signalled as its AAC-LC core.
+func (config *Config) ADTS(length int) []byte {
+	length += 7
+	profile := config.ObjectType - 1
+	if config.ObjectType < 1 || config.ObjectType > 4 {
+		profile = 1
+	}
+	return []byte{
+		0xff,
+		0xf1,
+		profile<<6 | config.FreqIndex<<2 | config.Channels>>2,
+		config.Channels&3<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length&7)<<5 | 0x1f,
+		0xfc,
+	}
+}
+
+func ParseADTS(data []byte) (config *Config, header int, length int, err error) {
+	if len(data) < 7 || data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+		return nil, 0, 0, errors.New("Bad ADTS sync")
+	}
+	config = &Config{
+		ObjectType: data[2]>>6 + 1,
+		FreqIndex:  data[2] >> 2 & 0x0f,
+		Channels:   data[2]&1<<2 | data[3]>>6,
+	}
+	if int(config.FreqIndex) >= len(SampleRates) {
+		return nil, 0, 0, errors.New("Bad ADTS sample rate index")
+	}
+	config.SampleRate = SampleRates[config.FreqIndex]
+	header = 7
+	if data[1]&1 == 0 {
+		header = 9
+	}
+	length = int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5])>>5
+	if length < header {
+		return nil, 0, 0, errors.New("Bad ADTS frame length")
+	}
+	return
+}
@@ -0,0 +1,36 @@
+package aac
+
+import "testing"
+
+func TestConfig(t *testing.T) {
+	config, err := ParseConfig([]byte{0x12, 0x10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ObjectType != 2 || config.SampleRate != 44100 || config.Channels != 2 || config.Codec() != "mp4a.40.2" {
+		t.Errorf("parsed %+v", config)
+	}
+	if asc := MakeConfig(2, 48000, 1); asc[0] != 0x11 || asc[1] != 0x88 {
+		t.Errorf("made %x", asc)
+	}
+}
+
+func TestADTS(t *testing.T) {
+	config, _ := ParseConfig([]byte{0x11, 0x90})
+	header := config.ADTS(100)
+	parsed, size, length, err := ParseADTS(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 7 || length != 107 || *parsed != *config {
+		t.Errorf("parsed %+v %d %d", parsed, size, length)
+	}
+
+	for _, objectType := range []uint8{5, 29} {
+		he := &Config{ObjectType: objectType, FreqIndex: 6, Channels: 2}
+		parsed, _, _, err = ParseADTS(he.ADTS(100))
+		if err != nil || parsed.ObjectType != 2 || parsed.FreqIndex != 6 || parsed.Channels != 2 {
+			t.Errorf("object type %d in ADTS as %+v: %v", objectType, parsed, err)
+		}
+	}
+}
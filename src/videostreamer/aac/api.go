@@ -0,0 +1,8 @@
+package aac
+
+type Config struct {
+	ObjectType uint8
+	FreqIndex  uint8
+	SampleRate uint32
+	Channels   uint8
+}
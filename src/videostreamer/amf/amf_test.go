@@ -71,7 +71,7 @@ func maketest(val interface{}, t *testing.T) {
 	var buf bytes.Buffer
 	err := EncodeAMF(&buf, val)
 	if err != nil {
-		t.Error("err(%s) != nil", err)
+		t.Errorf("err(%s) != nil", err)
 	}
 
 	res, err := DecodeAMF(&buf)
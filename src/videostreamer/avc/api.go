@@ -0,0 +1,31 @@
+package avc
+
+const (
+	NALU_SLICE = 1
+	NALU_IDR   = 5
+	NALU_SEI   = 6
+	NALU_SPS   = 7
+	NALU_PPS   = 8
+	NALU_AUD   = 9
+)
+
+type Config struct {
+	Profile       uint8
+	Compatibility uint8
+	Level         uint8
+	LengthSize    int
+	SPS           [][]byte
+	PPS           [][]byte
+}
+
+type SPSInfo struct {
+	Profile uint8
+	Level   uint8
+	Width   uint32
+	Height  uint32
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
@@ -0,0 +1,250 @@
+package avc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"videostreamer/binutil"
+	"videostreamer/check"
+)
+
+func ParseConfig(data []byte) (config *Config, err error) {
+	defer check.CheckPanicHandler(&err)
+	rdr := bytes.NewReader(data)
+	if binutil.ReadInt(rdr, 1) != 1 {
+		return nil, errors.New("Unsupported AVCDecoderConfigurationRecord version")
+	}
+	config = &Config{
+		Profile:       uint8(binutil.ReadInt(rdr, 1)),
+		Compatibility: uint8(binutil.ReadInt(rdr, 1)),
+		Level:         uint8(binutil.ReadInt(rdr, 1)),
+		LengthSize:    binutil.ReadInt(rdr, 1)&0x03 + 1,
+	}
+	count := binutil.ReadInt(rdr, 1) & 0x1f
+	for i := 0; i < count; i++ {
+		config.SPS = append(config.SPS, binutil.ReadBuf(rdr, binutil.ReadInt(rdr, 2)))
+	}
+	count = binutil.ReadInt(rdr, 1)
+	for i := 0; i < count; i++ {
+		config.PPS = append(config.PPS, binutil.ReadBuf(rdr, binutil.ReadInt(rdr, 2)))
+	}
+	if len(config.SPS) == 0 {
+		return nil, errors.New("AVCDecoderConfigurationRecord without SPS")
+	}
+	return
+}
+
+func MakeConfig(sps [][]byte, pps [][]byte) []byte {
+	buf := bytes.Buffer{}
+	buf.Write([]byte{1, sps[0][1], sps[0][2], sps[0][3], 0xff, 0xe0 | byte(len(sps))})
+	for _, nalu := range sps {
+		binutil.WriteInt(&buf, len(nalu), 2)
+		buf.Write(nalu)
+	}
+	buf.WriteByte(byte(len(pps)))
+	for _, nalu := range pps {
+		binutil.WriteInt(&buf, len(nalu), 2)
+		buf.Write(nalu)
+	}
+	return buf.Bytes()
+}
+
+func (config *Config) Codec() string {
+	return fmt.Sprintf("avc1.%02x%02x%02x", config.Profile, config.Compatibility, config.Level)
+}
+
+func SplitNALUs(data []byte, size int) (nalus [][]byte) {
+	for len(data) >= size {
+		length := 0
+		for _, b := range data[:size] {
+			length = length<<8 | int(b)
+		}
+		data = data[size:]
+		if length > len(data) {
+			break
+		}
+		nalus = append(nalus, data[:length])
+		data = data[length:]
+	}
+	return
+}
+
+func JoinNALUs(nalus [][]byte) []byte {
+	buf := bytes.Buffer{}
+	for _, nalu := range nalus {
+		binutil.WriteInt(&buf, len(nalu), 4)
+		buf.Write(nalu)
+	}
+	return buf.Bytes()
+}
+
+func SplitAnnexB(data []byte) (nalus [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return
+}
+
+func AnnexB(nalus [][]byte) []byte {
+	buf := bytes.Buffer{}
+	for _, nalu := range nalus {
+		buf.Write([]byte{0, 0, 0, 1})
+		buf.Write(nalu)
+	}
+	return buf.Bytes()
+}
+
+func unescape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func (rdr *bitReader) bit() uint32 {
+	if rdr.pos >= len(rdr.data)*8 {
+		panic(errors.New("SPS truncated"))
+	}
+	bit := rdr.data[rdr.pos/8] >> uint(7-rdr.pos%8) & 1
+	rdr.pos++
+	return uint32(bit)
+}
+
+func (rdr *bitReader) bits(n int) (value uint32) {
+	for i := 0; i < n; i++ {
+		value = value<<1 | rdr.bit()
+	}
+	return
+}
+
+func (rdr *bitReader) ue() uint32 {
+	zeros := 0
+	for rdr.bit() == 0 {
+		zeros++
+		if zeros > 31 {
+			panic(errors.New("Bad exp-golomb code"))
+		}
+	}
+	return (1<<uint(zeros) - 1) + rdr.bits(zeros)
+}
+
+func (rdr *bitReader) se() int32 {
+	value := rdr.ue()
+	if value&1 == 1 {
+		return int32((value + 1) / 2)
+	}
+	return -int32(value / 2)
+}
+
+func (rdr *bitReader) skipScalingList(size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			next = (last + rdr.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+func ParseSPS(sps []byte) (info *SPSInfo, err error) {
+	defer check.CheckPanicHandler(&err)
+	if len(sps) < 4 || sps[0]&0x1f != NALU_SPS {
+		return nil, errors.New("Not an SPS")
+	}
+	rdr := &bitReader{data: unescape(sps[1:])}
+	info = &SPSInfo{}
+	info.Profile = uint8(rdr.bits(8))
+	rdr.bits(8)
+	info.Level = uint8(rdr.bits(8))
+	rdr.ue()
+	chroma := uint32(1)
+	switch info.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = rdr.ue()
+		if chroma == 3 {
+			rdr.bit()
+		}
+		rdr.ue()
+		rdr.ue()
+		rdr.bit()
+		if rdr.bit() == 1 {
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if rdr.bit() == 1 {
+					if i < 6 {
+						rdr.skipScalingList(16)
+					} else {
+						rdr.skipScalingList(64)
+					}
+				}
+			}
+		}
+	}
+	rdr.ue()
+	switch rdr.ue() {
+	case 0:
+		rdr.ue()
+	case 1:
+		rdr.bit()
+		rdr.se()
+		rdr.se()
+		for n := rdr.ue(); n > 0; n-- {
+			rdr.se()
+		}
+	}
+	rdr.ue()
+	rdr.bit()
+	width := rdr.ue() + 1
+	height := rdr.ue() + 1
+	frameMbsOnly := rdr.bit()
+	if frameMbsOnly == 0 {
+		rdr.bit()
+	}
+	rdr.bit()
+	info.Width = width * 16
+	info.Height = (2 - frameMbsOnly) * height * 16
+	if rdr.bit() == 1 {
+		left, right, top, bottom := rdr.ue(), rdr.ue(), rdr.ue(), rdr.ue()
+		cropX, cropY := uint32(1), 2-frameMbsOnly
+		switch chroma {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		info.Width -= (left + right) * cropX
+		info.Height -= (top + bottom) * cropY
+	}
+	return
+}
@@ -0,0 +1,54 @@
+package avc
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	sps480  = []byte{0x67, 0x64, 0x00, 0x1e, 0xac, 0xd9, 0x40, 0xa0, 0x3d, 0xa1, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00, 0x00, 0x03, 0x00, 0x32, 0x0f, 0x16, 0x2d, 0x96}
+	sps1080 = []byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58}
+	pps     = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+func TestParseSPS(t *testing.T) {
+	for _, c := range []struct {
+		sps           []byte
+		width, height uint32
+	}{{sps480, 640, 480}, {sps1080, 1920, 1080}} {
+		info, err := ParseSPS(c.sps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Width != c.width || info.Height != c.height || info.Profile != 100 {
+			t.Errorf("parsed %+v instead of %dx%d", info, c.width, c.height)
+		}
+	}
+	if _, err := ParseSPS(sps480[:6]); err == nil {
+		t.Errorf("truncated SPS parsed")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	config, err := ParseConfig(MakeConfig([][]byte{sps1080}, [][]byte{pps}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LengthSize != 4 || !bytes.Equal(config.SPS[0], sps1080) || !bytes.Equal(config.PPS[0], pps) {
+		t.Errorf("config %+v", config)
+	}
+	if codec := config.Codec(); codec != "avc1.640028" {
+		t.Errorf("codec %s", codec)
+	}
+}
+
+func TestNALUs(t *testing.T) {
+	nalus := [][]byte{sps480, pps, {0x65, 0x88, 0x00, 0x00}}
+	if got := SplitNALUs(JoinNALUs(nalus), 4); len(got) != 3 || !bytes.Equal(got[2], nalus[2]) {
+		t.Errorf("length prefixed round trip %x", got)
+	}
+	annexb := append([]byte{0, 0, 1}, AnnexB(nalus)...)
+	if got := SplitAnnexB(annexb[3:]); len(got) != 3 || !bytes.Equal(got[0], sps480) || !bytes.Equal(got[2], nalus[2]) {
+		t.Errorf("annex b round trip %x", got)
+	}
+}
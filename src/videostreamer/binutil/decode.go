@@ -8,7 +8,7 @@ import (
 
 func ReadBuf(in io.Reader, size int) (buf []byte) {
 	buf = make([]byte, size)
-	check.Check1(in.Read(buf))
+	check.Check1(io.ReadFull(in, buf))
 	return
 }
 
@@ -1,9 +1,37 @@
 package core
 
+import "sync"
+
+const VIDEO_CODEC_AVC = 7
+
+const VIDEO_FRAME_KEY = 1
+
+const AUDIO_CODEC_AAC = 10
+
+const (
+	PACKET_TYPE_SEQUENCE_START         = 0
+	PACKET_TYPE_CODED_FRAMES           = 1
+	PACKET_TYPE_SEQUENCE_END           = 2
+	PACKET_TYPE_CODED_FRAMES_X         = 3
+	PACKET_TYPE_METADATA               = 4
+	PACKET_TYPE_MPEG2TS_SEQUENCE_START = 5
+	PACKET_TYPE_MULTITRACK             = 6
+	PACKET_TYPE_MODEX                  = 7
+)
+
+const (
+	FOURCC_AV1  = "av01"
+	FOURCC_VP9  = "vp09"
+	FOURCC_HEVC = "hvc1"
+)
+
+var FOURCCS = []string{FOURCC_AV1, FOURCC_VP9, FOURCC_HEVC}
+
 type MetaData struct {
-	Width     uint32
-	Height    uint32
-	Framerate uint32
+	Width      uint32
+	Height     uint32
+	Framerate  uint32
+	VideoCodec uint32
 }
 
 type VideoData struct {
@@ -23,10 +51,15 @@ type Stream struct {
 	KeyVideo  *VideoData
 	KeyAudio  *AudioData
 	Published bool
+	Watchers  []func(*Stream)
+	owner     interface{}
+	mutex     sync.RWMutex
 }
 
 type Application struct {
-	Streams map[string]*Stream
+	Streams  map[string]*Stream
+	Handlers []func(*Stream)
+	mutex    sync.RWMutex
 }
 
 type Consumer interface {
@@ -35,4 +68,9 @@ type Consumer interface {
 	ConsumeMeta(*MetaData)
 	Publish()
 	Unpublish()
+}
+
+// Passive consumers feed another output rather than a viewer, so they are left out of Subscribers.
+type Passive interface {
+	Passive()
 }
\ No newline at end of file
@@ -7,6 +7,7 @@ func NewApplication() *Application {
 }
 
 func (app *Application) AcquireStream(name string) *Stream {
+	app.mutex.Lock()
 	stream, ok := app.Streams[name]
 	if !ok {
 		stream = &Stream{
@@ -14,5 +15,27 @@ func (app *Application) AcquireStream(name string) *Stream {
 		}
 		app.Streams[name] = stream
 	}
+	handlers := app.Handlers
+	app.mutex.Unlock()
+	if !ok {
+		for _, h := range handlers {
+			h(stream)
+		}
+	}
 	return stream
-}
\ No newline at end of file
+}
+
+func (app *Application) Handle(f func(*Stream)) {
+	app.mutex.Lock()
+	app.Handlers = append(app.Handlers, f)
+	app.mutex.Unlock()
+}
+
+func (app *Application) ListStreams() (streams []*Stream) {
+	app.mutex.RLock()
+	for _, s := range app.Streams {
+		streams = append(streams, s)
+	}
+	app.mutex.RUnlock()
+	return
+}
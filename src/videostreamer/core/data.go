@@ -1,6 +1,9 @@
 package core
 
-import "videostreamer/binutil"
+import (
+	"encoding/binary"
+	"videostreamer/binutil"
+)
 
 func NewVideoData(time uint32, data []byte) *VideoData {
 	return &VideoData{
@@ -22,4 +25,77 @@ func NewMetaData(width uint32, height uint32, framerate uint32) *MetaData {
 		Height:    height,
 		Framerate: framerate,
 	}
-}
\ No newline at end of file
+}
+
+func (data *VideoData) Enhanced() bool {
+	return len(data.Data) > 0 && data.Data[0]&0x80 != 0
+}
+
+func (data *VideoData) IsAVC() bool {
+	return len(data.Data) > 0 && !data.Enhanced() && data.Data[0]&0x0f == VIDEO_CODEC_AVC
+}
+
+func (data *AudioData) IsAAC() bool {
+	return len(data.Data) > 0 && data.Data[0]>>4 == AUDIO_CODEC_AAC
+}
+
+func (data *VideoData) IsKeyFrame() bool {
+	return len(data.Data) > 0 && data.Data[0]>>4&7 == VIDEO_FRAME_KEY
+}
+
+// ExHeader parses the Enhanced RTMP header, skipping ModEx prefixes. Multitrack
+// packets carry their FourCC per track and report an empty one.
+func (data *VideoData) ExHeader() (packet uint8, fourcc string, ok bool) {
+	d := data.Data
+	if !data.Enhanced() {
+		return
+	}
+	packet = d[0] & 0x0f
+	i := 1
+	for packet == PACKET_TYPE_MODEX {
+		if i >= len(d) {
+			return 0, "", false
+		}
+		size := int(d[i]) + 1
+		i++
+		if size == 256 {
+			if i+2 > len(d) {
+				return 0, "", false
+			}
+			size = (int(d[i])<<8 | int(d[i+1])) + 1
+			i += 2
+		}
+		i += size
+		if i >= len(d) {
+			return 0, "", false
+		}
+		packet = d[i] & 0x0f
+		i++
+	}
+	if packet == PACKET_TYPE_MULTITRACK {
+		return packet, "", true
+	}
+	if i+4 > len(d) {
+		return 0, "", false
+	}
+	return packet, string(d[i : i+4]), true
+}
+
+func (data *VideoData) IsSequenceHeader() bool {
+	if data.Enhanced() {
+		packet, _, ok := data.ExHeader()
+		return ok && packet == PACKET_TYPE_SEQUENCE_START
+	}
+	return len(data.Data) > 1 && data.Data[1] == 0
+}
+
+// CodecID is the onMetaData videocodecid: the FLV codec ID or the FourCC as a number.
+func (data *VideoData) CodecID() uint32 {
+	if _, fourcc, ok := data.ExHeader(); ok && len(fourcc) == 4 {
+		return binary.BigEndian.Uint32([]byte(fourcc))
+	}
+	if len(data.Data) == 0 || data.Enhanced() {
+		return 0
+	}
+	return uint32(data.Data[0] & 0x0f)
+}
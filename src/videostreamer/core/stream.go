@@ -1,10 +1,14 @@
 package core
 
 func (stream *Stream) Subscribe(consumer Consumer) {
+	stream.mutex.Lock()
 	stream.Consumers = append(stream.Consumers, consumer)
+	stream.mutex.Unlock()
+	stream.notify()
 }
 
 func (stream *Stream) Unsubscribe(consumer Consumer) {
+	stream.mutex.Lock()
 	l := len(stream.Consumers)-1
 	for i, c := range stream.Consumers {
 		if c == consumer {
@@ -13,64 +17,198 @@ func (stream *Stream) Unsubscribe(consumer Consumer) {
 			break
 		}
 	}
+	stream.mutex.Unlock()
+	stream.notify()
 }
 
-func (stream *Stream) Publish() {
+func (stream *Stream) Watch(f func(*Stream)) {
+	stream.mutex.Lock()
+	stream.Watchers = append(stream.Watchers, f)
+	stream.mutex.Unlock()
+}
+
+func (stream *Stream) notify() {
+	stream.mutex.RLock()
+	watchers := stream.Watchers
+	stream.mutex.RUnlock()
+	for _, w := range watchers {
+		w(stream)
+	}
+}
+
+func (stream *Stream) Subscribers() int {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	n := 0
 	for _, c := range stream.Consumers {
+		if _, ok := c.(Passive); !ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (stream *Stream) consumers() []Consumer {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	return append([]Consumer(nil), stream.Consumers...)
+}
+
+func (stream *Stream) IsPublished() bool {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	return stream.Published
+}
+
+// Keys returns the cached metadata and sequence headers a joining consumer starts from.
+func (stream *Stream) Keys() (meta *MetaData, video *VideoData, audio *AudioData) {
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	return stream.Metadata, stream.KeyVideo, stream.KeyAudio
+}
+
+// Claim reserves the stream for one publisher. It fails while another publisher
+// holds the claim or the stream is already published.
+func (stream *Stream) Claim(owner interface{}) bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.Published || stream.owner != nil {
+		return false
+	}
+	stream.owner = owner
+	return true
+}
+
+// Release frees the claim of owner and tells the watchers, so one that failed
+// to claim the stream meanwhile can try again.
+func (stream *Stream) Release(owner interface{}) {
+	stream.mutex.Lock()
+	released := stream.owner == owner
+	if released {
+		stream.owner = nil
+	}
+	stream.mutex.Unlock()
+	if released {
+		stream.notify()
+	}
+}
+
+func (stream *Stream) Publish() {
+	for _, c := range stream.consumers() {
 		stream.Bootstrap(c)
 	}
+	stream.mutex.Lock()
 	stream.Published = true
+	stream.mutex.Unlock()
+	stream.notify()
 }
 
 func (stream *Stream) Bootstrap(c Consumer) {
+	meta, video, audio := stream.Keys()
 	c.Publish()
-	if stream.Metadata != nil {
-		c.ConsumeMeta(stream.Metadata)
+	if meta != nil {
+		c.ConsumeMeta(meta)
 	}
-	if stream.KeyVideo != nil {
-		c.ConsumeVideo(stream.KeyVideo)
+	if video != nil {
+		c.ConsumeVideo(video)
 	}
-	if stream.KeyAudio != nil {
-		c.ConsumeAudio(stream.KeyAudio)
+	if audio != nil {
+		c.ConsumeAudio(audio)
 	}
 }
 
 func (stream *Stream) Unpublish() {
-	for _, c := range stream.Consumers {
+	for _, c := range stream.consumers() {
 		c.Unpublish()
 	}
+	stream.mutex.Lock()
 	stream.Published = false
+	stream.mutex.Unlock()
+	stream.notify()
 }
 
 func (stream *Stream) BroadcastVideo(data *VideoData) {
-	if stream.KeyVideo != nil {
-		stream.KeyVideo.Time = data.Time
+	stream.mutex.Lock()
+	if key := stream.KeyVideo; key != nil && key.Time != data.Time {
+		stream.KeyVideo = &VideoData{Time: data.Time, Data: key.Data}
 	}
-	if !stream.Published {
+	published := stream.Published
+	stream.mutex.Unlock()
+	if !published {
 		return
 	}
-	for _, c := range stream.Consumers {
+	for _, c := range stream.consumers() {
 		c.ConsumeVideo(data)
 	}
 }
 
 func (stream *Stream) BroadcastAudio(data *AudioData) {
-	if stream.KeyAudio != nil {
-		stream.KeyAudio.Time = data.Time
+	stream.mutex.Lock()
+	if key := stream.KeyAudio; key != nil && key.Time != data.Time {
+		stream.KeyAudio = &AudioData{Time: data.Time, Data: key.Data}
 	}
-	if !stream.Published {
+	published := stream.Published
+	stream.mutex.Unlock()
+	if !published {
 		return
 	}
-	for _, c := range stream.Consumers {
+	for _, c := range stream.consumers() {
 		c.ConsumeAudio(data)
 	}
 }
 
 func (stream *Stream) BroadcastMeta(data *MetaData) {
-	if !stream.Published {
+	if !stream.IsPublished() {
 		return
 	}
-	for _, c := range stream.Consumers {
+	for _, c := range stream.consumers() {
 		c.ConsumeMeta(data)
 	}
+}
+
+func (stream *Stream) ReceiveVideo(data *VideoData) {
+	if data.IsSequenceHeader() {
+		stream.mutex.Lock()
+		stream.KeyVideo = data
+		if stream.Metadata != nil {
+			stream.Metadata = stream.codecMeta(stream.Metadata)
+		}
+		published := stream.Published
+		stream.mutex.Unlock()
+		if !published {
+			stream.Publish()
+		}
+	}
+	stream.BroadcastVideo(data)
+}
+
+func (stream *Stream) ReceiveAudio(data *AudioData) {
+	if len(data.Data) > 1 && data.IsAAC() && data.Data[1] == 0 {
+		stream.mutex.Lock()
+		stream.KeyAudio = data
+		stream.mutex.Unlock()
+	}
+	stream.BroadcastAudio(data)
+}
+
+func (stream *Stream) ReceiveMeta(data *MetaData) {
+	stream.mutex.Lock()
+	data = stream.codecMeta(data)
+	stream.Metadata = data
+	stream.mutex.Unlock()
+	stream.BroadcastMeta(data)
+}
+
+// codecMeta makes videocodecid follow the cached sequence header rather than what the publisher claims.
+func (stream *Stream) codecMeta(data *MetaData) *MetaData {
+	if stream.KeyVideo == nil {
+		return data
+	}
+	codec := stream.KeyVideo.CodecID()
+	if codec == 0 || codec == data.VideoCodec {
+		return data
+	}
+	meta := *data
+	meta.VideoCodec = codec
+	return &meta
 }
\ No newline at end of file
@@ -0,0 +1,70 @@
+package dash
+
+import (
+	"sync"
+	"time"
+	"videostreamer/core"
+	"videostreamer/fmp4"
+)
+
+const (
+	DEFAULT_TARGET = 2 * time.Second
+	DEFAULT_WINDOW = 6
+	DEFAULT_IDLE   = 30 * time.Second
+	KEEP_BEHIND    = 2
+	TIMESCALE      = 1000
+)
+
+type Config struct {
+	Target time.Duration
+	Window int
+	Idle   time.Duration
+}
+
+type Segment struct {
+	Time     uint32
+	Duration uint32
+	Data     []byte
+}
+
+type Representation struct {
+	ID       string
+	Track    *fmp4.Track
+	Init     []byte
+	Segments []*Segment
+	pending  *Segment
+	muxer    *fmp4.Muxer
+}
+
+type Period struct {
+	ID      int
+	Start   uint32
+	started bool
+	Video   *Representation
+	Audio   *Representation
+}
+
+type Packager struct {
+	Stream  *core.Stream
+	Config  *Config
+	Start   time.Time
+	Periods []*Period
+	periods int
+	based   bool
+	ended   bool
+	ready   chan struct{}
+	isReady bool
+	mutex   sync.Mutex
+}
+
+type entry struct {
+	Packager *Packager
+	idle     *time.Timer
+}
+
+type Handler struct {
+	App     *core.Application
+	Config  *Config
+	entries map[string]*entry
+	mutex   sync.Mutex
+}
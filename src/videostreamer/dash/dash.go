@@ -0,0 +1,125 @@
+package dash
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"videostreamer/core"
+	"videostreamer/httpflv"
+	"videostreamer/logger"
+)
+
+func NewHandler(app *core.Application, config *Config) *Handler {
+	return &Handler{
+		App:     app,
+		Config:  config,
+		entries: make(map[string]*entry),
+	}
+}
+
+func ParsePath(path string) (name string, file string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func (handler *Handler) packager(name string, create bool) *Packager {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	e := handler.entries[name]
+	if e == nil {
+		if !create {
+			return nil
+		}
+		stream := handler.App.AcquireStream(name)
+		e = &entry{Packager: NewPackager(stream, handler.Config)}
+		handler.entries[name] = e
+		e.idle = time.AfterFunc(handler.Config.Idle, func() {
+			handler.drop(name, e)
+		})
+		logger.Infof("Packaging %s for DASH", name)
+		if stream.IsPublished() {
+			stream.Bootstrap(e.Packager)
+		}
+		stream.Subscribe(e.Packager)
+	}
+	e.idle.Reset(handler.Config.Idle)
+	return e.Packager
+}
+
+func (handler *Handler) drop(name string, e *entry) {
+	handler.mutex.Lock()
+	if handler.entries[name] == e {
+		delete(handler.entries, name)
+	}
+	handler.mutex.Unlock()
+	e.Packager.Stream.Unsubscribe(e.Packager)
+	logger.Infof("Stopped packaging idle %s for DASH", name)
+}
+
+func timeURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	path := strings.SplitN(r.RequestURI, "?", 2)[0]
+	return scheme + "://" + r.Host + strings.TrimSuffix(path, r.URL.Path) + "/time"
+}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if httpflv.Cors(w, r) {
+		return
+	}
+	if r.URL.Path == "/time" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(timestamp(time.Now())))
+		return
+	}
+	name, file, ok := ParsePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if file == "index.mpd" {
+		handler.serveManifest(w, r, name)
+	} else {
+		handler.serveMedia(w, r, name, file)
+	}
+}
+
+func (handler *Handler) serveManifest(w http.ResponseWriter, r *http.Request, name string) {
+	packager := handler.packager(name, true)
+	select {
+	case <-packager.ready:
+	case <-time.After(3 * handler.Config.Target):
+		http.NotFound(w, r)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(packager.Manifest(timeURL(r))))
+}
+
+func (handler *Handler) serveMedia(w http.ResponseWriter, r *http.Request, name string, file string) {
+	packager := handler.packager(name, false)
+	if packager == nil {
+		http.NotFound(w, r)
+		return
+	}
+	data, video := packager.Media(file)
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if video {
+		w.Header().Set("Content-Type", "video/mp4")
+	} else {
+		w.Header().Set("Content-Type", "audio/mp4")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,109 @@
+package dash
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/core"
+	"videostreamer/testutil"
+)
+
+func TestPackager(t *testing.T) {
+	config := NewConfig()
+	packager := NewPackager(&core.Stream{Name: "cam"}, config)
+	packager.ConsumeVideo(core.NewVideoData(0, testutil.Seq))
+	packager.ConsumeAudio(core.NewAudioData(0, testutil.AudioSeq))
+	testutil.Feed(packager.ConsumeVideo, packager.ConsumeAudio, 0, 6500)
+
+	manifest := packager.Manifest("http://example.com/dash/time")
+	for _, want := range []string{
+		"type=\"dynamic\"",
+		"<Period id=\"1\" start=\"PT0.000S\">",
+		"<SegmentTemplate timescale=\"1000\" initialization=\"p1-$RepresentationID$-init.mp4\" media=\"p1-$RepresentationID$-$Time$.m4s\">",
+		"<S t=\"0\" d=\"2000\" r=\"2\"/>",
+		"<Representation id=\"video\" codecs=\"avc1.64001e\"",
+		"width=\"640\" height=\"480\"/>",
+		"<Representation id=\"audio\" codecs=\"mp4a.40.2\"",
+		"audioSamplingRate=\"44100\"",
+		"value=\"2\"/>",
+		"<UTCTiming schemeIdUri=\"urn:mpeg:dash:utc:http-iso:2014\" value=\"http://example.com/dash/time\"/>",
+	} {
+		if !strings.Contains(manifest, want) {
+			t.Errorf("manifest lacks %q:\n%s", want, manifest)
+		}
+	}
+	if data, video := packager.Media("p1-video-2000.m4s"); data == nil || !video {
+		t.Error("video segment not served")
+	}
+	if data, video := packager.Media("p1-audio-init.mp4"); data == nil || video {
+		t.Error("audio init not served")
+	}
+	if data, _ := packager.Media("p1-video-1000.m4s"); data != nil {
+		t.Error("served segment at wrong time")
+	}
+
+	packager.Unpublish()
+	packager.Publish()
+	packager.ConsumeVideo(core.NewVideoData(0, testutil.Seq))
+	packager.ConsumeAudio(core.NewAudioData(0, testutil.AudioSeq))
+	testutil.Feed(packager.ConsumeVideo, packager.ConsumeAudio, 0, 2500)
+	manifest = packager.Manifest("")
+	if !strings.Contains(manifest, "<Period id=\"2\" start=\"PT6.") || !strings.Contains(manifest, "media=\"p2-$RepresentationID$-$Time$.m4s\"") {
+		t.Errorf("no second period after republish:\n%s", manifest)
+	}
+}
+
+func attached(handler *Handler) bool {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	return len(handler.entries) > 0
+}
+
+func TestHTTP(t *testing.T) {
+	app := core.NewApplication()
+	config := NewConfig()
+	config.Target = time.Second
+	mux := http.NewServeMux()
+	handler := NewHandler(app, config)
+	mux.Handle("/dash/", http.StripPrefix("/dash", handler))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	stream := app.AcquireStream("cam")
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	stream.ReceiveAudio(core.NewAudioData(0, testutil.AudioSeq))
+	go func() {
+		for deadline := time.Now().Add(5 * time.Second); !attached(handler) && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		testutil.Feed(stream.ReceiveVideo, stream.ReceiveAudio, 0, 3500)
+	}()
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	resp, body := get("/dash/live/cam/index.mpd")
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/dash+xml" || !strings.Contains(body, "value=\""+server.URL+"/dash/time\"") {
+		t.Fatalf("manifest %d:\n%s", resp.StatusCode, body)
+	}
+	resp, body = get("/dash/live/cam/p1-video-0.m4s")
+	if resp.StatusCode != 200 || !strings.Contains(body, "moof") {
+		t.Errorf("segment %d with %d bytes", resp.StatusCode, len(body))
+	}
+	resp, body = get("/dash/time")
+	if _, err := time.Parse("2006-01-02T15:04:05.000Z", body); resp.StatusCode != 200 || err != nil {
+		t.Errorf("time %d: %q", resp.StatusCode, body)
+	}
+	if resp, _ = get("/dash/live/cam/p1-video-99.m4s"); resp.StatusCode != 404 {
+		t.Errorf("missing segment served with %d", resp.StatusCode)
+	}
+}
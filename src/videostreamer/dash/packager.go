@@ -0,0 +1,345 @@
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"videostreamer/core"
+	"videostreamer/fmp4"
+	"videostreamer/logger"
+)
+
+func NewConfig() *Config {
+	return &Config{
+		Target: DEFAULT_TARGET,
+		Window: DEFAULT_WINDOW,
+		Idle:   DEFAULT_IDLE,
+	}
+}
+
+func NewPackager(stream *core.Stream, config *Config) *Packager {
+	packager := &Packager{
+		Stream: stream,
+		Config: config,
+		ready:  make(chan struct{}),
+	}
+	packager.period()
+	return packager
+}
+
+func (packager *Packager) target() uint32 {
+	return uint32(packager.Config.Target / time.Millisecond)
+}
+
+func (packager *Packager) period() {
+	packager.periods++
+	period := &Period{ID: packager.periods}
+	period.Video = packager.representation(period, "video")
+	period.Audio = packager.representation(period, "audio")
+	packager.Periods = append(packager.Periods, period)
+	packager.based = false
+}
+
+func (packager *Packager) representation(period *Period, id string) *Representation {
+	representation := &Representation{ID: id}
+	muxer := fmp4.NewMuxer(0)
+	if id == "video" {
+		muxer.SkipAudio = true
+	} else {
+		muxer.SkipVideo = true
+		muxer.FragmentDuration = packager.target()
+	}
+	muxer.OnInit = func(init []byte) {
+		representation.Init = init
+		representation.Track = muxer.Audio
+		if id == "video" {
+			representation.Track = muxer.Video
+		}
+	}
+	muxer.OnFragment = func(fragment *fmp4.Fragment) {
+		packager.fragment(period, representation, fragment)
+	}
+	representation.muxer = muxer
+	return representation
+}
+
+func (packager *Packager) current() *Period {
+	return packager.Periods[len(packager.Periods)-1]
+}
+
+func (packager *Packager) end() (end uint32) {
+	for _, period := range packager.Periods {
+		for _, representation := range []*Representation{period.Video, period.Audio} {
+			if n := len(representation.Segments); n > 0 {
+				last := representation.Segments[n-1]
+				if e := period.Start + last.Time + last.Duration; e > end {
+					end = e
+				}
+			}
+		}
+	}
+	return
+}
+
+func (packager *Packager) fragment(period *Period, representation *Representation, fragment *fmp4.Fragment) {
+	if !period.started {
+		period.started = true
+		now := time.Now()
+		end := fragment.Time + fragment.Duration
+		if packager.Start.IsZero() {
+			packager.Start = now.Add(-time.Duration(end) * time.Millisecond)
+		} else {
+			if elapsed := uint32(now.Sub(packager.Start) / time.Millisecond); elapsed > end {
+				period.Start = elapsed - end
+			}
+			if last := packager.end(); period.Start < last {
+				period.Start = last
+			}
+		}
+	}
+	pending := representation.pending
+	if pending == nil {
+		pending = &Segment{Time: fragment.Time}
+		representation.pending = pending
+	}
+	pending.Duration = fragment.Time + fragment.Duration - pending.Time
+	pending.Data = append(pending.Data, fragment.Data...)
+	if pending.Duration >= packager.target() {
+		packager.finish(representation)
+	}
+}
+
+func (packager *Packager) finish(representation *Representation) {
+	if representation.pending == nil {
+		return
+	}
+	representation.Segments = append(representation.Segments, representation.pending)
+	representation.pending = nil
+	packager.trim()
+	if !packager.isReady {
+		packager.isReady = true
+		close(packager.ready)
+	}
+}
+
+func (packager *Packager) trim() {
+	end := packager.end()
+	keep := uint32(packager.Config.Window+KEEP_BEHIND) * packager.target()
+	for _, period := range packager.Periods {
+		for _, representation := range []*Representation{period.Video, period.Audio} {
+			for len(representation.Segments) > 0 {
+				first := representation.Segments[0]
+				if period.Start+first.Time+first.Duration+keep >= end {
+					break
+				}
+				representation.Segments = representation.Segments[1:]
+			}
+		}
+	}
+	for len(packager.Periods) > 1 && len(packager.Periods[0].Video.Segments) == 0 && len(packager.Periods[0].Audio.Segments) == 0 {
+		packager.Periods = packager.Periods[1:]
+	}
+}
+
+func (packager *Packager) Passive() {
+}
+
+func (packager *Packager) Publish() {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+	if packager.ended {
+		packager.ended = false
+		packager.period()
+	}
+}
+
+func (packager *Packager) Unpublish() {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+	period := packager.current()
+	for _, representation := range []*Representation{period.Video, period.Audio} {
+		representation.muxer.Flush()
+		packager.finish(representation)
+	}
+	packager.ended = true
+}
+
+func (packager *Packager) rebase(period *Period, d []byte, time uint32) {
+	if !packager.based && len(d) > 1 && d[1] == 1 {
+		packager.based = true
+		period.Video.muxer.Rebase(time)
+		period.Audio.muxer.Rebase(time)
+	}
+}
+
+func (packager *Packager) ConsumeVideo(data *core.VideoData) {
+	if !data.IsAVC() {
+		return
+	}
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+	period := packager.current()
+	packager.rebase(period, data.Data, data.Time)
+	if err := period.Video.muxer.WriteVideo(data); err != nil {
+		logger.Warnf("Cannot package video of %s: %v", packager.Stream.Name, err)
+	}
+}
+
+func (packager *Packager) ConsumeAudio(data *core.AudioData) {
+	if !data.IsAAC() {
+		return
+	}
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+	period := packager.current()
+	packager.rebase(period, data.Data, data.Time)
+	if err := period.Audio.muxer.WriteAudio(data); err != nil {
+		logger.Warnf("Cannot package audio of %s: %v", packager.Stream.Name, err)
+	}
+}
+
+func (packager *Packager) ConsumeMeta(data *core.MetaData) {}
+
+func duration(ms uint32) string {
+	return fmt.Sprintf("PT%.3fS", float64(ms)/1000)
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (representation *Representation) bandwidth() uint64 {
+	size, length := uint64(0), uint64(0)
+	for _, segment := range representation.Segments {
+		size += uint64(len(segment.Data))
+		length += uint64(segment.Duration)
+	}
+	if length == 0 {
+		return 1
+	}
+	return size * 8 * 1000 / length
+}
+
+func (packager *Packager) adaptation(buf *bytes.Buffer, period *Period, representation *Representation, from uint32) {
+	segments := []*Segment{}
+	for _, segment := range representation.Segments {
+		if period.Start+segment.Time+segment.Duration > from {
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 || representation.Track == nil {
+		return
+	}
+	track := representation.Track
+	kind := "audio"
+	if track.Video {
+		kind = "video"
+	}
+	fmt.Fprintf(buf, "    <AdaptationSet contentType=\"%s\" mimeType=\"%s/mp4\" segmentAlignment=\"true\" startWithSAP=\"1\">\n", kind, kind)
+	fmt.Fprintf(buf, "      <SegmentTemplate timescale=\"%d\" initialization=\"p%d-$RepresentationID$-init.mp4\" media=\"p%d-$RepresentationID$-$Time$.m4s\">\n", TIMESCALE, period.ID, period.ID)
+	buf.WriteString("        <SegmentTimeline>\n")
+	for i := 0; i < len(segments); {
+		segment := segments[i]
+		repeat := 0
+		for i+repeat+1 < len(segments) && segments[i+repeat+1].Duration == segment.Duration && segments[i+repeat+1].Time == segments[i+repeat].Time+segment.Duration {
+			repeat++
+		}
+		if repeat > 0 {
+			fmt.Fprintf(buf, "          <S t=\"%d\" d=\"%d\" r=\"%d\"/>\n", segment.Time, segment.Duration, repeat)
+		} else {
+			fmt.Fprintf(buf, "          <S t=\"%d\" d=\"%d\"/>\n", segment.Time, segment.Duration)
+		}
+		i += repeat + 1
+	}
+	buf.WriteString("        </SegmentTimeline>\n      </SegmentTemplate>\n")
+	if track.Video {
+		fmt.Fprintf(buf, "      <Representation id=\"%s\" codecs=\"%s\" bandwidth=\"%d\" width=\"%d\" height=\"%d\"/>\n", representation.ID, track.Codec, representation.bandwidth(), track.Width, track.Height)
+	} else {
+		fmt.Fprintf(buf, "      <Representation id=\"%s\" codecs=\"%s\" bandwidth=\"%d\" audioSamplingRate=\"%d\">\n", representation.ID, track.Codec, representation.bandwidth(), track.SampleRate)
+		fmt.Fprintf(buf, "        <AudioChannelConfiguration schemeIdUri=\"urn:mpeg:dash:23003:3:audio_channel_configuration:2011\" value=\"%d\"/>\n", track.Channels)
+		buf.WriteString("      </Representation>\n")
+	}
+	buf.WriteString("    </AdaptationSet>\n")
+}
+
+func (packager *Packager) Manifest(utc string) string {
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+	target := packager.target()
+	depth := uint32(packager.Config.Window) * target
+	end := packager.end()
+	from := uint32(0)
+	if end > depth {
+		from = end - depth
+	}
+	longest := target
+	for _, period := range packager.Periods {
+		for _, representation := range []*Representation{period.Video, period.Audio} {
+			for _, segment := range representation.Segments {
+				if segment.Duration > longest {
+					longest = segment.Duration
+				}
+			}
+		}
+	}
+	now := time.Now()
+	buf := bytes.Buffer{}
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(&buf, "<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"dynamic\" availabilityStartTime=\"%s\" publishTime=\"%s\" minimumUpdatePeriod=\"%s\" minBufferTime=\"%s\" timeShiftBufferDepth=\"%s\" suggestedPresentationDelay=\"%s\" maxSegmentDuration=\"%s\">\n",
+		timestamp(packager.Start), timestamp(now), duration(target), duration(target), duration(depth), duration(3*target), duration(longest))
+	for _, period := range packager.Periods {
+		body := bytes.Buffer{}
+		packager.adaptation(&body, period, period.Video, from)
+		packager.adaptation(&body, period, period.Audio, from)
+		if body.Len() == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "  <Period id=\"%d\" start=\"%s\">\n", period.ID, duration(period.Start))
+		buf.Write(body.Bytes())
+		buf.WriteString("  </Period>\n")
+	}
+	fmt.Fprintf(&buf, "  <UTCTiming schemeIdUri=\"urn:mpeg:dash:utc:http-iso:2014\" value=\"%s\"/>\n", utc)
+	fmt.Fprintf(&buf, "  <UTCTiming schemeIdUri=\"urn:mpeg:dash:utc:direct:2014\" value=\"%s\"/>\n", timestamp(now))
+	buf.WriteString("</MPD>\n")
+	return buf.String()
+}
+
+func (packager *Packager) Media(file string) (data []byte, video bool) {
+	fields := strings.Split(strings.TrimPrefix(file, "p"), "-")
+	if len(fields) != 3 {
+		return nil, false
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, false
+	}
+	packager.mutex.Lock()
+	defer packager.mutex.Unlock()
+	for _, period := range packager.Periods {
+		if period.ID != id {
+			continue
+		}
+		representation := period.Audio
+		if fields[1] == period.Video.ID {
+			representation = period.Video
+		} else if fields[1] != period.Audio.ID {
+			return nil, false
+		}
+		video = representation == period.Video
+		if fields[2] == "init.mp4" {
+			return representation.Init, video
+		}
+		time, err := strconv.ParseUint(strings.TrimSuffix(fields[2], ".m4s"), 10, 32)
+		if err != nil {
+			return nil, false
+		}
+		for _, segment := range representation.Segments {
+			if uint64(segment.Time) == time {
+				return segment.Data, video
+			}
+		}
+	}
+	return nil, false
+}
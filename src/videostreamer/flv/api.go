@@ -0,0 +1,28 @@
+package flv
+
+import "io"
+
+const (
+	TAG_AUDIO  = 8
+	TAG_VIDEO  = 9
+	TAG_SCRIPT = 18
+)
+
+const (
+	FLAG_AUDIO = 0x04
+	FLAG_VIDEO = 0x01
+)
+
+type Tag struct {
+	Type uint8
+	Time uint32
+	Data []byte
+}
+
+type Writer struct {
+	W io.Writer
+}
+
+type Reader struct {
+	R io.Reader
+}
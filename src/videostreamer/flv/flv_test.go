@@ -0,0 +1,54 @@
+package flv
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"videostreamer/core"
+)
+
+func TestRoundTrip(t *testing.T) {
+	buf := bytes.Buffer{}
+	writer := NewWriter(&buf)
+	writer.WriteHeader(FLAG_AUDIO | FLAG_VIDEO)
+	writer.WriteMeta(0, core.NewMetaData(640, 480, 25))
+	writer.WriteVideo(core.NewVideoData(0x12345678, []byte{0x17, 0x00}))
+	writer.WriteAudio(core.NewAudioData(40, []byte{0xaf, 0x01, 0x21}))
+
+	reader := NewReader(&buf)
+	if flags, err := reader.ReadHeader(); err != nil || flags != FLAG_AUDIO|FLAG_VIDEO {
+		t.Fatalf("header flags %#x %v", flags, err)
+	}
+	for _, want := range []Tag{
+		{TAG_SCRIPT, 0, EncodeMetadata(core.NewMetaData(640, 480, 25))},
+		{TAG_VIDEO, 0x12345678, []byte{0x17, 0x00}},
+		{TAG_AUDIO, 40, []byte{0xaf, 0x01, 0x21}},
+	} {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag.Type != want.Type || tag.Time != want.Time || !bytes.Equal(tag.Data, want.Data) {
+			t.Errorf("tag %+v instead of %+v", tag, want)
+		}
+	}
+	if _, err := reader.ReadTag(); err != io.EOF {
+		t.Errorf("%v instead of EOF", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	meta := ParseMetadata(EncodeMetadata(core.NewMetaData(1280, 720, 30)))
+	want := core.NewMetaData(1280, 720, 30)
+	want.VideoCodec = core.VIDEO_CODEC_AVC
+	if meta == nil || *meta != *want {
+		t.Errorf("metadata %+v", meta)
+	}
+	want.VideoCodec = 0x68766331
+	if meta := ParseMetadata(EncodeMetadata(want)); meta == nil || *meta != *want {
+		t.Errorf("HEVC metadata %+v", meta)
+	}
+	if ParseMetadata([]byte{0x02, 0x00}) != nil {
+		t.Error("metadata from truncated script")
+	}
+}
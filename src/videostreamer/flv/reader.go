@@ -0,0 +1,70 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"videostreamer/amf"
+	"videostreamer/binutil"
+	"videostreamer/check"
+	"videostreamer/core"
+)
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{R: r}
+}
+
+func (reader *Reader) ReadHeader() (flags uint8, err error) {
+	defer check.CheckPanicHandler(&err)
+	head := binutil.ReadBuf(reader.R, 9)
+	if string(head[:3]) != "FLV" {
+		return 0, errors.New("Not an FLV file")
+	}
+	offset := int(head[5])<<24 | int(head[6])<<16 | int(head[7])<<8 | int(head[8])
+	if offset < 9 {
+		return 0, errors.New("Bad FLV header size")
+	}
+	binutil.ReadBuf(reader.R, offset-9)
+	binutil.ReadInt(reader.R, 4)
+	return head[4], nil
+}
+
+func (reader *Reader) ReadTag() (tag *Tag, err error) {
+	defer check.CheckPanicHandler(&err)
+	tag = &Tag{}
+	tag.Type = uint8(binutil.ReadInt(reader.R, 1) & 0x1f)
+	size := binutil.ReadInt(reader.R, 3)
+	tag.Time = uint32(binutil.ReadInt(reader.R, 3))
+	tag.Time |= uint32(binutil.ReadInt(reader.R, 1)) << 24
+	binutil.ReadInt(reader.R, 3)
+	tag.Data = binutil.ReadBuf(reader.R, size)
+	binutil.ReadInt(reader.R, 4)
+	return
+}
+
+func metanumber(raw amf.AMFMap, key string) uint32 {
+	if val, ok := raw[key].(float64); ok {
+		return uint32(val)
+	}
+	return 0
+}
+
+func ParseMetadata(data []byte) *core.MetaData {
+	rdr := bytes.NewReader(data)
+	for rdr.Len() > 0 {
+		val, err := amf.DecodeAMF(rdr)
+		if err != nil {
+			break
+		}
+		if raw, ok := val.(amf.AMFMap); ok {
+			meta := core.NewMetaData(metanumber(raw, "width"), metanumber(raw, "height"), metanumber(raw, "framerate"))
+			meta.VideoCodec = metanumber(raw, "videocodecid")
+			if fourcc, ok := raw["videocodecid"].(string); ok && len(fourcc) == 4 {
+				meta.VideoCodec = binary.BigEndian.Uint32([]byte(fourcc))
+			}
+			return meta
+		}
+	}
+	return nil
+}
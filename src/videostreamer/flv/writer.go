@@ -0,0 +1,70 @@
+package flv
+
+import (
+	"bytes"
+	"io"
+	"videostreamer/amf"
+	"videostreamer/binutil"
+	"videostreamer/check"
+	"videostreamer/core"
+)
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{W: w}
+}
+
+func EncodeMetadata(data *core.MetaData) []byte {
+	buf := bytes.Buffer{}
+	fw := float64(data.Width)
+	fh := float64(data.Height)
+	ff := float64(data.Framerate)
+	codec := float64(data.VideoCodec)
+	if codec == 0 {
+		codec = core.VIDEO_CODEC_AVC
+	}
+	amf.EncodeAMF(&buf, "onMetaData")
+	amf.EncodeAMF(&buf, struct {
+		Width         float64 `name:"width"`
+		Height        float64 `name:"height"`
+		DisplayWidth  float64 `name:"displayWidth"`
+		DisplayHeight float64 `name:"displayHeight"`
+		Duration      float64 `name:"duration"`
+		Framerate     float64 `name:"framerate"`
+		Videocodecid  float64 `name:"videocodecid"`
+		Audiocodecid  float64 `name:"audiocodecid"`
+	}{fw, fh, fw, fh, -1, ff, codec, 10})
+	return buf.Bytes()
+}
+
+func (writer *Writer) WriteHeader(flags uint8) (err error) {
+	defer check.CheckPanicHandler(&err)
+	binutil.WriteBuf(writer.W, []byte{'F', 'L', 'V', 0x01, flags, 0, 0, 0, 9})
+	binutil.WriteInt(writer.W, 0, 4)
+	return
+}
+
+func (writer *Writer) WriteTag(tag *Tag) (err error) {
+	defer check.CheckPanicHandler(&err)
+	buf := bytes.Buffer{}
+	binutil.WriteInt(&buf, int(tag.Type), 1)
+	binutil.WriteInt(&buf, len(tag.Data), 3)
+	binutil.WriteInt(&buf, int(tag.Time&0xFFFFFF), 3)
+	binutil.WriteInt(&buf, int(tag.Time>>24), 1)
+	binutil.WriteInt(&buf, 0, 3)
+	buf.Write(tag.Data)
+	binutil.WriteInt(&buf, 11+len(tag.Data), 4)
+	binutil.WriteBuf(writer.W, buf.Bytes())
+	return
+}
+
+func (writer *Writer) WriteVideo(data *core.VideoData) error {
+	return writer.WriteTag(&Tag{Type: TAG_VIDEO, Time: data.Time, Data: data.Data})
+}
+
+func (writer *Writer) WriteAudio(data *core.AudioData) error {
+	return writer.WriteTag(&Tag{Type: TAG_AUDIO, Time: data.Time, Data: data.Data})
+}
+
+func (writer *Writer) WriteMeta(time uint32, data *core.MetaData) error {
+	return writer.WriteTag(&Tag{Type: TAG_SCRIPT, Time: time, Data: EncodeMetadata(data)})
+}
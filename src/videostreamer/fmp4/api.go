@@ -0,0 +1,85 @@
+package fmp4
+
+import (
+	"sync"
+	"videostreamer/core"
+)
+
+const (
+	TRACK_VIDEO = 1
+	TRACK_AUDIO = 2
+)
+
+const (
+	VIDEO_TIMESCALE = 90000
+	AAC_FRAME       = 1024
+	AUDIO_FRAGMENT  = 1000
+	QUEUE_SIZE      = 64
+)
+
+type Track struct {
+	ID         uint32
+	Video      bool
+	Timescale  uint32
+	Codec      string
+	Width      uint32
+	Height     uint32
+	SampleRate uint32
+	Channels   uint8
+	Config     []byte
+}
+
+type Sample struct {
+	Time     uint64
+	Duration uint32
+	Offset   int32
+	Key      bool
+	Data     []byte
+}
+
+type Fragment struct {
+	Seq      uint32
+	Time     uint32
+	Duration uint32
+	Key      bool
+	Data     []byte
+}
+
+type Muxer struct {
+	Video            *Track
+	Audio            *Track
+	SkipVideo        bool
+	SkipAudio        bool
+	FragmentDuration uint32
+	OnInit           func(init []byte)
+	OnFragment       func(*Fragment)
+	seq              uint32
+	base             uint32
+	based            bool
+	started          bool
+	start            uint32
+	video            []*Sample
+	audio            []*Sample
+}
+
+type Handler struct {
+	App              *core.Application
+	FragmentDuration uint32
+}
+
+type segment struct {
+	init   bool
+	codecs string
+	data   []byte
+}
+
+type Session struct {
+	Stream  *core.Stream
+	Muxer   *Muxer
+	Dropped uint64
+	queue   chan *segment
+	end     chan struct{}
+	mutex   sync.Mutex
+	waitKey bool
+	ended   bool
+}
@@ -0,0 +1,61 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+func u8(value uint8) []byte {
+	return []byte{value}
+}
+
+func u16(value uint16) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, value)
+	return buf
+}
+
+func u32(value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	return buf
+}
+
+func u64(value uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	return buf
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	buf.Write(u32(uint32(size)))
+	buf.WriteString(typ)
+	for _, p := range payload {
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+func fullbox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	return box(typ, append([][]byte{u32(uint32(version)<<24 | flags)}, payload...)...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var matrix = concat(u32(0x00010000), zeros(12), u32(0x00010000), zeros(12), u32(0x40000000))
+
+func descriptor(tag uint8, payload ...[]byte) []byte {
+	data := concat(payload...)
+	return concat([]byte{tag, 0x80, 0x80, 0x80, byte(len(data))}, data)
+}
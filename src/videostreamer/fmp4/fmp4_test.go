@@ -0,0 +1,173 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/core"
+	"videostreamer/testutil"
+	"videostreamer/websocket"
+)
+
+func children(data []byte) map[string][][]byte {
+	boxes := map[string][][]byte{}
+	for len(data) >= 8 {
+		size := binary.BigEndian.Uint32(data)
+		if size < 8 || int(size) > len(data) {
+			break
+		}
+		typ := string(data[4:8])
+		boxes[typ] = append(boxes[typ], data[8:size])
+		data = data[size:]
+	}
+	return boxes
+}
+
+func TestInitSegment(t *testing.T) {
+	video, err := VideoTrack(testutil.Seq[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := AudioTrack(testutil.ASC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Width != 640 || video.Height != 480 || video.Codec != "avc1.64001e" || audio.SampleRate != 44100 {
+		t.Errorf("tracks %+v %+v", video, audio)
+	}
+	top := children(InitSegment(video, audio))
+	if len(top["ftyp"]) != 1 || len(top["moov"]) != 1 {
+		t.Fatalf("top level boxes %v", top)
+	}
+	moov := children(top["moov"][0])
+	if len(moov["mvhd"]) != 1 || len(moov["trak"]) != 2 || len(children(moov["mvex"][0])["trex"]) != 2 {
+		t.Errorf("moov children %v", moov)
+	}
+	stsd := children(children(children(children(moov["trak"][0])["mdia"][0])["minf"][0])["stbl"][0])["stsd"][0]
+	if !bytes.Contains(stsd, []byte("avc1")) || !bytes.Contains(stsd, testutil.Seq[5:]) {
+		t.Errorf("video sample entry missing avcC")
+	}
+}
+
+func TestMuxer(t *testing.T) {
+	muxer := NewMuxer(0)
+	inits := 0
+	var fragments []*Fragment
+	muxer.OnInit = func([]byte) { inits++ }
+	muxer.OnFragment = func(fragment *Fragment) { fragments = append(fragments, fragment) }
+
+	muxer.WriteVideo(core.NewVideoData(1000, testutil.Seq))
+	muxer.WriteAudio(core.NewAudioData(1000, testutil.AudioSeq))
+	muxer.WriteVideo(core.NewVideoData(1000, testutil.Frame(false, 0)))
+	muxer.WriteVideo(core.NewVideoData(1000, testutil.Frame(true, 80)))
+	muxer.WriteAudio(core.NewAudioData(1010, []byte{0xaf, 0x01, 0x21}))
+	muxer.WriteVideo(core.NewVideoData(1040, testutil.Frame(false, 40)))
+	muxer.WriteAudio(core.NewAudioData(1033, []byte{0xaf, 0x01, 0x22}))
+	muxer.WriteVideo(core.NewVideoData(1080, testutil.Frame(true, 0)))
+	muxer.WriteAudio(core.NewAudioData(1080, []byte{0xaf, 0x01, 0x23}))
+	muxer.Flush()
+
+	if inits != 1 || len(fragments) != 2 {
+		t.Fatalf("%d inits and %d fragments", inits, len(fragments))
+	}
+	if f := fragments[0]; f.Time != 0 || f.Duration != 80 || !f.Key || f.Seq != 1 {
+		t.Errorf("first fragment %+v", f)
+	}
+	if f := fragments[1]; f.Time != 80 || f.Duration != 40 || f.Seq != 2 {
+		t.Errorf("second fragment %+v", f)
+	}
+	top := children(fragments[0].Data)
+	trafs := children(top["moof"][0])["traf"]
+	if len(trafs) != 2 {
+		t.Fatalf("%d trafs", len(trafs))
+	}
+	trun := children(trafs[0])["trun"][0]
+	if count := binary.BigEndian.Uint32(trun[4:]); count != 2 {
+		t.Errorf("%d video samples", count)
+	}
+	if duration := binary.BigEndian.Uint32(trun[12:]); duration != 40*90 {
+		t.Errorf("video sample duration %d", duration)
+	}
+	if offset := int32(binary.BigEndian.Uint32(trun[24:])); offset != 80*90 {
+		t.Errorf("composition offset %d", offset)
+	}
+	tfdt := children(trafs[1])["tfdt"][0]
+	if base := binary.BigEndian.Uint64(tfdt[4:]); base != 441 {
+		t.Errorf("audio decode time %d", base)
+	}
+	offset := binary.BigEndian.Uint32(children(trafs[1])["trun"][0][8:])
+	if !bytes.Equal(fragments[0].Data[offset:offset+1], []byte{0x21}) {
+		t.Errorf("audio data offset %d points at %x", offset, fragments[0].Data[offset:offset+1])
+	}
+}
+
+func publish(app *core.Application) *core.Stream {
+	stream := app.AcquireStream("cam")
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	stream.ReceiveAudio(core.NewAudioData(0, testutil.AudioSeq))
+	return stream
+}
+
+func feed(stream *core.Stream) {
+	for deadline := time.Now().Add(5 * time.Second); stream.Subscribers() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Frame(true, 0)))
+	stream.ReceiveAudio(core.NewAudioData(10, []byte{0xaf, 0x01, 0x21}))
+	stream.ReceiveVideo(core.NewVideoData(40, testutil.Frame(true, 0)))
+	stream.Unpublish()
+}
+
+func TestHTTP(t *testing.T) {
+	app := core.NewApplication()
+	server := httptest.NewServer(NewHandler(app))
+	defer server.Close()
+	stream := publish(app)
+	go feed(stream)
+
+	resp, err := http.Get(server.URL + "/live/cam.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != `video/mp4; codecs="avc1.64001e,mp4a.40.2"` {
+		t.Errorf("content type %s", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := children(body)
+	if len(top["ftyp"]) != 1 || len(top["moof"]) != 2 || len(top["mdat"]) != 2 {
+		t.Errorf("boxes %v", top)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	app := core.NewApplication()
+	server := httptest.NewServer(NewHandler(app))
+	defer server.Close()
+	stream := publish(app)
+	go feed(stream)
+
+	conn, err := websocket.Dial("ws" + strings.TrimPrefix(server.URL, "http") + "/live/cam.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	op, data, err := conn.ReadMessage()
+	if err != nil || op != websocket.OP_TEXT || !strings.HasPrefix(string(data), "video/mp4") {
+		t.Fatalf("first message %d %q %v", op, data, err)
+	}
+	for _, want := range []string{"ftyp", "moof", "moof"} {
+		op, data, err = conn.ReadMessage()
+		if err != nil || op != websocket.OP_BINARY || string(data[4:8]) != want {
+			t.Fatalf("expected %s, got %d %v", want, op, err)
+		}
+	}
+}
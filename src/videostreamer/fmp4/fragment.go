@@ -0,0 +1,47 @@
+package fmp4
+
+const (
+	SAMPLE_KEY     = 0x02000000
+	SAMPLE_NON_KEY = 0x01010000
+)
+
+type run struct {
+	track   *Track
+	samples []*Sample
+}
+
+func MediaSegment(seq uint32, runs ...run) []byte {
+	moof := buildMoof(seq, runs, 0)
+	moof = buildMoof(seq, runs, len(moof))
+	payload := [][]byte{}
+	for _, r := range runs {
+		for _, sample := range r.samples {
+			payload = append(payload, sample.Data)
+		}
+	}
+	return concat(moof, box("mdat", payload...))
+}
+
+func buildMoof(seq uint32, runs []run, size int) []byte {
+	trafs := [][]byte{}
+	offset := size + 8
+	for _, r := range runs {
+		entries := [][]byte{}
+		for _, sample := range r.samples {
+			flags := uint32(SAMPLE_KEY)
+			if r.track.Video && !sample.Key {
+				flags = SAMPLE_NON_KEY
+			}
+			entries = append(entries, u32(sample.Duration), u32(uint32(len(sample.Data))), u32(flags), u32(uint32(sample.Offset)))
+		}
+		trun := fullbox("trun", 1, 0xf01, u32(uint32(len(r.samples))), u32(uint32(offset)), concat(entries...))
+		trafs = append(trafs, box("traf",
+			fullbox("tfhd", 0, 0x020000, u32(r.track.ID)),
+			fullbox("tfdt", 1, 0, u64(r.samples[0].Time)),
+			trun))
+		for _, sample := range r.samples {
+			offset += len(sample.Data)
+		}
+	}
+	return box("moof", fullbox("mfhd", 0, 0, u32(seq)), concat(trafs...))
+}
@@ -0,0 +1,186 @@
+package fmp4
+
+import (
+	"fmt"
+	"net/http"
+	"videostreamer/core"
+	"videostreamer/httpflv"
+	"videostreamer/logger"
+	"videostreamer/websocket"
+)
+
+func NewHandler(app *core.Application) *Handler {
+	return &Handler{App: app}
+}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsUpgrade(r) {
+		handler.serveWebSocket(w, r)
+		return
+	}
+	if httpflv.Cors(w, r) {
+		return
+	}
+	_, name, ok := httpflv.ParsePath(r.URL.Path, ".mp4")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	session := handler.attach(name)
+	defer session.Stream.Unsubscribe(session)
+	logger.Infof("MSE client %s playing %s", r.RemoteAddr, name)
+
+	flusher, _ := w.(http.Flusher)
+	headers := false
+	err := session.pump(r.Context().Done(), func(seg *segment) error {
+		if !headers {
+			w.Header().Set("Content-Type", mime(seg.codecs))
+			w.Header().Set("Cache-Control", "no-cache")
+			headers = true
+		}
+		if _, err := w.Write(seg.data); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Infof("MSE client %s gone: %v", r.RemoteAddr, err)
+	}
+}
+
+func (handler *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	_, name, ok := httpflv.ParsePath(r.URL.Path, ".mp4")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	session := handler.attach(name)
+	defer session.Stream.Unsubscribe(session)
+	logger.Infof("MSE WebSocket client %s playing %s", r.RemoteAddr, name)
+
+	gone := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+	err = session.pump(gone, func(seg *segment) error {
+		if seg.init {
+			if err := conn.WriteMessage(websocket.OP_TEXT, []byte(mime(seg.codecs))); err != nil {
+				return err
+			}
+		}
+		return conn.WriteMessage(websocket.OP_BINARY, seg.data)
+	})
+	if err != nil {
+		logger.Infof("MSE WebSocket client %s gone: %v", r.RemoteAddr, err)
+	}
+}
+
+func (handler *Handler) attach(name string) *Session {
+	stream := handler.App.AcquireStream(name)
+	session := NewSession(stream, handler.FragmentDuration)
+	if stream.IsPublished() {
+		stream.Bootstrap(session)
+	}
+	stream.Subscribe(session)
+	return session
+}
+
+func mime(codecs string) string {
+	return fmt.Sprintf("video/mp4; codecs=\"%s\"", codecs)
+}
+
+func NewSession(stream *core.Stream, duration uint32) *Session {
+	session := &Session{
+		Stream: stream,
+		Muxer:  NewMuxer(duration),
+		queue:  make(chan *segment, QUEUE_SIZE),
+		end:    make(chan struct{}),
+	}
+	session.Muxer.OnInit = func(init []byte) {
+		session.waitKey = false
+		session.enqueue(&segment{init: true, codecs: session.Muxer.Codecs(), data: init})
+	}
+	session.Muxer.OnFragment = func(fragment *Fragment) {
+		if session.waitKey && !fragment.Key {
+			return
+		}
+		session.waitKey = false
+		session.enqueue(&segment{data: fragment.Data})
+	}
+	return session
+}
+
+func (session *Session) enqueue(seg *segment) {
+	if session.ended {
+		return
+	}
+	select {
+	case session.queue <- seg:
+	default:
+		session.waitKey = true
+		session.Dropped++
+	}
+}
+
+func (session *Session) Publish() {}
+
+func (session *Session) Unpublish() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.Muxer.Flush()
+	if !session.ended {
+		session.ended = true
+		close(session.end)
+	}
+}
+
+func (session *Session) ConsumeVideo(data *core.VideoData) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if err := session.Muxer.WriteVideo(data); err != nil {
+		logger.Warnf("Cannot mux video of %s: %v", session.Stream.Name, err)
+	}
+}
+
+func (session *Session) ConsumeAudio(data *core.AudioData) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if err := session.Muxer.WriteAudio(data); err != nil {
+		logger.Warnf("Cannot mux audio of %s: %v", session.Stream.Name, err)
+	}
+}
+
+func (session *Session) ConsumeMeta(data *core.MetaData) {}
+
+func (session *Session) pump(gone <-chan struct{}, write func(*segment) error) error {
+	for {
+		select {
+		case seg := <-session.queue:
+			if err := write(seg); err != nil {
+				return err
+			}
+		case <-session.end:
+			for len(session.queue) > 0 {
+				if err := write(<-session.queue); err != nil {
+					return err
+				}
+			}
+			return nil
+		case <-gone:
+			return nil
+		}
+	}
+}
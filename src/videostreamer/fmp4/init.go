@@ -0,0 +1,54 @@
+package fmp4
+
+func InitSegment(tracks ...*Track) []byte {
+	traks := [][]byte{}
+	trexs := [][]byte{}
+	next := uint32(1)
+	for _, track := range tracks {
+		traks = append(traks, trak(track))
+		trexs = append(trexs, fullbox("trex", 0, 0, u32(track.ID), u32(1), u32(0), u32(0), u32(0)))
+		if track.ID >= next {
+			next = track.ID + 1
+		}
+	}
+	mvhd := fullbox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0),
+		u32(0x00010000), u16(0x0100), zeros(10), matrix, zeros(24), u32(next))
+	moov := box("moov", concat(mvhd, concat(traks...), box("mvex", trexs...)))
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41"))
+	return concat(ftyp, moov)
+}
+
+func trak(track *Track) []byte {
+	volume, handler, name := uint16(0), "vide", "VideoHandler"
+	var header, entry []byte
+	if track.Video {
+		header = fullbox("vmhd", 0, 1, zeros(8))
+		entry = box("avc1",
+			zeros(6), u16(1), zeros(16), u16(uint16(track.Width)), u16(uint16(track.Height)),
+			u32(0x00480000), u32(0x00480000), u32(0), u16(1), zeros(32), u16(0x0018), u16(0xffff),
+			box("avcC", track.Config))
+	} else {
+		volume, handler, name = 0x0100, "soun", "SoundHandler"
+		header = fullbox("smhd", 0, 0, zeros(4))
+		entry = box("mp4a",
+			zeros(6), u16(1), zeros(8), u16(uint16(track.Channels)), u16(16), zeros(4), u32(track.SampleRate<<16),
+			fullbox("esds", 0, 0, descriptor(0x03, u16(0), u8(0),
+				descriptor(0x04, u8(0x40), u8(0x15), zeros(3), u32(0), u32(0),
+					descriptor(0x05, track.Config)),
+				descriptor(0x06, u8(0x02)))))
+	}
+	tkhd := fullbox("tkhd", 0, 3,
+		u32(0), u32(0), u32(track.ID), u32(0), u32(0), zeros(8), u16(0), u16(0), u16(volume), u16(0),
+		matrix, u32(track.Width<<16), u32(track.Height<<16))
+	mdhd := fullbox("mdhd", 0, 0, u32(0), u32(0), u32(track.Timescale), u32(0), u16(0x55c4), u16(0))
+	hdlr := fullbox("hdlr", 0, 0, u32(0), []byte(handler), zeros(12), []byte(name), zeros(1))
+	dinf := box("dinf", fullbox("dref", 0, 0, u32(1), fullbox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullbox("stsd", 0, 0, u32(1), entry),
+		fullbox("stts", 0, 0, u32(0)),
+		fullbox("stsc", 0, 0, u32(0)),
+		fullbox("stsz", 0, 0, u32(0), u32(0)),
+		fullbox("stco", 0, 0, u32(0)))
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", header, dinf, stbl)))
+}
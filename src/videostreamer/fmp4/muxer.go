@@ -0,0 +1,266 @@
+package fmp4
+
+import (
+	"bytes"
+	"strings"
+	"videostreamer/aac"
+	"videostreamer/avc"
+	"videostreamer/binutil"
+	"videostreamer/core"
+)
+
+func NewMuxer(duration uint32) *Muxer {
+	return &Muxer{FragmentDuration: duration}
+}
+
+func VideoTrack(record []byte) (*Track, error) {
+	config, err := avc.ParseConfig(record)
+	if err != nil {
+		return nil, err
+	}
+	info, err := avc.ParseSPS(config.SPS[0])
+	if err != nil {
+		return nil, err
+	}
+	return &Track{
+		ID:        TRACK_VIDEO,
+		Video:     true,
+		Timescale: VIDEO_TIMESCALE,
+		Codec:     config.Codec(),
+		Width:     info.Width,
+		Height:    info.Height,
+		Config:    binutil.Dup(record),
+	}, nil
+}
+
+func AudioTrack(asc []byte) (*Track, error) {
+	config, err := aac.ParseConfig(asc)
+	if err != nil {
+		return nil, err
+	}
+	return &Track{
+		ID:         TRACK_AUDIO,
+		Timescale:  config.SampleRate,
+		Codec:      config.Codec(),
+		SampleRate: config.SampleRate,
+		Channels:   config.Channels,
+		Config:     binutil.Dup(asc),
+	}, nil
+}
+
+func (muxer *Muxer) tracks() (tracks []*Track) {
+	if muxer.Video != nil && !muxer.SkipVideo {
+		tracks = append(tracks, muxer.Video)
+	}
+	if muxer.Audio != nil && !muxer.SkipAudio {
+		tracks = append(tracks, muxer.Audio)
+	}
+	return
+}
+
+func (muxer *Muxer) Codecs() string {
+	codecs := []string{}
+	for _, track := range muxer.tracks() {
+		codecs = append(codecs, track.Codec)
+	}
+	return strings.Join(codecs, ",")
+}
+
+func (muxer *Muxer) Init() []byte {
+	return InitSegment(muxer.tracks()...)
+}
+
+func (muxer *Muxer) WriteVideo(data *core.VideoData) error {
+	d := data.Data
+	if len(d) < 5 || !data.IsAVC() {
+		return nil
+	}
+	switch d[1] {
+	case 0:
+		track, err := VideoTrack(d[5:])
+		if err != nil {
+			return err
+		}
+		if muxer.Video == nil || !bytes.Equal(muxer.Video.Config, track.Config) {
+			muxer.Flush()
+			muxer.Video = track
+		}
+	case 1:
+		if muxer.Video == nil || muxer.SkipVideo {
+			return nil
+		}
+		cts := int32(uint32(d[2])<<16|uint32(d[3])<<8|uint32(d[4])) << 8 >> 8
+		muxer.pushVideo(&Sample{Time: uint64(data.Time), Offset: cts, Key: d[0]>>4 == 1, Data: d[5:]})
+	}
+	return nil
+}
+
+func (muxer *Muxer) WriteAudio(data *core.AudioData) error {
+	d := data.Data
+	if len(d) < 2 || !data.IsAAC() {
+		return nil
+	}
+	switch d[1] {
+	case 0:
+		track, err := AudioTrack(d[2:])
+		if err != nil {
+			return err
+		}
+		if muxer.Audio == nil || !bytes.Equal(muxer.Audio.Config, track.Config) {
+			muxer.Flush()
+			muxer.Audio = track
+		}
+	case 1:
+		if muxer.Audio == nil || muxer.SkipAudio {
+			return nil
+		}
+		muxer.pushAudio(&Sample{Time: uint64(data.Time), Key: true, Data: d[2:]})
+	}
+	return nil
+}
+
+func (muxer *Muxer) videoless() bool {
+	return muxer.Video == nil || muxer.SkipVideo
+}
+
+func (muxer *Muxer) Rebase(time uint32) {
+	muxer.base = time
+	muxer.based = true
+}
+
+func (muxer *Muxer) begin(time uint32) {
+	if !muxer.based {
+		muxer.Rebase(time)
+	}
+	muxer.started = true
+	muxer.start = time
+	if muxer.OnInit != nil {
+		muxer.OnInit(muxer.Init())
+	}
+}
+
+func (muxer *Muxer) late(time uint32, pending []*Sample) bool {
+	if n := len(pending); n > 0 && int32(time-uint32(pending[n-1].Time)) < 0 {
+		return true
+	}
+	return int32(time-muxer.base) < 0 || int32(time-muxer.start) < 0
+}
+
+func (muxer *Muxer) pushVideo(sample *Sample) {
+	time := uint32(sample.Time)
+	if !muxer.started {
+		if !sample.Key {
+			return
+		}
+		muxer.begin(time)
+	}
+	if muxer.late(time, muxer.video) {
+		return
+	}
+	if len(muxer.video) > 0 && (sample.Key || (muxer.FragmentDuration > 0 && time-muxer.start >= muxer.FragmentDuration)) {
+		muxer.cut(time)
+	}
+	muxer.video = append(muxer.video, sample)
+}
+
+func (muxer *Muxer) pushAudio(sample *Sample) {
+	time := uint32(sample.Time)
+	if !muxer.started {
+		if !muxer.videoless() {
+			return
+		}
+		muxer.begin(time)
+	}
+	if muxer.late(time, muxer.audio) {
+		return
+	}
+	duration := muxer.FragmentDuration
+	if duration == 0 {
+		duration = AUDIO_FRAGMENT
+	}
+	if muxer.videoless() && len(muxer.audio) > 0 && time-muxer.start >= duration {
+		muxer.cut(time)
+	}
+	muxer.audio = append(muxer.audio, sample)
+}
+
+func (muxer *Muxer) Flush() {
+	if !muxer.started {
+		return
+	}
+	end := muxer.start
+	if n := len(muxer.video); n > 0 {
+		delta := uint32(40)
+		if n > 1 {
+			delta = uint32(muxer.video[n-1].Time - muxer.video[n-2].Time)
+		}
+		end = uint32(muxer.video[n-1].Time) + delta
+	}
+	if n := len(muxer.audio); n > 0 && uint32(muxer.audio[n-1].Time) >= end {
+		end = uint32(muxer.audio[n-1].Time) + 1
+	}
+	muxer.cut(end)
+	muxer.started = false
+}
+
+func (muxer *Muxer) cut(end uint32) {
+	runs := []run{}
+	video := muxer.video
+	muxer.video = nil
+	if len(video) > 0 {
+		samples := make([]*Sample, len(video))
+		for i, sample := range video {
+			next := uint64(end)
+			if i+1 < len(video) {
+				next = video[i+1].Time
+			}
+			samples[i] = &Sample{
+				Time:     uint64(uint32(sample.Time)-muxer.base) * VIDEO_TIMESCALE / 1000,
+				Duration: uint32((next - sample.Time) * VIDEO_TIMESCALE / 1000),
+				Offset:   sample.Offset * VIDEO_TIMESCALE / 1000,
+				Key:      sample.Key,
+				Data:     sample.Data,
+			}
+		}
+		runs = append(runs, run{muxer.Video, samples})
+	}
+	audio := []*Sample{}
+	rest := []*Sample{}
+	for _, sample := range muxer.audio {
+		if int32(uint32(sample.Time)-end) < 0 {
+			audio = append(audio, sample)
+		} else {
+			rest = append(rest, sample)
+		}
+	}
+	muxer.audio = rest
+	if len(audio) > 0 {
+		rate := uint64(muxer.Audio.SampleRate)
+		samples := make([]*Sample, len(audio))
+		for i, sample := range audio {
+			time := uint64(uint32(sample.Time)-muxer.base) * rate / 1000
+			duration := uint32(AAC_FRAME)
+			if i+1 < len(audio) {
+				duration = uint32(uint64(uint32(audio[i+1].Time)-muxer.base)*rate/1000 - time)
+			}
+			samples[i] = &Sample{Time: time, Duration: duration, Key: true, Data: sample.Data}
+		}
+		runs = append(runs, run{muxer.Audio, samples})
+	}
+	start := muxer.start
+	muxer.start = end
+	if len(runs) == 0 {
+		return
+	}
+	muxer.seq++
+	fragment := &Fragment{
+		Seq:      muxer.seq,
+		Time:     start - muxer.base,
+		Duration: end - start,
+		Key:      len(video) == 0 || video[0].Key,
+		Data:     MediaSegment(muxer.seq, runs...),
+	}
+	if muxer.OnFragment != nil {
+		muxer.OnFragment(fragment)
+	}
+}
@@ -0,0 +1,94 @@
+package hls
+
+import (
+	"bytes"
+	"sync"
+	"time"
+	"videostreamer/core"
+	"videostreamer/fmp4"
+	"videostreamer/ts"
+)
+
+const (
+	DEFAULT_TARGET = 2 * time.Second
+	DEFAULT_WINDOW = 6
+	DEFAULT_IDLE   = 30 * time.Second
+	DEFAULT_PART   = 500 * time.Millisecond
+	KEEP_BEHIND    = 2
+	PART_SEGMENTS  = 3
+)
+
+type Config struct {
+	Target time.Duration
+	Window int
+	Idle   time.Duration
+	Part   time.Duration
+}
+
+type Segment struct {
+	Seq           uint64
+	Duration      uint32
+	Discontinuity bool
+	Data          []byte
+}
+
+type Segmenter struct {
+	Stream        *core.Stream
+	Config        *Config
+	Segments      []*Segment
+	seq           uint64
+	discSeq       uint64
+	muxer         *ts.Muxer
+	buf           bytes.Buffer
+	start         uint32
+	last          uint32
+	started       bool
+	discontinuity bool
+	ended         bool
+	ready         chan struct{}
+	isReady       bool
+	mutex         sync.Mutex
+}
+
+type Part struct {
+	Duration    uint32
+	Independent bool
+	Data        []byte
+}
+
+type LLSegment struct {
+	Seq           uint64
+	Duration      uint32
+	Map           int
+	Discontinuity bool
+	Complete      bool
+	Parts         []*Part
+}
+
+type LLSegmenter struct {
+	Stream        *core.Stream
+	Config        *Config
+	Segments      []*LLSegment
+	Maps          map[int][]byte
+	seq           uint64
+	discSeq       uint64
+	maps          int
+	muxer         *fmp4.Muxer
+	discontinuity bool
+	ended         bool
+	changed       chan struct{}
+	mutex         sync.Mutex
+}
+
+type entry struct {
+	Consumer core.Consumer
+	Stream   *core.Stream
+	idle     *time.Timer
+}
+
+type Handler struct {
+	App     *core.Application
+	Config  *Config
+	entries map[string]*entry
+	mutex   sync.Mutex
+}
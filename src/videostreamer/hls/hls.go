@@ -0,0 +1,158 @@
+package hls
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"videostreamer/core"
+	"videostreamer/httpflv"
+	"videostreamer/logger"
+)
+
+func NewHandler(app *core.Application, config *Config) *Handler {
+	handler := &Handler{
+		App:     app,
+		Config:  config,
+		entries: make(map[string]*entry),
+	}
+	app.Handle(handler.attach)
+	return handler
+}
+
+func ParsePath(path string) (name string, file string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func (handler *Handler) acquire(key string, name string, create func(*core.Stream) core.Consumer) core.Consumer {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	e := handler.entries[key]
+	if e == nil {
+		if create == nil {
+			return nil
+		}
+		stream := handler.App.AcquireStream(name)
+		e = &entry{Consumer: create(stream), Stream: stream}
+		handler.entries[key] = e
+		e.idle = time.AfterFunc(handler.Config.Idle, func() {
+			handler.drop(key, e)
+		})
+		logger.Infof("Segmenting %s for HLS", key)
+		if stream.IsPublished() {
+			stream.Bootstrap(e.Consumer)
+		}
+		stream.Subscribe(e.Consumer)
+	}
+	e.idle.Reset(handler.Config.Idle)
+	return e.Consumer
+}
+
+// attach starts segmenting a stream once per publish, so its playlist has
+// segments by the time the first player asks, however long the GOP. Unless
+// a player asks within the idle timeout, the segmenter is dropped again.
+func (handler *Handler) attach(stream *core.Stream) {
+	var published int32
+	stream.Watch(func(stream *core.Stream) {
+		if !stream.IsPublished() {
+			atomic.StoreInt32(&published, 0)
+		} else if atomic.CompareAndSwapInt32(&published, 0, 1) {
+			go handler.segmenter(stream.Name, true)
+		}
+	})
+}
+
+func (handler *Handler) drop(key string, e *entry) {
+	handler.mutex.Lock()
+	if handler.entries[key] == e {
+		delete(handler.entries, key)
+	}
+	handler.mutex.Unlock()
+	e.Stream.Unsubscribe(e.Consumer)
+	logger.Infof("Stopped segmenting idle %s", key)
+}
+
+func (handler *Handler) segmenter(name string, create bool) *Segmenter {
+	var factory func(*core.Stream) core.Consumer
+	if create {
+		factory = func(stream *core.Stream) core.Consumer {
+			return NewSegmenter(stream, handler.Config)
+		}
+	}
+	if consumer := handler.acquire(name, name, factory); consumer != nil {
+		return consumer.(*Segmenter)
+	}
+	return nil
+}
+
+func (handler *Handler) lowLatency(name string, create bool) *LLSegmenter {
+	var factory func(*core.Stream) core.Consumer
+	if create {
+		factory = func(stream *core.Stream) core.Consumer {
+			return NewLLSegmenter(stream, handler.Config)
+		}
+	}
+	if consumer := handler.acquire(name+"/ll", name, factory); consumer != nil {
+		return consumer.(*LLSegmenter)
+	}
+	return nil
+}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if httpflv.Cors(w, r) {
+		return
+	}
+	name, file, ok := ParsePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case file == "index.m3u8":
+		handler.servePlaylist(w, r, name)
+	case file == "ll.m3u8":
+		handler.serveLLPlaylist(w, r, name)
+	case strings.HasSuffix(file, ".ts"):
+		handler.serveSegment(w, r, name, strings.TrimSuffix(file, ".ts"))
+	case strings.HasSuffix(file, ".mp4"), strings.HasSuffix(file, ".m4s"):
+		handler.serveLLMedia(w, r, name, file)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (handler *Handler) servePlaylist(w http.ResponseWriter, r *http.Request, name string) {
+	segmenter := handler.segmenter(name, true)
+	select {
+	case <-segmenter.ready:
+	case <-time.After(3 * handler.Config.Target):
+		http.NotFound(w, r)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(segmenter.Playlist()))
+}
+
+func (handler *Handler) serveSegment(w http.ResponseWriter, r *http.Request, name string, file string) {
+	seq, err := strconv.ParseUint(file, 10, 64)
+	segmenter := handler.segmenter(name, false)
+	if err != nil || segmenter == nil {
+		http.NotFound(w, r)
+		return
+	}
+	segment := segmenter.Segment(seq)
+	if segment == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(segment.Data)
+}
@@ -0,0 +1,156 @@
+package hls
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/core"
+	"videostreamer/testutil"
+)
+
+func TestSegmenter(t *testing.T) {
+	config := NewConfig()
+	config.Window = 2
+	segmenter := NewSegmenter(&core.Stream{Name: "cam"}, config)
+	segmenter.ConsumeVideo(core.NewVideoData(0, testutil.Seq))
+	segmenter.ConsumeAudio(core.NewAudioData(0, []byte{0xaf, 0x00, 0x12, 0x10}))
+	testutil.Feed(segmenter.ConsumeVideo, segmenter.ConsumeAudio, 500, 7000)
+
+	playlist := segmenter.Playlist()
+	for _, want := range []string{"#EXT-X-TARGETDURATION:2\n", "#EXT-X-MEDIA-SEQUENCE:0\n", "#EXTINF:2.000,\n0.ts\n#EXTINF:2.000,\n1.ts\n"} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist lacks %q:\n%s", want, playlist)
+		}
+	}
+	if segment := segmenter.Segment(0); segment == nil || segment.Duration != 2000 || len(segment.Data)%188 != 0 {
+		t.Errorf("first segment %+v", segment)
+	}
+
+	segmenter.Unpublish()
+	if !strings.HasSuffix(segmenter.Playlist(), "#EXTINF:1.500,\n2.ts\n#EXT-X-ENDLIST\n") {
+		t.Errorf("unpublished playlist:\n%s", segmenter.Playlist())
+	}
+	segmenter.Publish()
+	testutil.Feed(segmenter.ConsumeVideo, segmenter.ConsumeAudio, 0, 2500)
+	if playlist = segmenter.Playlist(); !strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\n3.ts\n") {
+		t.Errorf("no discontinuity after republish:\n%s", playlist)
+	}
+	testutil.Feed(segmenter.ConsumeVideo, segmenter.ConsumeAudio, 2500, 7000)
+	playlist = segmenter.Playlist()
+	if !strings.Contains(playlist, "#EXT-X-DISCONTINUITY-SEQUENCE:1\n") || strings.Contains(playlist, "ENDLIST") {
+		t.Errorf("republished playlist:\n%s", playlist)
+	}
+}
+
+func TestSegmenterSkipsOtherCodecs(t *testing.T) {
+	segmenter := NewSegmenter(&core.Stream{Name: "hevc"}, NewConfig())
+	segmenter.Publish()
+	for ts := uint32(0); ts < 10000; ts += 500 {
+		segmenter.ConsumeVideo(core.NewVideoData(ts, []byte{0x91, 'h', 'v', 'c', '1', 0x01, 0x01, 0x26, 0x01}))
+		segmenter.ConsumeAudio(core.NewAudioData(ts, []byte{0x2f, 0x01, 0xff, 0xfb}))
+	}
+	if segment := segmenter.Segment(0); segment != nil {
+		t.Errorf("segmented HEVC and MP3 into %+v", segment)
+	}
+}
+
+func attached(handler *Handler, key string) bool {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	return handler.entries[key] != nil
+}
+
+func TestSegmentOnPublish(t *testing.T) {
+	app := core.NewApplication()
+	config := NewConfig()
+	config.Target = time.Second
+	config.Idle = 200 * time.Millisecond
+	handler := NewHandler(app, config)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	stream := app.AcquireStream("cam")
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	for deadline := time.Now().Add(5 * time.Second); !attached(handler, "cam"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("publishing did not start segmenting")
+		}
+	}
+	for ts := uint32(0); ts < 7000; ts += 500 {
+		stream.ReceiveVideo(core.NewVideoData(ts, testutil.Frame(ts%6000 == 0, 0)))
+	}
+
+	resp, err := http.Get(server.URL + "/live/cam/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.Contains(string(body), "#EXTINF:6.000,\n0.ts\n") {
+		t.Errorf("playlist of a stream with 6s GOP %d:\n%s", resp.StatusCode, body)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); attached(handler, "cam"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("segmenter of a published stream kept without players")
+		}
+	}
+	other := NewSegmenter(stream, config)
+	stream.Subscribe(other)
+	stream.Unsubscribe(other)
+	time.Sleep(2 * config.Idle)
+	if attached(handler, "cam") {
+		t.Error("segmenter restarted without a new publish")
+	}
+
+	stream.Unpublish()
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	for deadline := time.Now().Add(5 * time.Second); !attached(handler, "cam"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("republishing did not start segmenting")
+		}
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	app := core.NewApplication()
+	config := NewConfig()
+	config.Target = time.Second
+	handler := NewHandler(app, config)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	stream := app.AcquireStream("cam")
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	go func() {
+		for deadline := time.Now().Add(5 * time.Second); !attached(handler, "cam") && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		testutil.Feed(stream.ReceiveVideo, stream.ReceiveAudio, 0, 3000)
+	}()
+
+	resp, err := http.Get(server.URL + "/live/cam/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/vnd.apple.mpegurl" || !strings.Contains(string(body), "\n0.ts\n") {
+		t.Fatalf("playlist %d:\n%s", resp.StatusCode, body)
+	}
+	resp, err = http.Get(server.URL + "/live/cam/0.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || len(body) == 0 || len(body)%188 != 0 || body[0] != 0x47 {
+		t.Errorf("segment %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if resp, _ = http.Get(server.URL + "/live/cam/99.ts"); resp.StatusCode != 404 {
+		t.Errorf("missing segment served with %d", resp.StatusCode)
+	}
+}
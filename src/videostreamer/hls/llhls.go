@@ -0,0 +1,374 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"videostreamer/core"
+	"videostreamer/fmp4"
+	"videostreamer/logger"
+)
+
+func NewLLSegmenter(stream *core.Stream, config *Config) *LLSegmenter {
+	segmenter := &LLSegmenter{
+		Stream:  stream,
+		Config:  config,
+		Maps:    make(map[int][]byte),
+		changed: make(chan struct{}),
+	}
+	segmenter.reset()
+	return segmenter
+}
+
+func (segmenter *LLSegmenter) reset() {
+	segmenter.muxer = fmp4.NewMuxer(uint32(segmenter.Config.Part / time.Millisecond))
+	segmenter.muxer.OnInit = segmenter.init
+	segmenter.muxer.OnFragment = segmenter.fragment
+}
+
+func (segmenter *LLSegmenter) notify() {
+	close(segmenter.changed)
+	segmenter.changed = make(chan struct{})
+}
+
+func (segmenter *LLSegmenter) last() *LLSegment {
+	if n := len(segmenter.Segments); n > 0 {
+		return segmenter.Segments[n-1]
+	}
+	return nil
+}
+
+func (segmenter *LLSegmenter) init(data []byte) {
+	segmenter.maps++
+	segmenter.Maps[segmenter.maps] = data
+}
+
+func (segmenter *LLSegmenter) fragment(fragment *fmp4.Fragment) {
+	target := uint32(segmenter.Config.Target / time.Millisecond)
+	current := segmenter.last()
+	if current != nil && fragment.Key && current.Duration >= target {
+		current.Complete = true
+	}
+	if current == nil || current.Complete {
+		current = &LLSegment{
+			Seq:           segmenter.seq,
+			Map:           segmenter.maps,
+			Discontinuity: segmenter.discontinuity,
+		}
+		segmenter.seq++
+		segmenter.discontinuity = false
+		segmenter.Segments = append(segmenter.Segments, current)
+		segmenter.trim()
+	}
+	current.Parts = append(current.Parts, &Part{Duration: fragment.Duration, Independent: fragment.Key, Data: fragment.Data})
+	current.Duration += fragment.Duration
+	segmenter.notify()
+}
+
+func (segmenter *LLSegmenter) trim() {
+	for len(segmenter.Segments) > segmenter.Config.Window+KEEP_BEHIND+1 {
+		if segmenter.Segments[0].Discontinuity {
+			segmenter.discSeq++
+		}
+		segmenter.Segments = segmenter.Segments[1:]
+	}
+	for id := range segmenter.Maps {
+		if id < segmenter.Segments[0].Map {
+			delete(segmenter.Maps, id)
+		}
+	}
+}
+
+func (segmenter *LLSegmenter) Passive() {
+}
+
+func (segmenter *LLSegmenter) Publish() {
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	if segmenter.ended {
+		segmenter.ended = false
+		segmenter.discontinuity = true
+		segmenter.reset()
+	}
+}
+
+func (segmenter *LLSegmenter) Unpublish() {
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	segmenter.muxer.Flush()
+	if last := segmenter.last(); last != nil {
+		last.Complete = true
+	}
+	segmenter.ended = true
+	segmenter.notify()
+}
+
+func (segmenter *LLSegmenter) ConsumeVideo(data *core.VideoData) {
+	if !data.IsAVC() {
+		return
+	}
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	if err := segmenter.muxer.WriteVideo(data); err != nil {
+		logger.Warnf("Cannot segment video of %s: %v", segmenter.Stream.Name, err)
+	}
+}
+
+func (segmenter *LLSegmenter) ConsumeAudio(data *core.AudioData) {
+	if !data.IsAAC() {
+		return
+	}
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	if err := segmenter.muxer.WriteAudio(data); err != nil {
+		logger.Warnf("Cannot segment audio of %s: %v", segmenter.Stream.Name, err)
+	}
+}
+
+func (segmenter *LLSegmenter) ConsumeMeta(data *core.MetaData) {}
+
+func (segmenter *LLSegmenter) has(msn uint64, part int) bool {
+	last := segmenter.last()
+	switch {
+	case last == nil || last.Seq < msn:
+		return false
+	case last.Seq > msn || last.Complete:
+		return true
+	}
+	return part >= 0 && len(last.Parts) > part
+}
+
+func (segmenter *LLSegmenter) Wait(msn uint64, part int, timeout time.Duration, done <-chan struct{}) bool {
+	deadline := time.After(timeout)
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	for !segmenter.has(msn, part) {
+		if segmenter.ended {
+			return false
+		}
+		changed := segmenter.changed
+		segmenter.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			segmenter.mutex.Lock()
+			return false
+		case <-done:
+			segmenter.mutex.Lock()
+			return false
+		}
+		segmenter.mutex.Lock()
+	}
+	return true
+}
+
+func (segmenter *LLSegmenter) Next() uint64 {
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	return segmenter.seq
+}
+
+func seconds(ms uint32) float64 {
+	return float64(ms) / 1000
+}
+
+func (segmenter *LLSegmenter) Playlist(skip bool) string {
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	segments := segmenter.Segments
+	discSeq := segmenter.discSeq
+	if len(segments) > segmenter.Config.Window+1 {
+		for _, segment := range segments[:len(segments)-segmenter.Config.Window-1] {
+			if segment.Discontinuity {
+				discSeq++
+			}
+		}
+		segments = segments[len(segments)-segmenter.Config.Window-1:]
+	}
+	target := uint32((segmenter.Config.Target + time.Second - 1) / time.Second)
+	part := uint32(segmenter.Config.Part / time.Millisecond)
+	total := uint32(0)
+	for _, segment := range segments {
+		if segment.Complete && (segment.Duration+999)/1000 > target {
+			target = (segment.Duration + 999) / 1000
+		}
+		for _, p := range segment.Parts {
+			if p.Duration > part {
+				part = p.Duration
+			}
+		}
+		total += segment.Duration
+	}
+	skipUntil := 6 * target * 1000
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:%d\n", target)
+	fmt.Fprintf(&buf, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=%.1f,PART-HOLD-BACK=%.3f\n", seconds(skipUntil), seconds(3*part))
+	fmt.Fprintf(&buf, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", seconds(part))
+	if len(segments) > 0 {
+		fmt.Fprintf(&buf, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].Seq)
+	}
+	if discSeq > 0 {
+		fmt.Fprintf(&buf, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discSeq)
+	}
+	if skip {
+		skipped := 0
+		for _, segment := range segments {
+			if !segment.Complete || total <= skipUntil {
+				break
+			}
+			total -= segment.Duration
+			skipped++
+		}
+		if skipped > 0 {
+			fmt.Fprintf(&buf, "#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skipped)
+			segments = segments[skipped:]
+		}
+	}
+	mapped := -1
+	for i, segment := range segments {
+		if segment.Discontinuity {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if segment.Map != mapped {
+			fmt.Fprintf(&buf, "#EXT-X-MAP:URI=\"init%d.mp4\"\n", segment.Map)
+			mapped = segment.Map
+		}
+		if i >= len(segments)-PART_SEGMENTS {
+			for n, p := range segment.Parts {
+				fmt.Fprintf(&buf, "#EXT-X-PART:DURATION=%.3f,URI=\"%d.%d.m4s\"", seconds(p.Duration), segment.Seq, n)
+				if p.Independent {
+					buf.WriteString(",INDEPENDENT=YES")
+				}
+				buf.WriteString("\n")
+			}
+		}
+		if segment.Complete {
+			fmt.Fprintf(&buf, "#EXTINF:%.3f,\n%d.m4s\n", seconds(segment.Duration), segment.Seq)
+		}
+	}
+	if segmenter.ended {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	} else if last := segmenter.last(); last != nil {
+		if last.Complete {
+			fmt.Fprintf(&buf, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%d.0.m4s\"\n", last.Seq+1)
+		} else {
+			fmt.Fprintf(&buf, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%d.%d.m4s\"\n", last.Seq, len(last.Parts))
+		}
+	}
+	return buf.String()
+}
+
+func (segmenter *LLSegmenter) Media(file string) []byte {
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	if strings.HasPrefix(file, "init") {
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(file, "init"), ".mp4"))
+		if err != nil {
+			return nil
+		}
+		return segmenter.Maps[id]
+	}
+	seq, part, err := parseMedia(file)
+	if err != nil {
+		return nil
+	}
+	for _, segment := range segmenter.Segments {
+		if segment.Seq != seq {
+			continue
+		}
+		if part >= 0 {
+			if part < len(segment.Parts) {
+				return segment.Parts[part].Data
+			}
+			return nil
+		}
+		if !segment.Complete {
+			return nil
+		}
+		data := [][]byte{}
+		for _, p := range segment.Parts {
+			data = append(data, p.Data)
+		}
+		return bytes.Join(data, nil)
+	}
+	return nil
+}
+
+func parseMedia(file string) (seq uint64, part int, err error) {
+	fields := strings.Split(strings.TrimSuffix(file, ".m4s"), ".")
+	if seq, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return
+	}
+	part = -1
+	switch len(fields) {
+	case 1:
+	case 2:
+		part, err = strconv.Atoi(fields[1])
+	default:
+		err = fmt.Errorf("Bad media name %s", file)
+	}
+	return
+}
+
+func (handler *Handler) serveLLPlaylist(w http.ResponseWriter, r *http.Request, name string) {
+	segmenter := handler.lowLatency(name, true)
+	query := r.URL.Query()
+	msn, part := uint64(0), 0
+	if value := query.Get("_HLS_msn"); value != "" {
+		var err error
+		if msn, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(w, "Bad _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		part = -1
+		if value = query.Get("_HLS_part"); value != "" {
+			if part, err = strconv.Atoi(value); err != nil || part < 0 {
+				http.Error(w, "Bad _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+		if msn > segmenter.Next()+2 {
+			http.Error(w, "_HLS_msn too far in the future", http.StatusBadRequest)
+			return
+		}
+	}
+	if !segmenter.Wait(msn, part, 3*handler.Config.Target, r.Context().Done()) {
+		if query.Get("_HLS_msn") == "" {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Playlist update not available", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	skip := query.Get("_HLS_skip") == "YES" || query.Get("_HLS_skip") == "v2"
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(segmenter.Playlist(skip)))
+}
+
+func (handler *Handler) serveLLMedia(w http.ResponseWriter, r *http.Request, name string, file string) {
+	segmenter := handler.lowLatency(name, false)
+	if segmenter == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if strings.HasSuffix(file, ".m4s") {
+		seq, part, err := parseMedia(file)
+		if err != nil || seq > segmenter.Next()+1 {
+			http.NotFound(w, r)
+			return
+		}
+		segmenter.Wait(seq, part, 3*handler.Config.Target, r.Context().Done())
+	}
+	data := segmenter.Media(file)
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Write(data)
+}
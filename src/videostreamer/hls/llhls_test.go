@@ -0,0 +1,105 @@
+package hls
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/core"
+	"videostreamer/testutil"
+)
+
+func TestLLSegmenter(t *testing.T) {
+	config := NewConfig()
+	config.Target = time.Second
+	segmenter := NewLLSegmenter(&core.Stream{Name: "cam"}, config)
+	segmenter.ConsumeVideo(core.NewVideoData(0, testutil.Seq))
+	segmenter.ConsumeAudio(core.NewAudioData(0, []byte{0xaf, 0x00, 0x12, 0x10}))
+	testutil.Feed(segmenter.ConsumeVideo, segmenter.ConsumeAudio, 0, 3500)
+
+	playlist := segmenter.Playlist(false)
+	for _, want := range []string{
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=6.0,PART-HOLD-BACK=1.500\n",
+		"#EXT-X-PART-INF:PART-TARGET=0.500\n",
+		"#EXT-X-MAP:URI=\"init1.mp4\"\n",
+		"#EXT-X-PART:DURATION=0.500,URI=\"0.0.m4s\",INDEPENDENT=YES\n#EXT-X-PART:DURATION=0.500,URI=\"0.1.m4s\"\n#EXTINF:1.000,\n0.m4s\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"2.2.m4s\"\n",
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist lacks %q:\n%s", want, playlist)
+		}
+	}
+	if !segmenter.has(2, 1) || segmenter.has(2, 2) || !segmenter.has(1, -1) || segmenter.has(2, -1) {
+		t.Error("wrong availability of parts")
+	}
+	part, whole := segmenter.Media("0.1.m4s"), segmenter.Media("0.m4s")
+	if len(part) == 0 || len(whole) <= len(part) || string(whole[len(whole)-len(part):]) != string(part) {
+		t.Errorf("segment of %d bytes does not end with part of %d bytes", len(whole), len(part))
+	}
+	if segmenter.Media("2.m4s") != nil || segmenter.Media("init1.mp4") == nil {
+		t.Error("wrong media served")
+	}
+
+	testutil.Feed(segmenter.ConsumeVideo, segmenter.ConsumeAudio, 3500, 10000)
+	if playlist = segmenter.Playlist(true); !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:3\n#EXT-X-SKIP:SKIPPED-SEGMENTS=1\n#EXT-X-MAP:URI=\"init1.mp4\"\n#EXTINF:1.000,\n4.m4s\n") {
+		t.Errorf("delta playlist:\n%s", playlist)
+	}
+
+	segmenter.Unpublish()
+	if playlist = segmenter.Playlist(false); !strings.HasSuffix(playlist, "#EXTINF:0.540,\n9.m4s\n#EXT-X-ENDLIST\n") {
+		t.Errorf("unpublished playlist:\n%s", playlist)
+	}
+	segmenter.Publish()
+	segmenter.ConsumeVideo(core.NewVideoData(0, testutil.Seq))
+	testutil.Feed(segmenter.ConsumeVideo, segmenter.ConsumeAudio, 0, 1500)
+	if playlist = segmenter.Playlist(false); !strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init2.mp4\"\n#EXT-X-PART:DURATION=0.500,URI=\"10.0.m4s\"") {
+		t.Errorf("republished playlist:\n%s", playlist)
+	}
+}
+
+func TestLLHTTP(t *testing.T) {
+	app := core.NewApplication()
+	config := NewConfig()
+	config.Target = time.Second
+	handler := NewHandler(app, config)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	stream := app.AcquireStream("cam")
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	go func() {
+		for deadline := time.Now().Add(5 * time.Second); !attached(handler, "cam/ll") && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		testutil.Feed(stream.ReceiveVideo, stream.ReceiveAudio, 0, 1500)
+		time.Sleep(100 * time.Millisecond)
+		testutil.Feed(stream.ReceiveVideo, stream.ReceiveAudio, 1500, 3500)
+	}()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, body := get("/live/cam/ll.m3u8"); status != 200 || !strings.Contains(body, "URI=\"0.0.m4s\"") {
+		t.Fatalf("playlist %d:\n%s", status, body)
+	}
+	if status, body := get("/live/cam/ll.m3u8?_HLS_msn=2&_HLS_part=0"); status != 200 || !strings.Contains(body, "URI=\"2.0.m4s\"") {
+		t.Errorf("blocking playlist %d:\n%s", status, body)
+	}
+	if status, body := get("/live/cam/1.m4s"); status != 200 || !strings.Contains(body, "moof") {
+		t.Errorf("segment %d with %d bytes", status, len(body))
+	}
+	if status, _ := get("/live/cam/ll.m3u8?_HLS_msn=99"); status != 400 {
+		t.Errorf("far future playlist served with %d", status)
+	}
+	if status, _ := get("/live/cam/1.9.m4s"); status != 404 {
+		t.Errorf("missing part served with %d", status)
+	}
+}
@@ -0,0 +1,188 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"videostreamer/binutil"
+	"videostreamer/core"
+	"videostreamer/logger"
+	"videostreamer/ts"
+)
+
+func NewConfig() *Config {
+	return &Config{
+		Target: DEFAULT_TARGET,
+		Window: DEFAULT_WINDOW,
+		Idle:   DEFAULT_IDLE,
+		Part:   DEFAULT_PART,
+	}
+}
+
+func NewSegmenter(stream *core.Stream, config *Config) *Segmenter {
+	segmenter := &Segmenter{
+		Stream: stream,
+		Config: config,
+		ready:  make(chan struct{}),
+	}
+	segmenter.muxer = ts.NewMuxer(&segmenter.buf)
+	return segmenter
+}
+
+func (segmenter *Segmenter) target() uint32 {
+	return uint32(segmenter.Config.Target.Nanoseconds() / 1e6)
+}
+
+func (segmenter *Segmenter) begin(time uint32) {
+	segmenter.buf.Reset()
+	segmenter.muxer.WriteTables()
+	segmenter.start = time
+	segmenter.last = time
+	segmenter.started = true
+}
+
+func (segmenter *Segmenter) finish(end uint32) {
+	if !segmenter.started {
+		return
+	}
+	segmenter.started = false
+	segment := &Segment{
+		Seq:           segmenter.seq,
+		Duration:      end - segmenter.start,
+		Discontinuity: segmenter.discontinuity,
+		Data:          binutil.Dup(segmenter.buf.Bytes()),
+	}
+	segmenter.seq++
+	segmenter.discontinuity = false
+	segmenter.Segments = append(segmenter.Segments, segment)
+	for len(segmenter.Segments) > segmenter.Config.Window+KEEP_BEHIND {
+		if segmenter.Segments[0].Discontinuity {
+			segmenter.discSeq++
+		}
+		segmenter.Segments = segmenter.Segments[1:]
+	}
+	if !segmenter.isReady {
+		segmenter.isReady = true
+		close(segmenter.ready)
+	}
+}
+
+func (segmenter *Segmenter) Passive() {
+}
+
+func (segmenter *Segmenter) Publish() {
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	if segmenter.ended {
+		segmenter.ended = false
+		segmenter.discontinuity = true
+	}
+}
+
+func (segmenter *Segmenter) Unpublish() {
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	segmenter.finish(segmenter.last)
+	segmenter.ended = true
+}
+
+func (segmenter *Segmenter) ConsumeVideo(data *core.VideoData) {
+	if !data.IsAVC() {
+		return
+	}
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	d := data.Data
+	if len(d) > 1 && d[1] == 1 {
+		key := d[0]>>4 == 1
+		if !segmenter.started {
+			if !key {
+				return
+			}
+			segmenter.begin(data.Time)
+		} else if key && data.Time-segmenter.start >= segmenter.target() {
+			segmenter.finish(data.Time)
+			segmenter.begin(data.Time)
+		}
+		segmenter.last = data.Time
+	}
+	if err := segmenter.muxer.WriteVideo(data); err != nil {
+		logger.Warnf("Cannot segment video of %s: %v", segmenter.Stream.Name, err)
+	}
+}
+
+func (segmenter *Segmenter) ConsumeAudio(data *core.AudioData) {
+	if !data.IsAAC() {
+		return
+	}
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	d := data.Data
+	if len(d) > 1 && d[1] == 1 {
+		if segmenter.muxer.Video == nil {
+			if !segmenter.started {
+				segmenter.begin(data.Time)
+			} else if data.Time-segmenter.start >= segmenter.target() {
+				segmenter.finish(data.Time)
+				segmenter.begin(data.Time)
+			}
+			segmenter.last = data.Time
+		} else if !segmenter.started {
+			return
+		}
+	}
+	if err := segmenter.muxer.WriteAudio(data); err != nil {
+		logger.Warnf("Cannot segment audio of %s: %v", segmenter.Stream.Name, err)
+	}
+}
+
+func (segmenter *Segmenter) ConsumeMeta(data *core.MetaData) {}
+
+func (segmenter *Segmenter) Playlist() string {
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	segments := segmenter.Segments
+	discSeq := segmenter.discSeq
+	if len(segments) > segmenter.Config.Window {
+		for _, segment := range segments[:len(segments)-segmenter.Config.Window] {
+			if segment.Discontinuity {
+				discSeq++
+			}
+		}
+		segments = segments[len(segments)-segmenter.Config.Window:]
+	}
+	target := uint32(1)
+	for _, segment := range segments {
+		if seconds := (segment.Duration + 999) / 1000; seconds > target {
+			target = seconds
+		}
+	}
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n", target)
+	if len(segments) > 0 {
+		fmt.Fprintf(&buf, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].Seq)
+	}
+	if discSeq > 0 {
+		fmt.Fprintf(&buf, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discSeq)
+	}
+	for _, segment := range segments {
+		if segment.Discontinuity {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%.3f,\n%d.ts\n", float64(segment.Duration)/1000, segment.Seq)
+	}
+	if segmenter.ended {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return buf.String()
+}
+
+func (segmenter *Segmenter) Segment(seq uint64) *Segment {
+	segmenter.mutex.Lock()
+	defer segmenter.mutex.Unlock()
+	for _, segment := range segmenter.Segments {
+		if segment.Seq == seq {
+			return segment
+		}
+	}
+	return nil
+}
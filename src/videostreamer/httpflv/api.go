@@ -0,0 +1,30 @@
+package httpflv
+
+import (
+	"sync"
+	"time"
+	"videostreamer/core"
+	"videostreamer/flv"
+)
+
+const (
+	QUEUE_SIZE    = 512
+	WRITE_TIMEOUT = 10 * time.Second
+)
+
+type Handler struct {
+	App *core.Application
+}
+
+type Session struct {
+	Stream      *core.Stream
+	Dropped     uint64
+	DropStalled bool
+	queue       chan *flv.Tag
+	end         chan struct{}
+	mutex       sync.Mutex
+	last        uint32
+	waitKey     bool
+	ended       bool
+	stalled     bool
+}
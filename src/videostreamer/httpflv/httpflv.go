@@ -0,0 +1,235 @@
+package httpflv
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"videostreamer/core"
+	"videostreamer/flv"
+	"videostreamer/logger"
+	"videostreamer/websocket"
+)
+
+var errStalled = errors.New("Player stalled, queue overflowed")
+
+func NewHandler(app *core.Application) *Handler {
+	return &Handler{App: app}
+}
+
+func ParsePath(path string, ext string) (app string, name string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || !strings.HasSuffix(parts[1], ext) {
+		return "", "", false
+	}
+	name = strings.TrimSuffix(parts[1], ext)
+	return parts[0], name, name != ""
+}
+
+func Cors(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Range")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+	return false
+}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsUpgrade(r) {
+		handler.serveWebSocket(w, r)
+		return
+	}
+	if Cors(w, r) {
+		return
+	}
+	_, name, ok := ParsePath(r.URL.Path, ".flv")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	stream := handler.App.AcquireStream(name)
+	session := NewSession(stream)
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+	writer := flv.NewWriter(w)
+	if err := writer.WriteHeader(flv.FLAG_AUDIO | flv.FLAG_VIDEO); err != nil {
+		return
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	logger.Infof("HTTP-FLV client %s playing %s", r.RemoteAddr, name)
+	if stream.IsPublished() {
+		stream.Bootstrap(session)
+	}
+	stream.Subscribe(session)
+	defer stream.Unsubscribe(session)
+	if err := session.Run(w, r.Context().Done()); err != nil {
+		logger.Infof("HTTP-FLV client %s gone: %v", r.RemoteAddr, err)
+	}
+}
+
+func (handler *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	_, name, ok := ParsePath(r.URL.Path, ".flv")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.WriteTimeout = WRITE_TIMEOUT
+	buf := bytes.Buffer{}
+	writer := flv.NewWriter(&buf)
+	writer.WriteHeader(flv.FLAG_AUDIO | flv.FLAG_VIDEO)
+	if err = conn.WriteMessage(websocket.OP_BINARY, buf.Bytes()); err != nil {
+		return
+	}
+
+	stream := handler.App.AcquireStream(name)
+	session := NewSession(stream)
+	session.DropStalled = true
+	logger.Infof("WebSocket-FLV client %s playing %s", r.RemoteAddr, name)
+	if stream.IsPublished() {
+		stream.Bootstrap(session)
+	}
+	stream.Subscribe(session)
+	defer stream.Unsubscribe(session)
+
+	gone := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+	err = session.pump(gone, func(tag *flv.Tag) error {
+		buf.Reset()
+		if err := writer.WriteTag(tag); err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.OP_BINARY, buf.Bytes())
+	})
+	if err != nil {
+		logger.Infof("WebSocket-FLV client %s gone: %v", r.RemoteAddr, err)
+	}
+}
+
+func NewSession(stream *core.Stream) *Session {
+	return &Session{
+		Stream:  stream,
+		queue:   make(chan *flv.Tag, QUEUE_SIZE),
+		end:     make(chan struct{}),
+		waitKey: true,
+	}
+}
+
+func (session *Session) Publish() {
+	session.mutex.Lock()
+	session.waitKey = true
+	session.mutex.Unlock()
+}
+
+func (session *Session) Unpublish() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if !session.ended {
+		session.ended = true
+		close(session.end)
+	}
+}
+
+func (session *Session) ConsumeVideo(data *core.VideoData) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.waitKey && !data.IsSequenceHeader() {
+		if !data.IsKeyFrame() {
+			return
+		}
+		session.waitKey = false
+	}
+	session.enqueue(&flv.Tag{Type: flv.TAG_VIDEO, Time: data.Time, Data: data.Data})
+}
+
+func (session *Session) ConsumeAudio(data *core.AudioData) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.enqueue(&flv.Tag{Type: flv.TAG_AUDIO, Time: data.Time, Data: data.Data})
+}
+
+func (session *Session) ConsumeMeta(data *core.MetaData) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.enqueue(&flv.Tag{Type: flv.TAG_SCRIPT, Time: session.last, Data: flv.EncodeMetadata(data)})
+}
+
+func (session *Session) enqueue(tag *flv.Tag) {
+	if session.ended {
+		return
+	}
+	session.last = tag.Time
+	select {
+	case session.queue <- tag:
+	default:
+		session.waitKey = true
+		session.Dropped++
+		if session.DropStalled {
+			session.stalled = true
+			session.ended = true
+			close(session.end)
+		}
+	}
+}
+
+func (session *Session) Run(w http.ResponseWriter, gone <-chan struct{}) error {
+	writer := flv.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+	return session.pump(gone, func(tag *flv.Tag) error {
+		if err := writer.WriteTag(tag); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+}
+
+func (session *Session) pump(gone <-chan struct{}, write func(*flv.Tag) error) error {
+	for {
+		select {
+		case tag := <-session.queue:
+			if err := write(tag); err != nil {
+				return err
+			}
+		case <-session.end:
+			session.mutex.Lock()
+			stalled := session.stalled
+			session.mutex.Unlock()
+			if stalled {
+				return errStalled
+			}
+			for len(session.queue) > 0 {
+				if err := write(<-session.queue); err != nil {
+					return err
+				}
+			}
+			return nil
+		case <-gone:
+			return nil
+		}
+	}
+}
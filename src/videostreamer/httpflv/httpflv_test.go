@@ -0,0 +1,163 @@
+package httpflv
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/core"
+	"videostreamer/flv"
+	"videostreamer/websocket"
+)
+
+var (
+	seq   = []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x42, 0x00, 0x1e}
+	key   = []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xde, 0xad}
+	inter = []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0xbe, 0xef}
+)
+
+func TestParsePath(t *testing.T) {
+	if app, name, ok := ParsePath("/live/cam.flv", ".flv"); !ok || app != "live" || name != "cam" {
+		t.Errorf("parsed %q %q %v", app, name, ok)
+	}
+	for _, path := range []string{"/cam.flv", "/live/cam.mp4", "/live/.flv", "/a/b/c.flv"} {
+		if _, _, ok := ParsePath(path, ".flv"); ok {
+			t.Errorf("accepted %s", path)
+		}
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	app := core.NewApplication()
+	server := httptest.NewServer(NewHandler(app))
+	defer server.Close()
+
+	stream := app.AcquireStream("cam")
+	stream.ReceiveMeta(core.NewMetaData(640, 480, 25))
+	stream.ReceiveVideo(core.NewVideoData(0, seq))
+
+	resp, err := http.Get(server.URL + "/live/cam.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "video/x-flv" || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("headers %v", resp.Header)
+	}
+	reader := flv.NewReader(resp.Body)
+	if _, err = reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); stream.Subscribers() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("player never subscribed")
+		}
+	}
+	stream.ReceiveVideo(core.NewVideoData(40, inter))
+	stream.ReceiveVideo(core.NewVideoData(80, key))
+	stream.ReceiveAudio(core.NewAudioData(80, []byte{0xaf, 0x01, 0x21}))
+	stream.Unpublish()
+
+	var tags []*flv.Tag
+	for {
+		tag, err := reader.ReadTag()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+	want := []struct {
+		typ  uint8
+		data []byte
+	}{
+		{flv.TAG_SCRIPT, flv.EncodeMetadata(core.NewMetaData(640, 480, 25))},
+		{flv.TAG_VIDEO, seq},
+		{flv.TAG_VIDEO, key},
+		{flv.TAG_AUDIO, []byte{0xaf, 0x01, 0x21}},
+	}
+	if len(tags) != len(want) {
+		t.Fatalf("%d tags instead of %d", len(tags), len(want))
+	}
+	for i, tag := range tags {
+		if tag.Type != want[i].typ || !bytes.Equal(tag.Data, want[i].data) {
+			t.Errorf("tag %d: %+v", i, tag)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewHandler(core.NewApplication()).ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/live/cam.flv", nil))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("preflight %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	app := core.NewApplication()
+	server := httptest.NewServer(NewHandler(app))
+	defer server.Close()
+
+	stream := app.AcquireStream("cam")
+	stream.ReceiveVideo(core.NewVideoData(0, seq))
+
+	conn, err := websocket.Dial("ws" + strings.TrimPrefix(server.URL, "http") + "/live/cam.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	received := bytes.Buffer{}
+	for deadline := time.Now().Add(5 * time.Second); stream.Subscribers() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("player never subscribed")
+		}
+	}
+	stream.ReceiveVideo(core.NewVideoData(40, key))
+	stream.Unpublish()
+	for {
+		op, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if op != websocket.OP_BINARY {
+			t.Errorf("message with opcode %d", op)
+		}
+		received.Write(data)
+	}
+
+	reader := flv.NewReader(&received)
+	if _, err = reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]byte{seq, key} {
+		tag, err := reader.ReadTag()
+		if err != nil || tag.Type != flv.TAG_VIDEO || !bytes.Equal(tag.Data, want) {
+			t.Errorf("tag %+v: %v", tag, err)
+		}
+	}
+	if _, err = reader.ReadTag(); err != io.EOF {
+		t.Errorf("%v instead of EOF", err)
+	}
+}
+
+func TestStalled(t *testing.T) {
+	session := NewSession(&core.Stream{Name: "cam"})
+	session.DropStalled = true
+	for i := 0; i <= QUEUE_SIZE; i++ {
+		session.ConsumeAudio(core.NewAudioData(uint32(i), []byte{0xaf, 0x01, 0x21}))
+	}
+	written := 0
+	err := session.pump(nil, func(tag *flv.Tag) error {
+		written++
+		return nil
+	})
+	if err != errStalled || session.Dropped != 1 {
+		t.Errorf("%v after %d tags with %d dropped", err, written, session.Dropped)
+	}
+}
@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"sync"
+	"time"
+	"videostreamer/core"
+)
+
+const (
+	STATE_IDLE       = "idle"
+	STATE_CONNECTING = "connecting"
+	STATE_LIVE       = "live"
+	STATE_BACKOFF    = "backoff"
+	STATE_STOPPED    = "stopped"
+)
+
+const (
+	MIN_BACKOFF = 1 * time.Second
+	MAX_BACKOFF = 60 * time.Second
+	QUEUE_SIZE  = 512
+	SPEC_LIMIT  = 4096
+)
+
+type Rule struct {
+	Pattern string
+	URL     string
+}
+
+type Destination struct {
+	Rule
+	Name string
+}
+
+type Status struct {
+	Destination string
+	Stream      string
+	URL         string
+	State       string
+	Error       string
+	Since       time.Time
+	Reconnects  uint32
+	Sent        uint64
+	Dropped     uint64
+}
+
+type Push struct {
+	Destination *Destination
+	Stream      *core.Stream
+	URL         string
+	queue       chan interface{}
+	stop        chan struct{}
+	mutex       sync.Mutex
+	status      Status
+	running     bool
+	live        bool
+	waitKey     bool
+}
+
+type Pull struct {
+	Stream  *core.Stream
+	URL     string
+	FourCCs []string
+	stop    chan struct{}
+	idle    *time.Timer
+}
+
+type Edge struct {
+	App     *core.Application
+	Origins []*Rule
+	Idle    time.Duration
+	FourCCs []string
+	pulls   map[*core.Stream]*Pull
+	mutex   sync.Mutex
+}
+
+type Manager struct {
+	App          *core.Application
+	Destinations map[string]*Destination
+	pushes       map[*Destination]map[*core.Stream]*Push
+	mutex        sync.Mutex
+}
+
+type Handler struct {
+	Manager *Manager
+}
+
+type Listing struct {
+	Destinations []Destination
+	Pushes       []Status
+}
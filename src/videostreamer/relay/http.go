@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"videostreamer/logger"
+)
+
+func NewHandler(manager *Manager) *Handler {
+	return &Handler{Manager: manager}
+}
+
+// ServeHTTP lists destinations and pushes on GET /, adds a destination from a
+// [pattern=]rtmp://host/app/{name} body on PUT /{name} and removes it on DELETE /{name}.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(r.URL.Path, "/")
+	if strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == "GET" && name == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Listing{
+			Destinations: handler.Manager.List(),
+			Pushes:       handler.Manager.Status(),
+		})
+	case r.Method == "PUT" && name != "":
+		body, err := io.ReadAll(io.LimitReader(r.Body, SPEC_LIMIT))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dest, err := ParseDestination(name, strings.TrimSpace(string(body)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = handler.Manager.Add(dest); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Infof("Added relay destination %s to %s", name, dest.URL)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "DELETE" && name != "":
+		if err := handler.Manager.Remove(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logger.Infof("Removed relay destination %s", name)
+		w.WriteHeader(http.StatusNoContent)
+	case name == "":
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
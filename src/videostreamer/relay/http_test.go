@@ -0,0 +1,67 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"videostreamer/core"
+)
+
+func TestHandler(t *testing.T) {
+	manager := NewManager(core.NewApplication())
+	server := httptest.NewServer(NewHandler(manager))
+	defer server.Close()
+
+	do := func(method string, path string, body string) int {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	url := "rtmp://" + closedAddr(t) + "/live/{name}"
+	for _, c := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"PUT", "/backup", "cam*=" + url, http.StatusCreated},
+		{"PUT", "/backup", url, http.StatusConflict},
+		{"PUT", "/bad", "cam*", http.StatusBadRequest},
+		{"POST", "/", url, http.StatusMethodNotAllowed},
+		{"PUT", "/a/b", url, http.StatusNotFound},
+	} {
+		if status := do(c.method, c.path, c.body); status != c.status {
+			t.Errorf("%s %s returned %d instead of %d", c.method, c.path, status, c.status)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listing Listing
+	err = json.NewDecoder(resp.Body).Decode(&listing)
+	resp.Body.Close()
+	if err != nil || len(listing.Destinations) != 1 || listing.Destinations[0].Name != "backup" || listing.Destinations[0].Pattern != "cam*" {
+		t.Errorf("listing %+v, %v", listing, err)
+	}
+
+	if status := do("DELETE", "/backup", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE returned %d", status)
+	}
+	if status := do("DELETE", "/backup", ""); status != http.StatusNotFound {
+		t.Errorf("second DELETE returned %d", status)
+	}
+	if len(manager.List()) != 0 {
+		t.Errorf("destinations left after DELETE: %+v", manager.List())
+	}
+}
@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"fmt"
+	"sort"
+	"videostreamer/core"
+)
+
+func NewManager(app *core.Application) *Manager {
+	manager := &Manager{
+		App:          app,
+		Destinations: make(map[string]*Destination),
+		pushes:       make(map[*Destination]map[*core.Stream]*Push),
+	}
+	app.Handle(manager.attachStream)
+	return manager
+}
+
+func (manager *Manager) Add(dest *Destination) error {
+	manager.mutex.Lock()
+	if _, ok := manager.Destinations[dest.Name]; ok {
+		manager.mutex.Unlock()
+		return fmt.Errorf("Destination %s already exists", dest.Name)
+	}
+	manager.Destinations[dest.Name] = dest
+	manager.pushes[dest] = make(map[*core.Stream]*Push)
+	manager.mutex.Unlock()
+
+	for _, stream := range manager.App.ListStreams() {
+		manager.attach(dest, stream)
+	}
+	return nil
+}
+
+func (manager *Manager) Remove(name string) error {
+	manager.mutex.Lock()
+	dest, ok := manager.Destinations[name]
+	if !ok {
+		manager.mutex.Unlock()
+		return fmt.Errorf("Destination %s does not exist", name)
+	}
+	pushes := manager.pushes[dest]
+	delete(manager.Destinations, name)
+	delete(manager.pushes, dest)
+	manager.mutex.Unlock()
+
+	for stream, push := range pushes {
+		stream.Unsubscribe(push)
+		push.Close()
+	}
+	return nil
+}
+
+func (manager *Manager) List() (dests []Destination) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for _, dest := range manager.Destinations {
+		dests = append(dests, *dest)
+	}
+	sort.Slice(dests, func(i, j int) bool {
+		return dests[i].Name < dests[j].Name
+	})
+	return
+}
+
+func (manager *Manager) Status() (statuses []Status) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for _, pushes := range manager.pushes {
+		for _, push := range pushes {
+			statuses = append(statuses, push.Status())
+		}
+	}
+	return
+}
+
+func (manager *Manager) attachStream(stream *core.Stream) {
+	manager.mutex.Lock()
+	var dests []*Destination
+	for _, dest := range manager.Destinations {
+		dests = append(dests, dest)
+	}
+	manager.mutex.Unlock()
+
+	for _, dest := range dests {
+		manager.attach(dest, stream)
+	}
+}
+
+func (manager *Manager) attach(dest *Destination, stream *core.Stream) {
+	if !dest.Matches(stream.Name) {
+		return
+	}
+	manager.mutex.Lock()
+	pushes := manager.pushes[dest]
+	if pushes == nil || pushes[stream] != nil {
+		manager.mutex.Unlock()
+		return
+	}
+	push := NewPush(dest, stream)
+	pushes[stream] = push
+	manager.mutex.Unlock()
+
+	stream.Subscribe(push)
+	if stream.IsPublished() {
+		stream.Bootstrap(push)
+	}
+}
@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"time"
+	"videostreamer/core"
+	"videostreamer/logger"
+	"videostreamer/rtmp"
+)
+
+func NewEdge(app *core.Application, idle time.Duration) *Edge {
+	edge := &Edge{
+		App:   app,
+		Idle:  idle,
+		pulls: make(map[*core.Stream]*Pull),
+	}
+	app.Handle(edge.attach)
+	return edge
+}
+
+func (edge *Edge) AddOrigin(rule *Rule) {
+	edge.mutex.Lock()
+	edge.Origins = append(edge.Origins, rule)
+	edge.mutex.Unlock()
+}
+
+func (edge *Edge) attach(stream *core.Stream) {
+	stream.Watch(edge.watch)
+}
+
+func (edge *Edge) watch(stream *core.Stream) {
+	edge.mutex.Lock()
+	defer edge.mutex.Unlock()
+	pull := edge.pulls[stream]
+	if stream.Subscribers() > 0 {
+		if pull != nil {
+			if pull.idle != nil {
+				pull.idle.Stop()
+				pull.idle = nil
+			}
+			return
+		}
+		for _, rule := range edge.Origins {
+			if rule.Matches(stream.Name) {
+				pull = NewPull(stream, rule.Expand(stream.Name))
+				pull.FourCCs = edge.FourCCs
+				if !stream.Claim(pull) {
+					return
+				}
+				edge.pulls[stream] = pull
+				go pull.run()
+				return
+			}
+		}
+		return
+	}
+	if pull != nil && pull.idle == nil {
+		pull.idle = time.AfterFunc(edge.Idle, func() {
+			edge.expire(stream, pull)
+		})
+	}
+}
+
+func (edge *Edge) expire(stream *core.Stream, pull *Pull) {
+	edge.mutex.Lock()
+	if edge.pulls[stream] != pull || pull.idle == nil || stream.Subscribers() > 0 {
+		edge.mutex.Unlock()
+		return
+	}
+	delete(edge.pulls, stream)
+	edge.mutex.Unlock()
+	logger.Infof("Stream %s idle, dropping upstream %s", stream.Name, pull.URL)
+	pull.Close()
+}
+
+func NewPull(stream *core.Stream, url string) *Pull {
+	return &Pull{
+		Stream: stream,
+		URL:    url,
+		stop:   make(chan struct{}),
+	}
+}
+
+func (pull *Pull) Close() {
+	close(pull.stop)
+}
+
+func (pull *Pull) ConsumeVideo(data *core.VideoData) {
+	pull.Stream.ReceiveVideo(data)
+}
+
+func (pull *Pull) ConsumeAudio(data *core.AudioData) {
+	pull.Stream.ReceiveAudio(data)
+}
+
+func (pull *Pull) ConsumeMeta(data *core.MetaData) {
+	pull.Stream.ReceiveMeta(data)
+}
+
+func (pull *Pull) Publish() {
+}
+
+func (pull *Pull) Unpublish() {
+	if pull.Stream.IsPublished() {
+		pull.Stream.Unpublish()
+	}
+}
+
+func (pull *Pull) run() {
+	defer pull.Stream.Release(pull)
+	defer pull.Unpublish()
+	backoff := MIN_BACKOFF
+	for {
+		err := pull.session(&backoff)
+		select {
+		case <-pull.stop:
+			return
+		default:
+		}
+		logger.Warnf("Pull of %s from %s failed: %v, retrying in %v", pull.Stream.Name, pull.URL, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-pull.stop:
+			return
+		}
+		backoff *= 2
+		if backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+	}
+}
+
+func (pull *Pull) session(backoff *time.Duration) error {
+	connurl, name, err := rtmp.SplitURL(pull.URL)
+	if err != nil {
+		return err
+	}
+	client, err := rtmp.DialFourCCs(connurl, pull.FourCCs)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err = client.Play(name, pull); err != nil {
+		return err
+	}
+	*backoff = MIN_BACKOFF
+	logger.Infof("Pulling %s from %s", pull.Stream.Name, pull.URL)
+	select {
+	case <-client.Done():
+		return client.Err()
+	case <-pull.stop:
+		return nil
+	}
+}
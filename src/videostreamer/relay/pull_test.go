@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"videostreamer/core"
+	"videostreamer/rtmp"
+	"videostreamer/testutil"
+)
+
+func TestEdgePull(t *testing.T) {
+	origin, stopOrigin := serveApp(t, core.NewApplication())
+	defer stopOrigin()
+
+	pub, err := rtmp.Dial("rtmp://" + origin + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	publisher, err := pub.Publish("cam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.ConsumeVideo(core.NewVideoData(0, seq))
+
+	app := core.NewApplication()
+	edge := NewEdge(app, 100*time.Millisecond)
+	edge.AddOrigin(&Rule{Pattern: "cam*", URL: "rtmp://" + origin + "/live/{name}"})
+	addr, stopEdge := serveApp(t, app)
+	defer stopEdge()
+
+	player, err := rtmp.Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := testutil.NewRecorder()
+	if err = player.Play("cam", rec); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(5 * time.Second)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for ts := uint32(40); ; ts += 40 {
+		select {
+		case got := <-rec.Video:
+			if bytes.Equal(got.Data, frame) {
+				goto received
+			}
+		case <-ticker.C:
+			publisher.ConsumeVideo(core.NewVideoData(ts, frame))
+		case <-deadline:
+			t.Fatal("edge did not deliver video from origin")
+		}
+	}
+received:
+	player.Close()
+	for i := 0; i < 100; i++ {
+		edge.mutex.Lock()
+		left := len(edge.pulls)
+		edge.mutex.Unlock()
+		if left == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("upstream connection kept after idle timeout")
+}
+
+func TestEdgeSkipsLocalStreams(t *testing.T) {
+	app := core.NewApplication()
+	edge := NewEdge(app, time.Second)
+	edge.AddOrigin(&Rule{Pattern: "cam*", URL: "rtmp://127.0.0.1:1/live/{name}"})
+
+	local := app.AcquireStream("cam")
+	local.Publish()
+	local.Subscribe(testutil.NewRecorder())
+	claimed := app.AcquireStream("cam-claimed")
+	claimed.Claim(t)
+	claimed.Subscribe(testutil.NewRecorder())
+	relayed := app.AcquireStream("cam-relayed")
+	relayed.Subscribe(NewPush(&Destination{}, relayed))
+	other := app.AcquireStream("studio")
+	other.Subscribe(testutil.NewRecorder())
+
+	edge.mutex.Lock()
+	pulls := len(edge.pulls)
+	edge.mutex.Unlock()
+	if pulls != 0 {
+		t.Errorf("edge pulled a stream with a local publisher, only relays or no matching origin")
+	}
+
+	pulled := app.AcquireStream("cam-pulled")
+	pulled.Subscribe(testutil.NewRecorder())
+	edge.mutex.Lock()
+	pull := edge.pulls[pulled]
+	edge.mutex.Unlock()
+	if pull == nil {
+		t.Fatal("edge did not pull a watched stream")
+	}
+	defer pull.Close()
+	if pulled.Claim(t) {
+		t.Errorf("local publisher claimed a stream the edge is pulling")
+	}
+
+	claimed.Release(t)
+	edge.mutex.Lock()
+	pull = edge.pulls[claimed]
+	edge.mutex.Unlock()
+	if pull == nil {
+		t.Fatal("edge did not pull a watched stream once its claim was released")
+	}
+	defer pull.Close()
+}
@@ -0,0 +1,255 @@
+package relay
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+	"videostreamer/core"
+	"videostreamer/logger"
+	"videostreamer/rtmp"
+)
+
+func ParseRule(spec string) (*Rule, error) {
+	rule := &Rule{
+		URL: spec,
+	}
+	if !strings.HasPrefix(spec, "rtmp://") {
+		idx := strings.Index(spec, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("Rule %s is neither url nor pattern=url", spec)
+		}
+		rule.Pattern = spec[:idx]
+		rule.URL = spec[idx+1:]
+	}
+	if _, err := path.Match(rule.Pattern, ""); err != nil {
+		return nil, fmt.Errorf("Bad pattern %s: %v", rule.Pattern, err)
+	}
+	if _, _, err := rtmp.SplitURL(rule.URL); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func ParseDestination(name string, spec string) (*Destination, error) {
+	rule, err := ParseRule(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Destination{Rule: *rule, Name: name}, nil
+}
+
+func (rule *Rule) Matches(name string) bool {
+	if rule.Pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(rule.Pattern, name)
+	return ok
+}
+
+func (rule *Rule) Expand(name string) string {
+	return strings.Replace(rule.URL, "{name}", name, -1)
+}
+
+func NewPush(dest *Destination, stream *core.Stream) *Push {
+	return &Push{
+		Destination: dest,
+		Stream:      stream,
+		URL:         dest.Expand(stream.Name),
+		queue:       make(chan interface{}, QUEUE_SIZE),
+		status: Status{
+			Destination: dest.Name,
+			Stream:      stream.Name,
+			URL:         dest.Expand(stream.Name),
+			State:       STATE_IDLE,
+			Since:       time.Now(),
+		},
+	}
+}
+
+func (push *Push) Status() Status {
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+	return push.status
+}
+
+func (push *Push) Passive() {
+}
+
+func (push *Push) Publish() {
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+	if push.running {
+		return
+	}
+	push.running = true
+	push.stop = make(chan struct{})
+	go push.run(push.stop)
+}
+
+func (push *Push) Unpublish() {
+	push.halt(STATE_IDLE)
+}
+
+func (push *Push) Close() {
+	push.halt(STATE_STOPPED)
+}
+
+func (push *Push) ConsumeVideo(data *core.VideoData) {
+	push.enqueue(data, data.IsKeyFrame())
+}
+
+func (push *Push) ConsumeAudio(data *core.AudioData) {
+	push.enqueue(data, false)
+}
+
+func (push *Push) ConsumeMeta(data *core.MetaData) {
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+	if !push.live {
+		return
+	}
+	select {
+	case push.queue <- data:
+	default:
+		push.status.Dropped++
+	}
+}
+
+func (push *Push) enqueue(data interface{}, key bool) {
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+	if !push.live {
+		return
+	}
+	if push.waitKey {
+		if !key {
+			return
+		}
+		push.waitKey = false
+	}
+	select {
+	case push.queue <- data:
+	default:
+		push.waitKey = true
+		push.status.Dropped++
+	}
+}
+
+func (push *Push) halt(state string) {
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+	if push.running {
+		close(push.stop)
+		push.running = false
+	}
+	push.live = false
+	push.status.State = state
+	push.status.Error = ""
+	push.status.Since = time.Now()
+}
+
+func (push *Push) transition(stop chan struct{}, state string, err error) bool {
+	push.mutex.Lock()
+	defer push.mutex.Unlock()
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	push.status.State = state
+	push.status.Since = time.Now()
+	if err != nil {
+		push.status.Error = err.Error()
+	}
+	if state == STATE_LIVE {
+		push.status.Error = ""
+		push.live = true
+		push.waitKey = true
+	} else {
+		push.live = false
+	}
+	return true
+}
+
+func (push *Push) run(stop chan struct{}) {
+	backoff := MIN_BACKOFF
+	for {
+		if !push.transition(stop, STATE_CONNECTING, nil) {
+			return
+		}
+		err := push.session(stop, &backoff)
+		if !push.transition(stop, STATE_BACKOFF, err) {
+			return
+		}
+		logger.Warnf("Push of %s to %s failed: %v, retrying in %v", push.Stream.Name, push.Destination.Name, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+		backoff *= 2
+		if backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+		push.mutex.Lock()
+		push.status.Reconnects++
+		push.mutex.Unlock()
+	}
+}
+
+func (push *Push) session(stop chan struct{}, backoff *time.Duration) error {
+	connurl, name, err := rtmp.SplitURL(push.URL)
+	if err != nil {
+		return err
+	}
+	client, err := rtmp.Dial(connurl)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	publisher, err := client.Publish(name)
+	if err != nil {
+		return err
+	}
+	*backoff = MIN_BACKOFF
+
+	for len(push.queue) > 0 {
+		<-push.queue
+	}
+	if !push.transition(stop, STATE_LIVE, nil) {
+		return nil
+	}
+	logger.Infof("Pushing %s to %s", push.Stream.Name, push.Destination.Name)
+	meta, video, audio := push.Stream.Keys()
+	if meta != nil {
+		publisher.ConsumeMeta(meta)
+	}
+	if video != nil {
+		publisher.ConsumeVideo(video)
+	}
+	if audio != nil {
+		publisher.ConsumeAudio(audio)
+	}
+
+	for {
+		select {
+		case data := <-push.queue:
+			switch data := data.(type) {
+			case *core.VideoData:
+				publisher.ConsumeVideo(data)
+			case *core.AudioData:
+				publisher.ConsumeAudio(data)
+			case *core.MetaData:
+				publisher.ConsumeMeta(data)
+			}
+			push.mutex.Lock()
+			push.status.Sent++
+			push.mutex.Unlock()
+		case <-client.Done():
+			return client.Err()
+		case <-stop:
+			return nil
+		}
+	}
+}
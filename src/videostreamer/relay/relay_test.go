@@ -0,0 +1,134 @@
+package relay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+	"videostreamer/core"
+	"videostreamer/rtmp"
+	"videostreamer/syncutil"
+	"videostreamer/testutil"
+)
+
+var (
+	seq   = []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x42, 0x00, 0x1e}
+	frame = []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xde, 0xad, 0xbe, 0xef}
+)
+
+func serveApp(t *testing.T, app *core.Application) (addr string, stop func()) {
+	return testutil.Serve(t, func(latch *syncutil.SyncLatch, ln net.Listener) {
+		rtmp.ServeListener(app, latch, ln, rtmp.NewConfig())
+	})
+}
+
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestParseDestination(t *testing.T) {
+	dest, err := ParseDestination("a", "cam*=rtmp://host/live/{name}_hd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dest.Matches("cam1") || dest.Matches("studio") {
+		t.Errorf("pattern %q matched wrong streams", dest.Pattern)
+	}
+	if url := dest.Expand("cam1"); url != "rtmp://host/live/cam1_hd" {
+		t.Errorf("expanded to %s", url)
+	}
+	if dest, err = ParseDestination("b", "rtmp://host/live/key"); err != nil || !dest.Matches("anything") {
+		t.Errorf("bare url destination %v %v", dest, err)
+	}
+	if _, err = ParseDestination("c", "cam*"); err == nil {
+		t.Errorf("accepted destination without url")
+	}
+}
+
+func TestPushRelay(t *testing.T) {
+	addr, stop := serveApp(t, core.NewApplication())
+	defer stop()
+
+	app := core.NewApplication()
+	manager := NewManager(app)
+	manager.Add(&Destination{Name: "dead", Rule: Rule{URL: "rtmp://" + closedAddr(t) + "/live/{name}"}})
+	manager.Add(&Destination{Name: "remote", Rule: Rule{Pattern: "cam*", URL: "rtmp://" + addr + "/live/{name}_out"}})
+
+	player, err := rtmp.Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	rec := testutil.NewRecorder()
+	if err = player.Play("cam_out", rec); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := app.AcquireStream("cam")
+	stream.KeyVideo = core.NewVideoData(0, seq)
+	stream.Publish()
+
+	deadline := time.After(5 * time.Second)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for ts := uint32(40); ; ts += 40 {
+		select {
+		case got := <-rec.Video:
+			if bytes.Equal(got.Data, frame) {
+				goto received
+			}
+		case <-ticker.C:
+			stream.BroadcastVideo(core.NewVideoData(ts, frame))
+		case <-deadline:
+			t.Fatalf("relay did not deliver video, status %+v", manager.Status())
+		}
+	}
+received:
+	for _, status := range manager.Status() {
+		switch status.Destination {
+		case "remote":
+			if status.State != STATE_LIVE || status.URL != "rtmp://"+addr+"/live/cam_out" {
+				t.Errorf("remote status %+v", status)
+			}
+		case "dead":
+			if status.State == STATE_LIVE {
+				t.Errorf("dead destination is live")
+			}
+		}
+	}
+
+	if err = manager.Remove("remote"); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.Consumers) != 1 {
+		t.Errorf("%d consumers left after remove", len(stream.Consumers))
+	}
+	stream.Unpublish()
+}
+
+func TestPushDropsWhenStalled(t *testing.T) {
+	stream := &core.Stream{Name: "cam"}
+	push := NewPush(&Destination{Name: "stalled", Rule: Rule{URL: "rtmp://127.0.0.1/live/{name}"}}, stream)
+	push.transition(make(chan struct{}), STATE_LIVE, nil)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < QUEUE_SIZE*2; i++ {
+			push.ConsumeVideo(core.NewVideoData(uint32(i), frame))
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("consume blocked on a stalled destination")
+	}
+	if push.Status().Dropped == 0 {
+		t.Errorf("nothing dropped on overflow")
+	}
+}
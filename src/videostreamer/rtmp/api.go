@@ -5,6 +5,7 @@ import (
 	"net"
 	"videostreamer/core"
 	"bytes"
+	"time"
 )
 
 const (
@@ -43,9 +44,15 @@ const (
 	USER_EVENT_PING_RESPONSE      = 7
 )
 
+const (
+	PEER_BAND_HARD    = 0
+	PEER_BAND_SOFT    = 1
+	PEER_BAND_DYNAMIC = 2
+)
+
 type Header struct {
 	Format    uint8
-	ChunkID   uint16
+	ChunkID   uint32
 	Timestamp uint32
 	Length    uint32
 	Type      uint8
@@ -54,9 +61,10 @@ type Header struct {
 }
 
 type RawMessage struct {
-	Header Header
-	Delta  uint32
-	Data   bytes.Buffer
+	Header   Header
+	Delta    uint32
+	Extended bool
+	Data     bytes.Buffer
 }
 
 type Message interface {
@@ -65,20 +73,71 @@ type Message interface {
 	String()          string
 }
 
+const AGGREGATE_LIMIT = 65536
+
+const (
+	EXTENDED_TIMESTAMP = 0xFFFFFF
+	MAX_CHUNK_ID       = 65599
+)
+
+type Config struct {
+	StrictHandshake  bool
+	AggregateWindow  time.Duration
+	AckWindow        uint32
+	PeerBandwidth    uint32
+	AckTimeout       time.Duration
+	HandshakeTimeout time.Duration
+	IdleTimeout      time.Duration
+	MediaTimeout     time.Duration
+	PingInterval     time.Duration
+	PingTimeout      time.Duration
+}
+
+type Stats struct {
+	Addr      string
+	Connected time.Time
+	RTT       time.Duration
+	InBytes   uint32
+	OutBytes  uint32
+	Lag       uint32
+}
+
+type NetStream struct {
+	ID         uint32
+	Stream     *core.Stream
+	Client     *RTMPClient
+	Publishing bool
+	LastMedia  time.Time
+}
+
 type RTMPContext struct {
 	Running  bool
+	Config   *Config
 	Conn     net.Conn
 	App      *core.Application
-	Client   core.Consumer
-	Stream   *core.Stream
-	In       map[uint16]*RawMessage
-	Out      map[uint16]*RawMessage
+	Streams  map[uint32]*NetStream
+	NextID   uint32
+	In       map[uint32]*RawMessage
+	Out      map[uint32]*RawMessage
 	InMsg    chan Message
 	OutMsg   chan Message
+	Done     chan struct{}
 	InChunk  uint32
 	OutChunk uint32
 	InAck    uint32
 	OutAck   uint32
 	InTrans  uint32
 	OutTrans uint32
+	InAcked  uint32
+	OutAcked uint32
+	Limit    uint32
+	LimitType uint8
+	FourCCs  []string
+	acked    chan struct{}
+	Epoch    time.Time
+	LastSeen time.Time
+	Active   time.Time
+	rtt      int64
+	lastIn   uint32
+	lastPing time.Time
 }
\ No newline at end of file
@@ -0,0 +1,259 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"videostreamer/binutil"
+)
+
+func roundTrip(t *testing.T, chunk uint32, msgs []Message) {
+	writer, reader := pipeContexts()
+	defer writer.Conn.Close()
+	writer.OutChunk = chunk
+	reader.InChunk = chunk
+	reader.InMsg = make(chan Message, len(msgs))
+	errs := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if err := writer.WriteMessage(msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for n := 0; n < len(msgs); {
+		if err := reader.ReadChunk(); err != nil {
+			t.Fatalf("chunk %d: %v", chunk, err)
+		}
+		for len(reader.InMsg) > 0 {
+			got, want := (<-reader.InMsg).(*VideoMessage), msgs[n].(*VideoMessage)
+			if got.Header().Timestamp != want.Header().Timestamp || got.Header().StreamID != want.Header().StreamID {
+				t.Errorf("chunk %d id %d message %d: header %+v instead of %+v", chunk, want.Header().ChunkID, n, *got.Header(), *want.Header())
+			}
+			if !bytes.Equal(got.Data, want.Data) {
+				t.Errorf("chunk %d id %d message %d: payload mismatch", chunk, want.Header().ChunkID, n)
+			}
+			n++
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	payload := make([]byte, 300)
+	for n := range payload {
+		payload[n] = byte(n)
+	}
+	for _, chunk := range []uint32{1, 7, 128, 4096} {
+		for _, id := range []uint32{2, 63, 64, 319, 320, 4242, MAX_CHUNK_ID} {
+			for _, start := range []uint32{0, 0xFFFFFE, 0xFFFFFFF0} {
+				for _, delta := range []uint32{40, 0xFFFFFF, 0x1234567} {
+					for _, fmt := range []uint8{BASIC_TYPE_FULL, BASIC_TYPE_MEDIUM, BASIC_TYPE_SHORT, BASIC_TYPE_NONE} {
+						var msgs []Message
+						ts := start
+						for _, f := range []uint8{BASIC_TYPE_FULL, BASIC_TYPE_MEDIUM, fmt, BASIC_TYPE_NONE} {
+							switch {
+							case f == BASIC_TYPE_NONE && fmt == BASIC_TYPE_FULL:
+								ts += ts
+							case f != BASIC_TYPE_FULL:
+								ts += delta
+							}
+							header := Header{ChunkID: id, StreamID: 1, Timestamp: ts, ForceFmt: true, Format: f}
+							msgs = append(msgs, NewMessage(header, &VideoMessage{Data: payload}))
+						}
+						roundTrip(t, chunk, msgs)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestChunkAutoFormat(t *testing.T) {
+	var msgs []Message
+	for n, ts := range []uint32{0, 40, 80, 0x1000000, 0x1000028, 20, 0xFFFFFFF0, 0x18} {
+		msgs = append(msgs, NewMessage(Header{ChunkID: 6, StreamID: 1 + uint32(n)/6, Timestamp: ts}, &VideoMessage{Data: make([]byte, 200)}))
+	}
+	roundTrip(t, 128, msgs)
+}
+
+func TestBasicHeader(t *testing.T) {
+	writer, reader := pipeContexts()
+	defer writer.Conn.Close()
+	ids := []uint32{2, 63, 64, 319, 320, 321, MAX_CHUNK_ID}
+	go func() {
+		for _, id := range ids {
+			writer.writeBasic(BASIC_TYPE_SHORT, id)
+		}
+	}()
+	for _, id := range ids {
+		fmt, got := reader.readBasic()
+		if fmt != BASIC_TYPE_SHORT || got != id {
+			t.Errorf("chunk id %d read back as fmt %d id %d", id, fmt, got)
+		}
+	}
+}
+
+func TestBasicHeaderVectors(t *testing.T) {
+	for _, v := range []struct {
+		raw    []byte
+		fmt    uint8
+		id     uint32
+		encode bool
+	}{
+		{[]byte{0x03}, BASIC_TYPE_FULL, 3, true},
+		{[]byte{0x7f}, BASIC_TYPE_MEDIUM, 63, true},
+		{[]byte{0x80, 0x00}, BASIC_TYPE_SHORT, 64, true},
+		{[]byte{0xc0, 0xff}, BASIC_TYPE_NONE, 319, true},
+		{[]byte{0x01, 0x00, 0x01}, BASIC_TYPE_FULL, 320, true},
+		{[]byte{0x41, 0x34, 0x12}, BASIC_TYPE_MEDIUM, 64 + 0x34 + 0x12*256, true},
+		{[]byte{0xc1, 0xff, 0xff}, BASIC_TYPE_NONE, MAX_CHUNK_ID, true},
+		{[]byte{0x01, 0x00, 0x00}, BASIC_TYPE_FULL, 64, false},
+		{[]byte{0x81, 0xff, 0x00}, BASIC_TYPE_SHORT, 319, false},
+	} {
+		writer, reader := pipeContexts()
+		go binutil.WriteBuf(writer.Conn, v.raw)
+		if fmt, id := reader.readBasic(); fmt != v.fmt || id != v.id {
+			t.Errorf("%x read as fmt %d id %d instead of fmt %d id %d", v.raw, fmt, id, v.fmt, v.id)
+		}
+		if v.encode {
+			go writer.writeBasic(v.fmt, v.id)
+			got := make([]byte, len(v.raw))
+			if _, err := io.ReadFull(reader.Conn, got); err != nil || !bytes.Equal(got, v.raw) {
+				t.Errorf("fmt %d id %d written as %x instead of %x", v.fmt, v.id, got, v.raw)
+			}
+		}
+		writer.Conn.Close()
+	}
+}
+
+func TestExtendedTimestampVectors(t *testing.T) {
+	payload := make([]byte, 200)
+	for n := range payload {
+		payload[n] = byte(n)
+	}
+	// A type 0 chunk with an extended timestamp, its type 3 continuation
+	// repeating it, then a type 2 chunk with an extended delta and a type 3
+	// chunk starting a new message with the same delta.
+	var raw []byte
+	raw = append(raw, 0x06, 0xff, 0xff, 0xff, 0x00, 0x00, 0xc8, MESSAGE_TYPE_VIDEO, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00)
+	raw = append(raw, payload[:128]...)
+	raw = append(raw, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	raw = append(raw, payload[128:]...)
+	first := len(raw)
+	raw = append(raw, 0x86, 0xff, 0xff, 0xff, 0x01, 0x00, 0x00, 0x00)
+	raw = append(raw, payload[:128]...)
+	raw = append(raw, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	raw = append(raw, payload[128:]...)
+	raw = append(raw, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	raw = append(raw, payload[:128]...)
+	raw = append(raw, 0xc6, 0x01, 0x00, 0x00, 0x00)
+	raw = append(raw, payload[128:]...)
+
+	writer, reader := pipeContexts()
+	defer writer.Conn.Close()
+	go binutil.WriteBuf(writer.Conn, raw)
+	for _, want := range []uint32{0x01000000, 0x02000000, 0x03000000} {
+		for len(reader.InMsg) == 0 {
+			if err := reader.ReadChunk(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg := (<-reader.InMsg).(*VideoMessage)
+		if msg.Header().Timestamp != want || !bytes.Equal(msg.Data, payload) {
+			t.Errorf("message at %#x read with timestamp %#x", want, msg.Header().Timestamp)
+		}
+	}
+
+	go writer.WriteMessage(NewMessage(Header{ChunkID: 6, StreamID: 1, Timestamp: 0x01000000, ForceFmt: true, Format: BASIC_TYPE_FULL}, &VideoMessage{Data: payload}))
+	got := make([]byte, first)
+	if _, err := io.ReadFull(reader.Conn, got); err != nil || !bytes.Equal(got, raw[:first]) {
+		t.Errorf("extended timestamp written as\n%x\ninstead of\n%x", got, raw[:first])
+	}
+}
+
+func TestTypeThreeAfterTypeZero(t *testing.T) {
+	// A type 3 chunk starting a new message after a type 0 chunk takes the
+	// type 0 timestamp as its delta.
+	raw := []byte{0x07, 0x00, 0x00, 0x64, 0x00, 0x00, 0x02, MESSAGE_TYPE_VIDEO, 0x01, 0x00, 0x00, 0x00, 0x17, 0x01}
+	raw = append(raw, 0xc7, 0x17, 0x01)
+
+	writer, reader := pipeContexts()
+	defer writer.Conn.Close()
+	go binutil.WriteBuf(writer.Conn, raw)
+	for _, want := range []uint32{100, 200} {
+		for len(reader.InMsg) == 0 {
+			if err := reader.ReadChunk(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := (<-reader.InMsg).Header().Timestamp; got != want {
+			t.Errorf("timestamp %d instead of %d", got, want)
+		}
+	}
+
+	go func() {
+		writer.WriteMessage(NewMessage(Header{ChunkID: 7, StreamID: 1, Timestamp: 100}, &VideoMessage{Data: []byte{0x17, 0x01}}))
+		writer.WriteMessage(NewMessage(Header{ChunkID: 7, StreamID: 1, Timestamp: 200}, &VideoMessage{Data: []byte{0x17, 0x01}}))
+	}()
+	got := make([]byte, len(raw))
+	if _, err := io.ReadFull(reader.Conn, got); err != nil || !bytes.Equal(got, raw) {
+		t.Errorf("written as %x instead of %x", got, raw)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	writer, reader := pipeContexts()
+	defer writer.Conn.Close()
+	go func() {
+		binutil.WriteBuf(writer.Conn, []byte{0x06, 0, 0, 0, 0, 0x01, 0x2c, MESSAGE_TYPE_VIDEO, 1, 0, 0, 0})
+		binutil.WriteBuf(writer.Conn, make([]byte, 128))
+		writer.WriteMessage(NewMessage(Header{ChunkID: 2}, &AbortMessage{Stream: 6}))
+		writer.WriteMessage(NewMessage(Header{ChunkID: 6, StreamID: 1, Timestamp: 40}, &VideoMessage{Data: []byte{0x17, 0x01}}))
+	}()
+	for {
+		if err := reader.ReadChunk(); err != nil {
+			t.Fatal(err)
+		}
+		if len(reader.InMsg) == 0 {
+			continue
+		}
+		msg := <-reader.InMsg
+		if _, ok := msg.(*AbortMessage); ok {
+			continue
+		}
+		video, ok := msg.(*VideoMessage)
+		if !ok || !bytes.Equal(video.Data, []byte{0x17, 0x01}) || video.Header().Timestamp != 40 {
+			t.Errorf("got %v after abort", msg)
+		}
+		return
+	}
+}
+
+func TestMalformedMessageDropped(t *testing.T) {
+	writer, reader := pipeContexts()
+	defer writer.Conn.Close()
+	go func() {
+		writer.WriteMessage(NewMessage(Header{ChunkID: 6, StreamID: 1}, &AggregateMessage{Messages: []Message{NewMessage(Header{}, &SetChunkSizeMessage{Size: 1})}}))
+		binutil.WriteBuf(writer.Conn, []byte{0x06, 0, 0, 0, 0, 0, 0x01, 0x7f, 1, 0, 0, 0, 0})
+		writer.WriteMessage(NewMessage(Header{ChunkID: 7, StreamID: 1, Timestamp: 40}, &VideoMessage{Data: []byte{0x17, 0x01}}))
+	}()
+	for {
+		if err := reader.ReadChunk(); err != nil {
+			t.Fatal(err)
+		}
+		if len(reader.InMsg) == 0 {
+			continue
+		}
+		msg := <-reader.InMsg
+		video, ok := msg.(*VideoMessage)
+		if !ok || !bytes.Equal(video.Data, []byte{0x17, 0x01}) || video.Header().Timestamp != 40 {
+			t.Errorf("got %v after malformed messages", msg)
+		}
+		return
+	}
+}
@@ -0,0 +1,476 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"videostreamer/amf"
+	"videostreamer/core"
+	"videostreamer/flv"
+	"videostreamer/logger"
+)
+
+const clientTimeout = 10 * time.Second
+
+type ClientConn struct {
+	Context   *RTMPContext
+	App       string
+	TcURL     string
+	Consumers map[uint32]core.Consumer
+	err       error
+	mutex     sync.Mutex
+	serial    float64
+	calls     map[float64]chan []amf.AMFValue
+	status    chan clientStatus
+	published map[uint32]bool
+	closing   sync.Once
+}
+
+type clientStatus struct {
+	StreamID uint32
+	Info     amf.AMFMap
+}
+
+func SplitURL(rawurl string) (connurl string, name string, err error) {
+	idx := strings.LastIndex(rawurl, "/")
+	if idx < 0 || idx == len(rawurl)-1 || strings.HasSuffix(rawurl[:idx], "/") {
+		return "", "", fmt.Errorf("No stream name in %s", rawurl)
+	}
+	return rawurl[:idx], rawurl[idx+1:], nil
+}
+
+func Dial(rawurl string) (client *ClientConn, err error) {
+	return DialFourCCs(rawurl, nil)
+}
+
+// DialFourCCs connects announcing the Enhanced RTMP codecs accepted in played
+// streams, nil announces none and only legacy codecs are delivered.
+func DialFourCCs(rawurl string, fourccs []string) (client *ClientConn, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtmp" {
+		return nil, fmt.Errorf("Unsupported scheme %s", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "1935")
+	}
+	conn, err := net.DialTimeout("tcp", host, clientTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(clientTimeout))
+	if err = ClientHandshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client = &ClientConn{
+		Context:   NewRTMPContext(conn, nil, NewConfig()),
+		App:       strings.TrimPrefix(u.Path, "/"),
+		TcURL:     rawurl,
+		Consumers: make(map[uint32]core.Consumer),
+		calls:     make(map[float64]chan []amf.AMFValue),
+		status:    make(chan clientStatus, 16),
+		published: make(map[uint32]bool),
+	}
+	go client.recv()
+	go client.send()
+	go client.hndl()
+
+	client.write(NewMessage(Header{ChunkID: 2}, &SetChunkSizeMessage{Size: 4096}))
+	var props interface{}
+	if fourccs != nil {
+		props = struct {
+			App            string   `name:"app"`
+			FlashVer       string   `name:"flashVer"`
+			TcURL          string   `name:"tcUrl"`
+			Type           string   `name:"type"`
+			Fpad           bool     `name:"fpad"`
+			Capabilities   float64  `name:"capabilities"`
+			AudioCodecs    float64  `name:"audioCodecs"`
+			VideoCodecs    float64  `name:"videoCodecs"`
+			VideoFunction  float64  `name:"videoFunction"`
+			ObjectEncoding float64  `name:"objectEncoding"`
+			FourCcList     []string `name:"fourCcList"`
+		}{client.App, "FMLE/3.0 (compatible; videostreamer)", rawurl, "nonprivate", false, 15, 0x0FFF, 0x00FF, 1, 0, fourccs}
+	} else {
+		props = struct {
+			App            string  `name:"app"`
+			FlashVer       string  `name:"flashVer"`
+			TcURL          string  `name:"tcUrl"`
+			Type           string  `name:"type"`
+			Fpad           bool    `name:"fpad"`
+			Capabilities   float64 `name:"capabilities"`
+			AudioCodecs    float64 `name:"audioCodecs"`
+			VideoCodecs    float64 `name:"videoCodecs"`
+			VideoFunction  float64 `name:"videoFunction"`
+			ObjectEncoding float64 `name:"objectEncoding"`
+		}{client.App, "FMLE/3.0 (compatible; videostreamer)", rawurl, "nonprivate", false, 15, 0x0FFF, 0x00FF, 1, 0}
+	}
+	_, err = client.call("connect", props)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (client *ClientConn) Play(name string, consumer core.Consumer) (err error) {
+	id, err := client.createStream()
+	if err != nil {
+		return
+	}
+	client.mutex.Lock()
+	client.Consumers[id] = consumer
+	client.mutex.Unlock()
+	client.write(NewMessage(Header{ChunkID: 2}, &UserMessage{
+		Event:  USER_EVENT_SET_BUFFER_LENGTH,
+		First:  id,
+		Second: 3000,
+	}))
+	client.write(client.command(8, id, "play", 0, nil, name))
+	if err = client.await(id, "NetStream.Play.Start"); err != nil {
+		client.mutex.Lock()
+		delete(client.Consumers, id)
+		client.mutex.Unlock()
+	}
+	return
+}
+
+func (client *ClientConn) Publish(name string) (publisher *ClientPublisher, err error) {
+	client.notify("releaseStream", nil, name)
+	client.notify("FCPublish", nil, name)
+	id, err := client.createStream()
+	if err != nil {
+		return
+	}
+	client.write(client.command(8, id, "publish", 0, nil, name, "live"))
+	if err = client.await(id, "NetStream.Publish.Start"); err != nil {
+		return
+	}
+	return &ClientPublisher{Client: client, StreamID: id, Name: name}, nil
+}
+
+func (client *ClientConn) DeleteStream(id uint32) {
+	client.mutex.Lock()
+	delete(client.Consumers, id)
+	delete(client.published, id)
+	client.mutex.Unlock()
+	client.write(client.command(3, 0, "deleteStream", 0, nil, id))
+}
+
+func (client *ClientConn) Close() {
+	client.closing.Do(func() {
+		close(client.Context.Done)
+		client.Context.Conn.Close()
+	})
+}
+
+func (client *ClientConn) Done() <-chan struct{} {
+	return client.Context.Done
+}
+
+type ClientPublisher struct {
+	Client   *ClientConn
+	StreamID uint32
+	Name     string
+}
+
+func (publisher *ClientPublisher) ConsumeVideo(data *core.VideoData) {
+	publisher.Client.write(NewMessage(Header{ChunkID: 6, Timestamp: data.Time, StreamID: publisher.StreamID}, &VideoMessage{Data: data.Data}))
+}
+
+func (publisher *ClientPublisher) ConsumeAudio(data *core.AudioData) {
+	publisher.Client.write(NewMessage(Header{ChunkID: 4, Timestamp: data.Time, StreamID: publisher.StreamID}, &AudioMessage{Data: data.Data}))
+}
+
+func (publisher *ClientPublisher) ConsumeMeta(data *core.MetaData) {
+	buf := bytes.Buffer{}
+	amf.EncodeAMF(&buf, "@setDataFrame")
+	buf.Write(makeMetadata(data, publisher.StreamID).(*Amf0MetaMessage).Data)
+	publisher.Client.write(NewMessage(Header{ChunkID: 3, StreamID: publisher.StreamID}, &Amf0MetaMessage{Data: buf.Bytes()}))
+}
+
+func (publisher *ClientPublisher) Close() {
+	publisher.Client.notify("FCUnpublish", nil, publisher.Name)
+	publisher.Client.DeleteStream(publisher.StreamID)
+}
+
+func (publisher *ClientPublisher) Publish() {
+}
+
+func (publisher *ClientPublisher) Unpublish() {
+}
+
+func (client *ClientConn) createStream() (uint32, error) {
+	res, err := client.call("createStream", nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(res) < 2 {
+		return 0, fmt.Errorf("Malformed createStream result")
+	}
+	id, ok := res[1].(float64)
+	if !ok {
+		return 0, fmt.Errorf("Malformed createStream result")
+	}
+	return uint32(id), nil
+}
+
+func (client *ClientConn) command(chunkid uint32, streamid uint32, name string, args ...interface{}) Message {
+	buf := bytes.Buffer{}
+	amf.EncodeAMF(&buf, name)
+	for _, arg := range args {
+		amf.EncodeAMF(&buf, arg)
+	}
+	return NewMessage(Header{ChunkID: chunkid, StreamID: streamid}, &Amf0CmdMessage{Data: buf.Bytes()})
+}
+
+func (client *ClientConn) notify(name string, args ...interface{}) {
+	client.mutex.Lock()
+	client.serial++
+	serial := client.serial
+	client.mutex.Unlock()
+	client.write(client.command(3, 0, name, append([]interface{}{serial}, args...)...))
+}
+
+func (client *ClientConn) call(name string, args ...interface{}) ([]amf.AMFValue, error) {
+	res := make(chan []amf.AMFValue, 1)
+	client.mutex.Lock()
+	client.serial++
+	serial := client.serial
+	client.calls[serial] = res
+	client.mutex.Unlock()
+
+	defer func() {
+		client.mutex.Lock()
+		delete(client.calls, serial)
+		client.mutex.Unlock()
+	}()
+
+	client.write(client.command(3, 0, name, append([]interface{}{serial}, args...)...))
+	select {
+	case vals := <-res:
+		if vals[0] == "_error" {
+			return nil, fmt.Errorf("%s failed: %s", name, describe(vals[1:]))
+		}
+		return vals[1:], nil
+	case <-client.Context.Done:
+		return nil, client.Err()
+	case <-time.After(clientTimeout):
+		return nil, fmt.Errorf("%s timed out", name)
+	}
+}
+
+func (client *ClientConn) await(id uint32, code string) error {
+	timeout := time.After(clientTimeout)
+	for {
+		select {
+		case status := <-client.status:
+			if status.StreamID != id && status.StreamID != 0 {
+				continue
+			}
+			info := status.Info
+			if info["code"] == code {
+				return nil
+			}
+			if info["level"] == "error" {
+				return fmt.Errorf("%v: %v", info["code"], info["description"])
+			}
+		case <-client.Context.Done:
+			return client.Err()
+		case <-timeout:
+			return fmt.Errorf("Waiting for %s timed out", code)
+		}
+	}
+}
+
+func (client *ClientConn) setErr(err error) {
+	client.mutex.Lock()
+	if client.err == nil {
+		client.err = err
+	}
+	client.mutex.Unlock()
+}
+
+func (client *ClientConn) Err() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.err != nil {
+		return client.err
+	}
+	return fmt.Errorf("Connection closed")
+}
+
+func describe(vals []amf.AMFValue) string {
+	for _, val := range vals {
+		if info, ok := val.(amf.AMFMap); ok {
+			return fmt.Sprintf("%v: %v", info["code"], info["description"])
+		}
+	}
+	return fmt.Sprint(vals)
+}
+
+func (client *ClientConn) write(msg Message) {
+	client.Context.Send(msg)
+}
+
+func (client *ClientConn) recv() {
+	for {
+		if err := client.Context.ReadChunk(); err != nil {
+			if err != io.EOF {
+				client.setErr(err)
+			}
+			break
+		}
+	}
+	close(client.Context.InMsg)
+}
+
+func (client *ClientConn) send() {
+	for {
+		select {
+		case msg := <-client.Context.OutMsg:
+			client.Context.awaitWindow()
+			if err := client.Context.WriteMessage(msg); err != nil {
+				client.setErr(err)
+				client.Close()
+				return
+			}
+			if msg.Header().Type == MESSAGE_TYPE_SET_CHUNK_SIZE {
+				client.Context.OutChunk = msg.(*SetChunkSizeMessage).Size
+			}
+		case <-client.Context.Done:
+			return
+		}
+	}
+}
+
+func (client *ClientConn) hndl() {
+	for msg := range client.Context.InMsg {
+		switch msg.Header().Type {
+		case MESSAGE_TYPE_AMF3_CMD, MESSAGE_TYPE_AMF3_CMD_ALT:
+			cmdmsg := msg.(*Amf0CmdMessage)
+			if len(cmdmsg.Data) > 0 {
+				client.handlecmd(msg.Header().StreamID, cmdmsg.Data[1:])
+			}
+		case MESSAGE_TYPE_AMF0_CMD:
+			client.handlecmd(msg.Header().StreamID, msg.(*Amf0CmdMessage).Data)
+		case MESSAGE_TYPE_AMF3_META, MESSAGE_TYPE_AMF0_META:
+			if meta := flv.ParseMetadata(msg.(*Amf0MetaMessage).Data); meta != nil {
+				if consumer := client.consumer(msg.Header().StreamID); consumer != nil {
+					consumer.ConsumeMeta(meta)
+				}
+			}
+		case MESSAGE_TYPE_WINACK, MESSAGE_TYPE_ACK, MESSAGE_TYPE_SET_PEER_BAND:
+			client.Context.HandleControl(msg)
+		case MESSAGE_TYPE_USER:
+			usr := msg.(*UserMessage)
+			switch usr.Event {
+			case USER_EVENT_STREAM_BEGIN:
+				client.setPublished(usr.First, true)
+			case USER_EVENT_STREAM_EOF:
+				client.setPublished(usr.First, false)
+			default:
+				client.Context.HandlePing(usr)
+			}
+		case MESSAGE_TYPE_AUDIO:
+			if consumer := client.consumer(msg.Header().StreamID); consumer != nil {
+				consumer.ConsumeAudio(core.NewAudioData(msg.Header().Timestamp, msg.(*AudioMessage).Data))
+			}
+		case MESSAGE_TYPE_VIDEO:
+			if consumer := client.consumer(msg.Header().StreamID); consumer != nil {
+				consumer.ConsumeVideo(core.NewVideoData(msg.Header().Timestamp, msg.(*VideoMessage).Data))
+			}
+		}
+	}
+	client.mutex.Lock()
+	var ids []uint32
+	for id := range client.Consumers {
+		ids = append(ids, id)
+	}
+	client.mutex.Unlock()
+	for _, id := range ids {
+		client.setPublished(id, false)
+	}
+	client.Close()
+}
+
+func (client *ClientConn) handlecmd(streamid uint32, data []byte) {
+	var vals []amf.AMFValue
+	rdr := bytes.NewReader(data)
+	for rdr.Len() > 0 {
+		val, err := amf.DecodeAMF(rdr)
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+		vals = append(vals, val)
+	}
+	if len(vals) < 2 {
+		return
+	}
+	switch vals[0] {
+	case "_result", "_error":
+		serial, _ := vals[1].(float64)
+		client.mutex.Lock()
+		res := client.calls[serial]
+		client.mutex.Unlock()
+		if res != nil {
+			select {
+			case res <- append([]amf.AMFValue{vals[0]}, vals[2:]...):
+			default:
+			}
+		}
+	case "onStatus":
+		for _, val := range vals[2:] {
+			info, ok := val.(amf.AMFMap)
+			if !ok {
+				continue
+			}
+			switch info["code"] {
+			case "NetStream.Play.PublishNotify":
+				client.setPublished(streamid, true)
+			case "NetStream.Play.UnpublishNotify", "NetStream.Play.Stop":
+				client.setPublished(streamid, false)
+			}
+			select {
+			case client.status <- clientStatus{StreamID: streamid, Info: info}:
+			default:
+			}
+		}
+	}
+}
+
+func (client *ClientConn) consumer(id uint32) core.Consumer {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Consumers[id]
+}
+
+func (client *ClientConn) setPublished(id uint32, published bool) {
+	client.mutex.Lock()
+	consumer := client.Consumers[id]
+	changed := consumer != nil && client.published[id] != published
+	if changed {
+		client.published[id] = published
+	}
+	client.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if published {
+		consumer.Publish()
+	} else {
+		consumer.Unpublish()
+	}
+}
@@ -0,0 +1,414 @@
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/amf"
+	"videostreamer/core"
+	"videostreamer/syncutil"
+	"videostreamer/testutil"
+)
+
+func startServer(t *testing.T, config *Config) (addr string, stop func()) {
+	return testutil.Serve(t, func(latch *syncutil.SyncLatch, ln net.Listener) {
+		ServeListener(core.NewApplication(), latch, ln, config)
+	})
+}
+
+func TestClientHandshake(t *testing.T) {
+	server, client := net.Pipe()
+	res := make(chan error, 1)
+	go func() {
+		res <- Handshake(server, true)
+	}()
+	if err := ClientHandshake(client); err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	if err := <-res; err != nil {
+		t.Fatalf("server rejected client handshake: %v", err)
+	}
+}
+
+func TestSplitURL(t *testing.T) {
+	conn, name, err := SplitURL("rtmp://example.com/live/key?token=1")
+	if err != nil || conn != "rtmp://example.com/live" || name != "key?token=1" {
+		t.Errorf("SplitURL returned %q %q %v", conn, name, err)
+	}
+	if _, _, err = SplitURL("rtmp://example.com/live/"); err == nil {
+		t.Errorf("SplitURL accepted empty stream name")
+	}
+}
+
+func expect(t *testing.T, ok bool, what string) {
+	if !ok {
+		t.Fatalf("did not receive %s", what)
+	}
+}
+
+func TestDuplicateResult(t *testing.T) {
+	res := make(chan []amf.AMFValue, 1)
+	client := &ClientConn{calls: map[float64]chan []amf.AMFValue{1: res}}
+	buf := bytes.Buffer{}
+	amf.EncodeAMF(&buf, "_result")
+	amf.EncodeAMF(&buf, 1)
+	amf.EncodeAMF(&buf, nil)
+	done := make(chan struct{})
+	go func() {
+		client.handlecmd(0, buf.Bytes())
+		client.handlecmd(0, buf.Bytes())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second result for the same call blocked the handler")
+	}
+	if len(res) != 1 {
+		t.Errorf("%d results queued", len(res))
+	}
+}
+
+func TestDialPublishPlay(t *testing.T) {
+	publishPlay(t, NewConfig())
+}
+
+func TestDialPublishPlayAggregated(t *testing.T) {
+	config := NewConfig()
+	config.AggregateWindow = 30 * time.Millisecond
+	publishPlay(t, config)
+}
+
+func publishPlay(t *testing.T, config *Config) {
+	addr, stop := startServer(t, config)
+	defer stop()
+
+	pub, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer pub.Close()
+	publisher, err := pub.Publish("test")
+	if err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	play, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer play.Close()
+	rec := testutil.NewRecorder()
+	if err = play.Play("test", rec); err != nil {
+		t.Fatalf("play failed: %v", err)
+	}
+
+	publisher.ConsumeMeta(core.NewMetaData(640, 480, 25))
+	seq := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x42, 0x00, 0x1e}
+	frame := []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0xde, 0xad, 0xbe, 0xef}
+	publisher.ConsumeVideo(core.NewVideoData(0, seq))
+	publisher.ConsumeVideo(core.NewVideoData(40, frame))
+	publisher.ConsumeAudio(core.NewAudioData(40, []byte{0xaf, 0x01, 0x21}))
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case ok := <-rec.State:
+		expect(t, ok, "publish")
+	case <-timeout:
+		t.Fatal("timed out waiting for stream begin")
+	}
+	for _, want := range [][]byte{seq, frame} {
+		select {
+		case got := <-rec.Video:
+			if bytes.Equal(got.Data, seq) && !bytes.Equal(want, seq) {
+				got = <-rec.Video
+			}
+			if !bytes.Equal(got.Data, want) {
+				t.Errorf("video %x instead of %x", got.Data, want)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for video")
+		}
+	}
+	select {
+	case got := <-rec.Audio:
+		if got.Time != 40 {
+			t.Errorf("audio timestamp %d instead of 40", got.Time)
+		}
+	case <-timeout:
+		t.Fatal("timed out waiting for audio")
+	}
+
+	pub.Close()
+	select {
+	case ok := <-rec.State:
+		expect(t, !ok, "unpublish")
+	case <-timeout:
+		t.Fatal("timed out waiting for stream eof")
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err = Dial("rtmp://" + addr + "/live"); err == nil {
+		t.Errorf("dial to closed port succeeded")
+	}
+}
+
+func TestMultipleNetStreams(t *testing.T) {
+	addr, stop := startServer(t, NewConfig())
+	defer stop()
+
+	pub, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	pubA, err := pub.Publish("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubB, err := pub.Publish("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pubA.StreamID == pubB.StreamID {
+		t.Fatalf("both publishes got stream id %d", pubA.StreamID)
+	}
+
+	play, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	recA, recB := testutil.NewRecorder(), testutil.NewRecorder()
+	if err = play.Play("a", recA); err != nil {
+		t.Fatal(err)
+	}
+	if err = play.Play("b", recB); err != nil {
+		t.Fatal(err)
+	}
+
+	seq := []byte{0x17, 0x00, 0x00, 0x00, 0x00}
+	pubA.ConsumeVideo(core.NewVideoData(0, seq))
+	pubB.ConsumeVideo(core.NewVideoData(0, seq))
+	pubA.ConsumeAudio(core.NewAudioData(10, []byte{0xaf, 0x01, 0x0a}))
+	pubB.ConsumeAudio(core.NewAudioData(20, []byte{0xaf, 0x01, 0x0b}))
+
+	timeout := time.After(5 * time.Second)
+	for _, c := range []struct {
+		rec  *testutil.Recorder
+		want byte
+	}{{recA, 0x0a}, {recB, 0x0b}} {
+		select {
+		case got := <-c.rec.Audio:
+			if got.Data[2] != c.want {
+				t.Errorf("audio %x delivered to wrong stream", got.Data)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for audio")
+		}
+	}
+
+	pubA.Close()
+	for {
+		select {
+		case ok := <-recA.State:
+			if ok {
+				continue
+			}
+		case ok := <-recB.State:
+			if !ok {
+				t.Fatal("deleting one stream unpublished the other")
+			}
+			continue
+		case <-timeout:
+			t.Fatal("timed out waiting for stream eof")
+		}
+		break
+	}
+	pubB.ConsumeAudio(core.NewAudioData(40, []byte{0xaf, 0x01, 0x0c}))
+	select {
+	case got := <-recB.Audio:
+		if got.Data[2] != 0x0c {
+			t.Errorf("audio %x instead of 0c", got.Data)
+		}
+	case <-timeout:
+		t.Fatal("remaining stream stopped after deleteStream")
+	}
+}
+
+func TestPublisherCommands(t *testing.T) {
+	addr, stop := startServer(t, NewConfig())
+	defer stop()
+
+	pub, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	for _, cmd := range []string{"releaseStream", "FCPublish"} {
+		if _, err = pub.call(cmd, nil, "test"); err != nil {
+			t.Errorf("%s got no result: %v", cmd, err)
+		}
+	}
+	publisher, err := pub.Publish("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	play, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	rec := testutil.NewRecorder()
+	if err = play.Play("test", rec); err != nil {
+		t.Fatal(err)
+	}
+	publisher.ConsumeVideo(core.NewVideoData(0, []byte{0x17, 0x00, 0x00, 0x00, 0x00}))
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case ok := <-rec.State:
+		expect(t, ok, "publish")
+	case <-timeout:
+		t.Fatal("timed out waiting for stream begin")
+	}
+
+	if _, err = pub.call("FCUnpublish", nil, "test"); err != nil {
+		t.Errorf("FCUnpublish got no result: %v", err)
+	}
+	if err = pub.await(publisher.StreamID, "NetStream.Unpublish.Success"); err != nil {
+		t.Errorf("no unpublish status: %v", err)
+	}
+	select {
+	case ok := <-rec.State:
+		expect(t, !ok, "unpublish")
+	case <-timeout:
+		t.Fatal("FCUnpublish with open connection did not unpublish")
+	}
+}
+
+func TestEnhancedPassthrough(t *testing.T) {
+	addr, stop := startServer(t, NewConfig())
+	defer stop()
+
+	pub, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	publisher, err := pub.Publish("hevc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := []*testutil.Recorder{testutil.NewRecorder(), testutil.NewRecorder()}
+	for i, fourccs := range [][]string{{core.FOURCC_HEVC}, nil} {
+		play, err := DialFourCCs("rtmp://"+addr+"/live", fourccs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer play.Close()
+		if err = play.Play("hevc", recs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publisher.ConsumeMeta(core.NewMetaData(1920, 1080, 30))
+	seq := []byte{0x90, 'h', 'v', 'c', '1', 0x01, 0x01, 0x60}
+	frame := []byte{0x93, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x02, 0x26, 0x01}
+	publisher.ConsumeVideo(core.NewVideoData(0, seq))
+	publisher.ConsumeVideo(core.NewVideoData(40, frame))
+	publisher.ConsumeAudio(core.NewAudioData(40, []byte{0xaf, 0x01, 0x21}))
+
+	timeout := time.After(5 * time.Second)
+	for _, rec := range recs {
+		select {
+		case ok := <-rec.State:
+			expect(t, ok, "publish")
+		case <-timeout:
+			t.Fatal("sequence start did not publish the stream")
+		}
+		select {
+		case <-rec.Audio:
+		case <-timeout:
+			t.Fatal("timed out waiting for audio")
+		}
+	}
+	for _, want := range [][]byte{seq, seq, frame} {
+		got := <-recs[0].Video
+		if !bytes.Equal(got.Data, want) {
+			t.Errorf("video %x instead of %x", got.Data, want)
+		}
+	}
+	if len(recs[1].Video) != 0 {
+		t.Errorf("%d HEVC packets sent to legacy player", len(recs[1].Video))
+	}
+
+	publisher.ConsumeMeta(core.NewMetaData(1920, 1080, 30))
+	for _, rec := range recs {
+		for i := 0; i < 2; i++ {
+			select {
+			case meta := <-rec.Meta:
+				if meta.VideoCodec != 0x68766331 {
+					t.Errorf("videocodecid %#x", meta.VideoCodec)
+				}
+			case <-timeout:
+				t.Fatal("timed out waiting for metadata")
+			}
+		}
+	}
+}
+
+func TestDuplicatePublish(t *testing.T) {
+	addr, stop := startServer(t, NewConfig())
+	defer stop()
+
+	first, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	publisher, err := first.Publish("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	play, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer play.Close()
+	rec := testutil.NewRecorder()
+	if err = play.Play("test", rec); err != nil {
+		t.Fatal(err)
+	}
+	publisher.ConsumeVideo(core.NewVideoData(0, []byte{0x17, 0x00, 0x00, 0x00, 0x00}))
+	select {
+	case ok := <-rec.State:
+		expect(t, ok, "publish")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for stream begin")
+	}
+
+	second, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = second.Publish("test"); err == nil || !strings.Contains(err.Error(), "NetStream.Publish.BadName") {
+		t.Errorf("second publisher: %v", err)
+	}
+	second.Close()
+	select {
+	case <-rec.State:
+		t.Error("rejected publisher unpublished the stream")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
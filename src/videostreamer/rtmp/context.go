@@ -2,45 +2,99 @@ package rtmp
 
 import (
 	"net"
+	"sync/atomic"
+	"time"
+	"videostreamer/logger"
 	"videostreamer/core"
 	"videostreamer/binutil"
 	"videostreamer/check"
 	"bytes"
+	"errors"
+	"strconv"
 )
 
+func NewConfig() *Config {
+	return &Config{
+		StrictHandshake: false,
+		AckWindow:        5000000,
+		PeerBandwidth:    5000000,
+		AckTimeout:       time.Second,
+		HandshakeTimeout: 10 * time.Second,
+		IdleTimeout:      30 * time.Second,
+		MediaTimeout:     30 * time.Second,
+		PingInterval:     10 * time.Second,
+		PingTimeout:      60 * time.Second,
+	}
+}
+
+type meteredConn struct {
+	net.Conn
+	context *RTMPContext
+}
+
+func (conn *meteredConn) Read(buf []byte) (n int, err error) {
+	n, err = conn.Conn.Read(buf)
+	atomic.AddUint32(&conn.context.InTrans, uint32(n))
+	return
+}
+
+func (conn *meteredConn) Write(buf []byte) (n int, err error) {
+	n, err = conn.Conn.Write(buf)
+	atomic.AddUint32(&conn.context.OutTrans, uint32(n))
+	return
+}
 
-func NewRTMPContext(conn net.Conn, app *core.Application) *RTMPContext {
-	return &RTMPContext{
+func NewRTMPContext(conn net.Conn, app *core.Application, config *Config) *RTMPContext {
+	context := &RTMPContext{
 		Running:  true,
-		Conn:     conn,
+		Config:   config,
 		App:      app,
-		In:       make(map[uint16]*RawMessage),
-		Out:      make(map[uint16]*RawMessage),
+		Streams:  make(map[uint32]*NetStream),
+		NextID:   1,
+		In:       make(map[uint32]*RawMessage),
+		Out:      make(map[uint32]*RawMessage),
 		InMsg:    make(chan Message, 16),
 		OutMsg:   make(chan Message, 16),
+		Done:     make(chan struct{}),
 		InChunk:  128,
 		OutChunk: 128,
+		acked:    make(chan struct{}, 1),
+		Epoch:    time.Now(),
 	}
+	context.LastSeen = context.Epoch
+	context.Active = context.Epoch
+	context.Conn = &meteredConn{Conn: conn, context: context}
+	return context
 }
 
-func (context *RTMPContext) readBasic() (fmt uint8, chunkid uint16) {
+func (context *RTMPContext) Send(msg Message) {
+	select {
+	case context.OutMsg <- msg:
+	case <-context.Done:
+	}
+}
+
+func (context *RTMPContext) readBasic() (fmt uint8, chunkid uint32) {
 	fst := binutil.ReadInt(context.Conn, 1)
 	fmt = uint8((fst>>6) & 0x03)
-	chunkid = uint16(fst & 0x3f)
+	chunkid = uint32(fst & 0x3f)
 	switch chunkid {
 	case 0:
-		chunkid = 64 + uint16(binutil.ReadInt(context.Conn, 1))
+		chunkid = 64 + uint32(binutil.ReadInt(context.Conn, 1))
 	case 1:
-		chunkid = 64 + uint16(binutil.ReadIntLE(context.Conn, 2))
+		chunkid = 64 + uint32(binutil.ReadIntLE(context.Conn, 2))
 	}
 	return fmt,chunkid
 }
 
-func (context *RTMPContext) writeBasic(fmt uint8, chunkid uint16) {
+func (context *RTMPContext) writeBasic(fmt uint8, chunkid uint32) {
 	fst := fmt<<6
+	if chunkid < 2 || chunkid > MAX_CHUNK_ID {
+		panic(errors.New("Invalid chunk stream id " + strconv.Itoa(int(chunkid))))
+	}
 	if chunkid >= 320 {
 		binutil.WriteInt(context.Conn, int(fst | 1), 1)
-		binutil.WriteIntLE(context.Conn, int(chunkid - 320), 2)
+		binutil.WriteIntLE(context.Conn, int(chunkid - 64), 2)
 	} else if chunkid >= 64 {
 		binutil.WriteInt(context.Conn, int(fst), 1)
 		binutil.WriteInt(context.Conn, int(chunkid - 64), 1)
@@ -49,7 +103,15 @@ func (context *RTMPContext) writeBasic(fmt uint8, chunkid uint16) {
 	}
 }
 
-func (context *RTMPContext) rawMessage(chunkid uint16) *RawMessage {
+func (context *RTMPContext) readExtended(raw *RawMessage, value uint32) uint32 {
+	raw.Extended = value == EXTENDED_TIMESTAMP
+	if raw.Extended {
+		value = uint32(binutil.ReadInt(context.Conn, 4))
+	}
+	return value
+}
+
+func (context *RTMPContext) rawMessage(chunkid uint32) *RawMessage {
 	raw := context.In[chunkid]
 	if raw == nil {
 		raw = &RawMessage{}
@@ -58,7 +120,7 @@ func (context *RTMPContext) rawMessage(chunkid uint16) *RawMessage {
 	return raw
 }
 
-func (context *RTMPContext) prevMessage(chunkid uint16) *RawMessage {
+func (context *RTMPContext) prevMessage(chunkid uint32) *RawMessage {
 	prev := context.Out[chunkid]
 	if prev == nil {
 		prev = &RawMessage{}
@@ -73,26 +135,34 @@ func (context *RTMPContext) ReadChunk() (err error) {
 	raw := context.rawMessage(chunkid)
 	switch fmt {
 	case BASIC_TYPE_FULL:
-		raw.Header.Timestamp = uint32(binutil.ReadInt(context.Conn, 3))
+		ts                  := uint32(binutil.ReadInt(context.Conn, 3))
 		raw.Header.Length    = uint32(binutil.ReadInt(context.Conn, 3))
 		raw.Header.Type      =  uint8(binutil.ReadInt(context.Conn, 1))
 		raw.Header.StreamID  = uint32(binutil.ReadIntLE(context.Conn, 4))
-		if raw.Header.Timestamp == 0xFFFFFF {
-			raw.Header.Timestamp = uint32(binutil.ReadInt(context.Conn, 4))
-		}
+		raw.Header.Timestamp = context.readExtended(raw, ts)
+		raw.Delta            = raw.Header.Timestamp
 	case BASIC_TYPE_MEDIUM:
-		raw.Delta            = uint32(binutil.ReadInt(context.Conn, 3))
-		raw.Header.Timestamp = raw.Header.Timestamp + raw.Delta
+		delta               := uint32(binutil.ReadInt(context.Conn, 3))
 		raw.Header.Length    = uint32(binutil.ReadInt(context.Conn, 3))
 		raw.Header.Type      =  uint8(binutil.ReadInt(context.Conn, 1))
+		raw.Delta            = context.readExtended(raw, delta)
+		raw.Header.Timestamp = raw.Header.Timestamp + raw.Delta
 	case BASIC_TYPE_SHORT:
-		raw.Delta            = uint32(binutil.ReadInt(context.Conn, 3))
+		delta               := uint32(binutil.ReadInt(context.Conn, 3))
+		raw.Delta            = context.readExtended(raw, delta)
 		raw.Header.Timestamp = raw.Header.Timestamp + raw.Delta
 	case BASIC_TYPE_NONE:
+		if raw.Extended {
+			binutil.ReadInt(context.Conn, 4)
+		}
 		if raw.Data.Len() == 0 {
 			raw.Header.Timestamp = raw.Header.Timestamp + raw.Delta
 		}
 	}
+	if raw.Data.Len() > 0 && fmt != BASIC_TYPE_NONE {
+		logger.Warnf("Discarding %d bytes of incomplete message on chunk stream %d", raw.Data.Len(), chunkid)
+		raw.Data.Reset()
+	}
 
 	expect := context.InChunk
 	if (expect + uint32(raw.Data.Len())) > raw.Header.Length {
@@ -100,65 +170,167 @@ func (context *RTMPContext) ReadChunk() (err error) {
 	}
 	raw.Data.Write(binutil.ReadBuf(context.Conn, int(expect)))
 
+	context.acknowledge()
 	if raw.Header.Length == uint32(raw.Data.Len()) {
-		msg := Decode(raw)
+		defer raw.Data.Reset()
+		var msg Message
+		if msg, err = Decode(raw); err != nil {
+			logger.Warnf("Dropping message on chunk stream %d: %v", chunkid, err)
+			return nil
+		}
 		switch msg.Header().Type {
 		case MESSAGE_TYPE_SET_CHUNK_SIZE:
-			context.InChunk = msg.(*SetChunkSizeMessage).Size
+			size := msg.(*SetChunkSizeMessage).Size & 0x7FFFFFFF
+			if size == 0 {
+				panic(errors.New("Invalid chunk size 0"))
+			}
+			context.InChunk = size
 			break;
+		case MESSAGE_TYPE_ABORT:
+			if aborted := context.In[(msg.(*AbortMessage).Stream)]; aborted != nil && aborted != raw {
+				aborted.Data.Reset()
+			}
+		case MESSAGE_TYPE_AGGREGATE:
+			for _, sub := range msg.(*AggregateMessage).Messages {
+				context.InMsg <- sub
+			}
+			return
 		}
 		context.InMsg <- msg
-		raw.Data.Reset()
 	}
 	return
 }
 
+func (context *RTMPContext) acknowledge() {
+	window := atomic.LoadUint32(&context.InAck)
+	received := atomic.LoadUint32(&context.InTrans)
+	if window == 0 || received - context.InAcked < window {
+		return
+	}
+	context.InAcked = received
+	context.Send(NewMessage(Header{ChunkID: 2}, &AckMessage{Size: received}))
+}
+
+func (context *RTMPContext) HandleControl(msg Message) {
+	switch msg := msg.(type) {
+	case *WinackMessage:
+		atomic.StoreUint32(&context.InAck, msg.Size)
+	case *AckMessage:
+		atomic.StoreUint32(&context.OutAcked, msg.Size)
+		select {
+		case context.acked <- struct{}{}:
+		default:
+		}
+	case *SetPeerBandMessage:
+		context.setPeerBand(msg.Size, msg.Type)
+	}
+}
+
+func (context *RTMPContext) setPeerBand(size uint32, typ uint8) {
+	limit := atomic.LoadUint32(&context.Limit)
+	switch typ {
+	case PEER_BAND_HARD:
+		limit = size
+	case PEER_BAND_SOFT:
+		if limit == 0 || size < limit {
+			limit = size
+		}
+	case PEER_BAND_DYNAMIC:
+		if limit == 0 || context.LimitType != PEER_BAND_HARD {
+			return
+		}
+		limit = size
+		typ = PEER_BAND_HARD
+	default:
+		return
+	}
+	context.LimitType = typ
+	atomic.StoreUint32(&context.Limit, limit)
+	if limit != atomic.LoadUint32(&context.OutAck) {
+		context.SendWinack(limit)
+	}
+}
+
+func (context *RTMPContext) SendWinack(size uint32) {
+	atomic.StoreUint32(&context.OutAck, size)
+	context.Send(NewMessage(Header{ChunkID: 2}, &WinackMessage{Size: size}))
+}
+
+func (context *RTMPContext) Lag() uint32 {
+	lag := int32(atomic.LoadUint32(&context.OutTrans) - atomic.LoadUint32(&context.OutAcked))
+	if atomic.LoadUint32(&context.OutAck) == 0 || lag < 0 {
+		return 0
+	}
+	return uint32(lag)
+}
+
+func (context *RTMPContext) awaitWindow() {
+	limit := atomic.LoadUint32(&context.Limit)
+	if limit == 0 {
+		return
+	}
+	timeout := time.After(context.Config.AckTimeout)
+	for context.Lag() >= limit {
+		select {
+		case <-context.acked:
+		case <-context.Done:
+			return
+		case <-timeout:
+			logger.Warnf("Peer did not acknowledge %d bytes in %v, sending anyway", context.Lag(), context.Config.AckTimeout)
+			return
+		}
+	}
+}
+
 func (context *RTMPContext) WriteMessage(msg Message) (err error) {
 	defer check.CheckPanicHandler(&err)
 	var buf bytes.Buffer
 	var fmt uint8
 	msg.Encode(&buf)
 	prev := context.prevMessage(msg.Header().ChunkID)
+	delta := msg.Header().Timestamp - prev.Header.Timestamp
 	if msg.Header().ForceFmt {
 		fmt = msg.Header().Format
 	}  else {
 		fmt = BASIC_TYPE_FULL
-		if prev.Header.StreamID == msg.Header().StreamID && msg.Header().StreamID != 0 {
+		if prev.Header.StreamID == msg.Header().StreamID && msg.Header().StreamID != 0 && int32(delta) >= 0 {
 			fmt = BASIC_TYPE_MEDIUM
 			if prev.Header.Length == uint32(buf.Len()) && prev.Header.Type == msg.Header().Type {
 				fmt = BASIC_TYPE_SHORT
-				if prev.Header.Timestamp + prev.Delta == msg.Header().Timestamp {
+				if prev.Delta == delta {
 					fmt = BASIC_TYPE_NONE
 				}
 			}
-			prev.Delta = msg.Header().Timestamp - prev.Header.Timestamp
 		}
 	}
 	prev.Header = *msg.Header()
+	prev.Header.Length = uint32(buf.Len())
 
 	context.writeBasic(fmt, msg.Header().ChunkID)
 
 	switch fmt {
 	case BASIC_TYPE_FULL:
-		ts := msg.Header().Timestamp
-		if ts >= 0xFFFFFF {
-			ts = 0xFFFFFF
-		}
-		binutil.WriteInt(context.Conn, int(ts), 3)
+		prev.Delta = msg.Header().Timestamp
+		prev.Extended = msg.Header().Timestamp >= EXTENDED_TIMESTAMP
+		binutil.WriteInt(context.Conn, int(truncated(msg.Header().Timestamp)), 3)
 		binutil.WriteInt(context.Conn, int(buf.Len()), 3)
 		binutil.WriteInt(context.Conn, int(msg.Header().Type), 1)
 		binutil.WriteIntLE(context.Conn, int(msg.Header().StreamID), 4)
-		if msg.Header().Timestamp >= 0xFFFFFF {
-			binutil.WriteInt(context.Conn, int(msg.Header().Timestamp), 4)
-		}
 	case BASIC_TYPE_MEDIUM:
-		binutil.WriteInt(context.Conn, int(prev.Delta), 3)
+		prev.Delta = delta
+		prev.Extended = delta >= EXTENDED_TIMESTAMP
+		binutil.WriteInt(context.Conn, int(truncated(delta)), 3)
 		binutil.WriteInt(context.Conn, int(buf.Len()), 3)
 		binutil.WriteInt(context.Conn, int(msg.Header().Type), 1)
 	case BASIC_TYPE_SHORT:
-		binutil.WriteInt(context.Conn, int(prev.Delta), 3)
+		prev.Delta = delta
+		prev.Extended = delta >= EXTENDED_TIMESTAMP
+		binutil.WriteInt(context.Conn, int(truncated(delta)), 3)
 	case BASIC_TYPE_NONE:
 	}
+	if prev.Extended {
+		binutil.WriteInt(context.Conn, int(prev.Delta), 4)
+	}
 
 	b := buf.Bytes()
 	off := uint32(0)
@@ -176,6 +348,69 @@ func (context *RTMPContext) WriteMessage(msg Message) (err error) {
 		off += context.OutChunk
 		lim += context.OutChunk
 		context.writeBasic(BASIC_TYPE_NONE, msg.Header().ChunkID)
+		if prev.Extended {
+			binutil.WriteInt(context.Conn, int(prev.Delta), 4)
+		}
 	}
 	return
-}
\ No newline at end of file
+}
+
+func truncated(value uint32) uint32 {
+	if value >= EXTENDED_TIMESTAMP {
+		return EXTENDED_TIMESTAMP
+	}
+	return value
+}
+
+func (context *RTMPContext) createStream() *NetStream {
+	for context.Streams[context.NextID] != nil || context.NextID == 0 {
+		context.NextID++
+	}
+	ns := &NetStream{ID: context.NextID}
+	context.Streams[ns.ID] = ns
+	context.NextID++
+	return ns
+}
+
+func (context *RTMPContext) netStream(id uint32) *NetStream {
+	ns := context.Streams[id]
+	if ns == nil {
+		ns = &NetStream{ID: id}
+		context.Streams[id] = ns
+	}
+	return ns
+}
+
+func (context *RTMPContext) publishing(id uint32) *NetStream {
+	ns := context.Streams[id]
+	if ns == nil || !ns.Publishing {
+		return nil
+	}
+	return ns
+}
+
+func (context *RTMPContext) closeStream(ns *NetStream) {
+	if ns.Stream == nil {
+		return
+	}
+	if ns.Client != nil {
+		ns.Stream.Unsubscribe(ns.Client)
+		ns.Client.flush()
+	}
+	if ns.Publishing {
+		if ns.Stream.IsPublished() {
+			ns.Stream.Unpublish()
+		}
+		ns.Stream.Release(ns)
+	}
+	ns.Stream = nil
+	ns.Client = nil
+	ns.Publishing = false
+}
+
+func (context *RTMPContext) deleteStream(id uint32) {
+	if ns := context.Streams[id]; ns != nil {
+		context.closeStream(ns)
+		delete(context.Streams, id)
+	}
+}
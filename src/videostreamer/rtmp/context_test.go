@@ -0,0 +1,120 @@
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func pipeContexts() (writer *RTMPContext, reader *RTMPContext) {
+	a, b := net.Pipe()
+	writer = NewRTMPContext(a, nil, NewConfig())
+	reader = NewRTMPContext(b, nil, NewConfig())
+	return
+}
+
+func TestAcknowledgement(t *testing.T) {
+	writer, reader := pipeContexts()
+	defer writer.Conn.Close()
+	reader.HandleControl(&WinackMessage{Size: 1000})
+
+	go func() {
+		for i := 0; i < 8; i++ {
+			writer.WriteMessage(NewMessage(Header{ChunkID: 6, StreamID: 1}, &VideoMessage{Data: make([]byte, 300)}))
+		}
+	}()
+	var acks []uint32
+	for i := 0; i < 8; {
+		if err := reader.ReadChunk(); err != nil {
+			t.Fatal(err)
+		}
+		for len(reader.InMsg) > 0 {
+			<-reader.InMsg
+			i++
+		}
+		for len(reader.OutMsg) > 0 {
+			acks = append(acks, (<-reader.OutMsg).(*AckMessage).Size)
+		}
+	}
+	if len(acks) != 2 {
+		t.Fatalf("%d acknowledgements for %d bytes with window 1000", len(acks), reader.InTrans)
+	}
+	if acks[0] < 1000 || acks[1]-acks[0] < 1000 || acks[1] > reader.InTrans {
+		t.Errorf("acknowledged sequence numbers %v", acks)
+	}
+}
+
+func TestPeerBandwidth(t *testing.T) {
+	context := NewRTMPContext(nil, nil, NewConfig())
+	winack := func() uint32 {
+		if len(context.OutMsg) == 0 {
+			return 0
+		}
+		return (<-context.OutMsg).(*WinackMessage).Size
+	}
+
+	context.setPeerBand(1000, PEER_BAND_DYNAMIC)
+	if context.Limit != 0 || winack() != 0 {
+		t.Errorf("dynamic limit without previous hard limit was applied")
+	}
+	context.setPeerBand(2000, PEER_BAND_SOFT)
+	if context.Limit != 2000 || winack() != 2000 {
+		t.Errorf("soft limit not applied, limit %d", context.Limit)
+	}
+	context.setPeerBand(3000, PEER_BAND_SOFT)
+	if context.Limit != 2000 || winack() != 0 {
+		t.Errorf("soft limit raised the limit to %d", context.Limit)
+	}
+	context.setPeerBand(3000, PEER_BAND_DYNAMIC)
+	if context.Limit != 2000 {
+		t.Errorf("dynamic limit after soft limit applied")
+	}
+	context.setPeerBand(4000, PEER_BAND_HARD)
+	if context.Limit != 4000 || winack() != 4000 {
+		t.Errorf("hard limit not applied, limit %d", context.Limit)
+	}
+	context.setPeerBand(1500, PEER_BAND_DYNAMIC)
+	if context.Limit != 1500 || context.LimitType != PEER_BAND_HARD || winack() != 1500 {
+		t.Errorf("dynamic limit after hard limit not applied, limit %d", context.Limit)
+	}
+}
+
+func TestAwaitWindow(t *testing.T) {
+	context := NewRTMPContext(nil, nil, NewConfig())
+	context.Config.AckTimeout = 5 * time.Second
+	context.OutAck = 100
+	context.Limit = 100
+	context.OutTrans = 500
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		context.HandleControl(&AckMessage{Size: 450})
+	}()
+	start := time.Now()
+	context.awaitWindow()
+	if elapsed := time.Since(start); elapsed > time.Second || elapsed < 50*time.Millisecond {
+		t.Errorf("window released after %v", elapsed)
+	}
+
+	context.Config.AckTimeout = 10 * time.Millisecond
+	context.OutTrans = 1000
+	start = time.Now()
+	context.awaitWindow()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("window released after %v despite the timeout", elapsed)
+	}
+	if context.Limit != 100 {
+		t.Errorf("limit %d after one late acknowledgement", context.Limit)
+	}
+
+	context.Config.AckTimeout = 5 * time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		context.HandleControl(&AckMessage{Size: 950})
+	}()
+	start = time.Now()
+	context.awaitWindow()
+	if elapsed := time.Since(start); elapsed > time.Second || elapsed < 50*time.Millisecond {
+		t.Errorf("window released after %v following a timeout", elapsed)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"videostreamer/logger"
 )
 
 var (
@@ -34,14 +35,21 @@ var (
 	serverVersion = []byte{
 		0x0D, 0x0E, 0x0A, 0x0D,
 	}
+	clientVersion = []byte{
+		0x09, 0x00, 0x7C, 0x02,
+	}
 )
 
-func findDigest(buf []byte, mod int) (offs int) {
+func digestOffset(buf []byte, mod int) (offs int) {
 	for n := 0; n < 4; n++ {
 		offs += int(buf[mod+n])
 	}
-	offs = (offs % 728) + mod + 4
-	dig := makeDigest(buf, clientKey2, offs)
+	return (offs % 728) + mod + 4
+}
+
+func findDigest(buf []byte, mod int, key []byte) (offs int) {
+	offs = digestOffset(buf, mod)
+	dig := makeDigest(buf, key, offs)
 	if bytes.Compare(buf[offs:offs+32], dig) != 0 {
 		offs = -1
 	}
@@ -63,26 +71,25 @@ func makeDigest(buf []byte, key []byte, offs int) []byte {
 	return sign.Sum(nil)
 }
 
-func stage1(buf []byte) (dig []byte) {
+func stage1(buf []byte) (dig []byte, sdig []byte) {
 	if buf[0] != 0x03 {
 		panic(fmt.Errorf("First byte of C0 was %#x instead of 0x03", buf[0]))
 	}
 
 	roffs := -1
-	if roffs = findDigest(buf[1:], 772); roffs == -1 {
-		if roffs = findDigest(buf[1:], 8); roffs == -1 {
-			panic(fmt.Errorf("Digest was not found in C0"))
+	if roffs = findDigest(buf[1:], 772, clientKey2); roffs == -1 {
+		if roffs = findDigest(buf[1:], 8, clientKey2); roffs == -1 {
+			copy(buf[5:9], []byte{0, 0, 0, 0})
+			check.Check1(rand.Read(buf[9:]))
+			return
 		}
 	}
 	dig = makeDigest(buf[roffs+1:roffs+1+32], serverKey, -1)
 	copy(buf[5:9], serverVersion)
 	check.Check1(rand.Read(buf[9:]))
-	woffs := 0
-	for n := 9; n < 13; n++ {
-		woffs += int(buf[n])
-	}
-	woffs = (woffs % 728) + 12
-	copy(buf[woffs+1:], makeDigest(buf[1:], serverKey2, woffs))
+	woffs := digestOffset(buf[1:], 8)
+	sdig = makeDigest(buf[1:], serverKey2, woffs)
+	copy(buf[woffs+1:], sdig)
 	return
 }
 
@@ -92,14 +99,74 @@ func stage2(buf []byte, dig []byte) {
 	return
 }
 
-func Handshake(rw io.ReadWriter) (err error) {
+func validC2(c2 []byte, s1 []byte, sdig []byte) bool {
+	if bytes.Equal(c2[:4], s1[:4]) && bytes.Equal(c2[8:], s1[8:]) {
+		return true
+	}
+	if sdig != nil {
+		key := makeDigest(sdig, clientKey, -1)
+		return bytes.Equal(c2[1536-32:], makeDigest(c2, key, 1536-32))
+	}
+	return false
+}
+
+func Handshake(rw io.ReadWriter, strict bool) (err error) {
 	defer check.CheckPanicHandler(&err)
-	var dig []byte
 	buf := binutil.ReadBuf(rw, 1537)
-	dig = stage1(buf)
+	c1 := binutil.Dup(buf[1:])
+	dig, sdig := stage1(buf)
 	binutil.WriteBuf(rw, buf)
-	stage2(buf[1:], dig)
+	s1 := binutil.Dup(buf[1:])
+	if dig != nil {
+		stage2(buf[1:], dig)
+	} else {
+		copy(buf[1:], c1)
+	}
 	binutil.WriteBuf(rw, buf[1:])
-	binutil.ReadBuf(rw, 1536)
+	c2 := binutil.ReadBuf(rw, 1536)
+	if !validC2(c2, s1, sdig) {
+		if strict {
+			panic(fmt.Errorf("C2 does not match S1"))
+		}
+		logger.Warn("C2 does not match S1")
+	}
+	return
+}
+
+func ClientHandshake(rw io.ReadWriter) (err error) {
+	defer check.CheckPanicHandler(&err)
+	buf := make([]byte, 1537)
+	buf[0] = 0x03
+	copy(buf[5:9], clientVersion)
+	check.Check1(rand.Read(buf[9:]))
+	offs := digestOffset(buf[1:], 8)
+	cdig := makeDigest(buf[1:], clientKey2, offs)
+	copy(buf[offs+1:], cdig)
+	c1 := binutil.Dup(buf[1:])
+	binutil.WriteBuf(rw, buf)
+
+	s0 := binutil.ReadBuf(rw, 1)
+	if s0[0] != 0x03 {
+		panic(fmt.Errorf("First byte of S0 was %#x instead of 0x03", s0[0]))
+	}
+	s1 := binutil.ReadBuf(rw, 1536)
+	s2 := binutil.ReadBuf(rw, 1536)
+	key := makeDigest(cdig, serverKey, -1)
+	if !bytes.Equal(s2[8:], c1[8:]) && !bytes.Equal(s2[1536-32:], makeDigest(s2, key, 1536-32)) {
+		panic(fmt.Errorf("S2 does not match C1"))
+	}
+
+	roffs := -1
+	if roffs = findDigest(s1, 772, serverKey2); roffs == -1 {
+		roffs = findDigest(s1, 8, serverKey2)
+	}
+	if roffs == -1 {
+		binutil.WriteBuf(rw, s1)
+		return
+	}
+	c2 := make([]byte, 1536)
+	check.Check1(rand.Read(c2))
+	copy(c2[1536-32:], makeDigest(c2, makeDigest(s1[roffs:roffs+32], clientKey, -1), 1536-32))
+	binutil.WriteBuf(rw, c2)
 	return
-}
\ No newline at end of file
+}
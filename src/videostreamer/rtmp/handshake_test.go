@@ -0,0 +1,139 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"videostreamer/binutil"
+)
+
+func plainC1() []byte {
+	c1 := make([]byte, 1537)
+	c1[0] = 0x03
+	rand.Read(c1[9:])
+	return c1
+}
+
+func digestC1() (c1 []byte, cdig []byte) {
+	c1 = plainC1()
+	copy(c1[5:9], []byte{0x09, 0x00, 0x7c, 0x02})
+	offs := 0
+	for n := 9; n < 13; n++ {
+		offs += int(c1[n])
+	}
+	offs = (offs % 728) + 12
+	cdig = makeDigest(c1[1:], clientKey2, offs)
+	copy(c1[offs+1:], cdig)
+	return
+}
+
+func runHandshake(t *testing.T, strict bool, c1 []byte, c2 func(s1, s2 []byte) []byte) (s1, s2 []byte, err error) {
+	server, client := net.Pipe()
+	defer client.Close()
+	res := make(chan error, 1)
+	go func() {
+		res <- Handshake(server, strict)
+		server.Close()
+	}()
+	binutil.WriteBuf(client, c1)
+	s0 := binutil.ReadBuf(client, 1)
+	if s0[0] != 0x03 {
+		t.Errorf("S0 was %#x instead of 0x03", s0[0])
+	}
+	s1 = binutil.ReadBuf(client, 1536)
+	s2 = binutil.ReadBuf(client, 1536)
+	binutil.WriteBuf(client, c2(s1, s2))
+	err = <-res
+	return
+}
+
+func echoC2(s1, s2 []byte) []byte {
+	return binutil.Dup(s1)
+}
+
+func garbageC2(s1, s2 []byte) []byte {
+	c2 := make([]byte, 1536)
+	rand.Read(c2)
+	return c2
+}
+
+func TestPlainHandshake(t *testing.T) {
+	c1 := plainC1()
+	s1, s2, err := runHandshake(t, true, c1, echoC2)
+	if err != nil {
+		t.Fatalf("plain handshake failed: %v", err)
+	}
+	if !bytes.Equal(s1[4:8], []byte{0, 0, 0, 0}) {
+		t.Errorf("S1 zero field was %v", s1[4:8])
+	}
+	if !bytes.Equal(s2, c1[1:]) {
+		t.Errorf("S2 is not an echo of C1")
+	}
+}
+
+func TestDigestHandshake(t *testing.T) {
+	c1, cdig := digestC1()
+	s1, s2, err := runHandshake(t, true, c1, func(s1, s2 []byte) []byte {
+		sdig := findServerDigest(t, s1)
+		c2 := garbageC2(s1, s2)
+		copy(c2[1536-32:], makeDigest(c2, makeDigest(sdig, clientKey, -1), 1536-32))
+		return c2
+	})
+	if err != nil {
+		t.Fatalf("digest handshake failed: %v", err)
+	}
+	if !bytes.Equal(s1[4:8], serverVersion) {
+		t.Errorf("S1 version was %v", s1[4:8])
+	}
+	key := makeDigest(cdig, serverKey, -1)
+	if !bytes.Equal(s2[1536-32:], makeDigest(s2, key, 1536-32)) {
+		t.Errorf("S2 digest mismatch")
+	}
+}
+
+func TestDigestHandshakeEchoC2(t *testing.T) {
+	c1, _ := digestC1()
+	if _, _, err := runHandshake(t, true, c1, echoC2); err != nil {
+		t.Fatalf("digest handshake with echoed C2 failed: %v", err)
+	}
+}
+
+func TestBadC2(t *testing.T) {
+	if _, _, err := runHandshake(t, true, plainC1(), garbageC2); err == nil {
+		t.Errorf("strict plain handshake accepted bad C2")
+	}
+	c1, _ := digestC1()
+	if _, _, err := runHandshake(t, true, c1, garbageC2); err == nil {
+		t.Errorf("strict digest handshake accepted bad C2")
+	}
+	if _, _, err := runHandshake(t, false, plainC1(), garbageC2); err != nil {
+		t.Errorf("lenient handshake rejected bad C2: %v", err)
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		c1 := plainC1()
+		c1[0] = 0x06
+		client.Write(c1)
+	}()
+	if err := Handshake(server, false); err == nil {
+		t.Errorf("handshake accepted version 6")
+	}
+}
+
+func findServerDigest(t *testing.T, s1 []byte) []byte {
+	offs := 0
+	for n := 8; n < 12; n++ {
+		offs += int(s1[n])
+	}
+	offs = (offs % 728) + 12
+	sdig := s1[offs : offs+32]
+	if !bytes.Equal(sdig, makeDigest(s1, serverKey2, offs)) {
+		t.Errorf("S1 digest mismatch")
+	}
+	return sdig
+}
@@ -0,0 +1,125 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	registry      = make(map[*RTMPContext]bool)
+	registryMutex sync.Mutex
+)
+
+func register(context *RTMPContext) {
+	registryMutex.Lock()
+	registry[context] = true
+	registryMutex.Unlock()
+}
+
+func unregister(context *RTMPContext) {
+	registryMutex.Lock()
+	delete(registry, context)
+	registryMutex.Unlock()
+}
+
+func Connections() (stats []Stats) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	for context := range registry {
+		stats = append(stats, context.Stats())
+	}
+	return
+}
+
+// ServeStats writes Connections as JSON, oldest connection first.
+func ServeStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := Connections()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Connected.Before(stats[j].Connected)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (context *RTMPContext) Stats() Stats {
+	return Stats{
+		Addr:      context.Conn.RemoteAddr().String(),
+		Connected: context.Epoch,
+		RTT:       context.RTT(),
+		InBytes:   atomic.LoadUint32(&context.InTrans),
+		OutBytes:  atomic.LoadUint32(&context.OutTrans),
+		Lag:       context.Lag(),
+	}
+}
+
+func (context *RTMPContext) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&context.rtt))
+}
+
+func (context *RTMPContext) timestamp(now time.Time) uint32 {
+	return uint32(now.Sub(context.Epoch) / time.Millisecond)
+}
+
+func (context *RTMPContext) HandlePing(msg *UserMessage) {
+	switch msg.Event {
+	case USER_EVENT_PING_REQUEST:
+		context.Send(NewMessage(Header{ChunkID: 2}, &UserMessage{Event: USER_EVENT_PING_RESPONSE, First: msg.First}))
+	case USER_EVENT_PING_RESPONSE:
+		rtt := time.Since(context.Epoch) - time.Duration(msg.First)*time.Millisecond
+		atomic.StoreInt64(&context.rtt, int64(rtt))
+	}
+}
+
+func (config *Config) tick() time.Duration {
+	tick := time.Second
+	for _, timeout := range []time.Duration{config.IdleTimeout, config.MediaTimeout, config.PingInterval, config.PingTimeout} {
+		if timeout > 0 && timeout/4 < tick {
+			tick = timeout / 4
+		}
+	}
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	return tick
+}
+
+func (context *RTMPContext) watchdog(now time.Time) error {
+	config := context.Config
+	if in := atomic.LoadUint32(&context.InTrans); in != context.lastIn {
+		context.lastIn = in
+		context.LastSeen = now
+	}
+	if config.PingInterval > 0 && now.Sub(context.lastPing) >= config.PingInterval {
+		context.lastPing = now
+		context.Send(NewMessage(Header{ChunkID: 2}, &UserMessage{Event: USER_EVENT_PING_REQUEST, First: context.timestamp(now)}))
+	}
+	if config.PingTimeout > 0 && now.Sub(context.LastSeen) > config.PingTimeout {
+		return fmt.Errorf("Peer silent for %v", now.Sub(context.LastSeen))
+	}
+	active := false
+	for _, ns := range context.Streams {
+		if ns.Stream == nil {
+			continue
+		}
+		active = true
+		if ns.Publishing && config.MediaTimeout > 0 && now.Sub(ns.LastMedia) > config.MediaTimeout {
+			return fmt.Errorf("No media for %s in %v", ns.Stream.Name, now.Sub(ns.LastMedia))
+		}
+	}
+	if active {
+		context.Active = now
+	} else if config.IdleTimeout > 0 && now.Sub(context.Active) > config.IdleTimeout {
+		return fmt.Errorf("Idle for %v", now.Sub(context.Active))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func keepaliveConfig() *Config {
+	config := NewConfig()
+	config.HandshakeTimeout = 200 * time.Millisecond
+	config.IdleTimeout = 0
+	config.MediaTimeout = 0
+	config.PingInterval = 0
+	config.PingTimeout = 0
+	return config
+}
+
+func expectClosed(t *testing.T, conn net.Conn, within time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(within))
+	buf := make([]byte, 4096)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if err != io.EOF {
+				t.Errorf("connection not closed by server: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	addr, stop := startServer(t, keepaliveConfig())
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectClosed(t, conn, 2*time.Second)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	config := keepaliveConfig()
+	config.IdleTimeout = 200 * time.Millisecond
+	addr, stop := startServer(t, config)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = ClientHandshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn, 2*time.Second)
+}
+
+func TestPingTimeout(t *testing.T) {
+	config := keepaliveConfig()
+	config.PingInterval = 50 * time.Millisecond
+	config.PingTimeout = 200 * time.Millisecond
+	addr, stop := startServer(t, config)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = ClientHandshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn, 2*time.Second)
+}
+
+func TestPingRTT(t *testing.T) {
+	config := keepaliveConfig()
+	config.PingInterval = 50 * time.Millisecond
+	config.PingTimeout = 200 * time.Millisecond
+	addr, stop := startServer(t, config)
+	defer stop()
+	client, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case <-client.Done():
+		t.Fatalf("server dropped a client answering pings: %v", client.Err())
+	default:
+	}
+	w := httptest.NewRecorder()
+	ServeStats(w, httptest.NewRequest("GET", "/stats", nil))
+	var connections []Stats
+	if err = json.Unmarshal(w.Body.Bytes(), &connections); err != nil {
+		t.Fatalf("stats %q: %v", w.Body, err)
+	}
+	for _, stats := range connections {
+		if stats.Addr == client.Context.Conn.LocalAddr().String() {
+			if stats.RTT <= 0 || stats.InBytes == 0 {
+				t.Errorf("stats %+v", stats)
+			}
+			return
+		}
+	}
+	t.Errorf("connection missing from %s", w.Body)
+}
+
+func TestMediaTimeout(t *testing.T) {
+	config := keepaliveConfig()
+	config.MediaTimeout = 200 * time.Millisecond
+	addr, stop := startServer(t, config)
+	defer stop()
+	client, err := Dial("rtmp://" + addr + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err = client.Publish("silent"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(2 * time.Second):
+		t.Errorf("silent publisher not dropped")
+	}
+}
@@ -64,8 +64,9 @@ func amfstring(msg interface{}, data []byte) string {
 	return header.(*Header).String() + " ~ [" + reflect.TypeOf(msg).Elem().Name() + "](" + res + ")"
 }
 
-func Decode(raw *RawMessage) Message {
+func Decode(raw *RawMessage) (Message, error) {
 	var msg Message
+	var err error
 	switch raw.Header.Type {
 	case MESSAGE_TYPE_SET_CHUNK_SIZE:
 		msg = decodeSetChunkSize(&raw.Data)
@@ -90,11 +91,16 @@ func Decode(raw *RawMessage) Message {
 	case MESSAGE_TYPE_AMF3_CMD: fallthrough
 	case MESSAGE_TYPE_AMF0_CMD:
 		msg = decodeAmf0Cmd(&raw.Data)
+	case MESSAGE_TYPE_AGGREGATE:
+		msg, err = decodeAggregate(&raw.Data, raw.Header)
 	default:
-		panic(fmt.Errorf("Unknown message type during deocde: %v", raw.Header.Type))
+		err = fmt.Errorf("Unknown message type during decode: %v", raw.Header.Type)
+	}
+	if err != nil {
+		return nil, err
 	}
 	reflect.ValueOf(msg).Elem().FieldByName("HeaderV").Set(reflect.ValueOf(raw.Header))
-	return msg
+	return msg, nil
 }
 
 func NewMessage(header Header, msg interface{}) Message {
@@ -119,6 +125,8 @@ func NewMessage(header Header, msg interface{}) Message {
 		header.Type = MESSAGE_TYPE_AMF0_META
 	case *Amf0CmdMessage:
 		header.Type = MESSAGE_TYPE_AMF0_CMD
+	case *AggregateMessage:
+		header.Type = MESSAGE_TYPE_AGGREGATE
 	}
 	reflect.ValueOf(msg).Elem().FieldByName("HeaderV").Set(reflect.ValueOf(header))
 	return msg.(Message)
@@ -327,3 +335,67 @@ func (msg *Amf0CmdMessage) Encode(buf io.Writer) {
 func (msg *Amf0CmdMessage) String() string {
 	return amfstring(msg, msg.Data)
 }
+
+///
+type AggregateMessage struct {
+	GenericMessage
+	Messages []Message
+}
+func decodeAggregate(rdr io.Reader, header Header) (Message, error) {
+	var agg AggregateMessage
+	buf := rdr.(*bytes.Buffer)
+	first := true
+	var base uint32
+	for buf.Len() > 0 {
+		if buf.Len() < 11 {
+			return nil, fmt.Errorf("Truncated aggregate sub-message header of %d bytes", buf.Len())
+		}
+		var raw RawMessage
+		raw.Header.ChunkID  = header.ChunkID
+		raw.Header.Type     =  uint8(binutil.ReadInt(buf, 1))
+		raw.Header.Length   = uint32(binutil.ReadInt(buf, 3))
+		raw.Header.Timestamp = uint32(binutil.ReadInt(buf, 3))
+		raw.Header.Timestamp |= uint32(binutil.ReadInt(buf, 1)) << 24
+		binutil.ReadInt(buf, 3) // stream id
+		raw.Header.StreamID = header.StreamID
+		switch raw.Header.Type {
+		case MESSAGE_TYPE_AUDIO, MESSAGE_TYPE_VIDEO, MESSAGE_TYPE_AMF0_META, MESSAGE_TYPE_AMF3_META:
+		default:
+			return nil, fmt.Errorf("Unexpected message type %v inside aggregate", raw.Header.Type)
+		}
+		if uint32(buf.Len()) < raw.Header.Length + 4 {
+			return nil, fmt.Errorf("Aggregate sub-message of %d bytes overruns aggregate", raw.Header.Length)
+		}
+		raw.Data.Write(binutil.ReadBuf(buf, int(raw.Header.Length)))
+		if back := uint32(binutil.ReadInt(buf, 4)); back != raw.Header.Length + 11 {
+			return nil, fmt.Errorf("Aggregate back pointer %d instead of %d", back, raw.Header.Length + 11)
+		}
+		if first {
+			base = raw.Header.Timestamp
+			first = false
+		}
+		raw.Header.Timestamp = header.Timestamp + (raw.Header.Timestamp - base)
+		msg, err := Decode(&raw)
+		if err != nil {
+			return nil, err
+		}
+		agg.Messages = append(agg.Messages, msg)
+	}
+	return &agg, nil
+}
+func (msg *AggregateMessage) Encode(buf io.Writer) {
+	for _, sub := range msg.Messages {
+		var data bytes.Buffer
+		sub.Encode(&data)
+		binutil.WriteInt(buf, int(sub.Header().Type), 1)
+		binutil.WriteInt(buf, data.Len(), 3)
+		binutil.WriteInt(buf, int(sub.Header().Timestamp & 0xFFFFFF), 3)
+		binutil.WriteInt(buf, int(sub.Header().Timestamp >> 24), 1)
+		binutil.WriteInt(buf, int(sub.Header().StreamID), 3)
+		binutil.WriteBuf(buf, data.Bytes())
+		binutil.WriteInt(buf, data.Len() + 11, 4)
+	}
+}
+func (msg *AggregateMessage) String() string {
+	return fmt.Sprintf("%s ~ [AggregateMessage]{%d messages}", msg.Header().String(), len(msg.Messages))
+}
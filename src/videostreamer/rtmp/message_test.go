@@ -0,0 +1,126 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"videostreamer/binutil"
+)
+
+func aggregate(t *testing.T, ts uint32, msgs ...Message) *RawMessage {
+	var raw RawMessage
+	agg := NewMessage(Header{ChunkID: 7, Timestamp: ts, StreamID: 1}, &AggregateMessage{Messages: msgs})
+	agg.Encode(&raw.Data)
+	raw.Header = *agg.Header()
+	raw.Header.Length = uint32(raw.Data.Len())
+	return &raw
+}
+
+func TestAggregateDecode(t *testing.T) {
+	raw := aggregate(t, 5000,
+		NewMessage(Header{Timestamp: 100}, &VideoMessage{Data: []byte{0x17, 0x01, 0xaa}}),
+		NewMessage(Header{Timestamp: 120}, &AudioMessage{Data: []byte{0xaf, 0x01, 0xbb}}),
+		NewMessage(Header{Timestamp: 0x1000140}, &VideoMessage{Data: []byte{0x27, 0x01, 0xcc}}),
+	)
+	decoded, err := Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := decoded.(*AggregateMessage)
+	if len(msg.Messages) != 3 {
+		t.Fatalf("%d sub-messages instead of 3", len(msg.Messages))
+	}
+	expected := []struct {
+		typ  uint8
+		ts   uint32
+		data []byte
+	}{
+		{MESSAGE_TYPE_VIDEO, 5000, []byte{0x17, 0x01, 0xaa}},
+		{MESSAGE_TYPE_AUDIO, 5020, []byte{0xaf, 0x01, 0xbb}},
+		{MESSAGE_TYPE_VIDEO, 5000 + 0x1000140 - 100, []byte{0x27, 0x01, 0xcc}},
+	}
+	for i, sub := range msg.Messages {
+		var data bytes.Buffer
+		sub.Encode(&data)
+		if sub.Header().Type != expected[i].typ || sub.Header().Timestamp != expected[i].ts || sub.Header().StreamID != 1 {
+			t.Errorf("sub-message %d header %+v", i, sub.Header())
+		}
+		if !bytes.Equal(data.Bytes(), expected[i].data) {
+			t.Errorf("sub-message %d data %x", i, data.Bytes())
+		}
+	}
+}
+
+func TestAggregateBackPointer(t *testing.T) {
+	raw := aggregate(t, 0, NewMessage(Header{}, &VideoMessage{Data: []byte{0x17, 0x01}}))
+	b := raw.Data.Bytes()
+	copy(b[len(b)-4:], []byte{0, 0, 0, 1})
+	if _, err := Decode(raw); err == nil {
+		t.Errorf("accepted bad back pointer")
+	}
+
+	raw = aggregate(t, 0, NewMessage(Header{}, &SetChunkSizeMessage{Size: 1}))
+	if _, err := Decode(raw); err == nil {
+		t.Errorf("accepted control message inside aggregate")
+	}
+
+	var short RawMessage
+	binutil.WriteInt(&short.Data, MESSAGE_TYPE_VIDEO, 1)
+	binutil.WriteInt(&short.Data, 100, 3)
+	binutil.WriteInt(&short.Data, 0, 7)
+	short.Header.Type = MESSAGE_TYPE_AGGREGATE
+	if _, err := Decode(&short); err == nil {
+		t.Errorf("accepted truncated aggregate")
+	}
+}
+
+func TestAggregateQueue(t *testing.T) {
+	config := NewConfig()
+	config.AggregateWindow = time.Second
+	context := NewRTMPContext(nil, nil, config)
+	context.OutMsg = make(chan Message)
+	client := &RTMPClient{Context: context, StreamID: 1}
+	audio := func(ts uint32) {
+		client.queue(NewMessage(Header{ChunkID: 4, Timestamp: ts, StreamID: 1}, &AudioMessage{Data: []byte{0xaf, 0x01}}), 2)
+	}
+
+	audio(0xfffffff0)
+	audio(0x10)
+	done := make(chan struct{})
+	go func() {
+		audio(0xffffff00)
+		close(done)
+	}()
+	var msg Message
+	select {
+	case msg = <-context.OutMsg:
+	case <-time.After(time.Second):
+		t.Fatal("timestamp going back did not flush the pending messages")
+	}
+	if agg, ok := msg.(*AggregateMessage); !ok || len(agg.Messages) != 2 || msg.Header().Timestamp != 0xfffffff0 {
+		t.Errorf("flushed %T %+v instead of an aggregate across the wrap", msg, msg.Header())
+	}
+	<-done
+
+	go client.flush()
+	time.Sleep(10 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		client.mutex.Lock()
+		client.mutex.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("flush holds the client mutex while the player is stalled")
+	}
+	select {
+	case msg = <-context.OutMsg:
+		if msg.Header().Timestamp != 0xffffff00 {
+			t.Errorf("flushed timestamp %d instead of %d", msg.Header().Timestamp, uint32(0xffffff00))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message queued after the jump back was not flushed")
+	}
+}
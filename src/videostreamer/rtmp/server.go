@@ -9,20 +9,27 @@ import (
 	"io"
 	"bytes"
 	"videostreamer/amf"
+	"time"
+	"sync"
+	"videostreamer/flv"
 )
 
-func Serve(app *core.Application, latch *syncutil.SyncLatch, addr string) {
+func Serve(app *core.Application, latch *syncutil.SyncLatch, addr string, config *Config) {
+	ln := check.Check1(net.Listen("tcp", addr)).(net.Listener)
+	ServeListener(app, latch, ln, config)
+}
+
+func ServeListener(app *core.Application, latch *syncutil.SyncLatch, ln net.Listener, config *Config) {
 	logger.Info("RTMP server started")
-	ln := check.Check1(net.Listen("tcp", addr)).(*net.TCPListener)
 	latch.Handle(func() {
 		ln.Close()
 	})
-	for latch.Running {
+	for latch.IsRunning() {
 		conn, err := ln.Accept()
 		if err != nil {
 			break
 		}
-		go connection(latch.SubLatch(), conn, app)
+		go connection(latch.SubLatch(), conn, app, config)
 	}
 
 	latch.Await()
@@ -31,21 +38,26 @@ func Serve(app *core.Application, latch *syncutil.SyncLatch, addr string) {
 	return
 }
 
-func connection(latch *syncutil.SyncLatch, conn net.Conn, app *core.Application) {
-	err := Handshake(conn)
+func connection(latch *syncutil.SyncLatch, conn net.Conn, app *core.Application, config *Config) {
 	latch.Handle(func() {
 		conn.Close()
 	})
-
+	if config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+	}
+	err := Handshake(conn, config.StrictHandshake)
 	if err != nil {
-		logger.Info("Handshake failed")
+		logger.Info("Handshake failed:", err)
 		latch.Complete()
 		return
 	}
+	conn.SetDeadline(time.Time{})
 
 	logger.Info("Clinet connected")
 
-	context := NewRTMPContext(conn, app)
+	context := NewRTMPContext(conn, app, config)
+	register(context)
+	defer unregister(context)
 
 	go recv(context, latch.SubLatch())
 	go send(context, latch.SubLatch())
@@ -57,32 +69,31 @@ func connection(latch *syncutil.SyncLatch, conn net.Conn, app *core.Application)
 }
 
 func recv(context *RTMPContext, latch *syncutil.SyncLatch) {
-	for latch.Running {
+	for latch.IsRunning() {
 		if err := context.ReadChunk(); err != nil {
-			if err != io.EOF && latch.Running {
+			if err != io.EOF && latch.IsRunning() {
 				logger.Error(err)
 			}
 			break
 		}
 	}
 	close(context.InMsg)
-	close(context.OutMsg)
-	if context.Stream != nil && context.Client != nil {
-		context.Stream.Unsubscribe(context.Client)
-	}
-	if context.Stream != nil && context.Client == nil {
-		context.Stream.Unpublish()
-	}
+	close(context.Done)
 	latch.Complete()
 }
 
 func send(context *RTMPContext, latch *syncutil.SyncLatch) {
-	for latch.Running {
-		msg := <- context.OutMsg
+	for latch.IsRunning() {
+		var msg Message
+		select {
+		case msg = <- context.OutMsg:
+		case <- context.Done:
+		}
 		if msg == nil {
 			break
 		}
 		//logger.Debug("<-", msg)
+		context.awaitWindow()
 		context.WriteMessage(msg)
 		if msg.Header().Type == MESSAGE_TYPE_SET_CHUNK_SIZE {
 			context.OutChunk = msg.(*SetChunkSizeMessage).Size
@@ -92,16 +103,27 @@ func send(context *RTMPContext, latch *syncutil.SyncLatch) {
 }
 
 func hndl(context *RTMPContext, latch *syncutil.SyncLatch) {
-	for latch.Running {
-		msg := <- context.InMsg
+	ticker := time.NewTicker(context.Config.tick())
+	defer ticker.Stop()
+	for latch.IsRunning() {
+		var msg Message
+		select {
+		case now := <- ticker.C:
+			if err := context.watchdog(now); err != nil {
+				logger.Info("Dropping client:", err)
+				context.Conn.Close()
+			}
+			continue
+		case msg = <- context.InMsg:
+		}
 		if msg == nil {
 			break
 		}
 		alt := false
 		//logger.Debug("->", msg)
 		switch msg.Header().Type {
-		case MESSAGE_TYPE_WINACK:
-			context.InAck = msg.(*WinackMessage).Size
+		case MESSAGE_TYPE_WINACK, MESSAGE_TYPE_ACK, MESSAGE_TYPE_SET_PEER_BAND:
+			context.HandleControl(msg)
 		case MESSAGE_TYPE_AMF3_CMD: fallthrough
 		case MESSAGE_TYPE_AMF3_CMD_ALT:
 			alt = true
@@ -121,75 +143,140 @@ func hndl(context *RTMPContext, latch *syncutil.SyncLatch) {
 		case MESSAGE_TYPE_USER:
 			handleuser(context, msg.(*UserMessage))
 		case MESSAGE_TYPE_AUDIO:
-			if context.Stream != nil {
-				context.Stream.BroadcastAudio(core.NewAudioData(msg.Header().Timestamp, msg.(*AudioMessage).Data))
+			if ns := context.publishing(msg.Header().StreamID); ns != nil {
+				ns.LastMedia = time.Now()
+				ns.Stream.ReceiveAudio(core.NewAudioData(msg.Header().Timestamp, msg.(*AudioMessage).Data))
 			}
 		case MESSAGE_TYPE_VIDEO:
-			if context.Stream != nil {
-				data := msg.(*VideoMessage).Data
-				viddata := core.NewVideoData(msg.Header().Timestamp, data)
-				if data[1] == 0 {
-					context.Stream.KeyVideo = viddata
-					if !context.Stream.Published {
-						context.Stream.Publish()
-					}
-				}
-				context.Stream.BroadcastVideo(viddata)
+			if ns := context.publishing(msg.Header().StreamID); ns != nil {
+				ns.LastMedia = time.Now()
+				ns.Stream.ReceiveVideo(core.NewVideoData(msg.Header().Timestamp, msg.(*VideoMessage).Data))
 			}
 		}
 	}
+	for id := range context.Streams {
+		context.deleteStream(id)
+	}
 	latch.Complete()
 }
 
 
 type RTMPClient struct {
-	Context *RTMPContext
+	Context  *RTMPContext
+	StreamID uint32
+	pending []Message
+	size    int
+	timer   *time.Timer
+	mutex   sync.Mutex
+	sending sync.Mutex
+}
+
+func (client *RTMPClient) queue(msg Message, size int) {
+	window := client.Context.Config.AggregateWindow
+	if window == 0 {
+		client.Context.Send(msg)
+		return
+	}
+	client.mutex.Lock()
+	if len(client.pending) > 0 && int32(msg.Header().Timestamp - client.pending[0].Header().Timestamp) < 0 {
+		client.mutex.Unlock()
+		client.flush()
+		client.mutex.Lock()
+	}
+	client.pending = append(client.pending, msg)
+	client.size += size + 15
+	if len(client.pending) == 1 {
+		client.timer = time.AfterFunc(window, client.flush)
+	}
+	full := int32(msg.Header().Timestamp - client.pending[0].Header().Timestamp) >= int32(window / time.Millisecond) || client.size >= AGGREGATE_LIMIT
+	client.mutex.Unlock()
+	if full {
+		client.flush()
+	}
+}
+
+// flush sends the pending messages without holding mutex, so a slow player
+// only stalls the sender while sending keeps batches in order.
+func (client *RTMPClient) flush() {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	client.mutex.Lock()
+	if client.timer != nil {
+		client.timer.Stop()
+		client.timer = nil
+	}
+	pending := client.pending
+	client.pending = nil
+	client.size = 0
+	client.mutex.Unlock()
+	switch len(pending) {
+	case 0:
+		return
+	case 1:
+		client.Context.Send(pending[0])
+	default:
+		client.Context.Send(NewMessage(Header{ChunkID: 7, Timestamp: pending[0].Header().Timestamp, StreamID: client.StreamID}, &AggregateMessage{Messages: pending}))
+	}
 }
 
 func (client *RTMPClient) ConsumeVideo(data *core.VideoData) {
-	client.Context.OutMsg <- NewMessage(Header{ChunkID:6, Timestamp: data.Time, StreamID: 1}, &VideoMessage{Data: data.Data})
+	if data.Enhanced() && !client.Context.playable(data) {
+		return
+	}
+	client.queue(NewMessage(Header{ChunkID:6, Timestamp: data.Time, StreamID: client.StreamID}, &VideoMessage{Data: data.Data}), len(data.Data))
 }
 
 func (client *RTMPClient) ConsumeAudio(data *core.AudioData) {
-	client.Context.OutMsg <- NewMessage(Header{ChunkID:4, Timestamp: data.Time, StreamID: 1}, &AudioMessage{Data: data.Data})
+	client.queue(NewMessage(Header{ChunkID:4, Timestamp: data.Time, StreamID: client.StreamID}, &AudioMessage{Data: data.Data}), len(data.Data))
 }
 
 func (client *RTMPClient) ConsumeMeta(data *core.MetaData) {
-	client.Context.OutMsg <- makeMetadata(data)
+	client.flush()
+	client.Context.Send(makeMetadata(data, client.StreamID))
 }
 
 func (client *RTMPClient) Publish() {
-	client.Context.OutMsg <- NewMessage(Header{ChunkID: 2}, &UserMessage{
+	client.flush()
+	client.Context.Send(NewMessage(Header{ChunkID: 2}, &UserMessage{
 		Event: USER_EVENT_STREAM_BEGIN,
-		First: 1,
-	})
+		First: client.StreamID,
+	}))
 }
 
 func (client *RTMPClient) Unpublish() {
-	client.Context.OutMsg <- NewMessage(Header{ChunkID: 2}, &UserMessage{
+	client.flush()
+	client.Context.Send(NewMessage(Header{ChunkID: 2}, &UserMessage{
 		Event: USER_EVENT_STREAM_EOF,
-		First: 1,
-	})
+		First: client.StreamID,
+	}))
 }
 
-func makeMetadata(data *core.MetaData) Message {
-	buf := bytes.Buffer{}
-	fw := float64(data.Width)
-	fh := float64(data.Height)
-	ff := float64(data.Framerate)
-	amf.EncodeAMF(&buf, "onMetaData")
-	amf.EncodeAMF(&buf, struct{
-		Width         float64 `name:"width"`
-		Height        float64 `name:"height"`
-		DisplayWidth  float64 `name:"displayWidth"`
-		DisplayHeight float64 `name:"displayHeight"`
-		Duration      float64 `name:"duration"`
-		Framerate     float64 `name:"framerate"`
-		Videocodecid  float64 `name:"videocodecid"`
-		Audiocodecid  float64 `name:"audiocodecid"`
-
-	}{fw, fh, fw, fh, -1, ff, 7, 10})
-	return NewMessage(Header{ChunkID: 3, StreamID: 1}, &Amf0MetaMessage{Data: buf.Bytes()})
+func fourccs(list amf.AMFValue) []string {
+	arr, ok := list.(amf.AMFArray)
+	if !ok {
+		return nil
+	}
+	ret := []string{}
+	for _, val := range arr {
+		if fourcc, ok := val.(string); ok {
+			ret = append(ret, fourcc)
+		}
+	}
+	return ret
+}
+
+func (context *RTMPContext) playable(data *core.VideoData) bool {
+	_, fourcc, _ := data.ExHeader()
+	for _, f := range context.FourCCs {
+		if f == "*" || f == fourcc || fourcc == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func makeMetadata(data *core.MetaData, streamid uint32) Message {
+	return NewMessage(Header{ChunkID: 3, StreamID: streamid}, &Amf0MetaMessage{Data: flv.EncodeMetadata(data)})
 }
 
 func handlecmd(context *RTMPContext, msg *Amf0CmdMessage) (err error) {
@@ -199,92 +286,176 @@ func handlecmd(context *RTMPContext, msg *Amf0CmdMessage) (err error) {
 	switch name {
 	case "connect":
 		serial := check.Check1(amf.DecodeAMF(rdr)).(float64)
+		props, _ := amf.DecodeAMF(rdr)
+		if props, ok := props.(amf.AMFMap); ok {
+			context.FourCCs = fourccs(props["fourCcList"])
+		}
 
-		context.OutMsg <- NewMessage(Header{ChunkID: 2}, &WinackMessage{Size: 5000000})
-
-		context.OutMsg <- NewMessage(Header{ChunkID: 2}, &SetPeerBandMessage{Size: 5000000, Type: 2})
-		context.OutMsg <- NewMessage(Header{ChunkID: 2}, &SetChunkSizeMessage{Size: 4096})
+		context.SendWinack(context.Config.AckWindow)
+		context.Send(NewMessage(Header{ChunkID: 2}, &SetPeerBandMessage{Size: context.Config.PeerBandwidth, Type: PEER_BAND_DYNAMIC}))
+		context.Send(NewMessage(Header{ChunkID: 2}, &SetChunkSizeMessage{Size: 4096}))
 		buf := bytes.Buffer{}
 		amf.EncodeAMF(&buf, "_result")
 		amf.EncodeAMF(&buf, serial)
-		amf.EncodeAMF(&buf, struct {
-			FmsVer string  `name:"fmsVer"`
-			Caps   float64 `name:"capabilities"`
-		}{"FMS/3,0,1,123", 31})
+		if context.FourCCs != nil {
+			amf.EncodeAMF(&buf, struct {
+				FmsVer     string   `name:"fmsVer"`
+				Caps       float64  `name:"capabilities"`
+				FourCcList []string `name:"fourCcList"`
+			}{"FMS/3,0,1,123", 31, context.FourCCs})
+		} else {
+			amf.EncodeAMF(&buf, struct {
+				FmsVer string  `name:"fmsVer"`
+				Caps   float64 `name:"capabilities"`
+			}{"FMS/3,0,1,123", 31})
+		}
 		amf.EncodeAMF(&buf, struct {
 			Level  string  `name:"level"`
 			Code   string  `name:"code"`
 			Desc   string  `name:"description"`
 			ObjEnc float64 `name:"objectEncoding"`
 		}{"status", "NetConnection.Connect.Success", "Connection succeeded.", 3})
-		context.OutMsg <- NewMessage(Header{ChunkID: 3}, &Amf0CmdMessage{Data: buf.Bytes()})
+		context.Send(NewMessage(Header{ChunkID: 3}, &Amf0CmdMessage{Data: buf.Bytes()}))
 	case "createStream":
 		serial := check.Check1(amf.DecodeAMF(rdr)).(float64)
+		ns := context.createStream()
 		buf := bytes.Buffer{}
 		amf.EncodeAMF(&buf, "_result")
 		amf.EncodeAMF(&buf, serial)
 		amf.EncodeAMF(&buf, nil)
-		amf.EncodeAMF(&buf, 1)
-		context.OutMsg <- NewMessage(Header{ChunkID: 3}, &Amf0CmdMessage{Data: buf.Bytes()})
+		amf.EncodeAMF(&buf, ns.ID)
+		context.Send(NewMessage(Header{ChunkID: 3}, &Amf0CmdMessage{Data: buf.Bytes()}))
+	case "deleteStream":
+		amf.DecodeAMF(rdr) // serial
+		amf.DecodeAMF(rdr) // nil
+		id := uint32(check.Check1(amf.DecodeAMF(rdr)).(float64))
+		if ns := context.Streams[id]; ns != nil {
+			unpublishStream(context, ns)
+		}
+		context.deleteStream(id)
+	case "closeStream":
+		if ns := context.Streams[msg.Header().StreamID]; ns != nil {
+			unpublishStream(context, ns)
+			context.closeStream(ns)
+		}
+	case "releaseStream":
+		serial := check.Check1(amf.DecodeAMF(rdr)).(float64)
+		resultMessage(context, serial)
+	case "FCPublish":
+		serial := check.Check1(amf.DecodeAMF(rdr)).(float64)
+		amf.DecodeAMF(rdr) // nil
+		streamname, _ := check.Check1(amf.DecodeAMF(rdr)).(string)
+		context.Send(fcMessage("onFCPublish", "NetStream.Publish.Start", streamname))
+		resultMessage(context, serial)
+	case "FCUnpublish":
+		serial := check.Check1(amf.DecodeAMF(rdr)).(float64)
+		amf.DecodeAMF(rdr) // nil
+		streamname, _ := check.Check1(amf.DecodeAMF(rdr)).(string)
+		for _, ns := range context.Streams {
+			if ns.Publishing && ns.Stream.Name == streamname {
+				unpublishStream(context, ns)
+			}
+		}
+		context.Send(fcMessage("onFCUnpublish", "NetStream.Unpublish.Success", streamname))
+		resultMessage(context, serial)
 	case "play":
 		amf.DecodeAMF(rdr) // serial
 		amf.DecodeAMF(rdr) // nil
 		streamname := check.Check1(amf.DecodeAMF(rdr)).(string)
-		context.Stream = context.App.AcquireStream(streamname)
-		context.Client = &RTMPClient{Context: context}
+		ns := context.netStream(msg.Header().StreamID)
+		context.closeStream(ns)
+		ns.Stream = context.App.AcquireStream(streamname)
+		ns.Client = &RTMPClient{Context: context, StreamID: ns.ID}
 
-		buf := bytes.Buffer{}
-		amf.EncodeAMF(&buf, "onStatus")
-		amf.EncodeAMF(&buf, 0)
-		amf.EncodeAMF(&buf, nil)
-		amf.EncodeAMF(&buf, struct {
-			Level string  `name:"level"`
-			Code  string  `name:"code"`
-			Desc  string  `name:"description"`
-		}{"status", "NetStream.Play.Start", "Start live."})
-		context.OutMsg <- NewMessage(Header{ChunkID: 5, StreamID: 1}, &Amf0CmdMessage{Data: buf.Bytes()})
+		context.Send(statusMessage(ns.ID, "status", "NetStream.Play.Start", "Start live."))
 
-		buf = bytes.Buffer{}
+		buf := bytes.Buffer{}
 		amf.EncodeAMF(&buf, "|RtmpSampleAccess")
 		amf.EncodeAMF(&buf, true)
 		amf.EncodeAMF(&buf, true)
-		context.OutMsg <- NewMessage(Header{ForceFmt: true, ChunkID: 5, StreamID: 1}, &Amf0MetaMessage{Data: buf.Bytes()})
-		if context.Stream.Published {
-			context.Stream.Bootstrap(context.Client)
+		context.Send(NewMessage(Header{ForceFmt: true, ChunkID: 5, StreamID: ns.ID}, &Amf0MetaMessage{Data: buf.Bytes()}))
+		if ns.Stream.IsPublished() {
+			ns.Stream.Bootstrap(ns.Client)
 		}
-		context.Stream.Subscribe(context.Client)
+		ns.Stream.Subscribe(ns.Client)
 	case "publish":
 		amf.DecodeAMF(rdr) // serial
 		amf.DecodeAMF(rdr) // nil
 		streamname := check.Check1(amf.DecodeAMF(rdr)).(string)
-		context.Stream = context.App.AcquireStream(streamname)
+		ns := context.netStream(msg.Header().StreamID)
+		context.closeStream(ns)
+		stream := context.App.AcquireStream(streamname)
+		if !stream.Claim(ns) {
+			context.Send(statusMessage(ns.ID, "error", "NetStream.Publish.BadName", streamname + " is already published."))
+			break
+		}
+		ns.Stream = stream
+		ns.Publishing = true
+		ns.LastMedia = time.Now()
 
-		buf := bytes.Buffer{}
-		amf.EncodeAMF(&buf, "onStatus")
-		amf.EncodeAMF(&buf, 0)
-		amf.EncodeAMF(&buf, nil)
-		amf.EncodeAMF(&buf, struct{
-			Level  string  `name:"level"`
-			Code   string  `name:"code"`
-			Desc   string  `name:"description"`
-		}{"status", "NetStream.Publish.Start", "Start publising."})
-		context.OutMsg <- NewMessage(Header{ChunkID: 5}, &Amf0CmdMessage{Data: buf.Bytes()})
+		context.Send(statusMessage(ns.ID, "status", "NetStream.Publish.Start", "Start publising."))
 	}
 	return
 }
 
+func unpublishStream(context *RTMPContext, ns *NetStream) {
+	if !ns.Publishing {
+		return
+	}
+	name := ns.Stream.Name
+	context.closeStream(ns)
+	context.Send(statusMessage(ns.ID, "status", "NetStream.Unpublish.Success", name + " is now unpublished."))
+}
+
+func resultMessage(context *RTMPContext, serial float64) {
+	if serial == 0 {
+		return
+	}
+	buf := bytes.Buffer{}
+	amf.EncodeAMF(&buf, "_result")
+	amf.EncodeAMF(&buf, serial)
+	amf.EncodeAMF(&buf, nil)
+	context.Send(NewMessage(Header{ChunkID: 3}, &Amf0CmdMessage{Data: buf.Bytes()}))
+}
+
+func fcMessage(name string, code string, desc string) Message {
+	buf := bytes.Buffer{}
+	amf.EncodeAMF(&buf, name)
+	amf.EncodeAMF(&buf, 0)
+	amf.EncodeAMF(&buf, nil)
+	amf.EncodeAMF(&buf, struct {
+		Code  string  `name:"code"`
+		Desc  string  `name:"description"`
+	}{code, desc})
+	return NewMessage(Header{ChunkID: 3}, &Amf0CmdMessage{Data: buf.Bytes()})
+}
+
+func statusMessage(streamid uint32, level string, code string, desc string) Message {
+	buf := bytes.Buffer{}
+	amf.EncodeAMF(&buf, "onStatus")
+	amf.EncodeAMF(&buf, 0)
+	amf.EncodeAMF(&buf, nil)
+	amf.EncodeAMF(&buf, struct {
+		Level string  `name:"level"`
+		Code  string  `name:"code"`
+		Desc  string  `name:"description"`
+	}{level, code, desc})
+	return NewMessage(Header{ChunkID: 5, StreamID: streamid}, &Amf0CmdMessage{Data: buf.Bytes()})
+}
+
 func handlemeta(context *RTMPContext, msg *Amf0MetaMessage) (err error) {
 	defer check.CheckPanicHandler(&err)
-	rdr := bytes.NewReader(msg.Data)
-	amf.DecodeAMF(rdr)
-	amf.DecodeAMF(rdr)
-	raw := check.Check1(amf.DecodeAMF(rdr)).(amf.AMFMap)
-	context.Stream.Metadata = core.NewMetaData(uint32(raw["width"].(float64)), uint32(raw["height"].(float64)), uint32(raw["framerate"].(float64)))
-	context.Stream.BroadcastMeta(context.Stream.Metadata)
+	meta := flv.ParseMetadata(msg.Data)
+	ns := context.publishing(msg.Header().StreamID)
+	if meta == nil || ns == nil {
+		return
+	}
+	ns.Stream.ReceiveMeta(meta)
 	return
 }
 
 func handleuser(context *RTMPContext, msg *UserMessage) (err error) {
 	defer check.CheckPanicHandler(&err)
+	context.HandlePing(msg)
 	return
 }
\ No newline at end of file
@@ -0,0 +1,211 @@
+package rtsp
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sync"
+	"time"
+	"videostreamer/aac"
+	"videostreamer/avc"
+	"videostreamer/core"
+)
+
+const (
+	RTP_VERSION  = 2
+	PAYLOAD_H264 = 96
+	PAYLOAD_AAC  = 97
+	VIDEO_CLOCK  = 90000
+	MAX_PAYLOAD  = 1400
+	NTP_OFFSET   = 2208988800
+)
+
+const (
+	RTCP_SR   = 200
+	RTCP_RR   = 201
+	RTCP_BYE  = 203
+	RTCP_PSFB = 206
+)
+
+const (
+	NALU_STAP_A = 24
+	NALU_FU_A   = 28
+)
+
+const (
+	TRACK_VIDEO = 0
+	TRACK_AUDIO = 1
+)
+
+const AAC_FRAME_SIZE = 1024
+
+const (
+	DEFAULT_TIMEOUT  = 60 * time.Second
+	DEFAULT_RTP_PORT = 8000
+	DESCRIBE_TIMEOUT = 5 * time.Second
+	WRITE_TIMEOUT    = 10 * time.Second
+	REPORT_INTERVAL  = 5 * time.Second
+	QUEUE_SIZE       = 512
+)
+
+type Config struct {
+	RTPPort         int
+	Timeout         time.Duration
+	DescribeTimeout time.Duration
+}
+
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+type Response struct {
+	Status int
+	Header map[string]string
+	Body   []byte
+}
+
+type Transport struct {
+	TCP         bool
+	Interleaved [2]int
+	ClientPort  [2]int
+}
+
+type Track struct {
+	ID          int
+	PayloadType uint8
+	ClockRate   uint32
+	SSRC        uint32
+	Seq         uint16
+	Offset      uint32
+	Packets     uint32
+	Octets      uint32
+	Transport   *Transport
+	Addr        *net.UDPAddr
+	ControlAddr *net.UDPAddr
+	lastTime    uint32
+	lastRTP     uint32
+	sent        bool
+}
+
+type RTPPacket struct {
+	PayloadType uint8
+	Marker      bool
+	Seq         uint16
+	Timestamp   uint32
+	SSRC        uint32
+	Payload     []byte
+}
+
+type AccessUnit struct {
+	Time    uint32
+	NALUs   [][]byte
+	Damaged bool
+}
+
+type H264Depacketizer struct {
+	unit     *AccessUnit
+	fragment []byte
+	seq      uint16
+	started  bool
+}
+
+type AACDepacketizer struct {
+	SizeLength       int
+	IndexLength      int
+	IndexDeltaLength int
+	fragment         []byte
+	size             int
+	seq              uint16
+	started          bool
+}
+
+type Announced struct {
+	Control     string
+	PayloadType uint8
+	ClockRate   uint32
+	Channels    int
+	Codec       string
+	Params      map[string]string
+}
+
+type Ingest struct {
+	Media     *Announced
+	Transport *Transport
+	Addr      *net.UDPAddr
+	h264      H264Depacketizer
+	aac       *AACDepacketizer
+	received  bool
+	anchor    uint32
+	lastRTP   uint32
+	extended  int64
+}
+
+type frame struct {
+	video bool
+	time  uint32
+	data  []byte
+}
+
+type Session struct {
+	ID       string
+	Stream   *core.Stream
+	Video    *avc.Config
+	Audio    *aac.Config
+	ASC      []byte
+	Tracks   [2]*Track
+	Dropped  uint64
+	server   *Server
+	conn     *Conn
+	queue    chan *frame
+	end      chan struct{}
+	mutex    sync.Mutex
+	lastSeen time.Time
+	base     uint32
+	wall     time.Time
+	based    bool
+	playing  bool
+	waitKey  bool
+	ended    bool
+}
+
+type Publisher struct {
+	ID        string
+	Stream    *core.Stream
+	Video     *Ingest
+	Audio     *Ingest
+	server    *Server
+	conn      *Conn
+	mutex     sync.Mutex
+	lastSeen  time.Time
+	start     time.Time
+	sps       []byte
+	pps       []byte
+	asc       []byte
+	started   bool
+	waitKey   bool
+	recording bool
+	published bool
+	ended     bool
+}
+
+type Conn struct {
+	Conn      net.Conn
+	server    *Server
+	reader    *bufio.Reader
+	announced *Publisher
+	mutex     sync.Mutex
+}
+
+type Server struct {
+	App        *core.Application
+	Config     *Config
+	sessions   map[string]*Session
+	publishers map[string]*Publisher
+	rtp        *net.UDPConn
+	rtcp       *net.UDPConn
+	mutex      sync.Mutex
+}
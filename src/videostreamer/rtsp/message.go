@@ -0,0 +1,166 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	409: "Conflict",
+	415: "Unsupported Media Type",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	505: "RTSP Version Not Supported",
+}
+
+func readBody(reader *bufio.Reader, header textproto.MIMEHeader) ([]byte, error) {
+	length := header.Get("Content-Length")
+	if length == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 0 || n > 1<<20 {
+		return nil, errors.New("Bad Content-Length " + length)
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(reader, body)
+	return body, err
+}
+
+func ReadRequest(reader *bufio.Reader) (*Request, error) {
+	tp := textproto.NewReader(reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "RTSP/") {
+		return nil, fmt.Errorf("Bad request line %q", line)
+	}
+	u, err := url.Parse(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	body, err := readBody(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Method: fields[0], URL: u, Header: header, Body: body}, nil
+}
+
+func ReadResponse(reader *bufio.Reader) (*Response, error) {
+	tp := textproto.NewReader(reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/") {
+		return nil, fmt.Errorf("Bad status line %q", line)
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	mime, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	body, err := readBody(reader, mime)
+	if err != nil {
+		return nil, err
+	}
+	header := make(map[string]string)
+	for key := range mime {
+		header[key] = mime.Get(key)
+	}
+	return &Response{Status: status, Header: header, Body: body}, nil
+}
+
+func NewResponse(status int) *Response {
+	return &Response{Status: status, Header: make(map[string]string)}
+}
+
+func (response *Response) Write(w io.Writer) error {
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "RTSP/1.0 %d %s\r\n", response.Status, statusText[response.Status])
+	if len(response.Body) > 0 {
+		response.Header["Content-Length"] = strconv.Itoa(len(response.Body))
+	}
+	keys := []string{}
+	for key := range response.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, response.Header[key])
+	}
+	buf.WriteString("\r\n")
+	buf.Write(response.Body)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func ParseTransport(value string) (*Transport, error) {
+	for _, spec := range strings.Split(value, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+		transport := &Transport{Interleaved: [2]int{-1, -1}}
+		switch strings.ToUpper(params[0]) {
+		case "RTP/AVP", "RTP/AVP/UDP":
+		case "RTP/AVP/TCP":
+			transport.TCP = true
+		default:
+			continue
+		}
+		multicast := false
+		for _, param := range params[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			switch strings.ToLower(kv[0]) {
+			case "multicast":
+				multicast = true
+			case "interleaved":
+				if len(kv) == 2 {
+					transport.Interleaved = parseRange(kv[1])
+				}
+			case "client_port":
+				if len(kv) == 2 {
+					transport.ClientPort = parseRange(kv[1])
+				}
+			}
+		}
+		if multicast || (!transport.TCP && transport.ClientPort[0] <= 0) {
+			continue
+		}
+		return transport, nil
+	}
+	return nil, errors.New("No supported transport in " + value)
+}
+
+func parseRange(value string) (r [2]int) {
+	fields := strings.SplitN(value, "-", 2)
+	r[0], _ = strconv.Atoi(fields[0])
+	r[1] = r[0] + 1
+	if len(fields) == 2 {
+		r[1], _ = strconv.Atoi(fields[1])
+	}
+	return
+}
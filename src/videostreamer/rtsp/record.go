@@ -0,0 +1,361 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/logger"
+)
+
+func (server *Server) announce(conn *Conn, request *Request) *Response {
+	name, control, ok := ParsePath(request.URL.Path)
+	if !ok || control != "" {
+		return NewResponse(404)
+	}
+	if !strings.HasPrefix(request.Header.Get("Content-Type"), "application/sdp") {
+		return NewResponse(415)
+	}
+	publisher := &Publisher{
+		ID:       hex.EncodeToString(random(8)),
+		Stream:   server.App.AcquireStream(name),
+		server:   server,
+		conn:     conn,
+		lastSeen: time.Now(),
+	}
+	for _, media := range ParseSDP(string(request.Body)) {
+		switch {
+		case media.Codec == "H264" && publisher.Video == nil:
+			publisher.Video = &Ingest{Media: media}
+		case media.Codec == "MPEG4-GENERIC" && publisher.Audio == nil && media.Config() != nil && media.Depacketizer() != nil:
+			publisher.Audio = &Ingest{Media: media, aac: media.Depacketizer()}
+			publisher.asc = media.Config()
+		}
+	}
+	if publisher.Video == nil && publisher.Audio == nil {
+		return NewResponse(415)
+	}
+	if !server.claim(publisher) {
+		return NewResponse(409)
+	}
+	if conn.announced != nil {
+		conn.announced.close()
+	}
+	conn.announced = publisher
+	logger.Infof("RTSP client %s announced %s", conn.Conn.RemoteAddr(), name)
+	return NewResponse(200)
+}
+
+func (server *Server) claim(publisher *Publisher) bool {
+	if !publisher.Stream.Claim(publisher) {
+		return false
+	}
+	server.mutex.Lock()
+	server.publishers[publisher.ID] = publisher
+	server.mutex.Unlock()
+	return true
+}
+
+func (server *Server) removePublisher(publisher *Publisher) {
+	server.mutex.Lock()
+	if server.publishers[publisher.ID] == publisher {
+		delete(server.publishers, publisher.ID)
+	}
+	server.mutex.Unlock()
+	publisher.Stream.Release(publisher)
+}
+
+func (server *Server) listPublishers() (publishers []*Publisher) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, publisher := range server.publishers {
+		publishers = append(publishers, publisher)
+	}
+	return
+}
+
+// publisher finds the announced publisher a request refers to by session or by connection.
+func (server *Server) publisher(conn *Conn, request *Request) *Publisher {
+	if id := strings.TrimSpace(strings.SplitN(request.Header.Get("Session"), ";", 2)[0]); id != "" {
+		server.mutex.Lock()
+		publisher := server.publishers[id]
+		server.mutex.Unlock()
+		if publisher != nil {
+			publisher.touch()
+		}
+		return publisher
+	}
+	if name, _, _ := ParsePath(request.URL.Path); conn.announced != nil && conn.announced.Stream.Name == name {
+		return conn.announced
+	}
+	return nil
+}
+
+func (server *Server) setupRecord(conn *Conn, publisher *Publisher, request *Request) *Response {
+	_, control, _ := ParsePath(request.URL.Path)
+	var ingest *Ingest
+	for _, candidate := range []*Ingest{publisher.Video, publisher.Audio} {
+		if candidate != nil && (candidate.Media.Control == request.URL.String() || path.Base(strings.TrimSuffix(candidate.Media.Control, "/")) == control) {
+			ingest = candidate
+		}
+	}
+	if ingest == nil {
+		return NewResponse(404)
+	}
+	transport, err := ParseTransport(request.Header.Get("Transport"))
+	if err != nil || (!transport.TCP && server.rtp == nil) {
+		return NewResponse(461)
+	}
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	if publisher.recording || publisher.ended {
+		return NewResponse(455)
+	}
+	id := TRACK_VIDEO
+	if ingest == publisher.Audio {
+		id = TRACK_AUDIO
+	}
+	response := NewResponse(200)
+	response.Header["Session"] = fmt.Sprintf("%s;timeout=%d", publisher.ID, int(server.Config.Timeout/time.Second))
+	if transport.TCP {
+		if transport.Interleaved[0] < 0 {
+			transport.Interleaved = [2]int{2 * id, 2*id + 1}
+		}
+		response.Header["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record", transport.Interleaved[0], transport.Interleaved[1])
+	} else {
+		ingest.Addr = &net.UDPAddr{IP: conn.Conn.RemoteAddr().(*net.TCPAddr).IP, Port: transport.ClientPort[0]}
+		response.Header["Transport"] = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;mode=record",
+			transport.ClientPort[0], transport.ClientPort[1], server.Config.RTPPort, server.Config.RTPPort+1)
+	}
+	ingest.Transport = transport
+	if ingest == publisher.Video {
+		publisher.waitKey = true
+	}
+	return response
+}
+
+func (server *Server) record(conn *Conn, request *Request) (*Response, func()) {
+	publisher := server.publisher(conn, request)
+	if publisher == nil {
+		return NewResponse(454), nil
+	}
+	if (publisher.Video == nil || publisher.Video.Transport == nil) && (publisher.Audio == nil || publisher.Audio.Transport == nil) {
+		return NewResponse(455), nil
+	}
+	response := NewResponse(200)
+	response.Header["Session"] = publisher.ID
+	return response, publisher.record
+}
+
+func (publisher *Publisher) ingests() (ingests []*Ingest) {
+	for _, ingest := range []*Ingest{publisher.Video, publisher.Audio} {
+		if ingest != nil && ingest.Transport != nil {
+			ingests = append(ingests, ingest)
+		}
+	}
+	return
+}
+
+func (publisher *Publisher) interleaved() bool {
+	for _, ingest := range publisher.ingests() {
+		if ingest.Transport.TCP {
+			return true
+		}
+	}
+	return false
+}
+
+func (publisher *Publisher) touch() {
+	publisher.mutex.Lock()
+	publisher.lastSeen = time.Now()
+	publisher.mutex.Unlock()
+}
+
+func (publisher *Publisher) expired(timeout time.Duration) bool {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	return !publisher.interleaved() && time.Since(publisher.lastSeen) > timeout
+}
+
+// channel returns the ingest receiving RTP on an interleaved channel, or whether it is an RTCP channel.
+func (publisher *Publisher) channel(channel int) (ingest *Ingest, rtcp bool) {
+	for _, ingest := range publisher.ingests() {
+		if ingest.Transport.TCP && ingest.Transport.Interleaved[0] == channel {
+			return ingest, false
+		}
+		if ingest.Transport.TCP && ingest.Transport.Interleaved[1] == channel {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+func (publisher *Publisher) record() {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	if publisher.recording || publisher.ended {
+		return
+	}
+	publisher.recording = true
+	publisher.lastSeen = time.Now()
+	logger.Infof("RTSP publisher %s recording %s", publisher.ID, publisher.Stream.Name)
+	if publisher.Audio != nil && publisher.Audio.Transport != nil {
+		publisher.Stream.ReceiveAudio(core.NewAudioData(0, append([]byte{0xaf, 0x00}, publisher.asc...)))
+		if publisher.Video == nil || publisher.Video.Transport == nil {
+			publisher.publish()
+		}
+	}
+	if publisher.Video != nil && publisher.Video.Transport != nil {
+		if sps, pps := publisher.Video.Media.SpropParameterSets(); sps != nil && pps != nil {
+			publisher.configure(0, sps, pps)
+		}
+	}
+}
+
+func (publisher *Publisher) publish() {
+	if publisher.published {
+		return
+	}
+	publisher.published = true
+	if !publisher.Stream.IsPublished() {
+		publisher.Stream.Publish()
+	}
+}
+
+func (publisher *Publisher) configure(t uint32, sps []byte, pps []byte) {
+	publisher.sps, publisher.pps = sps, pps
+	config := avc.MakeConfig([][]byte{sps}, [][]byte{pps})
+	publisher.Stream.ReceiveVideo(core.NewVideoData(t, append([]byte{0x17, 0, 0, 0, 0}, config...)))
+	publisher.published = true
+	if info, err := avc.ParseSPS(sps); err == nil {
+		publisher.Stream.ReceiveMeta(core.NewMetaData(info.Width, info.Height, 0))
+	}
+}
+
+func (publisher *Publisher) close() {
+	publisher.mutex.Lock()
+	if publisher.ended {
+		publisher.mutex.Unlock()
+		return
+	}
+	publisher.ended = true
+	if publisher.published && publisher.Stream.IsPublished() {
+		publisher.Stream.Unpublish()
+	}
+	publisher.mutex.Unlock()
+	publisher.server.removePublisher(publisher)
+	logger.Infof("RTSP publisher %s of %s closed", publisher.ID, publisher.Stream.Name)
+}
+
+func (publisher *Publisher) time(ingest *Ingest, rtp uint32) uint32 {
+	if !publisher.started {
+		publisher.started = true
+		publisher.start = time.Now()
+	}
+	if !ingest.received {
+		ingest.received = true
+		ingest.anchor = uint32(time.Since(publisher.start) / time.Millisecond)
+		ingest.lastRTP = rtp
+	}
+	ingest.extended += int64(int32(rtp - ingest.lastRTP))
+	ingest.lastRTP = rtp
+	return ingest.anchor + uint32(ingest.extended*1000/int64(ingest.Media.ClockRate))
+}
+
+func (publisher *Publisher) receive(ingest *Ingest, data []byte) {
+	packet, err := ParsePacket(data)
+	if err != nil || packet.PayloadType != ingest.Media.PayloadType {
+		return
+	}
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	publisher.lastSeen = time.Now()
+	if !publisher.recording || publisher.ended {
+		return
+	}
+	if ingest == publisher.Video {
+		for _, unit := range ingest.h264.Push(packet) {
+			publisher.video(unit)
+		}
+		return
+	}
+	frames := ingest.aac.Push(packet)
+	if len(frames) == 0 || !publisher.published {
+		return
+	}
+	t := publisher.time(ingest, packet.Timestamp)
+	for i, frame := range frames {
+		offset := uint32(i * AAC_FRAME_SIZE * 1000 / int(ingest.Media.ClockRate))
+		publisher.Stream.ReceiveAudio(core.NewAudioData(t+offset, append([]byte{0xaf, 0x01}, frame...)))
+	}
+}
+
+func (publisher *Publisher) video(unit *AccessUnit) {
+	t := publisher.time(publisher.Video, unit.Time)
+	if unit.Damaged {
+		publisher.waitKey = true
+		return
+	}
+	nalus := [][]byte{}
+	key := false
+	sps, pps := publisher.sps, publisher.pps
+	for _, nalu := range unit.NALUs {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case avc.NALU_SPS:
+			sps = nalu
+		case avc.NALU_PPS:
+			pps = nalu
+		case avc.NALU_AUD:
+		case avc.NALU_IDR:
+			key = true
+			nalus = append(nalus, nalu)
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	if sps == nil || pps == nil {
+		return
+	}
+	if !bytes.Equal(sps, publisher.sps) || !bytes.Equal(pps, publisher.pps) {
+		publisher.configure(t, sps, pps)
+	}
+	if publisher.waitKey {
+		if !key {
+			return
+		}
+		publisher.waitKey = false
+	}
+	if len(nalus) == 0 {
+		return
+	}
+	header := byte(0x27)
+	if key {
+		header = 0x17
+	}
+	publisher.Stream.ReceiveVideo(core.NewVideoData(t, append([]byte{header, 1, 0, 0, 0}, avc.JoinNALUs(nalus)...)))
+}
+
+// source returns the ingest an UDP address sends RTCP or RTP from.
+func (publisher *Publisher) source(addr *net.UDPAddr) (rtcp *Ingest, rtp *Ingest) {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	for _, ingest := range publisher.ingests() {
+		if ingest.Addr == nil || !ingest.Addr.IP.Equal(addr.IP) {
+			continue
+		}
+		if ingest.Transport.ClientPort[0] == addr.Port {
+			rtp = ingest
+		} else if ingest.Transport.ClientPort[1] == addr.Port {
+			rtcp = ingest
+		}
+	}
+	return
+}
@@ -0,0 +1,244 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+	"videostreamer/binutil"
+)
+
+func Packet(pt uint8, marker bool, seq uint16, ts uint32, ssrc uint32, payload []byte) []byte {
+	packet := make([]byte, 12+len(payload))
+	packet[0] = RTP_VERSION << 6
+	packet[1] = pt & 0x7f
+	if marker {
+		packet[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	binary.BigEndian.PutUint32(packet[4:], ts)
+	binary.BigEndian.PutUint32(packet[8:], ssrc)
+	copy(packet[12:], payload)
+	return packet
+}
+
+func PacketizeH264(nalus [][]byte, mtu int) (payloads [][]byte) {
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		if len(nalu) <= mtu {
+			payloads = append(payloads, nalu)
+			continue
+		}
+		indicator := nalu[0]&0xe0 | 28
+		kind := nalu[0] & 0x1f
+		data := nalu[1:]
+		for start := true; len(data) > 0; start = false {
+			n := mtu - 2
+			if n > len(data) {
+				n = len(data)
+			}
+			header := kind
+			if start {
+				header |= 0x80
+			}
+			if n == len(data) {
+				header |= 0x40
+			}
+			payloads = append(payloads, append([]byte{indicator, header}, data[:n]...))
+			data = data[n:]
+		}
+	}
+	return
+}
+
+func PacketizeAAC(frame []byte, mtu int) (payloads [][]byte) {
+	header := []byte{0x00, 0x10, byte(len(frame) >> 5), byte(len(frame) << 3)}
+	for data := frame; ; {
+		n := mtu - len(header)
+		if n > len(data) {
+			n = len(data)
+		}
+		payloads = append(payloads, append(append([]byte{}, header...), data[:n]...))
+		if data = data[n:]; len(data) == 0 {
+			return
+		}
+	}
+}
+
+func NTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() + NTP_OFFSET)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+func SenderReport(ssrc uint32, ntp uint64, rtp uint32, packets uint32, octets uint32) []byte {
+	report := make([]byte, 28)
+	report[0] = RTP_VERSION << 6
+	report[1] = RTCP_SR
+	binary.BigEndian.PutUint16(report[2:], 6)
+	binary.BigEndian.PutUint32(report[4:], ssrc)
+	binary.BigEndian.PutUint64(report[8:], ntp)
+	binary.BigEndian.PutUint32(report[16:], rtp)
+	binary.BigEndian.PutUint32(report[20:], packets)
+	binary.BigEndian.PutUint32(report[24:], octets)
+	return report
+}
+
+func Goodbye(ssrc uint32) []byte {
+	bye := make([]byte, 8)
+	bye[0] = RTP_VERSION<<6 | 1
+	bye[1] = RTCP_BYE
+	binary.BigEndian.PutUint16(bye[2:], 1)
+	binary.BigEndian.PutUint32(bye[4:], ssrc)
+	return bye
+}
+
+func PictureLoss(sender uint32, media uint32) []byte {
+	pli := make([]byte, 12)
+	pli[0] = RTP_VERSION<<6 | 1
+	pli[1] = RTCP_PSFB
+	binary.BigEndian.PutUint16(pli[2:], 2)
+	binary.BigEndian.PutUint32(pli[4:], sender)
+	binary.BigEndian.PutUint32(pli[8:], media)
+	return pli
+}
+
+func ParsePacket(data []byte) (*RTPPacket, error) {
+	if len(data) < 12 || data[0]>>6 != RTP_VERSION {
+		return nil, errors.New("Not an RTP packet")
+	}
+	header := 12 + 4*int(data[0]&0x0f)
+	if data[0]&0x10 != 0 {
+		if len(data) < header+4 {
+			return nil, errors.New("RTP extension truncated")
+		}
+		header += 4 + 4*int(binary.BigEndian.Uint16(data[header+2:]))
+	}
+	end := len(data)
+	if data[0]&0x20 != 0 && end > 0 {
+		end -= int(data[end-1])
+	}
+	if header > end {
+		return nil, errors.New("RTP packet truncated")
+	}
+	return &RTPPacket{
+		PayloadType: data[1] & 0x7f,
+		Marker:      data[1]&0x80 != 0,
+		Seq:         binary.BigEndian.Uint16(data[2:]),
+		Timestamp:   binary.BigEndian.Uint32(data[4:]),
+		SSRC:        binary.BigEndian.Uint32(data[8:]),
+		Payload:     data[header:end],
+	}, nil
+}
+
+func (d *H264Depacketizer) Push(packet *RTPPacket) (units []*AccessUnit) {
+	lost := d.started && packet.Seq != d.seq+1
+	if d.started && int16(packet.Seq-d.seq) <= 0 {
+		return
+	}
+	d.started, d.seq = true, packet.Seq
+	if d.unit != nil && d.unit.Time != packet.Timestamp {
+		units = append(units, d.unit)
+		d.unit = nil
+	}
+	if d.unit == nil {
+		d.unit = &AccessUnit{Time: packet.Timestamp}
+	}
+	if lost {
+		d.unit.Damaged = true
+		d.fragment = nil
+	}
+	payload := packet.Payload
+	if len(payload) == 0 {
+		return
+	}
+	switch kind := payload[0] & 0x1f; {
+	case kind >= 1 && kind <= 23:
+		d.unit.NALUs = append(d.unit.NALUs, binutil.Dup(payload))
+	case kind == NALU_STAP_A:
+		for data := payload[1:]; len(data) >= 2; {
+			size := int(binary.BigEndian.Uint16(data))
+			if 2+size > len(data) {
+				d.unit.Damaged = true
+				break
+			}
+			d.unit.NALUs = append(d.unit.NALUs, binutil.Dup(data[2:2+size]))
+			data = data[2+size:]
+		}
+	case kind == NALU_FU_A && len(payload) > 2:
+		if payload[1]&0x80 != 0 {
+			d.fragment = []byte{payload[0]&0xe0 | payload[1]&0x1f}
+		} else if d.fragment == nil {
+			d.unit.Damaged = true
+			break
+		}
+		d.fragment = append(d.fragment, payload[2:]...)
+		if payload[1]&0x40 != 0 {
+			d.unit.NALUs = append(d.unit.NALUs, d.fragment)
+			d.fragment = nil
+		}
+	}
+	if packet.Marker {
+		units = append(units, d.unit)
+		d.unit = nil
+	}
+	return
+}
+
+func readBits(data []byte, pos int, n int) (value int) {
+	for i := pos; i < pos+n; i++ {
+		value = value<<1 | int(data[i/8]>>(7-i%8)&1)
+	}
+	return
+}
+
+// Push returns the AAC frames completed by an RFC 3640 packet, consecutive frames are AAC_FRAME_SIZE samples apart.
+func (d *AACDepacketizer) Push(packet *RTPPacket) (frames [][]byte) {
+	lost := d.started && packet.Seq != d.seq+1
+	if d.started && int16(packet.Seq-d.seq) <= 0 {
+		return
+	}
+	d.started, d.seq = true, packet.Seq
+	if lost {
+		d.fragment = nil
+	}
+	payload := packet.Payload
+	if len(payload) < 2 {
+		return
+	}
+	bits := int(binary.BigEndian.Uint16(payload))
+	if 2+(bits+7)/8 > len(payload) {
+		return
+	}
+	headers, data := payload[2:2+(bits+7)/8], payload[2+(bits+7)/8:]
+	sizes := []int{}
+	for pos := 0; pos+d.SizeLength <= bits; {
+		sizes = append(sizes, readBits(headers, pos, d.SizeLength))
+		pos += d.SizeLength + d.IndexDeltaLength
+		if len(sizes) == 1 {
+			pos += d.IndexLength - d.IndexDeltaLength
+		}
+	}
+	if d.fragment != nil {
+		d.fragment = append(d.fragment, data...)
+		if len(d.fragment) >= d.size || packet.Marker {
+			if len(d.fragment) == d.size {
+				frames = append(frames, d.fragment)
+			}
+			d.fragment = nil
+		}
+		return
+	}
+	for _, size := range sizes {
+		if size > len(data) {
+			if len(sizes) == 1 && !packet.Marker {
+				d.fragment, d.size = binutil.Dup(data), size
+			}
+			return
+		}
+		frames = append(frames, binutil.Dup(data[:size]))
+		data = data[size:]
+	}
+	return
+}
@@ -0,0 +1,158 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/aac"
+	"videostreamer/avc"
+)
+
+func TestPacketizeH264(t *testing.T) {
+	small := []byte{0x67, 1, 2, 3}
+	large := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	payloads := PacketizeH264([][]byte{small, large}, 1400)
+	if len(payloads) != 4 || !bytes.Equal(payloads[0], small) {
+		t.Fatalf("%d payloads", len(payloads))
+	}
+	nalu := []byte{payloads[1][0]&0xe0 | payloads[1][1]&0x1f}
+	for i, payload := range payloads[1:] {
+		if len(payload) > 1400 || payload[0] != 0x60|28 {
+			t.Errorf("fragment %d: %d bytes indicator %x", i, len(payload), payload[0])
+		}
+		if start, end := payload[1]&0x80 != 0, payload[1]&0x40 != 0; start != (i == 0) || end != (i == 2) {
+			t.Errorf("fragment %d header %x", i, payload[1])
+		}
+		nalu = append(nalu, payload[2:]...)
+	}
+	if !bytes.Equal(nalu, large) {
+		t.Error("fragments do not reassemble")
+	}
+}
+
+func TestDepacketizeH264(t *testing.T) {
+	sps := []byte{0x67, 1, 2, 3}
+	large := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	d := &H264Depacketizer{}
+	seq := uint16(65534)
+	push := func(payloads [][]byte, ts uint32) (units []*AccessUnit) {
+		for i, payload := range payloads {
+			packet, err := ParsePacket(Packet(96, i == len(payloads)-1, seq, ts, 1, payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			seq++
+			units = append(units, d.Push(packet)...)
+		}
+		return
+	}
+	units := push(PacketizeH264([][]byte{sps, large}, 1400), 3000)
+	if len(units) != 1 || units[0].Time != 3000 || units[0].Damaged || len(units[0].NALUs) != 2 || !bytes.Equal(units[0].NALUs[1], large) {
+		t.Fatalf("units %+v", units)
+	}
+	stap := []byte{NALU_STAP_A, 0, 4, 0x67, 1, 2, 3, 0, 2, 0x68, 9}
+	if units = push([][]byte{stap, {0x65, 1}}, 6000); len(units) != 1 || len(units[0].NALUs) != 3 || !bytes.Equal(units[0].NALUs[1], []byte{0x68, 9}) {
+		t.Fatalf("STAP-A units %+v", units)
+	}
+	payloads := PacketizeH264([][]byte{large}, 1400)
+	seq++
+	if units = push(payloads[1:], 9000); len(units) != 1 || !units[0].Damaged || len(units[0].NALUs) != 0 {
+		t.Fatalf("lost fragment units %+v", units)
+	}
+	if units = push([][]byte{{0x41, 1}}, 12000); len(units) != 1 || units[0].Damaged {
+		t.Fatalf("recovered units %+v", units)
+	}
+	padded := Packet(96, true, seq, 15000, 1, []byte{0x41, 2, 0, 0, 3})
+	padded[0] |= 0x20
+	if packet, err := ParsePacket(padded); err != nil || !bytes.Equal(packet.Payload, []byte{0x41, 2}) {
+		t.Errorf("padded payload %x: %v", packet.Payload, err)
+	}
+}
+
+func TestPacketizeAAC(t *testing.T) {
+	frame := bytes.Repeat([]byte{0x21}, 371)
+	payloads := PacketizeAAC(frame, 1400)
+	if len(payloads) != 1 || !bytes.Equal(payloads[0][:4], []byte{0x00, 0x10, 0x0b, 0x98}) || !bytes.Equal(payloads[0][4:], frame) {
+		t.Errorf("payload %x", payloads[0][:4])
+	}
+	if payloads = PacketizeAAC(bytes.Repeat([]byte{0x21}, 2000), 1400); len(payloads) != 2 || len(payloads[0]) != 1400 || len(payloads[1]) != 4+2000-1396 {
+		t.Errorf("%d fragments", len(payloads))
+	}
+}
+
+func TestDepacketizeAAC(t *testing.T) {
+	d := &AACDepacketizer{SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3}
+	seq := uint16(1)
+	push := func(payloads [][]byte) (frames [][]byte) {
+		for i, payload := range payloads {
+			packet, err := ParsePacket(Packet(97, i == len(payloads)-1, seq, 1024, 1, payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			seq++
+			frames = append(frames, d.Push(packet)...)
+		}
+		return
+	}
+	if frames := push([][]byte{{0x00, 0x20, 0x00, 0x10, 0x00, 0x18, 0x21, 0x22, 0x31, 0x32, 0x33}}); len(frames) != 2 || !bytes.Equal(frames[1], []byte{0x31, 0x32, 0x33}) {
+		t.Errorf("frames %x", frames)
+	}
+	large := bytes.Repeat([]byte{0x21}, 2000)
+	if frames := push(PacketizeAAC(large, 1400)); len(frames) != 1 || !bytes.Equal(frames[0], large) {
+		t.Errorf("%d reassembled frames", len(frames))
+	}
+	payloads := PacketizeAAC(large, 1400)
+	seq++
+	if frames := push(payloads[1:]); len(frames) != 0 {
+		t.Errorf("%d frames from lost fragment", len(frames))
+	}
+}
+
+func TestSenderReport(t *testing.T) {
+	wall := time.Unix(1, 500000000)
+	report := SenderReport(0xdeadbeef, NTP(wall), 90000, 10, 1000)
+	if report[1] != RTCP_SR || binary.BigEndian.Uint16(report[2:]) != 6 || binary.BigEndian.Uint32(report[4:]) != 0xdeadbeef {
+		t.Errorf("header %x", report[:8])
+	}
+	if binary.BigEndian.Uint32(report[8:]) != NTP_OFFSET+1 || binary.BigEndian.Uint32(report[12:]) != 1<<31 {
+		t.Errorf("NTP %x", report[8:16])
+	}
+	if binary.BigEndian.Uint32(report[16:]) != 90000 || binary.BigEndian.Uint32(report[20:]) != 10 || binary.BigEndian.Uint32(report[24:]) != 1000 {
+		t.Errorf("counters %x", report[16:])
+	}
+}
+
+func TestSDP(t *testing.T) {
+	video, _ := avc.ParseConfig(avc.MakeConfig([][]byte{{0x67, 0x64, 0x00, 0x1e}}, [][]byte{{0x68, 0xeb}}))
+	asc := aac.MakeConfig(2, 44100, 2)
+	audio, _ := aac.ParseConfig(asc)
+	sdp := MakeSDP("cam", video, audio, asc)
+	for _, want := range []string{
+		"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n",
+		"packetization-mode=1;profile-level-id=64001E;sprop-parameter-sets=Z2QAHg==,aOs=\r\n",
+		"a=control:trackID=0\r\n",
+		"a=rtpmap:97 MPEG4-GENERIC/44100/2\r\n",
+		"mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=1210\r\n",
+		"a=control:trackID=1\r\n",
+	} {
+		if !strings.Contains(sdp, want) {
+			t.Errorf("SDP lacks %q:\n%s", want, sdp)
+		}
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	transport, err := ParseTransport("RTP/AVP/TCP;unicast;interleaved=2-3")
+	if err != nil || !transport.TCP || transport.Interleaved != [2]int{2, 3} {
+		t.Errorf("%+v %v", transport, err)
+	}
+	transport, err = ParseTransport("RTP/AVP;multicast,RTP/AVP;unicast;client_port=5000-5001")
+	if err != nil || transport.TCP || transport.ClientPort != [2]int{5000, 5001} {
+		t.Errorf("%+v %v", transport, err)
+	}
+	if _, err = ParseTransport("RTP/SAVP;unicast;client_port=5000-5001"); err == nil {
+		t.Error("accepted SAVP")
+	}
+}
@@ -0,0 +1,129 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"videostreamer/aac"
+	"videostreamer/avc"
+)
+
+func MakeSDP(name string, video *avc.Config, audio *aac.Config, asc []byte) string {
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "v=0\r\no=- %d 1 IN IP4 0.0.0.0\r\ns=%s\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\na=control:*\r\na=range:npt=now-\r\n", time.Now().Unix(), name)
+	if video != nil {
+		sets := []string{}
+		for _, nalu := range append(append([][]byte{}, video.SPS...), video.PPS...) {
+			sets = append(sets, base64.StdEncoding.EncodeToString(nalu))
+		}
+		fmt.Fprintf(&buf, "m=video 0 RTP/AVP %d\r\na=rtpmap:%d H264/%d\r\n", PAYLOAD_H264, PAYLOAD_H264, VIDEO_CLOCK)
+		fmt.Fprintf(&buf, "a=fmtp:%d packetization-mode=1;profile-level-id=%02X%02X%02X;sprop-parameter-sets=%s\r\n",
+			PAYLOAD_H264, video.Profile, video.Compatibility, video.Level, strings.Join(sets, ","))
+		fmt.Fprintf(&buf, "a=control:trackID=%d\r\n", TRACK_VIDEO)
+	}
+	if audio != nil {
+		fmt.Fprintf(&buf, "m=audio 0 RTP/AVP %d\r\na=rtpmap:%d MPEG4-GENERIC/%d/%d\r\n", PAYLOAD_AAC, PAYLOAD_AAC, audio.SampleRate, audio.Channels)
+		fmt.Fprintf(&buf, "a=fmtp:%d streamtype=5;profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%s\r\n",
+			PAYLOAD_AAC, hex.EncodeToString(asc))
+		fmt.Fprintf(&buf, "a=control:trackID=%d\r\n", TRACK_AUDIO)
+	}
+	return buf.String()
+}
+
+// ParseSDP returns the H.264 and AAC media announced by a publisher.
+func ParseSDP(body string) (media []*Announced) {
+	var current *Announced
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "m="):
+			current = nil
+			fields := strings.Fields(line[2:])
+			if len(fields) < 4 || (fields[0] != "video" && fields[0] != "audio") {
+				continue
+			}
+			pt, err := strconv.Atoi(fields[3])
+			if err != nil || pt < 0 || pt > 127 {
+				continue
+			}
+			current = &Announced{PayloadType: uint8(pt), Params: make(map[string]string)}
+			media = append(media, current)
+		case current == nil:
+		case strings.HasPrefix(line, "a=control:"):
+			current.Control = strings.TrimSpace(line[len("a=control:"):])
+		case strings.HasPrefix(line, "a=rtpmap:"), strings.HasPrefix(line, "a=fmtp:"):
+			key, value, _ := strings.Cut(line[2:], ":")
+			pt, rest, _ := strings.Cut(value, " ")
+			if pt != strconv.Itoa(int(current.PayloadType)) {
+				continue
+			}
+			if key == "fmtp" {
+				for _, param := range strings.Split(rest, ";") {
+					name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+					current.Params[strings.ToLower(name)] = value
+				}
+				continue
+			}
+			parts := strings.Split(strings.TrimSpace(rest), "/")
+			current.Codec = strings.ToUpper(parts[0])
+			if len(parts) > 1 {
+				clock, _ := strconv.Atoi(parts[1])
+				current.ClockRate = uint32(clock)
+			}
+			current.Channels = 1
+			if len(parts) > 2 {
+				current.Channels, _ = strconv.Atoi(parts[2])
+			}
+		}
+	}
+	supported := media[:0]
+	for _, m := range media {
+		if (m.Codec == "H264" || m.Codec == "MPEG4-GENERIC") && m.ClockRate > 0 {
+			supported = append(supported, m)
+		}
+	}
+	return supported
+}
+
+// SpropParameterSets decodes the SPS and PPS announced for an H.264 track.
+func (media *Announced) SpropParameterSets() (sps []byte, pps []byte) {
+	for _, set := range strings.Split(media.Params["sprop-parameter-sets"], ",") {
+		nalu, err := base64.StdEncoding.DecodeString(set)
+		if err != nil || len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case avc.NALU_SPS:
+			sps = nalu
+		case avc.NALU_PPS:
+			pps = nalu
+		}
+	}
+	return
+}
+
+// Depacketizer builds the RFC 3640 depacketizer of an AAC track, nil unless AU headers are announced.
+func (media *Announced) Depacketizer() *AACDepacketizer {
+	param := func(name string) int {
+		n, _ := strconv.Atoi(media.Params[name])
+		return n
+	}
+	d := &AACDepacketizer{SizeLength: param("sizelength"), IndexLength: param("indexlength"), IndexDeltaLength: param("indexdeltalength")}
+	if d.SizeLength <= 0 || d.SizeLength > 16 || d.IndexLength > 8 || d.IndexDeltaLength > 8 {
+		return nil
+	}
+	return d
+}
+
+// Config returns the AudioSpecificConfig announced for an AAC track.
+func (media *Announced) Config() []byte {
+	asc, err := hex.DecodeString(media.Params["config"])
+	if err != nil || len(asc) < 2 {
+		return nil
+	}
+	return asc
+}
@@ -0,0 +1,427 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"videostreamer/check"
+	"videostreamer/core"
+	"videostreamer/logger"
+	"videostreamer/syncutil"
+)
+
+const METHODS = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER, ANNOUNCE, RECORD"
+
+func NewConfig() *Config {
+	return &Config{
+		Timeout:         DEFAULT_TIMEOUT,
+		RTPPort:         DEFAULT_RTP_PORT,
+		DescribeTimeout: DESCRIBE_TIMEOUT,
+	}
+}
+
+func NewServer(app *core.Application, config *Config) *Server {
+	return &Server{
+		App:        app,
+		Config:     config,
+		sessions:   make(map[string]*Session),
+		publishers: make(map[string]*Publisher),
+	}
+}
+
+func Serve(app *core.Application, latch *syncutil.SyncLatch, addr string, config *Config) {
+	ln := check.Check1(net.Listen("tcp", addr)).(net.Listener)
+	NewServer(app, config).ServeListener(latch, ln)
+}
+
+func (server *Server) ServeListener(latch *syncutil.SyncLatch, ln net.Listener) {
+	logger.Info("RTSP server started")
+	latch.Handle(func() {
+		ln.Close()
+	})
+	if server.Config.RTPPort > 0 {
+		if err := server.listenUDP(ln.Addr().(*net.TCPAddr).IP); err != nil {
+			logger.Warnf("RTSP over UDP disabled: %v", err)
+		} else {
+			latch.Handle(func() {
+				server.rtp.Close()
+				server.rtcp.Close()
+			})
+		}
+	}
+	go server.reap(latch)
+	for latch.IsRunning() {
+		conn, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		go server.connection(latch.SubLatch(), conn)
+	}
+
+	latch.Await()
+	latch.Complete()
+	logger.Info("RTSP server done")
+}
+
+func (server *Server) listenUDP(ip net.IP) (err error) {
+	if server.rtp, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: server.Config.RTPPort}); err != nil {
+		return
+	}
+	if server.rtcp, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: server.Config.RTPPort + 1}); err != nil {
+		server.rtp.Close()
+		server.rtp = nil
+		return
+	}
+	go server.receiveReports()
+	go server.receiveRTP()
+	return
+}
+
+func (server *Server) receiveReports() {
+	buf := make([]byte, 1500)
+	for {
+		_, addr, err := server.rtcp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		for _, session := range server.list() {
+			for _, track := range session.tracks() {
+				if track != nil && track.ControlAddr != nil && track.ControlAddr.IP.Equal(addr.IP) && track.ControlAddr.Port == addr.Port {
+					session.touch()
+				}
+			}
+		}
+		for _, publisher := range server.listPublishers() {
+			if ingest, _ := publisher.source(addr); ingest != nil {
+				publisher.touch()
+			}
+		}
+	}
+}
+
+func (server *Server) receiveRTP() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := server.rtp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		for _, publisher := range server.listPublishers() {
+			if _, ingest := publisher.source(addr); ingest != nil {
+				publisher.receive(ingest, buf[:n])
+			}
+		}
+	}
+}
+
+func (server *Server) reap(latch *syncutil.SyncLatch) {
+	tick := server.Config.Timeout / 4
+	if tick < time.Second {
+		tick = time.Second
+	}
+	for latch.IsRunning() {
+		time.Sleep(tick)
+		for _, session := range server.list() {
+			if session.expired(server.Config.Timeout) {
+				logger.Infof("RTSP session %s of %s timed out", session.ID, session.Stream.Name)
+				session.close()
+			}
+		}
+		for _, publisher := range server.listPublishers() {
+			if publisher.expired(server.Config.Timeout) {
+				logger.Infof("RTSP publisher %s of %s timed out", publisher.ID, publisher.Stream.Name)
+				publisher.close()
+			}
+		}
+	}
+}
+
+func (server *Server) list() (sessions []*Session) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, session := range server.sessions {
+		sessions = append(sessions, session)
+	}
+	return
+}
+
+func (server *Server) add(session *Session) {
+	server.mutex.Lock()
+	server.sessions[session.ID] = session
+	server.mutex.Unlock()
+}
+
+func (server *Server) remove(session *Session) {
+	server.mutex.Lock()
+	delete(server.sessions, session.ID)
+	server.mutex.Unlock()
+}
+
+func (server *Server) session(request *Request) *Session {
+	id := strings.TrimSpace(strings.SplitN(request.Header.Get("Session"), ";", 2)[0])
+	server.mutex.Lock()
+	session := server.sessions[id]
+	server.mutex.Unlock()
+	if session != nil {
+		session.touch()
+	}
+	return session
+}
+
+func (server *Server) connection(latch *syncutil.SyncLatch, netconn net.Conn) {
+	latch.Handle(func() {
+		netconn.Close()
+	})
+	conn := &Conn{Conn: netconn, server: server, reader: bufio.NewReader(netconn)}
+	defer func() {
+		for _, session := range server.list() {
+			if session.conn == conn && session.interleaved() {
+				session.close()
+			}
+		}
+		for _, publisher := range server.listPublishers() {
+			if publisher.conn == conn && (publisher.interleaved() || !publisher.recording) {
+				publisher.close()
+			}
+		}
+		latch.Complete()
+	}()
+	logger.Infof("RTSP client %s connected", netconn.RemoteAddr())
+	for {
+		head, err := conn.reader.Peek(1)
+		if err != nil {
+			break
+		}
+		if head[0] == '$' {
+			if err = conn.readInterleaved(); err != nil {
+				break
+			}
+			continue
+		}
+		request, err := ReadRequest(conn.reader)
+		if err != nil {
+			if err != io.EOF {
+				logger.Infof("RTSP client %s sent bad request: %v", netconn.RemoteAddr(), err)
+			}
+			break
+		}
+		response, after := server.handle(conn, request)
+		response.Header["CSeq"] = request.Header.Get("CSeq")
+		conn.mutex.Lock()
+		netconn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+		err = response.Write(netconn)
+		conn.mutex.Unlock()
+		if err != nil {
+			break
+		}
+		if after != nil {
+			after()
+		}
+	}
+	logger.Infof("RTSP client %s disconnected", netconn.RemoteAddr())
+}
+
+func (conn *Conn) readInterleaved() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn.reader, header); err != nil {
+		return err
+	}
+	data := make([]byte, int(header[2])<<8|int(header[3]))
+	if _, err := io.ReadFull(conn.reader, data); err != nil {
+		return err
+	}
+	if publisher := conn.announced; publisher != nil {
+		ingest, rtcp := publisher.channel(int(header[1]))
+		if ingest != nil {
+			publisher.receive(ingest, data)
+		} else if rtcp {
+			publisher.touch()
+		}
+	}
+	for _, session := range conn.server.list() {
+		if session.conn == conn {
+			session.touch()
+		}
+	}
+	return nil
+}
+
+func (conn *Conn) interleave(channel int, data []byte) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.Conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	if _, err := conn.Conn.Write([]byte{'$', byte(channel), byte(len(data) >> 8), byte(len(data))}); err != nil {
+		return err
+	}
+	_, err := conn.Conn.Write(data)
+	return err
+}
+
+func ParsePath(path string) (name string, control string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	if len(parts) == 3 {
+		control = parts[2]
+	}
+	return parts[1], control, true
+}
+
+func baseURL(request *Request) string {
+	u := *request.URL
+	u.RawQuery = ""
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+func (server *Server) handle(conn *Conn, request *Request) (*Response, func()) {
+	switch request.Method {
+	case "OPTIONS":
+		response := NewResponse(200)
+		response.Header["Public"] = METHODS
+		return response, nil
+	case "DESCRIBE":
+		return server.describe(request), nil
+	case "SETUP":
+		return server.setup(conn, request), nil
+	case "PLAY":
+		return server.play(request)
+	case "TEARDOWN":
+		if session := server.session(request); session != nil {
+			session.close()
+		} else if publisher := server.publisher(conn, request); publisher != nil {
+			publisher.close()
+		}
+		return NewResponse(200), nil
+	case "GET_PARAMETER", "SET_PARAMETER":
+		if server.session(request) == nil {
+			server.publisher(conn, request)
+		}
+		return NewResponse(200), nil
+	case "ANNOUNCE":
+		return server.announce(conn, request), nil
+	case "RECORD":
+		return server.record(conn, request)
+	}
+	response := NewResponse(501)
+	response.Header["Public"] = METHODS
+	return response, nil
+}
+
+type probe struct {
+	once  sync.Once
+	ready chan struct{}
+}
+
+func (p *probe) ConsumeVideo(data *core.VideoData) {
+	if len(data.Data) > 1 && data.Data[1] == 1 {
+		p.once.Do(func() { close(p.ready) })
+	}
+}
+
+func (p *probe) ConsumeAudio(data *core.AudioData) {
+	if len(data.Data) > 1 && data.Data[1] == 1 {
+		p.once.Do(func() { close(p.ready) })
+	}
+}
+
+func (p *probe) ConsumeMeta(data *core.MetaData) {}
+func (p *probe) Publish()                        {}
+func (p *probe) Unpublish()                      {}
+
+func (server *Server) describe(request *Request) *Response {
+	name, control, ok := ParsePath(request.URL.Path)
+	if !ok || control != "" {
+		return NewResponse(404)
+	}
+	stream := server.App.AcquireStream(name)
+	if _, video, audio := stream.Keys(); !stream.IsPublished() || video == nil || audio == nil {
+		p := &probe{ready: make(chan struct{})}
+		stream.Subscribe(p)
+		select {
+		case <-p.ready:
+		case <-time.After(server.Config.DescribeTimeout):
+		}
+		stream.Unsubscribe(p)
+	}
+	video, audio, asc := streamConfig(stream)
+	if !stream.IsPublished() || (video == nil && audio == nil) {
+		return NewResponse(404)
+	}
+	response := NewResponse(200)
+	response.Header["Content-Type"] = "application/sdp"
+	response.Header["Content-Base"] = baseURL(request) + "/"
+	response.Body = []byte(MakeSDP(name, video, audio, asc))
+	return response
+}
+
+func (server *Server) setup(conn *Conn, request *Request) *Response {
+	name, control, ok := ParsePath(request.URL.Path)
+	if ok && server.session(request) == nil {
+		if publisher := server.publisher(conn, request); publisher != nil {
+			return server.setupRecord(conn, publisher, request)
+		}
+	}
+	if !ok || !strings.HasPrefix(control, "trackID=") {
+		return NewResponse(404)
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(control, "trackID="))
+	if err != nil || (id != TRACK_VIDEO && id != TRACK_AUDIO) {
+		return NewResponse(404)
+	}
+	transport, err := ParseTransport(request.Header.Get("Transport"))
+	if err != nil || (!transport.TCP && server.rtp == nil) {
+		return NewResponse(461)
+	}
+	session := server.session(request)
+	if request.Header.Get("Session") != "" {
+		if session == nil {
+			return NewResponse(454)
+		}
+		if session.Stream.Name != name || session.playing {
+			return NewResponse(455)
+		}
+	} else {
+		session = newSession(server, conn, server.App.AcquireStream(name))
+	}
+	if (id == TRACK_VIDEO && session.Video == nil) || (id == TRACK_AUDIO && session.Audio == nil) {
+		return NewResponse(404)
+	}
+	track := session.setup(id, transport, conn.Conn.RemoteAddr().(*net.TCPAddr).IP)
+	server.add(session)
+
+	response := NewResponse(200)
+	response.Header["Session"] = fmt.Sprintf("%s;timeout=%d", session.ID, int(server.Config.Timeout/time.Second))
+	if transport.TCP {
+		response.Header["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", transport.Interleaved[0], transport.Interleaved[1], track.SSRC)
+	} else {
+		response.Header["Transport"] = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=%08X",
+			transport.ClientPort[0], transport.ClientPort[1], server.Config.RTPPort, server.Config.RTPPort+1, track.SSRC)
+	}
+	return response
+}
+
+func (server *Server) play(request *Request) (*Response, func()) {
+	session := server.session(request)
+	if session == nil {
+		return NewResponse(454), nil
+	}
+	base := baseURL(request)
+	if _, control, _ := ParsePath(request.URL.Path); control != "" {
+		base = strings.TrimSuffix(base, "/"+control)
+	}
+	infos := session.rtpInfo(base)
+	if len(infos) == 0 {
+		return NewResponse(455), nil
+	}
+	response := NewResponse(200)
+	response.Header["Session"] = session.ID
+	response.Header["Range"] = "npt=0.000-"
+	response.Header["RTP-Info"] = strings.Join(infos, ",")
+	return response, session.play
+}
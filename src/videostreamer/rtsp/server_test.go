@@ -0,0 +1,358 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/testutil"
+)
+
+var idr = append([]byte{0x17, 0x01, 0x00, 0x00, 0x00}, avc.JoinNALUs([][]byte{{0x65, 0x88, 0x84}})...)
+
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	cseq   int
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &client{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *client) do(method string, url string, headers ...string) *Response {
+	c.cseq++
+	fmt.Fprintf(c.conn, "%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.cseq)
+	for _, header := range headers {
+		fmt.Fprintf(c.conn, "%s\r\n", header)
+	}
+	fmt.Fprint(c.conn, "\r\n")
+	for {
+		if head, err := c.reader.Peek(1); err == nil && head[0] == '$' {
+			c.frame()
+			continue
+		}
+		response, err := ReadResponse(c.reader)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if response.Header["Cseq"] != fmt.Sprint(c.cseq) {
+			c.t.Errorf("CSeq %q instead of %d", response.Header["Cseq"], c.cseq)
+		}
+		return response
+	}
+}
+
+func (c *client) frame() (channel byte, data []byte) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, header); err != nil || header[0] != '$' {
+		c.t.Fatalf("bad interleaved header %x: %v", header, err)
+	}
+	data = make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		c.t.Fatal(err)
+	}
+	return header[1], data
+}
+
+func publish(app *core.Application) *core.Stream {
+	stream := app.AcquireStream("cam")
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	stream.ReceiveAudio(core.NewAudioData(0, testutil.AudioSeq))
+	return stream
+}
+
+func TestPlayInterleaved(t *testing.T) {
+	app := core.NewApplication()
+	stream := publish(app)
+	config := NewConfig()
+	config.RTPPort = 0
+	config.DescribeTimeout = 200 * time.Millisecond
+	addr, stop := testutil.Serve(t, NewServer(app, config).ServeListener)
+	defer stop()
+	c := dial(t, addr)
+	defer c.conn.Close()
+	url := "rtsp://" + addr + "/live/cam"
+
+	if response := c.do("OPTIONS", url); response.Status != 200 || !strings.Contains(response.Header["Public"], "DESCRIBE") {
+		t.Errorf("OPTIONS %+v", response)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		stream.ReceiveAudio(core.NewAudioData(0, []byte{0xaf, 0x01, 0x21}))
+	}()
+	response := c.do("DESCRIBE", url, "Accept: application/sdp")
+	if response.Status != 200 || response.Header["Content-Base"] != url+"/" || !strings.Contains(string(response.Body), "sprop-parameter-sets=") {
+		t.Fatalf("DESCRIBE %+v\n%s", response, response.Body)
+	}
+	if response = c.do("DESCRIBE", "rtsp://"+addr+"/live/missing"); response.Status != 404 {
+		t.Errorf("DESCRIBE of missing stream %d", response.Status)
+	}
+
+	response = c.do("SETUP", url+"/trackID=0", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+	if response.Status != 200 || !strings.HasPrefix(response.Header["Transport"], "RTP/AVP/TCP;unicast;interleaved=0-1;ssrc=") {
+		t.Fatalf("SETUP %+v", response)
+	}
+	session := strings.SplitN(response.Header["Session"], ";", 2)[0]
+	if response = c.do("SETUP", url+"/trackID=1", "Transport: RTP/AVP/TCP;unicast;interleaved=2-3", "Session: "+session); response.Status != 200 {
+		t.Fatalf("second SETUP %+v", response)
+	}
+	if response = c.do("PLAY", url+"/", "Session: nope"); response.Status != 454 {
+		t.Errorf("PLAY of unknown session %d", response.Status)
+	}
+	response = c.do("PLAY", url+"/", "Session: "+session)
+	if response.Status != 200 || !strings.Contains(response.Header["Rtp-Info"], "url="+url+"/trackID=0;seq=") {
+		t.Fatalf("PLAY %+v", response)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); stream.Subscribers() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("player never subscribed")
+		}
+	}
+	stream.ReceiveVideo(core.NewVideoData(40, []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9a}))
+	stream.ReceiveVideo(core.NewVideoData(80, idr))
+	stream.ReceiveAudio(core.NewAudioData(80, []byte{0xaf, 0x01, 0x21}))
+
+	var ts uint32
+	for i, want := range [][]byte{testutil.SPS, testutil.PPS, {0x65, 0x88, 0x84}} {
+		channel, packet := c.frame()
+		if channel != 0 || packet[0] != 0x80 || packet[1]&0x7f != PAYLOAD_H264 || !bytes.Equal(packet[12:], want) {
+			t.Errorf("video packet %d on channel %d: %x", i, channel, packet)
+		}
+		if marker := packet[1]&0x80 != 0; marker != (i == 2) {
+			t.Errorf("video packet %d marker %v", i, marker)
+		}
+		ts = binary.BigEndian.Uint32(packet[4:])
+	}
+	channel, packet := c.frame()
+	if channel != 2 || packet[1] != 0x80|PAYLOAD_AAC || !bytes.Equal(packet[12:], []byte{0x00, 0x10, 0x00, 0x08, 0x21}) {
+		t.Errorf("audio packet on channel %d: %x", channel, packet)
+	}
+	if !strings.Contains(response.Header["Rtp-Info"], fmt.Sprintf("rtptime=%d", ts)) {
+		t.Errorf("first video timestamp %d not announced in %s", ts, response.Header["Rtp-Info"])
+	}
+
+	if response = c.do("TEARDOWN", url, "Session: "+session); response.Status != 200 {
+		t.Errorf("TEARDOWN %d", response.Status)
+	}
+	for deadline := time.Now().Add(5 * time.Second); stream.Subscribers() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("player never unsubscribed")
+		}
+	}
+}
+
+func TestPlayUDP(t *testing.T) {
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	player, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	playerPort := player.LocalAddr().(*net.UDPAddr).Port
+
+	app := core.NewApplication()
+	stream := publish(app)
+	config := NewConfig()
+	config.RTPPort = port
+	addr, stop := testutil.Serve(t, NewServer(app, config).ServeListener)
+	defer stop()
+	c := dial(t, addr)
+	defer c.conn.Close()
+	url := "rtsp://" + addr + "/live/cam"
+
+	response := c.do("SETUP", url+"/trackID=1", fmt.Sprintf("Transport: RTP/AVP;unicast;client_port=%d-%d", playerPort, playerPort+1))
+	want := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=", playerPort, playerPort+1, port, port+1)
+	if response.Status != 200 || !strings.HasPrefix(response.Header["Transport"], want) {
+		t.Fatalf("SETUP %+v", response)
+	}
+	session := strings.SplitN(response.Header["Session"], ";", 2)[0]
+	if response = c.do("PLAY", url, "Session: "+session); response.Status != 200 {
+		t.Fatalf("PLAY %+v", response)
+	}
+	for deadline := time.Now().Add(5 * time.Second); stream.Subscribers() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("player never subscribed")
+		}
+	}
+	stream.ReceiveAudio(core.NewAudioData(80, []byte{0xaf, 0x01, 0x21}))
+
+	player.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := player.ReadFromUDP(buf)
+	if err != nil || from.Port != port || !bytes.Equal(buf[12:n], []byte{0x00, 0x10, 0x00, 0x08, 0x21}) {
+		t.Errorf("RTP from %v: %x %v", from, buf[:n], err)
+	}
+}
+
+func announcement(url string) string {
+	return "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=cam\r\nt=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1;sprop-parameter-sets=" + base64.StdEncoding.EncodeToString(testutil.SPS) + "," + base64.StdEncoding.EncodeToString(testutil.PPS) + "\r\n" +
+		"a=control:" + url + "/streamid=0\r\n" +
+		"m=audio 0 RTP/AVP 97\r\na=rtpmap:97 MPEG4-GENERIC/44100/2\r\n" +
+		"a=fmtp:97 profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=1210\r\n" +
+		"a=control:streamid=1\r\n"
+}
+
+func (c *client) announce(url string) *Response {
+	body := announcement(url)
+	c.cseq++
+	fmt.Fprintf(c.conn, "ANNOUNCE %s RTSP/1.0\r\nCSeq: %d\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", url, c.cseq, len(body), body)
+	response, err := ReadResponse(c.reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return response
+}
+
+func (c *client) interleave(channel byte, packet []byte) {
+	c.conn.Write(append([]byte{'$', channel, byte(len(packet) >> 8), byte(len(packet))}, packet...))
+}
+
+func TestRecordInterleaved(t *testing.T) {
+	app := core.NewApplication()
+	stream := app.AcquireStream("cam")
+	record := testutil.NewRecorder()
+	stream.Subscribe(record)
+	config := NewConfig()
+	config.RTPPort = 0
+	addr, stop := testutil.Serve(t, NewServer(app, config).ServeListener)
+	defer stop()
+	c := dial(t, addr)
+	defer c.conn.Close()
+	url := "rtsp://" + addr + "/live/cam"
+
+	if response := c.announce(url); response.Status != 200 {
+		t.Fatalf("ANNOUNCE %+v", response)
+	}
+	other := dial(t, addr)
+	defer other.conn.Close()
+	if response := other.announce(url); response.Status != 409 {
+		t.Errorf("second ANNOUNCE %d", response.Status)
+	}
+	response := c.do("SETUP", url+"/streamid=0", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1;mode=record")
+	if response.Status != 200 || response.Header["Transport"] != "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record" {
+		t.Fatalf("SETUP %+v", response)
+	}
+	session := strings.SplitN(response.Header["Session"], ";", 2)[0]
+	if response = c.do("SETUP", url+"/streamid=1", "Transport: RTP/AVP/TCP;unicast;interleaved=2-3;mode=record", "Session: "+session); response.Status != 200 {
+		t.Fatalf("second SETUP %+v", response)
+	}
+	if response = c.do("RECORD", url, "Session: "+session); response.Status != 200 {
+		t.Fatalf("RECORD %+v", response)
+	}
+
+	record.ExpectState(t, true)
+	if data := record.NextAudio(t); !bytes.Equal(data.Data, testutil.AudioSeq) {
+		t.Errorf("audio sequence header %x", data.Data)
+	}
+	if data := record.NextVideo(t); !bytes.Equal(data.Data, testutil.Seq) {
+		t.Errorf("video sequence header %x", data.Data)
+	}
+
+	c.interleave(0, Packet(96, true, 99, 5400, 1, []byte{0x41, 0x9a}))
+	large := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 3000)...)
+	payloads := PacketizeH264([][]byte{large}, MAX_PAYLOAD)
+	for i, payload := range payloads {
+		c.interleave(0, Packet(96, i == len(payloads)-1, uint16(100+i), 9000, 1, payload))
+	}
+	c.interleave(2, Packet(97, true, 7, 44100, 2, []byte{0x00, 0x20, 0x00, 0x10, 0x00, 0x18, 0x21, 0x22, 0x31, 0x32, 0x33}))
+	c.interleave(0, Packet(96, true, uint16(100+len(payloads)), 12600, 1, []byte{0x41, 0x9a}))
+
+	key := record.NextVideo(t)
+	for key.Data[1] == 0 {
+		key = record.NextVideo(t)
+	}
+	inter := record.NextVideo(t)
+	if !bytes.Equal(key.Data, append([]byte{0x17, 1, 0, 0, 0}, avc.JoinNALUs([][]byte{large})...)) {
+		t.Errorf("key frame %x", key.Data[:12])
+	}
+	if inter.Data[0] != 0x27 || inter.Time-key.Time != 40 {
+		t.Errorf("inter frame %x at %d", inter.Data[:5], inter.Time-key.Time)
+	}
+	first, second := record.NextAudio(t), record.NextAudio(t)
+	if !bytes.Equal(first.Data, []byte{0xaf, 1, 0x21, 0x22}) || !bytes.Equal(second.Data, []byte{0xaf, 1, 0x31, 0x32, 0x33}) || second.Time-first.Time != 23 {
+		t.Errorf("audio %x then %x %dms later", first.Data, second.Data, second.Time-first.Time)
+	}
+
+	if response = c.do("TEARDOWN", url, "Session: "+session); response.Status != 200 {
+		t.Errorf("TEARDOWN %d", response.Status)
+	}
+	record.ExpectState(t, false)
+	if response := other.announce(url); response.Status != 200 {
+		t.Errorf("ANNOUNCE after TEARDOWN %d", response.Status)
+	}
+}
+
+func TestRecordUDP(t *testing.T) {
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	camera, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer camera.Close()
+	cameraPort := camera.LocalAddr().(*net.UDPAddr).Port
+
+	app := core.NewApplication()
+	stream := app.AcquireStream("cam")
+	record := testutil.NewRecorder()
+	stream.Subscribe(record)
+	config := NewConfig()
+	config.RTPPort = port
+	addr, stop := testutil.Serve(t, NewServer(app, config).ServeListener)
+	defer stop()
+	c := dial(t, addr)
+	defer c.conn.Close()
+	url := "rtsp://" + addr + "/live/cam"
+
+	if response := c.announce(url); response.Status != 200 {
+		t.Fatalf("ANNOUNCE %+v", response)
+	}
+	response := c.do("SETUP", url+"/streamid=1", fmt.Sprintf("Transport: RTP/AVP;unicast;client_port=%d-%d;mode=record", cameraPort, cameraPort+1))
+	if response.Status != 200 || !strings.Contains(response.Header["Transport"], fmt.Sprintf("server_port=%d-%d", port, port+1)) {
+		t.Fatalf("SETUP %+v", response)
+	}
+	session := strings.SplitN(response.Header["Session"], ";", 2)[0]
+	if response = c.do("RECORD", url, "Session: "+session); response.Status != 200 {
+		t.Fatalf("RECORD %+v", response)
+	}
+	record.ExpectState(t, true)
+	if data := record.NextAudio(t); !bytes.Equal(data.Data, testutil.AudioSeq) {
+		t.Errorf("audio sequence header %x", data.Data)
+	}
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	camera.WriteToUDP(Packet(97, true, 1, 0, 2, []byte{0x00, 0x10, 0x00, 0x10, 0x21, 0x22}), server)
+	if data := record.NextAudio(t); !bytes.Equal(data.Data, []byte{0xaf, 1, 0x21, 0x22}) {
+		t.Errorf("audio frame %x", data.Data)
+	}
+	c.conn.Close()
+	if response := dial(t, addr).announce(url); response.Status != 409 {
+		t.Errorf("ANNOUNCE while recording over UDP %d", response.Status)
+	}
+}
@@ -0,0 +1,306 @@
+package rtsp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+	"videostreamer/aac"
+	"videostreamer/avc"
+	"videostreamer/binutil"
+	"videostreamer/core"
+	"videostreamer/logger"
+)
+
+func random(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+func streamConfig(stream *core.Stream) (video *avc.Config, audio *aac.Config, asc []byte) {
+	_, keyVideo, keyAudio := stream.Keys()
+	if key := keyVideo; key != nil && len(key.Data) > 5 && key.IsAVC() {
+		if config, err := avc.ParseConfig(key.Data[5:]); err == nil && len(config.SPS) > 0 {
+			video = config
+		}
+	}
+	if key := keyAudio; key != nil && len(key.Data) > 2 && key.IsAAC() {
+		if config, err := aac.ParseConfig(key.Data[2:]); err == nil {
+			audio, asc = config, binutil.Dup(key.Data[2:])
+		}
+	}
+	return
+}
+
+func newSession(server *Server, conn *Conn, stream *core.Stream) *Session {
+	session := &Session{
+		ID:       hex.EncodeToString(random(8)),
+		Stream:   stream,
+		server:   server,
+		conn:     conn,
+		queue:    make(chan *frame, QUEUE_SIZE),
+		end:      make(chan struct{}),
+		lastSeen: time.Now(),
+	}
+	session.Video, session.Audio, session.ASC = streamConfig(stream)
+	return session
+}
+
+func (session *Session) setup(id int, transport *Transport, ip net.IP) *Track {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	track := &Track{
+		ID:        id,
+		SSRC:      binary.BigEndian.Uint32(random(4)),
+		Seq:       binary.BigEndian.Uint16(random(2)),
+		Offset:    binary.BigEndian.Uint32(random(4)),
+		Transport: transport,
+	}
+	if id == TRACK_VIDEO {
+		track.PayloadType, track.ClockRate = PAYLOAD_H264, VIDEO_CLOCK
+	} else {
+		track.PayloadType, track.ClockRate = PAYLOAD_AAC, session.Audio.SampleRate
+	}
+	if transport.TCP {
+		if transport.Interleaved[0] < 0 {
+			transport.Interleaved = [2]int{2 * id, 2*id + 1}
+		}
+	} else {
+		track.Addr = &net.UDPAddr{IP: ip, Port: transport.ClientPort[0]}
+		track.ControlAddr = &net.UDPAddr{IP: ip, Port: transport.ClientPort[1]}
+	}
+	session.Tracks[id] = track
+	return track
+}
+
+func (session *Session) touch() {
+	session.mutex.Lock()
+	session.lastSeen = time.Now()
+	session.mutex.Unlock()
+}
+
+func (session *Session) tracks() [2]*Track {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.Tracks
+}
+
+func (session *Session) interleaved() bool {
+	for _, track := range session.tracks() {
+		if track != nil && track.Transport.TCP {
+			return true
+		}
+	}
+	return false
+}
+
+func (session *Session) expired(timeout time.Duration) bool {
+	if session.interleaved() {
+		return false
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return time.Since(session.lastSeen) > timeout
+}
+
+// rtpInfo describes where each track's RTP sequence and timestamp start for PLAY.
+func (session *Session) rtpInfo(base string) (infos []string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	for _, track := range session.Tracks {
+		if track != nil {
+			infos = append(infos, fmt.Sprintf("url=%s/trackID=%d;seq=%d;rtptime=%d", base, track.ID, track.Seq, track.Offset))
+		}
+	}
+	return
+}
+
+func (session *Session) play() {
+	session.mutex.Lock()
+	if session.playing {
+		session.mutex.Unlock()
+		return
+	}
+	session.playing = true
+	session.mutex.Unlock()
+	if session.Stream.IsPublished() {
+		session.Stream.Bootstrap(session)
+	}
+	session.Stream.Subscribe(session)
+	go session.run()
+}
+
+func (session *Session) close() {
+	session.mutex.Lock()
+	if session.ended {
+		session.mutex.Unlock()
+		return
+	}
+	session.ended = true
+	close(session.end)
+	session.mutex.Unlock()
+	session.Stream.Unsubscribe(session)
+	session.server.remove(session)
+}
+
+func (session *Session) Publish() {
+	session.mutex.Lock()
+	session.waitKey = session.Tracks[TRACK_VIDEO] != nil
+	session.mutex.Unlock()
+}
+
+func (session *Session) Unpublish() {
+	session.close()
+}
+
+func (session *Session) ConsumeVideo(data *core.VideoData) {
+	d := data.Data
+	if len(d) < 5 || d[0]&0x0f != 7 {
+		return
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if !session.playing || session.ended || session.Tracks[TRACK_VIDEO] == nil {
+		return
+	}
+	switch d[1] {
+	case 0:
+		if config, err := avc.ParseConfig(d[5:]); err == nil && len(config.SPS) > 0 {
+			session.Video = config
+		}
+	case 1:
+		if session.waitKey {
+			if d[0]>>4 != 1 {
+				return
+			}
+			session.waitKey = false
+		}
+		cts := int32(uint32(d[2])<<16|uint32(d[3])<<8|uint32(d[4])) << 8 >> 8
+		session.enqueue(&frame{video: true, time: data.Time + uint32(cts), data: d[5:]})
+	}
+}
+
+func (session *Session) ConsumeAudio(data *core.AudioData) {
+	d := data.Data
+	if len(d) < 3 || !data.IsAAC() || d[1] != 1 {
+		return
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if !session.playing || session.ended || session.Tracks[TRACK_AUDIO] == nil {
+		return
+	}
+	session.enqueue(&frame{time: data.Time, data: d[2:]})
+}
+
+func (session *Session) ConsumeMeta(data *core.MetaData) {}
+
+func (session *Session) enqueue(f *frame) {
+	select {
+	case session.queue <- f:
+	default:
+		session.Dropped++
+		session.waitKey = session.Tracks[TRACK_VIDEO] != nil
+	}
+}
+
+func (session *Session) run() {
+	ticker := time.NewTicker(REPORT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case f := <-session.queue:
+			if err := session.send(f); err != nil {
+				logger.Infof("RTSP session %s of %s gone: %v", session.ID, session.Stream.Name, err)
+				session.close()
+				return
+			}
+		case <-ticker.C:
+			session.report()
+		case <-session.end:
+			for _, track := range session.tracks() {
+				if track != nil && track.sent {
+					session.write(track, true, Goodbye(track.SSRC))
+				}
+			}
+			return
+		}
+	}
+}
+
+func (session *Session) send(f *frame) error {
+	if !session.based {
+		session.based = true
+		session.base = f.time
+		session.wall = time.Now()
+	}
+	var track *Track
+	var payloads [][]byte
+	if f.video {
+		session.mutex.Lock()
+		track = session.Tracks[TRACK_VIDEO]
+		config := session.Video
+		session.mutex.Unlock()
+		nalus := [][]byte{}
+		idr, sps := false, false
+		for _, nalu := range avc.SplitNALUs(f.data, config.LengthSize) {
+			if len(nalu) == 0 || nalu[0]&0x1f == avc.NALU_AUD {
+				continue
+			}
+			idr = idr || nalu[0]&0x1f == avc.NALU_IDR
+			sps = sps || nalu[0]&0x1f == avc.NALU_SPS
+			nalus = append(nalus, nalu)
+		}
+		if idr && !sps {
+			nalus = append(append(append([][]byte{}, config.SPS...), config.PPS...), nalus...)
+		}
+		payloads = PacketizeH264(nalus, MAX_PAYLOAD)
+	} else {
+		track = session.tracks()[TRACK_AUDIO]
+		payloads = PacketizeAAC(f.data, MAX_PAYLOAD)
+	}
+	rtp := track.Offset + uint32(int64(int32(f.time-session.base))*int64(track.ClockRate)/1000)
+	session.mutex.Lock()
+	seq := track.Seq
+	track.Seq += uint16(len(payloads))
+	session.mutex.Unlock()
+	for i, payload := range payloads {
+		packet := Packet(track.PayloadType, i == len(payloads)-1, seq+uint16(i), rtp, track.SSRC, payload)
+		if err := session.write(track, false, packet); err != nil {
+			return err
+		}
+		track.Packets++
+		track.Octets += uint32(len(payload))
+	}
+	track.lastTime, track.lastRTP, track.sent = f.time, rtp, true
+	return nil
+}
+
+func (session *Session) report() {
+	for _, track := range session.tracks() {
+		if track == nil || !track.sent {
+			continue
+		}
+		wall := session.wall.Add(time.Duration(int32(track.lastTime-session.base)) * time.Millisecond)
+		session.write(track, true, SenderReport(track.SSRC, NTP(wall), track.lastRTP, track.Packets, track.Octets))
+	}
+}
+
+func (session *Session) write(track *Track, rtcp bool, data []byte) error {
+	if track.Transport.TCP {
+		channel := track.Transport.Interleaved[0]
+		if rtcp {
+			channel = track.Transport.Interleaved[1]
+		}
+		return session.conn.interleave(channel, data)
+	}
+	conn, addr := session.server.rtp, track.Addr
+	if rtcp {
+		conn, addr = session.server.rtcp, track.ControlAddr
+	}
+	conn.WriteToUDP(data, addr)
+	return nil
+}
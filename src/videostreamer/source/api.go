@@ -0,0 +1,32 @@
+package source
+
+import (
+	"sync"
+	"time"
+	"videostreamer/core"
+)
+
+const (
+	DEFAULT_INTERVAL = 40
+	RETRY_DELAY      = time.Second
+)
+
+type Config struct {
+	Stream string
+	Path   string
+}
+
+type File struct {
+	Config   *Config
+	Stream   *core.Stream
+	Loops    uint64
+	stop     chan struct{}
+	done     chan struct{}
+	mutex    sync.Mutex
+	wall     time.Time
+	offset   uint32
+	keyVideo []byte
+	keyAudio []byte
+	meta     *core.MetaData
+	closed   bool
+}
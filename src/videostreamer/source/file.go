@@ -0,0 +1,191 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"videostreamer/core"
+	"videostreamer/flv"
+	"videostreamer/logger"
+)
+
+func ParseConfig(spec string) (*Config, error) {
+	idx := strings.Index(spec, "=")
+	if idx <= 0 || idx == len(spec)-1 {
+		return nil, fmt.Errorf("Source %s is not name=file.flv", spec)
+	}
+	return &Config{Stream: spec[:idx], Path: spec[idx+1:]}, nil
+}
+
+func open(path string) (*os.File, *flv.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := flv.NewReader(bufio.NewReader(f))
+	if _, err = reader.ReadHeader(); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, reader, nil
+}
+
+// Start publishes an FLV file to its stream in a loop until closed. It fails
+// if another publisher holds the stream.
+func Start(app *core.Application, config *Config) (*File, error) {
+	f, _, err := open(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	file := &File{
+		Config: config,
+		Stream: app.AcquireStream(config.Stream),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if !file.Stream.Claim(file) {
+		return nil, fmt.Errorf("Stream %s is already published", config.Stream)
+	}
+	go file.run()
+	logger.Infof("Publishing %s from %s", config.Stream, config.Path)
+	return file, nil
+}
+
+func (file *File) Close() {
+	file.mutex.Lock()
+	if file.closed {
+		file.mutex.Unlock()
+		return
+	}
+	file.closed = true
+	file.mutex.Unlock()
+	close(file.stop)
+	<-file.done
+}
+
+func (file *File) run() {
+	defer close(file.done)
+	defer file.Stream.Release(file)
+	file.wall = time.Now()
+	for {
+		duration, err := file.play()
+		if err == nil && duration == 0 {
+			err = fmt.Errorf("%s has no media", file.Config.Path)
+		}
+		if err == nil {
+			file.Loops++
+		} else {
+			if err != errStopped {
+				logger.Warnf("Publishing %s from %s failed: %v, retrying in %v", file.Stream.Name, file.Config.Path, err, RETRY_DELAY)
+			}
+			select {
+			case <-time.After(RETRY_DELAY):
+			case <-file.stop:
+			}
+			file.offset = uint32(time.Since(file.wall) / time.Millisecond)
+		}
+		select {
+		case <-file.stop:
+			if file.Stream.IsPublished() {
+				file.Stream.Unpublish()
+			}
+			return
+		default:
+		}
+	}
+}
+
+var errStopped = errors.New("Stopped")
+
+// wait paces output in real time, at being milliseconds since the first pass started.
+func (file *File) wait(at uint32) error {
+	select {
+	case <-time.After(time.Until(file.wall.Add(time.Duration(at) * time.Millisecond))):
+		return nil
+	case <-file.stop:
+		return errStopped
+	}
+}
+
+// play sends one pass over the file shifted to continue the previous one and returns its duration.
+func (file *File) play() (uint32, error) {
+	f, reader, err := open(file.Config.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var first, last, interval uint32
+	previous := make(map[uint8]uint32)
+	for {
+		tag, err := reader.ReadTag()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if len(previous) == 0 {
+			first = tag.Time
+		}
+		rel := last
+		if int32(tag.Time-first) > int32(last) {
+			rel = tag.Time - first
+		}
+		if p, ok := previous[tag.Type]; ok && rel > p {
+			interval = rel - p
+		}
+		previous[tag.Type], last = rel, rel
+		if err = file.wait(file.offset + rel); err != nil {
+			return 0, err
+		}
+		file.send(tag, file.offset+rel)
+	}
+	if len(previous) == 0 {
+		return 0, nil
+	}
+	if interval == 0 {
+		interval = DEFAULT_INTERVAL
+	}
+	file.offset += last + interval
+	return last + interval, nil
+}
+
+func (file *File) send(tag *flv.Tag, t uint32) {
+	d := tag.Data
+	switch tag.Type {
+	case flv.TAG_SCRIPT:
+		if meta := flv.ParseMetadata(d); meta != nil && (file.meta == nil || *meta != *file.meta) {
+			file.meta = meta
+			file.Stream.ReceiveMeta(meta)
+		}
+	case flv.TAG_VIDEO:
+		if len(d) > 1 && d[1] == 0 {
+			if bytes.Equal(d, file.keyVideo) {
+				return
+			}
+			file.keyVideo = d
+		}
+		file.Stream.ReceiveVideo(core.NewVideoData(t, d))
+		file.publish()
+	case flv.TAG_AUDIO:
+		if len(d) > 1 && d[0]>>4 == 10 && d[1] == 0 {
+			if bytes.Equal(d, file.keyAudio) {
+				return
+			}
+			file.keyAudio = d
+		}
+		file.Stream.ReceiveAudio(core.NewAudioData(t, d))
+		file.publish()
+	}
+}
+
+func (file *File) publish() {
+	if !file.Stream.IsPublished() {
+		file.Stream.Publish()
+	}
+}
@@ -0,0 +1,94 @@
+package source
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/flv"
+	"videostreamer/testutil"
+)
+
+func writeFile(t *testing.T) string {
+	buf := bytes.Buffer{}
+	writer := flv.NewWriter(&buf)
+	writer.WriteHeader(flv.FLAG_AUDIO | flv.FLAG_VIDEO)
+	writer.WriteMeta(1000, core.NewMetaData(640, 480, 25))
+	writer.WriteVideo(core.NewVideoData(1000, testutil.Seq))
+	writer.WriteAudio(core.NewAudioData(1000, testutil.AudioSeq))
+	writer.WriteVideo(core.NewVideoData(1000, append([]byte{0x17, 0x01, 0, 0, 0}, avc.JoinNALUs([][]byte{{0x65, 0x88}})...)))
+	writer.WriteAudio(core.NewAudioData(1010, []byte{0xaf, 0x01, 0x21}))
+	writer.WriteVideo(core.NewVideoData(1040, append([]byte{0x27, 0x01, 0, 0, 0}, avc.JoinNALUs([][]byte{{0x41, 0x9a}})...)))
+	path := filepath.Join(t.TempDir(), "slate.flv")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoop(t *testing.T) {
+	config, err := ParseConfig("slate=" + writeFile(t))
+	if err != nil || config.Stream != "slate" {
+		t.Fatalf("config %+v: %v", config, err)
+	}
+	app := core.NewApplication()
+	record := testutil.NewRecorder()
+	app.AcquireStream("slate").Subscribe(record)
+	begin := time.Now()
+	file, err := Start(app, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if published := <-record.State; !published {
+		t.Fatal("stream not published")
+	}
+	frames := []*core.VideoData{}
+	headers := 0
+	for len(frames) < 6 {
+		select {
+		case data := <-record.Video:
+			if data.Data[1] == 0 {
+				headers++
+			} else {
+				frames = append(frames, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d frames", len(frames))
+		}
+	}
+	for i, want := range []uint32{0, 40, 80, 120, 160, 200} {
+		if frames[i].Time != want {
+			t.Errorf("frame %d at %d instead of %d", i, frames[i].Time, want)
+		}
+	}
+	if elapsed := time.Since(begin); elapsed < 190*time.Millisecond {
+		t.Errorf("three passes took only %v", elapsed)
+	}
+	if meta := <-record.Meta; meta.Width != 640 || len(record.Meta) != 0 {
+		t.Errorf("metadata %+v, %d more", meta, len(record.Meta))
+	}
+	if _, err := Start(app, config); err == nil {
+		t.Error("started a second publisher on the same stream")
+	}
+	file.Close()
+	for published := range record.State {
+		if !published {
+			break
+		}
+	}
+	if file, err = Start(app, config); err != nil {
+		t.Errorf("stream still claimed after close: %v", err)
+	} else {
+		file.Close()
+	}
+	if headers > 2 || len(record.Audio) == 0 {
+		t.Errorf("%d video sequence headers, %d audio tags", headers, len(record.Audio))
+	}
+	if _, err := Start(app, &Config{Stream: "missing", Path: filepath.Join(t.TempDir(), "missing.flv")}); err == nil {
+		t.Error("started from a missing file")
+	}
+}
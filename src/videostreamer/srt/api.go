@@ -0,0 +1,183 @@
+package srt
+
+import (
+	"net"
+	"sync"
+	"time"
+	"videostreamer/core"
+	"videostreamer/ts"
+)
+
+const (
+	CONTROL_HANDSHAKE = 0x0000
+	CONTROL_KEEPALIVE = 0x0001
+	CONTROL_ACK       = 0x0002
+	CONTROL_NAK       = 0x0003
+	CONTROL_SHUTDOWN  = 0x0005
+	CONTROL_ACKACK    = 0x0006
+	CONTROL_DROPREQ   = 0x0007
+	CONTROL_USER      = 0x7fff
+)
+
+const (
+	HANDSHAKE_INDUCTION  = 0x00000001
+	HANDSHAKE_CONCLUSION = 0xffffffff
+	HANDSHAKE_REJECT     = 1000
+	HANDSHAKE_MAGIC      = 0x4a17
+)
+
+const (
+	EXT_HSREQ   = 1
+	EXT_HSRSP   = 2
+	EXT_KMREQ   = 3
+	EXT_KMRSP   = 4
+	EXT_SID     = 5
+	FLAG_HSREQ  = 0x1
+	FLAG_KMREQ  = 0x2
+	FLAG_CONFIG = 0x4
+)
+
+const (
+	SRT_VERSION = 0x010500
+	SRT_FLAGS   = 0x3f
+)
+
+const (
+	REJECT_PEER        = 2
+	REJECT_RESOURCE    = 3
+	REJECT_ROGUE       = 4
+	REJECT_VERSION     = 8
+	REJECT_BADSECRET   = 10
+	REJECT_UNSECURE    = 11
+	REJECT_BAD_REQUEST = 1400
+	REJECT_BAD_MODE    = 1405
+	REJECT_CONFLICT    = 1409
+)
+
+const (
+	KM_NOSECRET  = 3
+	KM_BADSECRET = 4
+	KM_EVEN      = 1
+	KM_ODD       = 2
+	CIPHER_CTR   = 2
+	SALT_SIZE    = 16
+	KEK_ROUNDS   = 2048
+)
+
+const (
+	MIN_PASSPHRASE = 10
+	MAX_PASSPHRASE = 79
+)
+
+const (
+	HEADER_SIZE     = 16
+	MTU             = 1500
+	MAX_PAYLOAD     = 1456
+	PAYLOAD_SIZE    = 7 * ts.PACKET_SIZE
+	FLOW_WINDOW     = 8192
+	SEQ_MASK        = 0x7fffffff
+	ACK_INTERVAL    = 10 * time.Millisecond
+	NAK_INTERVAL    = 20 * time.Millisecond
+	KEEPALIVE       = time.Second
+	DEFAULT_LATENCY = 120 * time.Millisecond
+	PEER_TIMEOUT    = 5 * time.Second
+	COOKIE_PERIOD   = time.Minute
+	DIAL_TIMEOUT    = 3 * time.Second
+	HANDSHAKE_RETRY = 250 * time.Millisecond
+)
+
+type Config struct {
+	Latency     time.Duration
+	Passphrase  string
+	PeerTimeout time.Duration
+}
+
+type Packet struct {
+	Control   bool
+	Type      uint16
+	Subtype   uint16
+	Info      uint32
+	Seq       uint32
+	Flags     uint32
+	Timestamp uint32
+	Socket    uint32
+	Payload   []byte
+}
+
+type Handshake struct {
+	Version    uint32
+	Encryption uint16
+	Extension  uint16
+	InitialSeq uint32
+	MTU        uint32
+	Window     uint32
+	Type       uint32
+	Socket     uint32
+	Cookie     uint32
+	Extensions map[uint16][]byte
+}
+
+type segment struct {
+	data []byte
+	due  time.Time
+}
+
+type Server struct {
+	App    *core.Application
+	Config *Config
+	conn   *net.UDPConn
+	secret []byte
+	conns  map[uint32]*Conn
+	peers  map[string]*Conn
+	mutex  sync.Mutex
+}
+
+type Conn struct {
+	ID        uint32
+	Peer      uint32
+	Addr      *net.UDPAddr
+	Stream    *core.Stream
+	Latency   time.Duration
+	Received  uint64
+	Lost      uint64
+	Dropped   uint64
+	server    *Server
+	demuxer   *ts.Demuxer
+	keys      [2][]byte
+	salt      []byte
+	start     time.Time
+	base      time.Time
+	last      time.Time
+	sent      time.Time
+	next      uint32
+	highest   uint32
+	buffer    map[uint32]*segment
+	loss      map[uint32]time.Time
+	ackNumber uint32
+	acked     uint32
+	acks      map[uint32]time.Time
+	rtt       time.Duration
+	variance  time.Duration
+	epoch     int64
+	lastTime  uint32
+	response  []byte
+	stop      chan struct{}
+	mutex     sync.Mutex
+	closed    bool
+}
+
+type Caller struct {
+	ID      uint32
+	Peer    uint32
+	Latency time.Duration
+	conn    *net.UDPConn
+	key     []byte
+	salt    []byte
+	start   time.Time
+	seq     uint32
+	msg     uint32
+	sent    map[uint32]*Packet
+	skip    func(seq uint32) bool
+	mutex   sync.Mutex
+	closed  bool
+}
@@ -0,0 +1,228 @@
+package srt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+func randomUint32() uint32 {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return binary.BigEndian.Uint32(buf)
+}
+
+// Dial connects to an SRT listener as a publishing caller.
+func Dial(addr string, streamid string, passphrase string, latency time.Duration) (*Caller, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Caller{
+		ID:      randomUint32()&0x3fffffff | 1,
+		Latency: latency,
+		conn:    conn,
+		start:   time.Now(),
+		seq:     randomUint32() & SEQ_MASK,
+		sent:    make(map[uint32]*Packet),
+	}
+	if err = c.handshake(streamid, passphrase); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	go c.read()
+	return c, nil
+}
+
+func (c *Caller) exchange(hs *Handshake, deadline time.Time) (*Handshake, error) {
+	buf := make([]byte, MTU)
+	for time.Now().Before(deadline) {
+		c.write(&Packet{Control: true, Type: CONTROL_HANDSHAKE, Payload: hs.Bytes(c.conn.RemoteAddr().(*net.UDPAddr).IP)})
+		c.conn.SetReadDeadline(time.Now().Add(HANDSHAKE_RETRY))
+		for {
+			n, err := c.conn.Read(buf)
+			if err != nil {
+				break
+			}
+			packet, err := ParsePacket(buf[:n])
+			if err != nil || !packet.Control || packet.Type != CONTROL_HANDSHAKE || packet.Socket != c.ID {
+				continue
+			}
+			response, err := ParseHandshake(packet.Payload)
+			if err != nil {
+				continue
+			}
+			if response.Type >= HANDSHAKE_REJECT && response.Type < HANDSHAKE_CONCLUSION-1 {
+				return nil, fmt.Errorf("SRT connection rejected with reason %d", response.Type-HANDSHAKE_REJECT)
+			}
+			if response.Type == hs.Type {
+				return response, nil
+			}
+		}
+	}
+	return nil, errors.New("SRT handshake timed out")
+}
+
+func (c *Caller) handshake(streamid string, passphrase string) error {
+	deadline := time.Now().Add(DIAL_TIMEOUT)
+	hs := &Handshake{
+		Version:    4,
+		Extension:  2,
+		InitialSeq: c.seq,
+		MTU:        MTU,
+		Window:     FLOW_WINDOW,
+		Type:       HANDSHAKE_INDUCTION,
+		Socket:     c.ID,
+	}
+	response, err := c.exchange(hs, deadline)
+	if err != nil {
+		return err
+	}
+	if response.Version < 5 || response.Extension != HANDSHAKE_MAGIC {
+		return errors.New("SRT listener does not support HSv5")
+	}
+	hs.Version = 5
+	hs.Extension = FLAG_HSREQ | FLAG_CONFIG
+	hs.Type = HANDSHAKE_CONCLUSION
+	hs.Cookie = response.Cookie
+	hs.Extensions = map[uint16][]byte{
+		EXT_HSREQ: MakeHSExtension(SRT_VERSION, SRT_FLAGS, uint16(c.Latency/time.Millisecond)),
+		EXT_SID:   EncodeStreamID(streamid),
+	}
+	if passphrase != "" {
+		c.salt = make([]byte, SALT_SIZE)
+		c.key = make([]byte, 16)
+		rand.Read(c.salt)
+		rand.Read(c.key)
+		km, err := MakeKeyMaterial(passphrase, c.salt, c.key)
+		if err != nil {
+			return err
+		}
+		hs.Encryption = 2
+		hs.Extension |= FLAG_KMREQ
+		hs.Extensions[EXT_KMREQ] = km
+	}
+	if response, err = c.exchange(hs, deadline); err != nil {
+		return err
+	}
+	if km := response.Extensions[EXT_KMRSP]; passphrase != "" && len(km) <= 4 {
+		return errors.New("SRT listener refused the key material")
+	}
+	if hsrsp := response.Extensions[EXT_HSRSP]; len(hsrsp) >= 12 {
+		c.Latency = time.Duration(binary.BigEndian.Uint32(hsrsp[8:])>>16) * time.Millisecond
+	}
+	c.Peer = response.Socket
+	return nil
+}
+
+func (c *Caller) timestamp() uint32 {
+	return uint32(time.Since(c.start) / time.Microsecond)
+}
+
+func (c *Caller) write(packet *Packet) error {
+	packet.Socket = c.Peer
+	if packet.Control {
+		packet.Timestamp = c.timestamp()
+	}
+	_, err := c.conn.Write(packet.Bytes())
+	return err
+}
+
+func (c *Caller) read() {
+	buf := make([]byte, MTU)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		packet, err := ParsePacket(buf[:n])
+		if err != nil || !packet.Control {
+			continue
+		}
+		c.mutex.Lock()
+		switch packet.Type {
+		case CONTROL_ACK:
+			c.write(&Packet{Control: true, Type: CONTROL_ACKACK, Info: packet.Info})
+			if len(packet.Payload) >= 4 {
+				ack := binary.BigEndian.Uint32(packet.Payload)
+				for seq := range c.sent {
+					if seqDiff(seq, ack) < 0 {
+						delete(c.sent, seq)
+					}
+				}
+			}
+		case CONTROL_NAK:
+			for cif := packet.Payload; len(cif) >= 4; cif = cif[4:] {
+				first := binary.BigEndian.Uint32(cif)
+				last := first
+				if first&0x80000000 != 0 && len(cif) >= 8 {
+					first &= SEQ_MASK
+					cif = cif[4:]
+					last = binary.BigEndian.Uint32(cif)
+				}
+				for seq := first; seqDiff(seq, last) <= 0; seq = seqAdd(seq, 1) {
+					if sent := c.sent[seq]; sent != nil {
+						sent.Flags |= 0x04000000
+						c.write(sent)
+					}
+				}
+			}
+		case CONTROL_SHUTDOWN:
+			c.closed = true
+			c.conn.Close()
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// Write sends data, usually whole MPEG-TS packets, in payloads of up to seven TS packets.
+func (c *Caller) Write(data []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return 0, errors.New("SRT connection closed")
+	}
+	written := 0
+	for len(data) > 0 {
+		n := min(len(data), PAYLOAD_SIZE)
+		payload := data[:n]
+		key := uint32(0)
+		if c.key != nil {
+			key = KM_EVEN
+			payload, _ = Crypt(c.key, c.salt, c.seq, payload)
+		} else {
+			payload = append([]byte{}, payload...)
+		}
+		packet := &Packet{Seq: c.seq, Flags: dataFlags(c.msg, key, false), Timestamp: c.timestamp(), Payload: payload}
+		c.sent[c.seq] = packet
+		if c.skip == nil || !c.skip(c.seq) {
+			if err := c.write(packet); err != nil {
+				return written, err
+			}
+		}
+		c.seq = seqAdd(c.seq, 1)
+		c.msg++
+		written += n
+		data = data[n:]
+	}
+	return written, nil
+}
+
+func (c *Caller) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.write(&Packet{Control: true, Type: CONTROL_SHUTDOWN, Payload: make([]byte, 4)})
+	return c.conn.Close()
+}
@@ -0,0 +1,258 @@
+package srt
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+	"videostreamer/logger"
+)
+
+func (c *Conn) run() {
+	ticker := time.NewTicker(ACK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			c.mutex.Lock()
+			if now.Sub(c.last) > c.server.Config.PeerTimeout {
+				logger.Infof("SRT caller %s of %s timed out", c.Addr, c.Stream.Name)
+				c.close()
+			} else {
+				c.deliver(now)
+				c.ack(now)
+				c.nak(now, false)
+				if now.Sub(c.sent) > KEEPALIVE {
+					c.send(&Packet{Control: true, Type: CONTROL_KEEPALIVE})
+				}
+			}
+			c.mutex.Unlock()
+		}
+	}
+}
+
+func (c *Conn) Close() {
+	c.mutex.Lock()
+	c.close()
+	c.mutex.Unlock()
+}
+
+func (c *Conn) close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.stop)
+	c.send(&Packet{Control: true, Type: CONTROL_SHUTDOWN, Payload: make([]byte, 4)})
+	c.server.remove(c)
+	c.demuxer.Flush()
+	if c.Stream.IsPublished() {
+		c.Stream.Unpublish()
+	}
+	c.Stream.Release(c)
+	logger.Infof("SRT caller %s of %s closed after %d packets, %d lost, %d dropped", c.Addr, c.Stream.Name, c.Received, c.Lost, c.Dropped)
+}
+
+func (c *Conn) send(packet *Packet) {
+	packet.Socket = c.Peer
+	packet.Timestamp = uint32(time.Since(c.start) / time.Microsecond)
+	c.sent = time.Now()
+	c.server.write(c.Addr, packet)
+}
+
+func (c *Conn) receive(packet *Packet) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	c.last = time.Now()
+	if !packet.Control {
+		c.data(packet)
+		return
+	}
+	switch packet.Type {
+	case CONTROL_ACKACK:
+		if at, ok := c.acks[packet.Info]; ok {
+			sample := c.last.Sub(at)
+			delta := c.rtt - sample
+			if delta < 0 {
+				delta = -delta
+			}
+			c.variance = (3*c.variance + delta) / 4
+			c.rtt = (7*c.rtt + sample) / 8
+			delete(c.acks, packet.Info)
+		}
+	case CONTROL_DROPREQ:
+		if len(packet.Payload) >= 8 {
+			c.drop(binary.BigEndian.Uint32(packet.Payload)&SEQ_MASK, binary.BigEndian.Uint32(packet.Payload[4:])&SEQ_MASK)
+		}
+	case CONTROL_SHUTDOWN:
+		c.close()
+	case CONTROL_USER:
+		if packet.Subtype == EXT_KMREQ {
+			c.rekey(packet.Payload)
+		}
+	}
+}
+
+func (c *Conn) rekey(km []byte) {
+	response := km
+	if salt, keys, err := ParseKeyMaterial(c.server.Config.Passphrase, km); err != nil || c.salt == nil {
+		response = binary.BigEndian.AppendUint32(nil, KM_BADSECRET)
+	} else {
+		c.salt = salt
+		for i := range keys {
+			if keys[i] != nil {
+				c.keys[i] = keys[i]
+			}
+		}
+	}
+	c.send(&Packet{Control: true, Type: CONTROL_USER, Subtype: EXT_KMRSP, Payload: response})
+}
+
+func (c *Conn) extend(ts uint32) int64 {
+	diff := int64(int32(ts - c.lastTime))
+	at := c.epoch + int64(c.lastTime) + diff
+	if diff > 0 {
+		c.lastTime = ts
+		c.epoch = at - int64(ts)
+	}
+	return at
+}
+
+func (c *Conn) data(packet *Packet) {
+	seq := packet.Seq & SEQ_MASK
+	if d := seqDiff(seq, c.next); d < 0 || d >= FLOW_WINDOW || c.buffer[seq] != nil {
+		return
+	}
+	payload := packet.Payload
+	if kk := packet.Key(); kk != 0 || c.salt != nil {
+		if kk == 0 || kk == KM_EVEN|KM_ODD || c.keys[kk-1] == nil {
+			return
+		}
+		payload, _ = Crypt(c.keys[kk-1], c.salt, seq, payload)
+	}
+	c.Received++
+	at := time.Duration(c.extend(packet.Timestamp)) * time.Microsecond
+	c.buffer[seq] = &segment{data: payload, due: c.base.Add(at + c.Latency)}
+	if d := seqDiff(seq, c.highest); d >= 0 {
+		if d > 0 {
+			now := time.Now()
+			for s := c.highest; s != seq; s = seqAdd(s, 1) {
+				c.loss[s] = time.Time{}
+			}
+			c.Lost += uint64(d)
+			c.nak(now, true)
+		}
+		c.highest = seqAdd(seq, 1)
+	} else {
+		delete(c.loss, seq)
+	}
+	c.deliver(time.Now())
+}
+
+func (c *Conn) deliver(now time.Time) {
+	for !c.closed {
+		if s := c.buffer[c.next]; s != nil {
+			if s.due.After(now) {
+				return
+			}
+			delete(c.buffer, c.next)
+			if err := c.demuxer.Write(s.data); err != nil {
+				logger.Debugf("SRT caller %s of %s: %v", c.Addr, c.Stream.Name, err)
+			}
+			c.next = seqAdd(c.next, 1)
+			continue
+		}
+		found := false
+		for s := seqAdd(c.next, 1); seqDiff(s, c.highest) < 0; s = seqAdd(s, 1) {
+			if segment := c.buffer[s]; segment != nil {
+				if segment.due.After(now) {
+					return
+				}
+				found = true
+				c.drop(c.next, seqAdd(s, -1))
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+func (c *Conn) drop(first uint32, last uint32) {
+	if seqDiff(last, first) < 0 || seqDiff(last, c.next) < 0 {
+		return
+	}
+	for s := first; seqDiff(s, last) <= 0; s = seqAdd(s, 1) {
+		if _, ok := c.loss[s]; ok {
+			delete(c.loss, s)
+			c.Dropped++
+		}
+	}
+	for seqDiff(c.next, first) >= 0 && seqDiff(c.next, last) <= 0 && c.buffer[c.next] == nil {
+		c.next = seqAdd(c.next, 1)
+	}
+	if seqDiff(c.highest, c.next) < 0 {
+		c.highest = c.next
+	}
+}
+
+func (c *Conn) ack(now time.Time) {
+	ack := c.next
+	for c.buffer[ack] != nil {
+		ack = seqAdd(ack, 1)
+	}
+	for number, at := range c.acks {
+		if now.Sub(at) > time.Second {
+			delete(c.acks, number)
+		}
+	}
+	if ack == c.acked {
+		return
+	}
+	c.acked = ack
+	c.ackNumber++
+	c.acks[c.ackNumber] = now
+	cif := binary.BigEndian.AppendUint32(nil, ack)
+	cif = binary.BigEndian.AppendUint32(cif, uint32(c.rtt/time.Microsecond))
+	cif = binary.BigEndian.AppendUint32(cif, uint32(c.variance/time.Microsecond))
+	cif = binary.BigEndian.AppendUint32(cif, uint32(max(FLOW_WINDOW-len(c.buffer), 2)))
+	cif = append(cif, make([]byte, 12)...)
+	c.send(&Packet{Control: true, Type: CONTROL_ACK, Info: c.ackNumber, Payload: cif})
+}
+
+// nak reports losses not reported within the last round trip, or only the fresh ones.
+func (c *Conn) nak(now time.Time, fresh bool) {
+	interval := max(c.rtt+4*c.variance, NAK_INTERVAL)
+	seqs := []int{}
+	for s, at := range c.loss {
+		if fresh && at.IsZero() || !fresh && now.Sub(at) > interval {
+			seqs = append(seqs, int(seqDiff(s, c.next)))
+			c.loss[s] = now
+		}
+	}
+	if len(seqs) == 0 {
+		return
+	}
+	sort.Ints(seqs)
+	cif := []byte{}
+	for i := 0; i < len(seqs); {
+		j := i
+		for j+1 < len(seqs) && seqs[j+1] == seqs[j]+1 {
+			j++
+		}
+		first, last := seqAdd(c.next, int32(seqs[i])), seqAdd(c.next, int32(seqs[j]))
+		if i == j {
+			cif = binary.BigEndian.AppendUint32(cif, first)
+		} else {
+			cif = binary.BigEndian.AppendUint32(cif, first|0x80000000)
+			cif = binary.BigEndian.AppendUint32(cif, last)
+		}
+		i = j + 1
+	}
+	c.send(&Packet{Control: true, Type: CONTROL_NAK, Payload: cif})
+}
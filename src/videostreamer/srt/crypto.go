@@ -0,0 +1,131 @@
+package srt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+var wrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+func DeriveKEK(passphrase string, salt []byte, size int) ([]byte, error) {
+	return pbkdf2.Key(sha1.New, passphrase, salt[len(salt)-8:], KEK_ROUNDS, size)
+}
+
+func WrapKey(kek []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(key)%8 != 0 {
+		return nil, errors.New("Key size not a multiple of 8")
+	}
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	copy(out[8:], key)
+	a := append([]byte{}, wrapIV...)
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, a)
+			copy(buf[8:], out[8*i:])
+			block.Encrypt(buf, buf)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf)^t)
+			copy(out[8*i:], buf[8:])
+		}
+	}
+	copy(out, a)
+	return out, nil
+}
+
+func UnwrapKey(kek []byte, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("Bad wrapped key size")
+	}
+	n := len(wrapped)/8 - 1
+	out := append([]byte{}, wrapped...)
+	a := append([]byte{}, wrapped[:8]...)
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf, binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], out[8*i:8*i+8])
+			block.Decrypt(buf, buf)
+			copy(a, buf)
+			copy(out[8*i:], buf[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(a, wrapIV) != 1 {
+		return nil, errors.New("Key unwrap integrity check failed")
+	}
+	return out[8:], nil
+}
+
+// MakeKeyMaterial builds a KMREQ carrying the even key only.
+func MakeKeyMaterial(passphrase string, salt []byte, key []byte) ([]byte, error) {
+	kek, err := DeriveKEK(passphrase, salt, len(key))
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := WrapKey(kek, key)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{0x12, 0x20, 0x29, KM_EVEN, 0, 0, 0, 0, CIPHER_CTR, 0, 2, 0, 0, 0, byte(len(salt) / 4), byte(len(key) / 4)}
+	data = append(data, salt...)
+	return append(data, wrapped...), nil
+}
+
+// ParseKeyMaterial returns the salt and the even and odd keys announced in a KMREQ.
+func ParseKeyMaterial(passphrase string, data []byte) (salt []byte, keys [2][]byte, err error) {
+	if len(data) < 16 || data[0] != 0x12 || data[1] != 0x20 || data[2] != 0x29 || data[8] != CIPHER_CTR {
+		return nil, keys, errors.New("Unsupported SRT key material")
+	}
+	kk := data[3] & 3
+	slen, klen := 4*int(data[14]), 4*int(data[15])
+	count := 1
+	if kk == KM_EVEN|KM_ODD {
+		count = 2
+	}
+	if kk == 0 || slen != SALT_SIZE || (klen != 16 && klen != 24 && klen != 32) || len(data) < 16+slen+count*klen+8 {
+		return nil, keys, errors.New("Malformed SRT key material")
+	}
+	salt = data[16 : 16+slen]
+	kek, err := DeriveKEK(passphrase, salt, klen)
+	if err != nil {
+		return nil, keys, err
+	}
+	unwrapped, err := UnwrapKey(kek, data[16+slen:16+slen+count*klen+8])
+	if err != nil {
+		return nil, keys, err
+	}
+	for i := 0; i < 2; i++ {
+		if kk&(1<<i) != 0 {
+			keys[i], unwrapped = unwrapped[:klen], unwrapped[klen:]
+		}
+	}
+	return salt, keys, nil
+}
+
+func Crypt(key []byte, salt []byte, seq uint32, payload []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt[:14])
+	binary.BigEndian.PutUint32(iv[10:], binary.BigEndian.Uint32(iv[10:])^seq)
+	out := make([]byte, len(payload))
+	cipher.NewCTR(block, iv).XORKeyStream(out, payload)
+	return out, nil
+}
@@ -0,0 +1,170 @@
+package srt
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+func ParsePacket(data []byte) (*Packet, error) {
+	if len(data) < HEADER_SIZE {
+		return nil, errors.New("Short SRT packet")
+	}
+	packet := &Packet{
+		Timestamp: binary.BigEndian.Uint32(data[8:]),
+		Socket:    binary.BigEndian.Uint32(data[12:]),
+		Payload:   data[HEADER_SIZE:],
+	}
+	if data[0]&0x80 != 0 {
+		packet.Control = true
+		packet.Type = binary.BigEndian.Uint16(data) & 0x7fff
+		packet.Subtype = binary.BigEndian.Uint16(data[2:])
+		packet.Info = binary.BigEndian.Uint32(data[4:])
+	} else {
+		packet.Seq = binary.BigEndian.Uint32(data)
+		packet.Flags = binary.BigEndian.Uint32(data[4:])
+	}
+	return packet, nil
+}
+
+func (packet *Packet) Bytes() []byte {
+	data := make([]byte, HEADER_SIZE, HEADER_SIZE+len(packet.Payload))
+	if packet.Control {
+		binary.BigEndian.PutUint16(data, 0x8000|packet.Type)
+		binary.BigEndian.PutUint16(data[2:], packet.Subtype)
+		binary.BigEndian.PutUint32(data[4:], packet.Info)
+	} else {
+		binary.BigEndian.PutUint32(data, packet.Seq&SEQ_MASK)
+		binary.BigEndian.PutUint32(data[4:], packet.Flags)
+	}
+	binary.BigEndian.PutUint32(data[8:], packet.Timestamp)
+	binary.BigEndian.PutUint32(data[12:], packet.Socket)
+	return append(data, packet.Payload...)
+}
+
+func (packet *Packet) Key() uint32 {
+	return packet.Flags >> 27 & 3
+}
+
+func (packet *Packet) Retransmitted() bool {
+	return packet.Flags&0x04000000 != 0
+}
+
+func dataFlags(msg uint32, key uint32, retransmit bool) uint32 {
+	flags := 3<<30 | key<<27 | msg&0x03ffffff
+	if retransmit {
+		flags |= 0x04000000
+	}
+	return flags
+}
+
+func seqDiff(a uint32, b uint32) int32 {
+	return int32((a-b)<<1) >> 1
+}
+
+func seqAdd(seq uint32, n int32) uint32 {
+	return (seq + uint32(n)) & SEQ_MASK
+}
+
+func ParseHandshake(data []byte) (*Handshake, error) {
+	if len(data) < 48 {
+		return nil, errors.New("Short SRT handshake")
+	}
+	hs := &Handshake{
+		Version:    binary.BigEndian.Uint32(data),
+		Encryption: binary.BigEndian.Uint16(data[4:]),
+		Extension:  binary.BigEndian.Uint16(data[6:]),
+		InitialSeq: binary.BigEndian.Uint32(data[8:]),
+		MTU:        binary.BigEndian.Uint32(data[12:]),
+		Window:     binary.BigEndian.Uint32(data[16:]),
+		Type:       binary.BigEndian.Uint32(data[20:]),
+		Socket:     binary.BigEndian.Uint32(data[24:]),
+		Cookie:     binary.BigEndian.Uint32(data[28:]),
+		Extensions: make(map[uint16][]byte),
+	}
+	for ext := data[48:]; len(ext) >= 4; {
+		kind := binary.BigEndian.Uint16(ext)
+		length := 4 * int(binary.BigEndian.Uint16(ext[2:]))
+		if 4+length > len(ext) {
+			return nil, errors.New("Truncated SRT handshake extension")
+		}
+		hs.Extensions[kind] = ext[4 : 4+length]
+		ext = ext[4+length:]
+	}
+	return hs, nil
+}
+
+func (hs *Handshake) Bytes(peer net.IP) []byte {
+	data := make([]byte, 48)
+	binary.BigEndian.PutUint32(data, hs.Version)
+	binary.BigEndian.PutUint16(data[4:], hs.Encryption)
+	binary.BigEndian.PutUint16(data[6:], hs.Extension)
+	binary.BigEndian.PutUint32(data[8:], hs.InitialSeq)
+	binary.BigEndian.PutUint32(data[12:], hs.MTU)
+	binary.BigEndian.PutUint32(data[16:], hs.Window)
+	binary.BigEndian.PutUint32(data[20:], hs.Type)
+	binary.BigEndian.PutUint32(data[24:], hs.Socket)
+	binary.BigEndian.PutUint32(data[28:], hs.Cookie)
+	if ip := peer.To4(); ip != nil {
+		for i := range ip {
+			data[32+i] = ip[3-i]
+		}
+	} else {
+		copy(data[32:], peer)
+	}
+	kinds := []int{}
+	for kind := range hs.Extensions {
+		kinds = append(kinds, int(kind))
+	}
+	sort.Ints(kinds)
+	for _, kind := range kinds {
+		ext := hs.Extensions[uint16(kind)]
+		data = binary.BigEndian.AppendUint16(data, uint16(kind))
+		data = binary.BigEndian.AppendUint16(data, uint16(len(ext)/4))
+		data = append(data, ext...)
+	}
+	return data
+}
+
+func MakeHSExtension(version uint32, flags uint32, latency uint16) []byte {
+	data := binary.BigEndian.AppendUint32(nil, version)
+	data = binary.BigEndian.AppendUint32(data, flags)
+	return binary.BigEndian.AppendUint32(data, uint32(latency)<<16|uint32(latency))
+}
+
+func swapWords(data []byte) []byte {
+	out := make([]byte, (len(data)+3)/4*4)
+	copy(out, data)
+	for i := 0; i < len(out); i += 4 {
+		out[i], out[i+1], out[i+2], out[i+3] = out[i+3], out[i+2], out[i+1], out[i]
+	}
+	return out
+}
+
+func EncodeStreamID(id string) []byte {
+	return swapWords([]byte(id))
+}
+
+func DecodeStreamID(data []byte) string {
+	return strings.TrimRight(string(swapWords(data)), "\x00")
+}
+
+func ParseStreamID(id string) (name string, mode string) {
+	name, mode = id, "publish"
+	if strings.HasPrefix(id, "#!::") {
+		name = ""
+		for _, pair := range strings.Split(id[4:], ",") {
+			key, value, _ := strings.Cut(pair, "=")
+			switch key {
+			case "r":
+				name = value
+			case "m":
+				mode = value
+			}
+		}
+	}
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	return parts[len(parts)-1], mode
+}
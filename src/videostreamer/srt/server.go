@@ -0,0 +1,255 @@
+package srt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+	"videostreamer/check"
+	"videostreamer/core"
+	"videostreamer/logger"
+	"videostreamer/syncutil"
+	"videostreamer/ts"
+)
+
+func NewConfig() *Config {
+	return &Config{
+		Latency:     DEFAULT_LATENCY,
+		PeerTimeout: PEER_TIMEOUT,
+	}
+}
+
+func NewServer(app *core.Application, config *Config) *Server {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return &Server{
+		App:    app,
+		Config: config,
+		secret: secret,
+		conns:  make(map[uint32]*Conn),
+		peers:  make(map[string]*Conn),
+	}
+}
+
+func Serve(app *core.Application, latch *syncutil.SyncLatch, addr string, config *Config) {
+	udpAddr := check.Check1(net.ResolveUDPAddr("udp", addr)).(*net.UDPAddr)
+	conn := check.Check1(net.ListenUDP("udp", udpAddr)).(*net.UDPConn)
+	NewServer(app, config).ServeConn(latch, conn)
+}
+
+func (server *Server) ServeConn(latch *syncutil.SyncLatch, conn *net.UDPConn) {
+	logger.Info("SRT server started")
+	server.conn = conn
+	latch.Handle(func() {
+		conn.Close()
+	})
+	buf := make([]byte, MTU)
+	for latch.IsRunning() {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		packet, err := ParsePacket(append([]byte{}, buf[:n]...))
+		if err != nil {
+			continue
+		}
+		if packet.Control && packet.Type == CONTROL_HANDSHAKE && packet.Socket == 0 {
+			server.handshake(addr, packet)
+			continue
+		}
+		server.mutex.Lock()
+		c := server.conns[packet.Socket]
+		server.mutex.Unlock()
+		if c != nil && c.Addr.IP.Equal(addr.IP) && c.Addr.Port == addr.Port {
+			c.receive(packet)
+		}
+	}
+	for _, c := range server.list() {
+		c.Close()
+	}
+	latch.Complete()
+	logger.Info("SRT server done")
+}
+
+func (server *Server) list() (conns []*Conn) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, c := range server.conns {
+		conns = append(conns, c)
+	}
+	return
+}
+
+func (server *Server) cookie(addr *net.UDPAddr, at time.Time) uint32 {
+	mac := hmac.New(sha256.New, server.secret)
+	fmt.Fprintf(mac, "%s/%d", addr, at.Unix()/int64(COOKIE_PERIOD/time.Second))
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+func (server *Server) write(addr *net.UDPAddr, packet *Packet) {
+	server.conn.WriteToUDP(packet.Bytes(), addr)
+}
+
+func (server *Server) reply(addr *net.UDPAddr, socket uint32, hs *Handshake) {
+	server.write(addr, &Packet{Control: true, Type: CONTROL_HANDSHAKE, Socket: socket, Payload: hs.Bytes(addr.IP)})
+}
+
+func (server *Server) reject(addr *net.UDPAddr, hs *Handshake, reason uint32) {
+	logger.Infof("SRT caller %s rejected with reason %d", addr, reason)
+	server.reply(addr, hs.Socket, &Handshake{
+		Version:    5,
+		InitialSeq: hs.InitialSeq,
+		MTU:        MTU,
+		Window:     FLOW_WINDOW,
+		Type:       HANDSHAKE_REJECT + reason,
+		Cookie:     hs.Cookie,
+	})
+}
+
+func (server *Server) handshake(addr *net.UDPAddr, packet *Packet) {
+	hs, err := ParseHandshake(packet.Payload)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	switch hs.Type {
+	case HANDSHAKE_INDUCTION:
+		server.reply(addr, hs.Socket, &Handshake{
+			Version:    5,
+			Extension:  HANDSHAKE_MAGIC,
+			InitialSeq: hs.InitialSeq,
+			MTU:        MTU,
+			Window:     FLOW_WINDOW,
+			Type:       HANDSHAKE_INDUCTION,
+			Cookie:     server.cookie(addr, now),
+		})
+	case HANDSHAKE_CONCLUSION:
+		key := fmt.Sprintf("%s/%d", addr, hs.Socket)
+		server.mutex.Lock()
+		existing := server.peers[key]
+		server.mutex.Unlock()
+		if existing != nil {
+			server.conn.WriteToUDP(existing.response, addr)
+			return
+		}
+		if hs.Cookie != server.cookie(addr, now) && hs.Cookie != server.cookie(addr, now.Add(-COOKIE_PERIOD)) {
+			server.reject(addr, hs, REJECT_ROGUE)
+			return
+		}
+		server.conclude(addr, packet, hs, key)
+	}
+}
+
+func (server *Server) conclude(addr *net.UDPAddr, packet *Packet, hs *Handshake, key string) {
+	hsreq := hs.Extensions[EXT_HSREQ]
+	if hs.Version < 5 || len(hsreq) < 12 {
+		server.reject(addr, hs, REJECT_VERSION)
+		return
+	}
+	name, mode := ParseStreamID(DecodeStreamID(hs.Extensions[EXT_SID]))
+	if mode != "publish" {
+		server.reject(addr, hs, REJECT_BAD_MODE)
+		return
+	}
+	if name == "" {
+		server.reject(addr, hs, REJECT_BAD_REQUEST)
+		return
+	}
+	km := hs.Extensions[EXT_KMREQ]
+	var salt []byte
+	var keys [2][]byte
+	var err error
+	if server.Config.Passphrase == "" || km == nil {
+		if km != nil || server.Config.Passphrase != "" {
+			server.reject(addr, hs, REJECT_UNSECURE)
+			return
+		}
+	} else if salt, keys, err = ParseKeyMaterial(server.Config.Passphrase, km); err != nil {
+		server.reject(addr, hs, REJECT_BADSECRET)
+		return
+	}
+	latency := server.Config.Latency
+	if peer := time.Duration(binary.BigEndian.Uint32(hsreq[8:])&0xffff) * time.Millisecond; peer > latency {
+		latency = peer
+	}
+
+	now := time.Now()
+	c := &Conn{
+		Peer:     hs.Socket,
+		Addr:     addr,
+		Stream:   server.App.AcquireStream(name),
+		Latency:  latency,
+		server:   server,
+		keys:     keys,
+		salt:     salt,
+		start:    now,
+		base:     now.Add(-time.Duration(packet.Timestamp) * time.Microsecond),
+		last:     now,
+		sent:     now,
+		next:     hs.InitialSeq & SEQ_MASK,
+		highest:  hs.InitialSeq & SEQ_MASK,
+		buffer:   make(map[uint32]*segment),
+		loss:     make(map[uint32]time.Time),
+		acks:     make(map[uint32]time.Time),
+		rtt:      100 * time.Millisecond,
+		variance: 50 * time.Millisecond,
+		stop:     make(chan struct{}),
+	}
+	c.acked = c.next
+	c.demuxer = ts.NewDemuxer(c.Stream)
+	if !server.claim(c, key) {
+		server.reject(addr, hs, REJECT_CONFLICT)
+		return
+	}
+	response := &Handshake{
+		Version:    5,
+		Extension:  FLAG_HSREQ,
+		InitialSeq: hs.InitialSeq,
+		MTU:        MTU,
+		Window:     FLOW_WINDOW,
+		Type:       HANDSHAKE_CONCLUSION,
+		Socket:     c.ID,
+		Cookie:     hs.Cookie,
+		Extensions: map[uint16][]byte{
+			EXT_HSRSP: MakeHSExtension(SRT_VERSION, SRT_FLAGS, uint16(latency/time.Millisecond)),
+		},
+	}
+	if km != nil {
+		response.Extension |= FLAG_KMREQ
+		response.Extensions[EXT_KMRSP] = km
+	}
+	c.response = (&Packet{Control: true, Type: CONTROL_HANDSHAKE, Socket: hs.Socket, Payload: response.Bytes(addr.IP)}).Bytes()
+	server.conn.WriteToUDP(c.response, addr)
+	logger.Infof("SRT caller %s publishing %s with %v latency", addr, name, latency)
+	go c.run()
+}
+
+func (server *Server) claim(c *Conn, key string) bool {
+	if !c.Stream.Claim(c) {
+		return false
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for c.ID == 0 || server.conns[c.ID] != nil {
+		id := make([]byte, 4)
+		rand.Read(id)
+		c.ID = binary.BigEndian.Uint32(id) & 0x3fffffff
+	}
+	server.conns[c.ID] = c
+	server.peers[key] = c
+	return true
+}
+
+func (server *Server) remove(c *Conn) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	delete(server.conns, c.ID)
+	for key, other := range server.peers {
+		if other == c {
+			delete(server.peers, key)
+		}
+	}
+}
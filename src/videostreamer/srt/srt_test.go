@@ -0,0 +1,175 @@
+package srt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/testutil"
+	"videostreamer/ts"
+)
+
+var idr = append([]byte{0x17, 0x01, 0x00, 0x00, 0x00}, avc.JoinNALUs([][]byte{append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 3000)...)})...)
+
+func stream() []byte {
+	buf := bytes.Buffer{}
+	muxer := ts.NewMuxer(&buf)
+	muxer.WriteVideo(core.NewVideoData(0, testutil.Seq))
+	muxer.WriteTables()
+	muxer.WriteVideo(core.NewVideoData(0, idr))
+	for i := uint32(1); i <= 4; i++ {
+		muxer.WriteVideo(core.NewVideoData(40*i, append([]byte{0x27, 0x01, 0x00, 0x00, 0x00}, avc.JoinNALUs([][]byte{{0x41, byte(i)}})...)))
+	}
+	return buf.Bytes()
+}
+
+func expect(t *testing.T, record *testutil.Recorder) {
+	select {
+	case published := <-record.State:
+		if !published {
+			t.Fatal("stream unpublished")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream not published")
+	}
+	frames := []*core.VideoData{}
+	timeout := time.After(3 * time.Second)
+	for len(frames) < 4 {
+		select {
+		case data := <-record.Video:
+			if data.Data[1] == 1 {
+				frames = append(frames, data)
+			}
+		case <-timeout:
+			t.Fatalf("received %d frames", len(frames))
+		}
+	}
+	if !bytes.Equal(frames[0].Data, idr) || frames[3].Data[0] != 0x27 || frames[3].Time-frames[0].Time != 120 {
+		t.Errorf("frames %x... and %x at %d", frames[0].Data[:10], frames[3].Data, frames[3].Time)
+	}
+}
+
+func publish(t *testing.T, config *Config, passphrase string, skip func(uint32) bool) {
+	app := core.NewApplication()
+	record := testutil.NewRecorder()
+	app.AcquireStream("test").Subscribe(record)
+	addr, stop := testutil.ServeUDP(t, NewServer(app, config).ServeConn)
+	defer stop()
+
+	caller, err := Dial(addr, "#!::r=live/test,m=publish", passphrase, 40*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller.skip = skip
+	if caller.Latency != config.Latency {
+		t.Errorf("negotiated latency %v", caller.Latency)
+	}
+	if _, err := caller.Write(stream()); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, record)
+	caller.Close()
+	select {
+	case published := <-record.State:
+		if published {
+			t.Error("stream published again")
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("stream not unpublished")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	config := NewConfig()
+	config.Latency = 60 * time.Millisecond
+	publish(t, config, "", nil)
+}
+
+func TestEncrypted(t *testing.T) {
+	config := NewConfig()
+	config.Latency = 60 * time.Millisecond
+	config.Passphrase = "correct horse battery"
+	publish(t, config, config.Passphrase, nil)
+
+	addr, stop := testutil.ServeUDP(t, NewServer(core.NewApplication(), config).ServeConn)
+	defer stop()
+	for passphrase, reason := range map[string]string{"wrong horse battery": "reason 10", "": "reason 11"} {
+		if _, err := Dial(addr, "test", passphrase, 0); err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("dial with %q: %v", passphrase, err)
+		}
+	}
+}
+
+func TestRetransmit(t *testing.T) {
+	config := NewConfig()
+	config.Latency = 200 * time.Millisecond
+	skipped := map[uint32]bool{}
+	publish(t, config, "", func(seq uint32) bool {
+		if len(skipped) < 2 && !skipped[seq] {
+			skipped[seq] = true
+			return true
+		}
+		return false
+	})
+}
+
+func TestSeqBeyondWindow(t *testing.T) {
+	c := &Conn{next: 10, highest: 10, buffer: make(map[uint32]*segment), loss: make(map[uint32]time.Time)}
+	c.data(&Packet{Seq: seqAdd(10, 1<<29), Payload: []byte{0x47}})
+	c.data(&Packet{Seq: seqAdd(10, FLOW_WINDOW), Payload: []byte{0x47}})
+	if len(c.buffer) != 0 || len(c.loss) != 0 || c.highest != 10 {
+		t.Errorf("packets beyond the flow window buffered %d, lost %d, highest %d", len(c.buffer), len(c.loss), c.highest)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	app := core.NewApplication()
+	addr, stop := testutil.ServeUDP(t, NewServer(app, NewConfig()).ServeConn)
+	defer stop()
+	caller, err := Dial(addr, "live/test", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+	if _, err := Dial(addr, "#!::r=test", "", 0); err == nil || !strings.Contains(err.Error(), "reason 1409") {
+		t.Errorf("second publisher: %v", err)
+	}
+	if _, err := Dial(addr, "#!::r=other,m=request", "", 0); err == nil || !strings.Contains(err.Error(), "reason 1405") {
+		t.Errorf("player: %v", err)
+	}
+}
+
+func TestKeyWrap(t *testing.T) {
+	kek, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	key, _ := hex.DecodeString("00112233445566778899aabbccddeeff")
+	wrapped, err := WrapKey(kek, key)
+	if err != nil || hex.EncodeToString(wrapped) != "1fa68b0a8112b447aef34bd8fb5a7b829d3e862371d2cfe5" {
+		t.Fatalf("wrapped %x: %v", wrapped, err)
+	}
+	if unwrapped, err := UnwrapKey(kek, wrapped); err != nil || !bytes.Equal(unwrapped, key) {
+		t.Errorf("unwrapped %x: %v", unwrapped, err)
+	}
+	wrapped[3] ^= 1
+	if _, err := UnwrapKey(kek, wrapped); err == nil {
+		t.Error("corrupt key unwrapped")
+	}
+}
+
+func TestStreamID(t *testing.T) {
+	encoded := EncodeStreamID("live/test")
+	if len(encoded) != 12 || string(encoded[:4]) != "evil" || DecodeStreamID(encoded) != "live/test" {
+		t.Errorf("encoded %q", encoded)
+	}
+	for id, want := range map[string][2]string{
+		"test":                         {"test", "publish"},
+		"#!::r=live/cam1,m=publish":    {"cam1", "publish"},
+		"#!::u=admin,r=cam2,m=request": {"cam2", "request"},
+	} {
+		if name, mode := ParseStreamID(id); name != want[0] || mode != want[1] {
+			t.Errorf("%q parsed as %s %s", id, name, mode)
+		}
+	}
+}
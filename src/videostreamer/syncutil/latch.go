@@ -5,44 +5,60 @@ import (
 )
 
 type SyncLatch struct {
-	Running  bool
 	Group    sync.WaitGroup
 	Parent   *SyncLatch
 	Children []*SyncLatch
 	Handlers []func()
+	running  bool
+	mutex    sync.Mutex
 }
 
 func NewSyncLatch() *SyncLatch {
 	return &SyncLatch{
-		Running: true,
-		Group: sync.WaitGroup{},
+		Group:   sync.WaitGroup{},
+		running: true,
 	}
 }
 
+func (latch *SyncLatch) IsRunning() bool {
+	latch.mutex.Lock()
+	defer latch.mutex.Unlock()
+	return latch.running
+}
+
 func (latch *SyncLatch) SubLatch() (child *SyncLatch) {
 	latch.Group.Add(1)
 	child = &SyncLatch{
-		Running: true,
-		Group: sync.WaitGroup{},
-		Parent: latch,
+		Group:   sync.WaitGroup{},
+		Parent:  latch,
+		running: true,
 	}
+	latch.mutex.Lock()
 	latch.Children = append(latch.Children, child)
+	latch.mutex.Unlock()
 	return child
 }
 
 func (latch *SyncLatch) callHandlers() {
-	if latch.Running {
-		latch.Running = false
-		length := len(latch.Handlers) - 1
-		for i := range latch.Handlers {
-			latch.Handlers[length - i]()
+	latch.mutex.Lock()
+	running := latch.running
+	latch.running = false
+	handlers := latch.Handlers
+	latch.mutex.Unlock()
+	if running {
+		length := len(handlers) - 1
+		for i := range handlers {
+			handlers[length-i]()
 		}
 	}
 }
 
 func (latch *SyncLatch) Terminate() {
 	latch.callHandlers()
-	for _, c := range latch.Children {
+	latch.mutex.Lock()
+	children := append([]*SyncLatch(nil), latch.Children...)
+	latch.mutex.Unlock()
+	for _, c := range children {
 		c.Terminate()
 	}
 }
@@ -59,5 +75,7 @@ func (latch *SyncLatch) Complete() {
 }
 
 func (latch *SyncLatch) Handle(f func()) {
+	latch.mutex.Lock()
 	latch.Handlers = append(latch.Handlers, f)
+	latch.mutex.Unlock()
 }
\ No newline at end of file
@@ -0,0 +1,34 @@
+// Package testutil holds the media fixtures, consumers and server helpers
+// shared by the protocol tests.
+package testutil
+
+import (
+	"videostreamer/avc"
+	"videostreamer/core"
+)
+
+var (
+	SPS      = []byte{0x67, 0x64, 0x00, 0x1e, 0xac, 0xd9, 0x40, 0xa0, 0x3d, 0xa1, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00, 0x00, 0x03, 0x00, 0x32, 0x0f, 0x16, 0x2d, 0x96}
+	PPS      = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	Seq      = append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avc.MakeConfig([][]byte{SPS}, [][]byte{PPS})...)
+	ASC      = []byte{0x12, 0x10}
+	AudioSeq = append([]byte{0xaf, 0x00}, ASC...)
+)
+
+// Frame is an AVC video tag holding one small slice.
+func Frame(key bool, cts int) []byte {
+	head := byte(0x27)
+	if key {
+		head = 0x17
+	}
+	return append([]byte{head, 0x01, byte(cts >> 16), byte(cts >> 8), byte(cts)}, avc.JoinNALUs([][]byte{{0x65, 0x88, 0x84}})...)
+}
+
+// Feed sends a frame and an AAC tag every 500ms from from up to to, with a key
+// frame every second.
+func Feed(video func(*core.VideoData), audio func(*core.AudioData), from uint32, to uint32) {
+	for ts := from; ts < to; ts += 500 {
+		video(core.NewVideoData(ts, Frame(ts%1000 == 0, 0)))
+		audio(core.NewAudioData(ts, []byte{0xaf, 0x01, 0x21}))
+	}
+}
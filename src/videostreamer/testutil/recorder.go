@@ -0,0 +1,100 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+	"videostreamer/core"
+)
+
+const (
+	RECORDER_QUEUE = 64
+	WAIT_TIMEOUT   = 5 * time.Second
+)
+
+// Recorder is a consumer that queues what it receives. Once a queue is full
+// it drops data rather than stall the stream.
+type Recorder struct {
+	Video chan *core.VideoData
+	Audio chan *core.AudioData
+	Meta  chan *core.MetaData
+	State chan bool
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		Video: make(chan *core.VideoData, RECORDER_QUEUE),
+		Audio: make(chan *core.AudioData, RECORDER_QUEUE),
+		Meta:  make(chan *core.MetaData, RECORDER_QUEUE),
+		State: make(chan bool, RECORDER_QUEUE),
+	}
+}
+
+func (r *Recorder) ConsumeVideo(data *core.VideoData) {
+	select {
+	case r.Video <- data:
+	default:
+	}
+}
+
+func (r *Recorder) ConsumeAudio(data *core.AudioData) {
+	select {
+	case r.Audio <- data:
+	default:
+	}
+}
+
+func (r *Recorder) ConsumeMeta(data *core.MetaData) {
+	select {
+	case r.Meta <- data:
+	default:
+	}
+}
+
+func (r *Recorder) Publish() {
+	r.state(true)
+}
+
+func (r *Recorder) Unpublish() {
+	r.state(false)
+}
+
+func (r *Recorder) state(published bool) {
+	select {
+	case r.State <- published:
+	default:
+	}
+}
+
+func (r *Recorder) ExpectState(t *testing.T, published bool) {
+	t.Helper()
+	select {
+	case state := <-r.State:
+		if state != published {
+			t.Fatalf("published %v", state)
+		}
+	case <-time.After(WAIT_TIMEOUT):
+		t.Fatalf("never published %v", published)
+	}
+}
+
+func (r *Recorder) NextVideo(t *testing.T) *core.VideoData {
+	t.Helper()
+	select {
+	case data := <-r.Video:
+		return data
+	case <-time.After(WAIT_TIMEOUT):
+		t.Fatal("no video")
+	}
+	return nil
+}
+
+func (r *Recorder) NextAudio(t *testing.T) *core.AudioData {
+	t.Helper()
+	select {
+	case data := <-r.Audio:
+		return data
+	case <-time.After(WAIT_TIMEOUT):
+		t.Fatal("no audio")
+	}
+	return nil
+}
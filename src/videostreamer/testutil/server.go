@@ -0,0 +1,29 @@
+package testutil
+
+import (
+	"net"
+	"testing"
+	"videostreamer/syncutil"
+)
+
+// Serve runs serve on a loopback TCP listener until stop is called.
+func Serve(t *testing.T, serve func(*syncutil.SyncLatch, net.Listener)) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latch := syncutil.NewSyncLatch()
+	go serve(latch.SubLatch(), ln)
+	return ln.Addr().String(), latch.Terminate
+}
+
+// ServeUDP runs serve on a loopback UDP socket until stop is called.
+func ServeUDP(t *testing.T, serve func(*syncutil.SyncLatch, *net.UDPConn)) (addr string, stop func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	latch := syncutil.NewSyncLatch()
+	go serve(latch.SubLatch(), conn)
+	return conn.LocalAddr().String(), latch.Terminate
+}
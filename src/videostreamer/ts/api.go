@@ -0,0 +1,66 @@
+package ts
+
+import (
+	"io"
+	"videostreamer/aac"
+	"videostreamer/avc"
+	"videostreamer/core"
+)
+
+const PACKET_SIZE = 188
+
+const (
+	PID_PAT   = 0x0000
+	PID_PMT   = 0x1000
+	PID_VIDEO = 0x0100
+	PID_AUDIO = 0x0101
+	PID_NULL  = 0x1fff
+)
+
+const (
+	STREAM_TYPE_AAC  = 0x0f
+	STREAM_TYPE_H264 = 0x1b
+)
+
+const (
+	STREAM_ID_VIDEO = 0xe0
+	STREAM_ID_AUDIO = 0xc0
+)
+
+const (
+	TIMESTAMP_BITS = 33
+	AAC_FRAME_SIZE = 1024
+)
+
+type Muxer struct {
+	W        io.Writer
+	PMTPID   uint16
+	VideoPID uint16
+	AudioPID uint16
+	Video    *avc.Config
+	Audio    *aac.Config
+	Delay    uint64
+	cc       map[uint16]uint8
+}
+
+type elementary struct {
+	kind    uint8
+	data    []byte
+	length  int
+	started bool
+}
+
+type Demuxer struct {
+	Stream    *core.Stream
+	pmtPID    int
+	pids      map[uint16]*elementary
+	carry     []byte
+	sps       []byte
+	pps       []byte
+	audio     *aac.Config
+	video     bool
+	last      int64
+	base      int64
+	based     bool
+	published bool
+}
@@ -0,0 +1,275 @@
+package ts
+
+import (
+	"bytes"
+	"errors"
+	"videostreamer/aac"
+	"videostreamer/avc"
+	"videostreamer/core"
+)
+
+func NewDemuxer(stream *core.Stream) *Demuxer {
+	return &Demuxer{
+		Stream: stream,
+		pmtPID: -1,
+		pids:   make(map[uint16]*elementary),
+	}
+}
+
+func (demuxer *Demuxer) Write(data []byte) error {
+	if len(demuxer.carry) > 0 {
+		data = append(demuxer.carry, data...)
+		demuxer.carry = nil
+	}
+	for len(data) >= PACKET_SIZE {
+		if data[0] != 0x47 || len(data) > PACKET_SIZE && data[PACKET_SIZE] != 0x47 {
+			next := bytes.IndexByte(data[1:], 0x47)
+			if next < 0 {
+				return errors.New("Lost MPEG-TS sync")
+			}
+			data = data[1+next:]
+			continue
+		}
+		demuxer.packet(data[:PACKET_SIZE])
+		data = data[PACKET_SIZE:]
+	}
+	demuxer.carry = append([]byte{}, data...)
+	return nil
+}
+
+func (demuxer *Demuxer) Flush() {
+	for _, es := range demuxer.pids {
+		demuxer.flush(es)
+	}
+}
+
+func (demuxer *Demuxer) packet(pkt []byte) {
+	pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	start := pkt[1]&0x40 != 0
+	payload := pkt[4:]
+	switch pkt[3] >> 4 & 3 {
+	case 0, 2:
+		return
+	case 3:
+		if int(pkt[4]) >= len(payload) {
+			return
+		}
+		payload = payload[1+int(pkt[4]):]
+	}
+	switch {
+	case pid == PID_PAT:
+		if start {
+			demuxer.pat(payload)
+		}
+	case int(pid) == demuxer.pmtPID:
+		if start {
+			demuxer.pmt(payload)
+		}
+	default:
+		es := demuxer.pids[pid]
+		if es == nil {
+			return
+		}
+		if start {
+			demuxer.flush(es)
+			es.started = true
+			es.data = append(es.data[:0], payload...)
+			es.length = -1
+			if len(payload) >= 6 {
+				if n := int(payload[4])<<8 | int(payload[5]); n > 0 {
+					es.length = 6 + n
+				}
+			}
+		} else if es.started {
+			es.data = append(es.data, payload...)
+		}
+		if es.started && es.length > 0 && len(es.data) >= es.length {
+			demuxer.flush(es)
+		}
+	}
+}
+
+func psi(payload []byte, table uint8) []byte {
+	if len(payload) < 1 || 1+int(payload[0]) >= len(payload) {
+		return nil
+	}
+	sec := payload[1+int(payload[0]):]
+	if len(sec) < 12 || sec[0] != table {
+		return nil
+	}
+	length := int(sec[1]&0x0f)<<8 | int(sec[2])
+	if 3+length > len(sec) || length < 9 || CRC32(sec[:3+length]) != 0 {
+		return nil
+	}
+	return sec[8 : 3+length-4]
+}
+
+func (demuxer *Demuxer) pat(payload []byte) {
+	for body := psi(payload, 0x00); len(body) >= 4; body = body[4:] {
+		if program := int(body[0])<<8 | int(body[1]); program != 0 {
+			demuxer.pmtPID = int(body[2]&0x1f)<<8 | int(body[3])
+			return
+		}
+	}
+}
+
+func (demuxer *Demuxer) pmt(payload []byte) {
+	body := psi(payload, 0x02)
+	if len(body) < 4 {
+		return
+	}
+	info := int(body[2]&0x0f)<<8 | int(body[3])
+	if 4+info > len(body) {
+		return
+	}
+	pids := make(map[uint16]*elementary)
+	video := false
+	for body = body[4+info:]; len(body) >= 5; {
+		kind := body[0]
+		pid := uint16(body[1]&0x1f)<<8 | uint16(body[2])
+		length := int(body[3]&0x0f)<<8 | int(body[4])
+		if 5+length > len(body) {
+			break
+		}
+		body = body[5+length:]
+		if kind != STREAM_TYPE_H264 && kind != STREAM_TYPE_AAC {
+			continue
+		}
+		video = video || kind == STREAM_TYPE_H264
+		if es := demuxer.pids[pid]; es != nil && es.kind == kind {
+			pids[pid] = es
+		} else {
+			pids[pid] = &elementary{kind: kind}
+		}
+	}
+	demuxer.pids = pids
+	demuxer.video = video
+}
+
+func readTimestamp(data []byte) int64 {
+	return int64(data[0]>>1&7)<<30 | int64(data[1])<<22 | int64(data[2]>>1)<<15 | int64(data[3])<<7 | int64(data[4]>>1)
+}
+
+func (demuxer *Demuxer) unwrap(ts int64) int64 {
+	if !demuxer.based {
+		demuxer.based = true
+		demuxer.base = ts
+		demuxer.last = ts
+		return ts
+	}
+	diff := (ts - demuxer.last) & (1<<TIMESTAMP_BITS - 1)
+	if diff >= 1<<(TIMESTAMP_BITS-1) {
+		diff -= 1 << TIMESTAMP_BITS
+	}
+	demuxer.last += diff
+	return demuxer.last
+}
+
+func (demuxer *Demuxer) millis(ts int64) uint32 {
+	if ts < demuxer.base {
+		return 0
+	}
+	return uint32((ts - demuxer.base) / 90)
+}
+
+func (demuxer *Demuxer) flush(es *elementary) {
+	if !es.started {
+		return
+	}
+	es.started = false
+	data := es.data
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return
+	}
+	flags := data[7]
+	header := 9 + int(data[8])
+	if header > len(data) || flags&0x80 == 0 || len(data) < 14 {
+		return
+	}
+	pts := readTimestamp(data[9:])
+	dts := pts
+	if flags&0x40 != 0 && len(data) >= 19 {
+		dts = readTimestamp(data[14:])
+	}
+	dts = demuxer.unwrap(dts)
+	pts = dts + (pts-dts)&(1<<TIMESTAMP_BITS-1)
+	if pts-dts >= 1<<(TIMESTAMP_BITS-1) {
+		pts -= 1 << TIMESTAMP_BITS
+	}
+	payload := data[header:]
+	if es.length > 0 && es.length < len(data) {
+		payload = data[header:es.length]
+	}
+	if es.kind == STREAM_TYPE_H264 {
+		demuxer.h264(demuxer.millis(dts), int32((pts-dts)/90), payload)
+	} else {
+		demuxer.aac(demuxer.millis(pts), payload)
+	}
+}
+
+func (demuxer *Demuxer) h264(time uint32, cts int32, payload []byte) {
+	nalus := [][]byte{}
+	key, changed := false, false
+	for _, nalu := range avc.SplitAnnexB(payload) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case avc.NALU_SPS:
+			changed = changed || !bytes.Equal(nalu, demuxer.sps)
+			demuxer.sps = append([]byte{}, nalu...)
+		case avc.NALU_PPS:
+			changed = changed || !bytes.Equal(nalu, demuxer.pps)
+			demuxer.pps = append([]byte{}, nalu...)
+		case avc.NALU_AUD:
+		case avc.NALU_IDR:
+			key = true
+			nalus = append(nalus, nalu)
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	if demuxer.sps == nil || demuxer.pps == nil {
+		return
+	}
+	if changed {
+		config := avc.MakeConfig([][]byte{demuxer.sps}, [][]byte{demuxer.pps})
+		demuxer.Stream.ReceiveVideo(core.NewVideoData(time, append([]byte{0x17, 0, 0, 0, 0}, config...)))
+		demuxer.published = true
+		if info, err := avc.ParseSPS(demuxer.sps); err == nil {
+			demuxer.Stream.ReceiveMeta(core.NewMetaData(info.Width, info.Height, 0))
+		}
+	}
+	if len(nalus) == 0 {
+		return
+	}
+	header := byte(0x27)
+	if key {
+		header = 0x17
+	}
+	frame := []byte{header, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	demuxer.Stream.ReceiveVideo(core.NewVideoData(time, append(frame, avc.JoinNALUs(nalus)...)))
+}
+
+func (demuxer *Demuxer) aac(time uint32, payload []byte) {
+	for i := 0; len(payload) > 0; i++ {
+		config, header, length, err := aac.ParseADTS(payload)
+		if err != nil || length > len(payload) {
+			return
+		}
+		if demuxer.audio == nil || *demuxer.audio != *config {
+			demuxer.audio = config
+			asc := aac.MakeConfig(config.ObjectType, config.SampleRate, config.Channels)
+			demuxer.Stream.ReceiveAudio(core.NewAudioData(time, append([]byte{0xaf, 0}, asc...)))
+			if !demuxer.video && !demuxer.published {
+				demuxer.published = true
+				if !demuxer.Stream.IsPublished() {
+					demuxer.Stream.Publish()
+				}
+			}
+		}
+		offset := uint32(i * AAC_FRAME_SIZE * 1000 / int(config.SampleRate))
+		demuxer.Stream.ReceiveAudio(core.NewAudioData(time+offset, append([]byte{0xaf, 1}, payload[header:length]...)))
+		payload = payload[length:]
+	}
+}
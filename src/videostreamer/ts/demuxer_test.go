@@ -0,0 +1,66 @@
+package ts
+
+import (
+	"bytes"
+	"testing"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/testutil"
+)
+
+func TestDemux(t *testing.T) {
+	buf := bytes.Buffer{}
+	muxer := NewMuxer(&buf)
+	muxer.WriteVideo(core.NewVideoData(0, testutil.Seq))
+	muxer.WriteAudio(core.NewAudioData(0, []byte{0xaf, 0x00, 0x12, 0x10}))
+	muxer.WriteTables()
+	frame := append([]byte{0x17, 0x01, 0x00, 0x00, 0x50}, avc.JoinNALUs([][]byte{bytes.Repeat([]byte{0x65}, 1000)})...)
+	muxer.WriteVideo(core.NewVideoData(1000, frame))
+	muxer.WriteAudio(core.NewAudioData(1000, []byte{0xaf, 0x01, 0x21, 0x22}))
+	muxer.WriteVideo(core.NewVideoData(1040, append([]byte{0x27, 0x01, 0x00, 0x00, 0x00}, avc.JoinNALUs([][]byte{{0x41, 0x9a}})...)))
+	muxer.WriteAudio(core.NewAudioData(1046, []byte{0xaf, 0x01, 0x23, 0x24}))
+
+	stream := core.NewApplication().AcquireStream("test")
+	record := testutil.NewRecorder()
+	stream.Subscribe(record)
+	demuxer := NewDemuxer(stream)
+	data := append([]byte{0x00, 0x47, 0x12}, buf.Bytes()...)
+	for len(data) > 0 {
+		n := 100
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := demuxer.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	demuxer.Flush()
+
+	if published := len(record.State); published != 1 || !<-record.State || len(record.Meta) == 0 {
+		t.Errorf("published %d with %d metadata", published, len(record.Meta))
+	} else if meta := <-record.Meta; meta.Width != 640 {
+		t.Errorf("metadata %+v", meta)
+	}
+	video, audio := []*core.VideoData{}, []*core.AudioData{}
+	for len(record.Video) > 0 {
+		video = append(video, <-record.Video)
+	}
+	for len(record.Audio) > 0 {
+		audio = append(audio, <-record.Audio)
+	}
+	if len(video) < 3 || !bytes.Equal(video[0].Data, testutil.Seq) {
+		t.Fatalf("%d video frames", len(video))
+	}
+	key, inter := video[len(video)-2], video[len(video)-1]
+	if key.Data[0] != 0x17 || key.Data[1] != 1 || key.Data[4] != 0x50 || len(key.Data) != 5+4+1000 {
+		t.Errorf("key frame %x", key.Data[:5])
+	}
+	if inter.Data[0] != 0x27 || inter.Time-key.Time != 40 || !bytes.Equal(inter.Data[5:], avc.JoinNALUs([][]byte{{0x41, 0x9a}})) {
+		t.Errorf("inter frame at %d: %x", inter.Time-key.Time, inter.Data)
+	}
+	last := audio[len(audio)-1]
+	if !bytes.Equal(audio[0].Data, []byte{0xaf, 0x00, 0x12, 0x10}) || !bytes.Equal(last.Data, []byte{0xaf, 0x01, 0x23, 0x24}) || last.Time-key.Time != 46 {
+		t.Errorf("audio %x then %x at %d", audio[0].Data, last.Data, last.Time-key.Time)
+	}
+}
@@ -0,0 +1,225 @@
+package ts
+
+import (
+	"bytes"
+	"io"
+	"videostreamer/aac"
+	"videostreamer/avc"
+	"videostreamer/core"
+)
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		W:        w,
+		PMTPID:   PID_PMT,
+		VideoPID: PID_VIDEO,
+		AudioPID: PID_AUDIO,
+		cc:       make(map[uint16]uint8),
+	}
+}
+
+func (muxer *Muxer) pcrPID() uint16 {
+	if muxer.Video != nil || muxer.Audio == nil {
+		return muxer.VideoPID
+	}
+	return muxer.AudioPID
+}
+
+func section(table uint8, id uint16, body []byte) []byte {
+	length := len(body) + 9
+	sec := []byte{table, 0xb0 | byte(length>>8), byte(length), byte(id >> 8), byte(id), 0xc1, 0, 0}
+	sec = append(sec, body...)
+	crc := CRC32(sec)
+	return append(sec, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func (muxer *Muxer) WriteTables() error {
+	pat := section(0x00, 1, []byte{0, 1, 0xe0 | byte(muxer.PMTPID>>8), byte(muxer.PMTPID)})
+	pcr := muxer.pcrPID()
+	body := []byte{0xe0 | byte(pcr>>8), byte(pcr), 0xf0, 0}
+	if muxer.Video != nil {
+		body = append(body, STREAM_TYPE_H264, 0xe0|byte(muxer.VideoPID>>8), byte(muxer.VideoPID), 0xf0, 0)
+	}
+	if muxer.Audio != nil {
+		body = append(body, STREAM_TYPE_AAC, 0xe0|byte(muxer.AudioPID>>8), byte(muxer.AudioPID), 0xf0, 0)
+	}
+	pmt := section(0x02, 1, body)
+	buf := bytes.Buffer{}
+	muxer.packet(&buf, PID_PAT, true, 0, -1, append([]byte{0}, pat...))
+	muxer.packet(&buf, muxer.PMTPID, true, 0, -1, append([]byte{0}, pmt...))
+	_, err := muxer.W.Write(buf.Bytes())
+	return err
+}
+
+func (muxer *Muxer) packet(buf *bytes.Buffer, pid uint16, start bool, flags byte, pcr int64, payload []byte) int {
+	pkt := bytes.Repeat([]byte{0xff}, PACKET_SIZE)
+	pkt[0] = 0x47
+	pkt[1] = byte(pid>>8) & 0x1f
+	if start {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	cc := muxer.cc[pid]
+	muxer.cc[pid] = (cc + 1) & 0x0f
+
+	var af []byte
+	if flags != 0 || pcr >= 0 {
+		af = []byte{flags}
+		if pcr >= 0 {
+			af[0] |= 0x10
+			af = append(af, make([]byte, 6)...)
+			putPCR(af[1:], uint64(pcr))
+		}
+	}
+	n := len(payload)
+	if af == nil && n >= 184 {
+		pkt[3] = 0x10 | cc
+		copy(pkt[4:], payload[:184])
+		buf.Write(pkt)
+		return 184
+	}
+	if af == nil && n < 183 {
+		af = []byte{0}
+	}
+	if n > 183-len(af) {
+		n = 183 - len(af)
+	}
+	stuffing := 183 - len(af) - n
+	pkt[3] = 0x30 | cc
+	pkt[4] = byte(len(af) + stuffing)
+	copy(pkt[5:], af)
+	copy(pkt[5+len(af)+stuffing:], payload[:n])
+	buf.Write(pkt)
+	return n
+}
+
+func putPCR(b []byte, base uint64) {
+	b[0] = byte(base >> 25)
+	b[1] = byte(base >> 17)
+	b[2] = byte(base >> 9)
+	b[3] = byte(base >> 1)
+	b[4] = byte(base<<7) | 0x7e
+	b[5] = 0
+}
+
+func SetPCR(pkt []byte, base uint64) bool {
+	if len(pkt) < 12 || pkt[3]&0x20 == 0 || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+		return false
+	}
+	putPCR(pkt[6:], base)
+	return true
+}
+
+func NullPacket() []byte {
+	pkt := bytes.Repeat([]byte{0xff}, PACKET_SIZE)
+	pkt[0], pkt[1], pkt[2], pkt[3] = 0x47, PID_NULL>>8, PID_NULL&0xff, 0x10
+	return pkt
+}
+
+func timestamp(prefix byte, ts uint64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0e | 1,
+		byte(ts >> 22),
+		byte(ts>>14) | 1,
+		byte(ts >> 7),
+		byte(ts<<1) | 1,
+	}
+}
+
+func (muxer *Muxer) WritePES(pid uint16, sid uint8, pts uint64, dts uint64, key bool, data []byte) error {
+	pcr := int64(-1)
+	if pid == muxer.pcrPID() {
+		pcr = int64(dts)
+	}
+	pts, dts = pts+muxer.Delay, dts+muxer.Delay
+	header := []byte{0, 0, 1, sid, 0, 0, 0x80, 0x80, 5}
+	if pts != dts {
+		header[7] = 0xc0
+		header[8] = 10
+		header = append(header, timestamp(3, pts)...)
+		header = append(header, timestamp(1, dts)...)
+	} else {
+		header = append(header, timestamp(2, pts)...)
+	}
+	if length := len(header) - 6 + len(data); length < 0x10000 && sid != STREAM_ID_VIDEO {
+		header[4] = byte(length >> 8)
+		header[5] = byte(length)
+	}
+	payload := append(header, data...)
+
+	buf := bytes.Buffer{}
+	flags := byte(0)
+	if key {
+		flags = 0x40
+	}
+	for start := true; len(payload) > 0; start = false {
+		n := muxer.packet(&buf, pid, start, flags, pcr, payload)
+		payload = payload[n:]
+		flags, pcr = 0, -1
+	}
+	_, err := muxer.W.Write(buf.Bytes())
+	return err
+}
+
+func (muxer *Muxer) WriteVideo(data *core.VideoData) error {
+	d := data.Data
+	if len(d) < 5 || !data.IsAVC() {
+		return nil
+	}
+	switch d[1] {
+	case 0:
+		config, err := avc.ParseConfig(d[5:])
+		if err != nil {
+			return err
+		}
+		muxer.Video = config
+	case 1:
+		if muxer.Video == nil {
+			return nil
+		}
+		key := d[0]>>4 == 1
+		cts := int32(uint32(d[2])<<16|uint32(d[3])<<8|uint32(d[4])) << 8 >> 8
+		nalus := [][]byte{{avc.NALU_AUD, 0xf0}}
+		if key {
+			nalus = append(nalus, muxer.Video.SPS...)
+			nalus = append(nalus, muxer.Video.PPS...)
+		}
+		for _, nalu := range avc.SplitNALUs(d[5:], muxer.Video.LengthSize) {
+			switch nalu[0] & 0x1f {
+			case avc.NALU_AUD:
+				continue
+			case avc.NALU_SPS, avc.NALU_PPS:
+				if key {
+					continue
+				}
+			}
+			nalus = append(nalus, nalu)
+		}
+		dts := uint64(data.Time) * 90
+		pts := uint64(int64(dts) + int64(cts)*90)
+		return muxer.WritePES(muxer.VideoPID, STREAM_ID_VIDEO, pts, dts, key, avc.AnnexB(nalus))
+	}
+	return nil
+}
+
+func (muxer *Muxer) WriteAudio(data *core.AudioData) error {
+	d := data.Data
+	if len(d) < 2 || !data.IsAAC() {
+		return nil
+	}
+	switch d[1] {
+	case 0:
+		config, err := aac.ParseConfig(d[2:])
+		if err != nil {
+			return err
+		}
+		muxer.Audio = config
+	case 1:
+		if muxer.Audio == nil {
+			return nil
+		}
+		ts := uint64(data.Time) * 90
+		return muxer.WritePES(muxer.AudioPID, STREAM_ID_AUDIO, ts, ts, muxer.Video == nil, append(muxer.Audio.ADTS(len(d)-2), d[2:]...))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package ts
+
+import (
+	"bytes"
+	"testing"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/testutil"
+)
+
+func payloads(t *testing.T, data []byte) map[uint16][][]byte {
+	if len(data)%PACKET_SIZE != 0 {
+		t.Fatalf("%d bytes is not a whole number of packets", len(data))
+	}
+	units := map[uint16][][]byte{}
+	cc := map[uint16]int{}
+	for ; len(data) > 0; data = data[PACKET_SIZE:] {
+		pkt := data[:PACKET_SIZE]
+		if pkt[0] != 0x47 {
+			t.Fatalf("lost sync")
+		}
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		if last, ok := cc[pid]; ok && int(pkt[3]&0x0f) != (last+1)&0x0f {
+			t.Errorf("continuity error on pid %#x", pid)
+		}
+		cc[pid] = int(pkt[3] & 0x0f)
+		payload := pkt[4:]
+		if pkt[3]&0x20 != 0 {
+			payload = pkt[5+int(pkt[4]):]
+		}
+		if pkt[1]&0x40 != 0 {
+			units[pid] = append(units[pid], nil)
+		}
+		if n := len(units[pid]); n > 0 {
+			units[pid][n-1] = append(units[pid][n-1], payload...)
+		}
+	}
+	return units
+}
+
+func TestCRC(t *testing.T) {
+	if crc := CRC32([]byte("123456789")); crc != 0x0376e6e7 {
+		t.Errorf("crc %#x", crc)
+	}
+}
+
+func TestMux(t *testing.T) {
+	buf := bytes.Buffer{}
+	muxer := NewMuxer(&buf)
+	muxer.WriteVideo(core.NewVideoData(0, testutil.Seq))
+	muxer.WriteAudio(core.NewAudioData(0, []byte{0xaf, 0x00, 0x12, 0x10}))
+	muxer.WriteTables()
+	frame := append([]byte{0x17, 0x01, 0x00, 0x00, 0x50}, avc.JoinNALUs([][]byte{bytes.Repeat([]byte{0x65}, 1000)})...)
+	muxer.WriteVideo(core.NewVideoData(1000, frame))
+	muxer.WriteAudio(core.NewAudioData(1000, []byte{0xaf, 0x01, 0x21, 0x22}))
+
+	units := payloads(t, buf.Bytes())
+	for _, pid := range []uint16{PID_PAT, PID_PMT} {
+		sec := units[pid][0][1:]
+		length := int(sec[1]&0x0f)<<8 | int(sec[2])
+		if CRC32(sec[:3+length]) != 0 {
+			t.Errorf("bad crc on pid %#x", pid)
+		}
+	}
+	pmt := units[PID_PMT][0][1:]
+	if pmt[12] != STREAM_TYPE_H264 || pmt[17] != STREAM_TYPE_AAC {
+		t.Errorf("pmt streams %x", pmt)
+	}
+
+	video := units[PID_VIDEO][0]
+	if !bytes.Equal(video[:4], []byte{0, 0, 1, STREAM_ID_VIDEO}) || video[7] != 0xc0 {
+		t.Fatalf("video pes header %x", video[:9])
+	}
+	pts := uint64(video[9]>>1&7)<<30 | uint64(video[10])<<22 | uint64(video[11]>>1)<<15 | uint64(video[12])<<7 | uint64(video[13]>>1)
+	if pts != (1000+0x50)*90 {
+		t.Errorf("pts %d", pts)
+	}
+	nalus := avc.SplitAnnexB(video[19:])
+	if len(nalus) != 4 || nalus[0][0] != avc.NALU_AUD || !bytes.Equal(nalus[1], testutil.SPS) || len(nalus[3]) != 1000 {
+		t.Errorf("%d nalus in access unit", len(nalus))
+	}
+
+	audio := units[PID_AUDIO][0]
+	if length := int(audio[4])<<8 | int(audio[5]); length != len(audio)-6 {
+		t.Errorf("audio pes length %d for %d bytes", length, len(audio)-6)
+	}
+	if adts := audio[14:]; adts[0] != 0xff || !bytes.Equal(adts[7:], []byte{0x21, 0x22}) {
+		t.Errorf("adts frame %x", adts)
+	}
+
+	buf.Reset()
+	inter := append([]byte{0x27, 0x01, 0, 0, 0}, avc.JoinNALUs([][]byte{{avc.NALU_AUD, 0xf0}, {0x41, 0x9a}})...)
+	muxer.WriteVideo(core.NewVideoData(1040, inter))
+	video = payloads(t, buf.Bytes())[PID_VIDEO][0]
+	if nalus = avc.SplitAnnexB(video[9+int(video[8]):]); len(nalus) != 2 || nalus[0][0] != avc.NALU_AUD || nalus[1][0] != 0x41 {
+		t.Errorf("non-key access unit %x", nalus)
+	}
+}
+
+func pcrOf(pkt []byte) int64 {
+	if pkt[3]&0x20 == 0 || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+		return -1
+	}
+	return int64(pkt[6])<<25 | int64(pkt[7])<<17 | int64(pkt[8])<<9 | int64(pkt[9])<<1 | int64(pkt[10]>>7)
+}
+
+func TestDelay(t *testing.T) {
+	buf := bytes.Buffer{}
+	muxer := NewMuxer(&buf)
+	muxer.Delay = 45000
+	muxer.WriteVideo(core.NewVideoData(0, testutil.Seq))
+	muxer.WriteVideo(core.NewVideoData(2000, append([]byte{0x17, 0x01, 0x00, 0x00, 0x00}, avc.JoinNALUs([][]byte{{0x65, 0x88}})...)))
+	pkt := buf.Bytes()[:PACKET_SIZE]
+	if pcr := pcrOf(pkt); pcr != 2000*90 {
+		t.Errorf("pcr %d", pcr)
+	}
+	video := payloads(t, buf.Bytes())[PID_VIDEO][0]
+	pts := uint64(video[9]>>1&7)<<30 | uint64(video[10])<<22 | uint64(video[11]>>1)<<15 | uint64(video[12])<<7 | uint64(video[13]>>1)
+	if pts != 2000*90+45000 {
+		t.Errorf("pts %d", pts)
+	}
+	if !SetPCR(pkt, 1<<32+7) || pcrOf(pkt) != 1<<32+7 {
+		t.Errorf("restamped pcr %d", pcrOf(pkt))
+	}
+	null := NullPacket()
+	if len(null) != PACKET_SIZE || uint16(null[1]&0x1f)<<8|uint16(null[2]) != PID_NULL || SetPCR(null, 0) {
+		t.Errorf("null packet %x", null[:4])
+	}
+}
@@ -0,0 +1,22 @@
+package tshttp
+
+import (
+	"time"
+	"videostreamer/core"
+)
+
+const (
+	READ_SIZE    = 64 * 188
+	READ_TIMEOUT = 10 * time.Second
+)
+
+type Handler struct {
+	App         *core.Application
+	ReadTimeout time.Duration
+}
+
+type Publisher struct {
+	Stream   *core.Stream
+	Addr     string
+	Received uint64
+}
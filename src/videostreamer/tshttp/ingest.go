@@ -0,0 +1,79 @@
+package tshttp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"videostreamer/core"
+	"videostreamer/logger"
+	"videostreamer/ts"
+)
+
+func NewHandler(app *core.Application) *Handler {
+	return &Handler{
+		App:         app,
+		ReadTimeout: READ_TIMEOUT,
+	}
+}
+
+// ParsePath accepts /{name} and /{app}/{name}, optionally with a .ts extension.
+func ParsePath(path string) (name string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 2 {
+		return "", false
+	}
+	name = strings.TrimSuffix(parts[len(parts)-1], ".ts")
+	return name, name != ""
+}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := ParsePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	publisher := &Publisher{Stream: handler.App.AcquireStream(name), Addr: r.RemoteAddr}
+	if !publisher.Stream.Claim(publisher) {
+		http.Error(w, "Stream "+name+" is already published", http.StatusConflict)
+		return
+	}
+	defer publisher.Stream.Release(publisher)
+	logger.Infof("MPEG-TS publisher %s publishing %s", r.RemoteAddr, name)
+
+	demuxer := ts.NewDemuxer(publisher.Stream)
+	controller := http.NewResponseController(w)
+	buf := make([]byte, READ_SIZE)
+	var err error
+	for {
+		if handler.ReadTimeout > 0 {
+			controller.SetReadDeadline(time.Now().Add(handler.ReadTimeout))
+		}
+		var n int
+		n, err = r.Body.Read(buf)
+		if n > 0 {
+			publisher.Received += uint64(n)
+			if werr := demuxer.Write(buf[:n]); werr != nil {
+				logger.Debugf("MPEG-TS publisher %s of %s: %v", r.RemoteAddr, name, werr)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	demuxer.Flush()
+	if publisher.Stream.IsPublished() {
+		publisher.Stream.Unpublish()
+	}
+	if err != io.EOF {
+		logger.Infof("MPEG-TS publisher %s of %s gone after %d bytes: %v", r.RemoteAddr, name, publisher.Received, err)
+		return
+	}
+	logger.Infof("MPEG-TS publisher %s of %s done after %d bytes", r.RemoteAddr, name, publisher.Received)
+	w.WriteHeader(http.StatusNoContent)
+}
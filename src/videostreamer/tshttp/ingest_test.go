@@ -0,0 +1,88 @@
+package tshttp
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/testutil"
+	"videostreamer/ts"
+)
+
+var idr = append([]byte{0x17, 0x01, 0x00, 0x00, 0x00}, avc.JoinNALUs([][]byte{append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 3000)...)})...)
+
+func TestIngest(t *testing.T) {
+	app := core.NewApplication()
+	record := testutil.NewRecorder()
+	app.AcquireStream("test").Subscribe(record)
+	server := httptest.NewServer(http.StripPrefix("/ingest", NewHandler(app)))
+	defer server.Close()
+
+	reader, writer := io.Pipe()
+	response := make(chan int, 1)
+	go func() {
+		res, err := http.Post(server.URL+"/ingest/live/test", "video/mp2t", reader)
+		if err != nil {
+			response <- 0
+			return
+		}
+		res.Body.Close()
+		response <- res.StatusCode
+	}()
+
+	muxer := ts.NewMuxer(writer)
+	muxer.WriteVideo(core.NewVideoData(0, testutil.Seq))
+	muxer.WriteTables()
+	muxer.WriteVideo(core.NewVideoData(0, idr))
+	frame := func(i uint32) {
+		data := append([]byte{0x27, 0x01, 0x00, 0x00, 0x50}, avc.JoinNALUs([][]byte{{0x41, byte(i)}})...)
+		muxer.WriteVideo(core.NewVideoData(40*i, data))
+	}
+	// the key frame is only complete once the next PES starts
+	frame(1)
+	record.ExpectState(t, true)
+
+	if res, err := http.Post(server.URL+"/ingest/test.ts", "video/mp2t", bytes.NewReader(nil)); err != nil || res.StatusCode != http.StatusConflict {
+		t.Errorf("second publisher: %v %v", res, err)
+	}
+	if !app.AcquireStream("claimed").Claim(t) {
+		t.Fatal("cannot claim idle stream")
+	}
+	if res, err := http.Post(server.URL+"/ingest/claimed", "video/mp2t", bytes.NewReader(nil)); err != nil || res.StatusCode != http.StatusConflict {
+		t.Errorf("publisher of claimed stream: %v %v", res, err)
+	}
+	if res, err := http.Get(server.URL + "/ingest/test"); err != nil || res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %v %v", res, err)
+	}
+
+	frame(2)
+	frame(3)
+	writer.Close()
+
+	frames := []*core.VideoData{}
+	timeout := time.After(3 * time.Second)
+	for len(frames) < 4 {
+		select {
+		case data := <-record.Video:
+			if data.Data[1] == 1 {
+				frames = append(frames, data)
+			}
+		case <-timeout:
+			t.Fatalf("received %d frames", len(frames))
+		}
+	}
+	if !bytes.Equal(frames[0].Data, idr) {
+		t.Errorf("key frame %x...", frames[0].Data[:10])
+	}
+	if last := frames[3]; last.Time-frames[0].Time != 120 || last.Data[0] != 0x27 || last.Data[4] != 0x50 {
+		t.Errorf("last frame %x at %d", last.Data, last.Time)
+	}
+	record.ExpectState(t, false)
+	if status := <-response; status != http.StatusNoContent {
+		t.Errorf("status %d", status)
+	}
+}
@@ -0,0 +1,65 @@
+package tsudp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+	"videostreamer/aac"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/ts"
+)
+
+const (
+	PACKETS_PER_DATAGRAM = 7
+	DATAGRAM_SIZE        = PACKETS_PER_DATAGRAM * ts.PACKET_SIZE
+)
+
+const (
+	DEFAULT_TTL    = 16
+	DEFAULT_DELAY  = 500 * time.Millisecond
+	TABLE_INTERVAL = 100
+	PACE_INTERVAL  = 2 * time.Millisecond
+	FLUSH_DELAY    = 20 * time.Millisecond
+	MAX_DRIFT      = time.Second
+	QUEUE_SIZE     = 512
+)
+
+type Config struct {
+	Stream    string
+	Addr      *net.UDPAddr
+	TTL       int
+	Interface string
+	PMTPID    uint16
+	VideoPID  uint16
+	AudioPID  uint16
+	Muxrate   int
+	Delay     time.Duration
+}
+
+type chunk struct {
+	time uint32
+	data []byte
+}
+
+type Output struct {
+	Config  *Config
+	Stream  *core.Stream
+	Sent    uint64
+	Dropped uint64
+	Late    uint64
+	conn    *net.UDPConn
+	muxer   *ts.Muxer
+	buf     bytes.Buffer
+	queue   chan *chunk
+	stop    chan struct{}
+	mutex   sync.Mutex
+	video   *avc.Config
+	audio   *aac.Config
+	tables  uint32
+	tabled  bool
+	waitKey bool
+	live    bool
+	closed  bool
+}
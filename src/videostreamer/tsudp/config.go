@@ -0,0 +1,80 @@
+package tsudp
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"videostreamer/ts"
+)
+
+func parsePID(value string) (uint16, error) {
+	pid, err := strconv.ParseUint(value, 0, 16)
+	if err != nil || pid < 0x10 || pid >= 0x1fff {
+		return 0, fmt.Errorf("Bad PID %s", value)
+	}
+	return uint16(pid), nil
+}
+
+func ParseConfig(spec string) (*Config, error) {
+	idx := strings.Index(spec, "=udp://")
+	if idx <= 0 {
+		return nil, fmt.Errorf("Output %s is not name=udp://host:port", spec)
+	}
+	u, err := url.Parse(spec[idx+1:])
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil || addr.Port == 0 {
+		return nil, fmt.Errorf("Output %s lacks host or port", spec)
+	}
+	config := &Config{
+		Stream:   spec[:idx],
+		Addr:     addr,
+		TTL:      DEFAULT_TTL,
+		PMTPID:   ts.PID_PMT,
+		VideoPID: ts.PID_VIDEO,
+		AudioPID: ts.PID_AUDIO,
+		Delay:    DEFAULT_DELAY,
+	}
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "ttl":
+			if config.TTL, err = strconv.Atoi(value); err != nil || config.TTL < 1 || config.TTL > 255 {
+				return nil, fmt.Errorf("Bad TTL %s", value)
+			}
+		case "iface":
+			config.Interface = value
+		case "muxrate":
+			if config.Muxrate, err = strconv.Atoi(value); err != nil || config.Muxrate < 0 {
+				return nil, fmt.Errorf("Bad muxrate %s", value)
+			}
+		case "delay":
+			if config.Delay, err = time.ParseDuration(value); err != nil || config.Delay < 0 {
+				return nil, fmt.Errorf("Bad delay %s", value)
+			}
+		case "pmt_pid":
+			config.PMTPID, err = parsePID(value)
+		case "video_pid":
+			config.VideoPID, err = parsePID(value)
+		case "audio_pid":
+			config.AudioPID, err = parsePID(value)
+		default:
+			return nil, fmt.Errorf("Unknown option %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.PMTPID == config.VideoPID || config.PMTPID == config.AudioPID || config.VideoPID == config.AudioPID {
+		return nil, fmt.Errorf("Output %s reuses a PID", spec)
+	}
+	return config, nil
+}
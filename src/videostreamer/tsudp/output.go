@@ -0,0 +1,260 @@
+package tsudp
+
+import (
+	"net"
+	"time"
+	"videostreamer/binutil"
+	"videostreamer/core"
+	"videostreamer/logger"
+	"videostreamer/ts"
+)
+
+func Start(app *core.Application, config *Config) (*Output, error) {
+	family := "udp4"
+	if config.Addr.IP.To4() == nil {
+		family = "udp6"
+	}
+	conn, err := net.ListenUDP(family, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := setOptions(conn, config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	output := &Output{
+		Config: config,
+		Stream: app.AcquireStream(config.Stream),
+		conn:   conn,
+		queue:  make(chan *chunk, QUEUE_SIZE),
+		stop:   make(chan struct{}),
+	}
+	output.muxer = ts.NewMuxer(&output.buf)
+	output.muxer.PMTPID = config.PMTPID
+	output.muxer.VideoPID = config.VideoPID
+	output.muxer.AudioPID = config.AudioPID
+	output.muxer.Delay = uint64(config.Delay / (time.Second / 90000))
+	go output.run()
+	if output.Stream.IsPublished() {
+		output.Stream.Bootstrap(output)
+	}
+	output.Stream.Subscribe(output)
+	logger.Infof("Sending %s as MPEG-TS to udp://%s", config.Stream, config.Addr)
+	return output, nil
+}
+
+func (output *Output) Close() {
+	output.mutex.Lock()
+	if output.closed {
+		output.mutex.Unlock()
+		return
+	}
+	output.closed = true
+	output.mutex.Unlock()
+	output.Stream.Unsubscribe(output)
+	close(output.stop)
+}
+
+func (output *Output) Passive() {
+}
+
+func (output *Output) Publish() {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	output.live = true
+	output.tabled = false
+	output.waitKey = true
+}
+
+func (output *Output) Unpublish() {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	output.live = false
+	output.muxer.Video, output.muxer.Audio = nil, nil
+}
+
+func (output *Output) tablesDue(time uint32, key bool) {
+	if !output.tabled || key || output.video != output.muxer.Video || output.audio != output.muxer.Audio || time-output.tables >= TABLE_INTERVAL {
+		output.muxer.WriteTables()
+		output.tables, output.tabled = time, true
+		output.video, output.audio = output.muxer.Video, output.muxer.Audio
+	}
+}
+
+func (output *Output) ConsumeVideo(data *core.VideoData) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	d := data.Data
+	if len(d) < 5 || !data.IsAVC() {
+		return
+	}
+	if d[1] == 1 {
+		if output.muxer.Video == nil {
+			return
+		}
+		key := d[0]>>4 == 1
+		if output.waitKey {
+			if !key {
+				return
+			}
+			output.waitKey = false
+		}
+		output.tablesDue(data.Time, key)
+	}
+	if err := output.muxer.WriteVideo(data); err != nil {
+		logger.Warnf("Cannot mux video of %s: %v", output.Stream.Name, err)
+	}
+	output.enqueue(data.Time)
+}
+
+func (output *Output) ConsumeAudio(data *core.AudioData) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	d := data.Data
+	if len(d) < 2 || !data.IsAAC() {
+		return
+	}
+	if d[1] == 1 {
+		if output.muxer.Audio == nil || output.waitKey && output.muxer.Video != nil {
+			return
+		}
+		output.tablesDue(data.Time, false)
+	}
+	if err := output.muxer.WriteAudio(data); err != nil {
+		logger.Warnf("Cannot mux audio of %s: %v", output.Stream.Name, err)
+	}
+	output.enqueue(data.Time)
+}
+
+func (output *Output) ConsumeMeta(data *core.MetaData) {}
+
+func (output *Output) enqueue(time uint32) {
+	if output.buf.Len() == 0 {
+		return
+	}
+	c := &chunk{time: time, data: binutil.Dup(output.buf.Bytes())}
+	output.buf.Reset()
+	select {
+	case output.queue <- c:
+	default:
+		output.Dropped++
+		output.waitKey = output.muxer.Video != nil
+	}
+}
+
+func (output *Output) send(datagram []byte) {
+	if _, err := output.conn.WriteToUDP(datagram, output.Config.Addr); err != nil {
+		logger.Debugf("Sending TS of %s to %s: %v", output.Stream.Name, output.Config.Addr, err)
+		return
+	}
+	output.mutex.Lock()
+	output.Sent += uint64(len(datagram))
+	output.mutex.Unlock()
+}
+
+func (output *Output) run() {
+	defer output.conn.Close()
+	if output.Config.Muxrate > 0 {
+		output.pace()
+		return
+	}
+	pending := []byte{}
+	flush := time.NewTimer(FLUSH_DELAY)
+	flush.Stop()
+	for {
+		select {
+		case c := <-output.queue:
+			pending = append(pending, c.data...)
+			for len(pending) >= DATAGRAM_SIZE {
+				output.send(pending[:DATAGRAM_SIZE])
+				pending = pending[DATAGRAM_SIZE:]
+			}
+			if len(pending) > 0 {
+				flush.Reset(FLUSH_DELAY)
+			}
+		case <-flush.C:
+			if len(pending) > 0 {
+				for len(pending) < DATAGRAM_SIZE {
+					pending = append(pending, ts.NullPacket()...)
+				}
+				output.send(pending)
+				pending = []byte{}
+			}
+		case <-output.stop:
+			return
+		}
+	}
+}
+
+func (output *Output) pace() {
+	rate := float64(output.Config.Muxrate) / 8 / ts.PACKET_SIZE
+	slot := func(n int64) time.Duration {
+		return time.Duration(float64(n) / rate * float64(time.Second))
+	}
+	ticker := time.NewTicker(PACE_INTERVAL)
+	defer ticker.Stop()
+	var start, anchor time.Time
+	var sent int64
+	var base uint32
+	anchored := false
+	waiting := []*chunk{}
+	backlog := [][]byte{}
+	for {
+		select {
+		case c := <-output.queue:
+			waiting = append(waiting, c)
+			continue
+		case <-ticker.C:
+		case <-output.stop:
+			return
+		}
+		now := time.Now()
+		for len(waiting) > 0 {
+			c := waiting[0]
+			due := anchor.Add(time.Duration(int32(c.time-base)) * time.Millisecond)
+			if !anchored || due.Sub(now) > MAX_DRIFT || now.Sub(due) > MAX_DRIFT {
+				anchor, base, anchored, due = now, c.time, true, now
+			}
+			if due.After(now) {
+				break
+			}
+			for data := c.data; len(data) >= ts.PACKET_SIZE; data = data[ts.PACKET_SIZE:] {
+				backlog = append(backlog, data[:ts.PACKET_SIZE])
+			}
+			waiting = waiting[1:]
+		}
+		output.mutex.Lock()
+		live := output.live
+		output.mutex.Unlock()
+		if !live && len(backlog) == 0 {
+			start = time.Time{}
+			continue
+		}
+		if start.IsZero() {
+			start, sent = now, 0
+		}
+		budget := int64(float64(now.Sub(start)) / float64(time.Second) * rate)
+		if budget-sent > int64(rate) {
+			output.Late++
+			start, sent, budget = now, 0, PACKETS_PER_DATAGRAM
+		}
+		for sent+PACKETS_PER_DATAGRAM <= budget {
+			datagram := make([]byte, 0, DATAGRAM_SIZE)
+			for i := int64(0); i < PACKETS_PER_DATAGRAM; i++ {
+				if len(backlog) == 0 {
+					datagram = append(datagram, ts.NullPacket()...)
+					continue
+				}
+				pkt := backlog[0]
+				backlog = backlog[1:]
+				stc := int64(base)*90 + int64(start.Add(slot(sent+i)).Sub(anchor)/(time.Second/90000))
+				if stc >= 0 {
+					ts.SetPCR(pkt, uint64(stc))
+				}
+				datagram = append(datagram, pkt...)
+			}
+			output.send(datagram)
+			sent += PACKETS_PER_DATAGRAM
+		}
+	}
+}
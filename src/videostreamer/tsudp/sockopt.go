@@ -0,0 +1,66 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package tsudp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+func setOptions(conn *net.UDPConn, config *Config) error {
+	var iface *net.Interface
+	if config.Interface != "" {
+		var err error
+		if iface, err = net.InterfaceByName(config.Interface); err != nil {
+			return err
+		}
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ip := config.Addr.IP
+	var inet4 [4]byte
+	if ip.To4() != nil && ip.IsMulticast() && iface != nil {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				copy(inet4[:], ipnet.IP.To4())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Interface %s has no IPv4 address", iface.Name)
+		}
+	}
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		s := int(fd)
+		switch {
+		case ip.To4() != nil && ip.IsMulticast():
+			opErr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, config.TTL)
+			if opErr == nil && iface != nil {
+				opErr = syscall.SetsockoptInet4Addr(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, inet4)
+			}
+		case ip.To4() != nil:
+			opErr = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TTL, config.TTL)
+		case ip.IsMulticast():
+			opErr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, config.TTL)
+			if opErr == nil && iface != nil {
+				opErr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index)
+			}
+		default:
+			opErr = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, config.TTL)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package tsudp
+
+import (
+	"errors"
+	"net"
+)
+
+func setOptions(conn *net.UDPConn, config *Config) error {
+	if config.Interface != "" || config.TTL != DEFAULT_TTL {
+		return errors.New("TTL and interface options are not supported on this platform")
+	}
+	return nil
+}
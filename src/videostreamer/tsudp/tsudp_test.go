@@ -0,0 +1,155 @@
+package tsudp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/testutil"
+	"videostreamer/ts"
+)
+
+var idr = append([]byte{0x17, 0x01, 0x00, 0x00, 0x00}, avc.JoinNALUs([][]byte{append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 2000)...)})...)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig("live=udp://239.1.2.3:5000?ttl=4&iface=lo&muxrate=4000000&pmt_pid=0x20&video_pid=0x21&audio_pid=34&delay=300ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Stream != "live" || config.Addr.String() != "239.1.2.3:5000" || config.TTL != 4 || config.Interface != "lo" || config.Muxrate != 4000000 {
+		t.Errorf("config %+v", config)
+	}
+	if config.PMTPID != 0x20 || config.VideoPID != 0x21 || config.AudioPID != 0x22 || config.Delay != 300*time.Millisecond {
+		t.Errorf("pids %+v", config)
+	}
+	if config, _ = ParseConfig("live=udp://127.0.0.1:5000"); config.TTL != DEFAULT_TTL || config.VideoPID != ts.PID_VIDEO || config.Muxrate != 0 {
+		t.Errorf("defaults %+v", config)
+	}
+	for _, spec := range []string{
+		"udp://127.0.0.1:5000",
+		"live=rtmp://127.0.0.1/live",
+		"live=udp://127.0.0.1",
+		"live=udp://127.0.0.1:5000?ttl=0",
+		"live=udp://127.0.0.1:5000?video_pid=0x1fff",
+		"live=udp://127.0.0.1:5000?video_pid=0x101",
+		"live=udp://127.0.0.1:5000?bogus=1",
+	} {
+		if _, err := ParseConfig(spec); err == nil {
+			t.Errorf("%s accepted", spec)
+		}
+	}
+}
+
+func listen(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UDPConn, timeout time.Duration) (datagrams [][]byte) {
+	buf := make([]byte, 65536)
+	deadline := time.Now().Add(timeout)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n != DATAGRAM_SIZE {
+			t.Fatalf("datagram of %d bytes", n)
+		}
+		for i := 0; i < n; i += ts.PACKET_SIZE {
+			if buf[i] != 0x47 {
+				t.Fatalf("lost sync in datagram")
+			}
+		}
+		datagrams = append(datagrams, append([]byte{}, buf[:n]...))
+	}
+}
+
+func pids(datagrams [][]byte) map[uint16]int {
+	counts := map[uint16]int{}
+	for _, datagram := range datagrams {
+		for i := 0; i < len(datagram); i += ts.PACKET_SIZE {
+			counts[uint16(datagram[i+1]&0x1f)<<8|uint16(datagram[i+2])]++
+		}
+	}
+	return counts
+}
+
+func TestOutput(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+	config, _ := ParseConfig("test=udp://" + conn.LocalAddr().String() + "?pmt_pid=0x30&video_pid=0x31&audio_pid=0x32")
+	app := core.NewApplication()
+	output, err := Start(app, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	stream := app.AcquireStream("test")
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	stream.ReceiveAudio(core.NewAudioData(0, testutil.AudioSeq))
+	stream.ReceiveVideo(core.NewVideoData(0, []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9a}))
+	stream.ReceiveVideo(core.NewVideoData(40, idr))
+	stream.ReceiveAudio(core.NewAudioData(40, []byte{0xaf, 0x01, 0x21}))
+	counts := pids(receive(t, conn, 300*time.Millisecond))
+	if counts[ts.PID_PAT] != 1 || counts[0x30] != 1 || counts[0x31] != 12 || counts[0x32] != 1 {
+		t.Errorf("packets per pid %v", counts)
+	}
+	if counts[ts.PID_VIDEO] != 0 || counts[ts.PID_NULL] != 6 {
+		t.Errorf("packets per pid %v", counts)
+	}
+}
+
+func TestPaced(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+	config, _ := ParseConfig("test=udp://" + conn.LocalAddr().String() + "?muxrate=2000000&delay=100ms")
+	app := core.NewApplication()
+	output, err := Start(app, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	stream := app.AcquireStream("test")
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	go func() {
+		for i := uint32(0); i < 25; i++ {
+			stream.ReceiveVideo(core.NewVideoData(1000+40*i, idr))
+			time.Sleep(40 * time.Millisecond)
+		}
+	}()
+	receive(t, conn, 200*time.Millisecond)
+	began := time.Now()
+	datagrams := receive(t, conn, 500*time.Millisecond)
+	rate := float64(len(datagrams)*DATAGRAM_SIZE*8) / time.Since(began).Seconds()
+	if rate < 1500000 || rate > 2500000 {
+		t.Errorf("rate %.0f bit/s", rate)
+	}
+	counts := pids(datagrams)
+	if counts[ts.PID_NULL] == 0 || counts[ts.PID_VIDEO] == 0 {
+		t.Errorf("packets per pid %v", counts)
+	}
+	last := int64(-1)
+	for _, datagram := range datagrams {
+		for i := 0; i < len(datagram); i += ts.PACKET_SIZE {
+			pkt := datagram[i : i+ts.PACKET_SIZE]
+			if pkt[3]&0x20 == 0 || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+				continue
+			}
+			pcr := int64(pkt[6])<<25 | int64(pkt[7])<<17 | int64(pkt[8])<<9 | int64(pkt[9])<<1 | int64(pkt[10]>>7)
+			if last >= 0 && (pcr <= last || pcr-last > 9000) {
+				t.Errorf("pcr %d after %d", pcr, last)
+			}
+			last = pcr
+		}
+	}
+	if last < 0 {
+		t.Error("no pcr")
+	}
+}
@@ -0,0 +1,303 @@
+package webrtc
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"net"
+	"sync"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/rtsp"
+)
+
+const (
+	STUN_BINDING_REQUEST  = 0x0001
+	STUN_BINDING_RESPONSE = 0x0101
+	STUN_BINDING_ERROR    = 0x0111
+	STUN_MAGIC            = 0x2112A442
+	STUN_FINGERPRINT_XOR  = 0x5354554e
+)
+
+const (
+	ATTR_USERNAME           = 0x0006
+	ATTR_MESSAGE_INTEGRITY  = 0x0008
+	ATTR_ERROR_CODE         = 0x0009
+	ATTR_XOR_MAPPED_ADDRESS = 0x0020
+	ATTR_PRIORITY           = 0x0024
+	ATTR_USE_CANDIDATE      = 0x0025
+	ATTR_FINGERPRINT        = 0x8028
+	ATTR_ICE_CONTROLLED     = 0x8029
+	ATTR_ICE_CONTROLLING    = 0x802a
+)
+
+const (
+	DTLS_VERSION      = 0xfefd
+	DTLS_MTU          = 1200
+	CONTENT_CCS       = 20
+	CONTENT_ALERT     = 21
+	CONTENT_HANDSHAKE = 22
+	CONTENT_DATA      = 23
+)
+
+const (
+	HANDSHAKE_CLIENT_HELLO        = 1
+	HANDSHAKE_SERVER_HELLO        = 2
+	HANDSHAKE_HELLO_VERIFY        = 3
+	HANDSHAKE_CERTIFICATE         = 11
+	HANDSHAKE_SERVER_KEY_EXCHANGE = 12
+	HANDSHAKE_CERTIFICATE_REQUEST = 13
+	HANDSHAKE_SERVER_HELLO_DONE   = 14
+	HANDSHAKE_CERTIFICATE_VERIFY  = 15
+	HANDSHAKE_CLIENT_KEY_EXCHANGE = 16
+	HANDSHAKE_FINISHED            = 20
+)
+
+const (
+	EXT_SUPPORTED_GROUPS     = 0x000a
+	EXT_POINT_FORMATS        = 0x000b
+	EXT_SIGNATURE_ALGORITHMS = 0x000d
+	EXT_USE_SRTP             = 0x000e
+	EXT_EXTENDED_MASTER      = 0x0017
+	EXT_RENEGOTIATION_INFO   = 0xff01
+)
+
+const (
+	SUITE_ECDHE_ECDSA_AES128_GCM = 0xc02b
+	CURVE_P256                   = 23
+	SIGNATURE_ECDSA_SHA256       = 0x0403
+	CERT_ECDSA_SIGN              = 64
+	SRTP_AES128_CM_SHA1_80       = 0x0001
+	SRTP_KEY_LEN                 = 16
+	SRTP_SALT_LEN                = 14
+	SRTP_TAG_LEN                 = 10
+)
+
+const (
+	HANDSHAKE_TIMEOUT  = 10 * time.Second
+	RETRANSMIT         = 500 * time.Millisecond
+	CONSENT_TIMEOUT    = 30 * time.Second
+	REPORT_INTERVAL    = 5 * time.Second
+	QUEUE_SIZE         = 512
+	MAX_OFFER          = 64 << 10
+	MAX_HANDSHAKE      = 64 << 10
+	MAX_PENDING        = 8
+	VIDEO_CLOCK        = 90000
+	OPUS_CLOCK         = 48000
+	MAX_PAYLOAD        = 1200
+	REBASE_GAP         = 40
+	PLI_INTERVAL       = time.Second
+	OPUS_PRE_SKIP      = 312
+	CANDIDATE_PRIORITY = 2130706431
+)
+
+const (
+	AUDIO_EX_HEADER           = 9
+	AUDIO_PACKET_SEQUENCE     = 0
+	AUDIO_PACKET_CODED_FRAMES = 1
+	FOURCC_OPUS               = "Opus"
+)
+
+type Certificate struct {
+	DER         []byte
+	Key         *ecdsa.PrivateKey
+	Fingerprint string
+}
+
+type StunMessage struct {
+	Type        uint16
+	Transaction []byte
+	Attributes  []StunAttribute
+	raw         []byte
+}
+
+type StunAttribute struct {
+	Type  uint16
+	Value []byte
+}
+
+type message struct {
+	typ    uint8
+	seq    uint16
+	length int
+	body   []byte
+	filled []bool
+	got    int
+}
+
+type DTLSConn struct {
+	Client       bool
+	Certificate  *Certificate
+	Fingerprint  string
+	Profile      uint16
+	send         func([]byte) error
+	transcript   bytes.Buffer
+	clientRandom []byte
+	serverRandom []byte
+	ecdhKey      *ecdh.PrivateKey
+	peerKey      []byte
+	peerCert     []byte
+	verified     bool
+	last         uint8
+	extended     bool
+	master       []byte
+	sendSeq      uint16
+	recvSeq      uint16
+	pending      map[uint16]*message
+	writeEpoch   uint16
+	writeSeq     uint64
+	readEpoch    uint16
+	writeAEAD    cipher.AEAD
+	writeIV      []byte
+	readAEAD     cipher.AEAD
+	readIV       []byte
+	flight       [][]byte
+	records      [][]byte
+	done         bool
+	closed       bool
+	mutex        sync.Mutex
+}
+
+type SRTPContext struct {
+	rtpBlock  cipher.Block
+	rtpSalt   []byte
+	rtpAuth   []byte
+	rtcpBlock cipher.Block
+	rtcpSalt  []byte
+	rtcpAuth  []byte
+	rocs      map[uint32]*rollover
+	rtcpIndex uint32
+}
+
+type rollover struct {
+	roc     uint32
+	last    uint16
+	started bool
+}
+
+type Media struct {
+	Kind        string
+	Mid         string
+	PayloadType uint8
+	Codec       string
+	Fmtp        string
+	Direction   string
+	SSRC        uint32
+	Feedback    []string
+	Payloads    []uint8
+	Rtpmaps     map[uint8]string
+	Fmtps       map[uint8]string
+}
+
+type Description struct {
+	Ufrag       string
+	Pwd         string
+	Fingerprint string
+	Setup       string
+	Candidates  []*net.UDPAddr
+	Media       []*Media
+}
+
+type Track struct {
+	Media    *Media
+	SSRC     uint32
+	Seq      uint16
+	Offset   uint32
+	Clock    uint32
+	Packets  uint32
+	Octets   uint32
+	lastTime uint32
+	lastRTP  uint32
+	sent     bool
+	received bool
+	anchor   uint32
+	extended int64
+}
+
+type Peer struct {
+	Conn      *net.UDPConn
+	Local     *Description
+	Remote    *Description
+	DTLS      *DTLSConn
+	OnRTP     func([]byte)
+	OnRTCP    func([]byte)
+	Connected chan struct{}
+	Done      chan struct{}
+	remote    *net.UDPAddr
+	dtls      chan []byte
+	send      *SRTPContext
+	recv      *SRTPContext
+	consent   time.Time
+	connected bool
+	closed    bool
+	mutex     sync.Mutex
+}
+
+type Config struct {
+	Host net.IP
+}
+
+type Player struct {
+	ID      string
+	Stream  *core.Stream
+	Peer    *Peer
+	Video   *Track
+	Audio   *Track
+	Dropped uint64
+	handler *Handler
+	config  *avc.Config
+	queue   chan *frame
+	mutex   sync.Mutex
+	base    uint32
+	based   bool
+	rebase  bool
+	last    uint32
+	wall    time.Time
+	playing bool
+	waitKey bool
+	ended   bool
+}
+
+type frame struct {
+	video bool
+	time  uint32
+	data  []byte
+}
+
+type Handler struct {
+	App         *core.Application
+	Config      *Config
+	Certificate *Certificate
+	players     map[string]*Player
+	mutex       sync.Mutex
+}
+
+type Publisher struct {
+	ID        string
+	Stream    *core.Stream
+	Peer      *Peer
+	Video     *Track
+	Audio     *Track
+	handler   *IngestHandler
+	h264      rtsp.H264Depacketizer
+	sps       []byte
+	pps       []byte
+	ssrc      uint32
+	start     time.Time
+	started   bool
+	lastPLI   time.Time
+	waitKey   bool
+	published bool
+	ended     bool
+	mutex     sync.Mutex
+}
+
+type IngestHandler struct {
+	App         *core.Application
+	Config      *Config
+	Certificate *Certificate
+	publishers  map[string]*Publisher
+	mutex       sync.Mutex
+}
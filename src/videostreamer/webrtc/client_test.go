@@ -0,0 +1,142 @@
+package webrtc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t      *testing.T
+	cert   *Certificate
+	conn   *net.UDPConn
+	ufrag  string
+	pwd    string
+	server *net.UDPAddr
+	dtls   *DTLSConn
+	send   *SRTPContext
+	recv   *SRTPContext
+	in     chan []byte
+	rtp    chan []byte
+	rtcp   chan []byte
+}
+
+func newTestClient(t *testing.T) *testClient {
+	cert, err := NewCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{
+		t:     t,
+		cert:  cert,
+		conn:  conn,
+		ufrag: randomString(4),
+		pwd:   randomString(12),
+		in:    make(chan []byte, 64),
+		rtp:   make(chan []byte, 1024),
+		rtcp:  make(chan []byte, 64),
+	}
+}
+
+func (c *testClient) offer(direction string, media ...string) string {
+	sdp := fmt.Sprintf("v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=ice-ufrag:%s\r\na=ice-pwd:%s\r\na=fingerprint:sha-256 %s\r\na=setup:actpass\r\n", c.ufrag, c.pwd, c.cert.Fingerprint)
+	for i, m := range media {
+		sdp += fmt.Sprintf("%s\r\na=mid:%d\r\na=%s\r\na=rtcp-mux\r\n", strings.ReplaceAll(m, "\n", "\r\n"), i, direction)
+	}
+	return sdp
+}
+
+func (c *testClient) connect(answer *Description) {
+	if len(answer.Candidates) == 0 {
+		c.t.Fatal("answer without candidates")
+	}
+	c.server = answer.Candidates[0]
+	request := NewStun(STUN_BINDING_REQUEST, []byte(randomString(6)))
+	request.Add(ATTR_USERNAME, []byte(answer.Ufrag+":"+c.ufrag))
+	request.Add(ATTR_ICE_CONTROLLING, []byte(randomString(4)))
+	request.Add(ATTR_USE_CANDIDATE, nil)
+	c.conn.WriteToUDP(request.Encode([]byte(answer.Pwd)), c.server)
+	buf := make([]byte, 1<<16)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := c.conn.ReadFromUDP(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	response, err := ParseStun(buf[:n])
+	if err != nil || response.Type != STUN_BINDING_RESPONSE || !response.CheckIntegrity([]byte(answer.Pwd)) {
+		c.t.Fatalf("bad binding response %x: %v", buf[:n], err)
+	}
+	if addr := ParseXorAddress(response.Get(ATTR_XOR_MAPPED_ADDRESS), response.Transaction); addr.Port != c.conn.LocalAddr().(*net.UDPAddr).Port {
+		c.t.Errorf("mapped address %v", addr)
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	go c.read()
+	c.dtls = NewDTLSConn(true, c.cert, answer.Fingerprint, func(data []byte) error {
+		_, err := c.conn.WriteToUDP(data, c.server)
+		return err
+	})
+	if err := c.dtls.Handshake(c.in); err != nil {
+		c.t.Fatal(err)
+	}
+	if c.send, c.recv, err = c.dtls.SRTPKeys(); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) read() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			close(c.rtp)
+			return
+		}
+		data := append([]byte{}, buf[:n]...)
+		switch {
+		case data[0] >= 20 && data[0] < 64:
+			select {
+			case c.in <- data:
+			default:
+			}
+		case data[0] >= 128 && data[0] < 192 && data[1] >= 192 && data[1] <= 223:
+			c.rtcp <- data
+		case data[0] >= 128 && data[0] < 192:
+			c.rtp <- data
+		}
+	}
+}
+
+func (c *testClient) readRTP() []byte {
+	select {
+	case data, ok := <-c.rtp:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		packet, err := c.recv.UnprotectRTP(data)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return packet
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no RTP received")
+	}
+	return nil
+}
+
+func (c *testClient) writeRTP(packet []byte) {
+	protected, err := c.send.ProtectRTP(packet)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn.WriteToUDP(protected, c.server)
+}
+
+func (c *testClient) close() {
+	c.conn.Close()
+}
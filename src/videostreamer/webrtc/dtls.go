@@ -0,0 +1,643 @@
+package webrtc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+	"videostreamer/binutil"
+	"videostreamer/check"
+)
+
+func NewCertificate() (*Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "videostreamer"},
+		NotBefore:    time.Now().Add(-24 * time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{DER: der, Key: key, Fingerprint: Fingerprint(der)}, nil
+}
+
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+func prf(secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	out := []byte{}
+	a := seed
+	for len(out) < n {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+func NewDTLSConn(client bool, cert *Certificate, fingerprint string, send func([]byte) error) *DTLSConn {
+	return &DTLSConn{
+		Client:      client,
+		Certificate: cert,
+		Fingerprint: fingerprint,
+		send:        send,
+		pending:     make(map[uint16]*message),
+	}
+}
+
+func (conn *DTLSConn) Established() bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.done
+}
+
+func (conn *DTLSConn) Export(label string, n int) []byte {
+	return prf(conn.master, label, append(append([]byte{}, conn.clientRandom...), conn.serverRandom...), n)
+}
+
+func (conn *DTLSConn) SRTPKeys() (local *SRTPContext, remote *SRTPContext, err error) {
+	keys := conn.Export("EXTRACTOR-dtls_srtp", 2*(SRTP_KEY_LEN+SRTP_SALT_LEN))
+	clientKey, serverKey := keys[:SRTP_KEY_LEN], keys[SRTP_KEY_LEN:2*SRTP_KEY_LEN]
+	clientSalt, serverSalt := keys[2*SRTP_KEY_LEN:2*SRTP_KEY_LEN+SRTP_SALT_LEN], keys[2*SRTP_KEY_LEN+SRTP_SALT_LEN:]
+	if !conn.Client {
+		clientKey, serverKey, clientSalt, serverSalt = serverKey, clientKey, serverSalt, clientSalt
+	}
+	if local, err = NewSRTPContext(clientKey, clientSalt); err != nil {
+		return
+	}
+	remote, err = NewSRTPContext(serverKey, serverSalt)
+	return
+}
+
+func (conn *DTLSConn) seal(typ uint8, epoch uint16, seq uint64, plaintext []byte) []byte {
+	explicit := binary.BigEndian.AppendUint64(nil, uint64(epoch)<<48|seq)
+	nonce := append(append([]byte{}, conn.writeIV...), explicit...)
+	aad := append(append([]byte{}, explicit...), typ, DTLS_VERSION>>8, DTLS_VERSION&0xff, byte(len(plaintext)>>8), byte(len(plaintext)))
+	return conn.writeAEAD.Seal(explicit, nonce, plaintext, aad)
+}
+
+func (conn *DTLSConn) unseal(typ uint8, header []byte, payload []byte) ([]byte, error) {
+	if len(payload) < 8+16 {
+		return nil, errors.New("DTLS record truncated")
+	}
+	nonce := append(append([]byte{}, conn.readIV...), payload[:8]...)
+	length := len(payload) - 8 - 16
+	aad := append(append([]byte{}, header[3:11]...), typ, DTLS_VERSION>>8, DTLS_VERSION&0xff, byte(length>>8), byte(length))
+	return conn.readAEAD.Open(nil, nonce, payload[8:], aad)
+}
+
+func (conn *DTLSConn) record(typ uint8, payload []byte) []byte {
+	if conn.writeEpoch > 0 {
+		payload = conn.seal(typ, conn.writeEpoch, conn.writeSeq, payload)
+	}
+	record := []byte{typ, DTLS_VERSION >> 8, DTLS_VERSION & 0xff}
+	record = binary.BigEndian.AppendUint64(record, uint64(conn.writeEpoch)<<48|conn.writeSeq)
+	record = binary.BigEndian.AppendUint16(record, uint16(len(payload)))
+	conn.writeSeq++
+	return append(record, payload...)
+}
+
+func (conn *DTLSConn) handshake(typ uint8, body []byte) {
+	msg := []byte{typ, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	msg = binary.BigEndian.AppendUint16(msg, conn.sendSeq)
+	msg = append(msg, 0, 0, 0, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	msg = append(msg, body...)
+	conn.sendSeq++
+	conn.transcript.Write(msg)
+	conn.records = append(conn.records, conn.record(CONTENT_HANDSHAKE, msg))
+}
+
+func (conn *DTLSConn) changeCipherSpec() {
+	conn.records = append(conn.records, conn.record(CONTENT_CCS, []byte{1}))
+	conn.writeEpoch++
+	conn.writeSeq = 0
+}
+
+func (conn *DTLSConn) flush() error {
+	conn.flight = nil
+	datagram := []byte{}
+	for _, record := range conn.records {
+		if len(datagram) > 0 && len(datagram)+len(record) > DTLS_MTU {
+			conn.flight = append(conn.flight, datagram)
+			datagram = []byte{}
+		}
+		datagram = append(datagram, record...)
+	}
+	if len(datagram) > 0 {
+		conn.flight = append(conn.flight, datagram)
+	}
+	conn.records = nil
+	return conn.retransmit()
+}
+
+func (conn *DTLSConn) retransmit() error {
+	for _, datagram := range conn.flight {
+		if err := conn.send(datagram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (conn *DTLSConn) Handshake(in <-chan []byte) error {
+	if conn.Client {
+		if err := conn.clientHello(); err != nil {
+			return err
+		}
+	}
+	deadline := time.NewTimer(HANDSHAKE_TIMEOUT)
+	defer deadline.Stop()
+	ticker := time.NewTicker(RETRANSMIT)
+	defer ticker.Stop()
+	for !conn.Established() {
+		select {
+		case datagram, ok := <-in:
+			if !ok {
+				return io.ErrClosedPipe
+			}
+			if err := conn.Handle(datagram); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			conn.mutex.Lock()
+			conn.retransmit()
+			conn.mutex.Unlock()
+		case <-deadline.C:
+			return errors.New("DTLS handshake timed out")
+		}
+	}
+	return nil
+}
+
+func (conn *DTLSConn) Handle(datagram []byte) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed {
+		return io.EOF
+	}
+	resend := false
+	for len(datagram) >= 13 {
+		header := datagram[:13]
+		length := int(binary.BigEndian.Uint16(header[11:]))
+		if 13+length > len(datagram) {
+			return errors.New("DTLS record truncated")
+		}
+		typ, epoch, payload := header[0], binary.BigEndian.Uint16(header[3:]), datagram[13:13+length]
+		datagram = datagram[13+length:]
+		if epoch != conn.readEpoch {
+			continue
+		}
+		if epoch > 0 {
+			var err error
+			if payload, err = conn.unseal(typ, header, payload); err != nil {
+				continue
+			}
+		}
+		switch typ {
+		case CONTENT_HANDSHAKE:
+			if conn.collect(payload) {
+				resend = true
+			}
+			for msg := conn.next(); msg != nil; msg = conn.next() {
+				if err := conn.step(msg); err != nil {
+					return err
+				}
+			}
+		case CONTENT_CCS:
+			if conn.readAEAD == nil {
+				return errors.New("ChangeCipherSpec before key exchange")
+			}
+			conn.readEpoch++
+		case CONTENT_ALERT:
+			if len(payload) >= 2 && (payload[0] == 2 || payload[1] == 0) {
+				conn.closed = true
+				return io.EOF
+			}
+		}
+	}
+	if resend && !(conn.Client && conn.done) {
+		conn.retransmit()
+	}
+	return nil
+}
+
+func (conn *DTLSConn) collect(payload []byte) (old bool) {
+	for len(payload) >= 12 {
+		typ := payload[0]
+		length := int(payload[1])<<16 | int(payload[2])<<8 | int(payload[3])
+		seq := binary.BigEndian.Uint16(payload[4:])
+		offset := int(payload[6])<<16 | int(payload[7])<<8 | int(payload[8])
+		size := int(payload[9])<<16 | int(payload[10])<<8 | int(payload[11])
+		if 12+size > len(payload) || offset+size > length || length > MAX_HANDSHAKE {
+			return
+		}
+		fragment := payload[12 : 12+size]
+		payload = payload[12+size:]
+		if seq < conn.recvSeq {
+			old = true
+			continue
+		}
+		if seq-conn.recvSeq >= MAX_PENDING {
+			continue
+		}
+		msg := conn.pending[seq]
+		if msg == nil {
+			msg = &message{typ: typ, seq: seq, length: length, body: make([]byte, length), filled: make([]bool, length)}
+			conn.pending[seq] = msg
+		}
+		if msg.typ != typ || msg.length != length {
+			continue
+		}
+		copy(msg.body[offset:], fragment)
+		for i := offset; i < offset+size; i++ {
+			if !msg.filled[i] {
+				msg.filled[i] = true
+				msg.got++
+			}
+		}
+	}
+	return
+}
+
+func (conn *DTLSConn) next() *message {
+	msg := conn.pending[conn.recvSeq]
+	if msg == nil || msg.got < msg.length {
+		return nil
+	}
+	delete(conn.pending, conn.recvSeq)
+	conn.recvSeq++
+	return msg
+}
+
+func (conn *DTLSConn) hash() []byte {
+	sum := sha256.Sum256(conn.transcript.Bytes())
+	return sum[:]
+}
+
+func (conn *DTLSConn) append(msg *message) {
+	header := []byte{msg.typ, byte(msg.length >> 16), byte(msg.length >> 8), byte(msg.length)}
+	header = binary.BigEndian.AppendUint16(header, msg.seq)
+	header = append(header, 0, 0, 0, byte(msg.length>>16), byte(msg.length>>8), byte(msg.length))
+	conn.transcript.Write(header)
+	conn.transcript.Write(msg.body)
+}
+
+// flows lists for the client and the server which handshake messages may follow
+// the last one received, so a peer cannot skip or reorder steps.
+var flows = map[bool]map[uint8][]uint8{
+	false: {
+		0:                             {HANDSHAKE_CLIENT_HELLO},
+		HANDSHAKE_CLIENT_HELLO:        {HANDSHAKE_CERTIFICATE},
+		HANDSHAKE_CERTIFICATE:         {HANDSHAKE_CLIENT_KEY_EXCHANGE},
+		HANDSHAKE_CLIENT_KEY_EXCHANGE: {HANDSHAKE_CERTIFICATE_VERIFY},
+		HANDSHAKE_CERTIFICATE_VERIFY:  {HANDSHAKE_FINISHED},
+	},
+	true: {
+		0:                             {HANDSHAKE_SERVER_HELLO},
+		HANDSHAKE_SERVER_HELLO:        {HANDSHAKE_CERTIFICATE},
+		HANDSHAKE_CERTIFICATE:         {HANDSHAKE_SERVER_KEY_EXCHANGE},
+		HANDSHAKE_SERVER_KEY_EXCHANGE: {HANDSHAKE_CERTIFICATE_REQUEST, HANDSHAKE_SERVER_HELLO_DONE},
+		HANDSHAKE_CERTIFICATE_REQUEST: {HANDSHAKE_SERVER_HELLO_DONE},
+		HANDSHAKE_SERVER_HELLO_DONE:   {HANDSHAKE_FINISHED},
+	},
+}
+
+func (conn *DTLSConn) expects(typ uint8) bool {
+	for _, next := range flows[conn.Client][conn.last] {
+		if next == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func (conn *DTLSConn) step(msg *message) (err error) {
+	defer check.CheckPanicHandler(&err)
+	if !conn.expects(msg.typ) {
+		return fmt.Errorf("Unexpected handshake message %d", msg.typ)
+	}
+	conn.last = msg.typ
+	before := conn.hash()
+	conn.append(msg)
+	r := bytes.NewReader(msg.body)
+	switch msg.typ {
+	case HANDSHAKE_CLIENT_HELLO:
+		return conn.serverHello(r)
+	case HANDSHAKE_SERVER_HELLO:
+		conn.readServerHello(r)
+	case HANDSHAKE_CERTIFICATE:
+		binutil.ReadInt(r, 3)
+		conn.peerCert = binutil.ReadBuf(r, binutil.ReadInt(r, 3))
+		conn.verified = false
+		if conn.Fingerprint != "" && !strings.EqualFold(Fingerprint(conn.peerCert), conn.Fingerprint) {
+			return errors.New("DTLS certificate does not match fingerprint")
+		}
+	case HANDSHAKE_SERVER_KEY_EXCHANGE:
+		if binutil.ReadInt(r, 1) != 3 || binutil.ReadInt(r, 2) != CURVE_P256 {
+			return errors.New("Unsupported key exchange curve")
+		}
+		conn.peerKey = binutil.ReadBuf(r, binutil.ReadInt(r, 1))
+		params := msg.body[:4+len(conn.peerKey)]
+		binutil.ReadInt(r, 2)
+		signature := binutil.ReadBuf(r, binutil.ReadInt(r, 2))
+		signed := append(append(append([]byte{}, conn.clientRandom...), conn.serverRandom...), params...)
+		check.Check0(conn.verify(signed, signature))
+	case HANDSHAKE_CERTIFICATE_REQUEST:
+	case HANDSHAKE_SERVER_HELLO_DONE:
+		return conn.clientFinish()
+	case HANDSHAKE_CLIENT_KEY_EXCHANGE:
+		conn.peerKey = binutil.ReadBuf(r, binutil.ReadInt(r, 1))
+		check.Check0(conn.keys())
+	case HANDSHAKE_CERTIFICATE_VERIFY:
+		binutil.ReadInt(r, 2)
+		check.Check0(conn.verify(conn.transcript.Bytes()[:conn.transcript.Len()-12-msg.length], binutil.ReadBuf(r, binutil.ReadInt(r, 2))))
+		conn.verified = true
+	case HANDSHAKE_FINISHED:
+		label := "server finished"
+		if !conn.Client {
+			label = "client finished"
+		}
+		if !hmac.Equal(msg.body, prf(conn.master, label, before, 12)) {
+			return errors.New("DTLS Finished does not verify")
+		}
+		if !conn.Client {
+			if conn.peerCert == nil {
+				return errors.New("DTLS peer sent no certificate")
+			}
+			if !conn.verified {
+				return errors.New("DTLS peer did not prove its certificate")
+			}
+			conn.changeCipherSpec()
+			conn.handshake(HANDSHAKE_FINISHED, prf(conn.master, "server finished", conn.hash(), 12))
+			check.Check0(conn.flush())
+		}
+		conn.done = true
+	default:
+		return fmt.Errorf("Unexpected handshake message %d", msg.typ)
+	}
+	return nil
+}
+
+func (conn *DTLSConn) verify(signed []byte, signature []byte) error {
+	if conn.peerCert == nil {
+		return errors.New("DTLS signature without certificate")
+	}
+	cert, err := x509.ParseCertificate(conn.peerCert)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("DTLS peer certificate is not ECDSA")
+	}
+	sum := sha256.Sum256(signed)
+	if !ecdsa.VerifyASN1(key, sum[:], signature) {
+		return errors.New("DTLS signature does not verify")
+	}
+	return nil
+}
+
+func (conn *DTLSConn) sign(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return check.Check1(ecdsa.SignASN1(rand.Reader, conn.Certificate.Key, sum[:])).([]byte)
+}
+
+func (conn *DTLSConn) keys() error {
+	remote, err := ecdh.P256().NewPublicKey(conn.peerKey)
+	if err != nil {
+		return err
+	}
+	secret, err := conn.ecdhKey.ECDH(remote)
+	if err != nil {
+		return err
+	}
+	randoms := append(append([]byte{}, conn.clientRandom...), conn.serverRandom...)
+	if conn.extended {
+		conn.master = prf(secret, "extended master secret", conn.hash(), 48)
+	} else {
+		conn.master = prf(secret, "master secret", randoms, 48)
+	}
+	block := prf(conn.master, "key expansion", append(append([]byte{}, conn.serverRandom...), conn.clientRandom...), 40)
+	clientKey, serverKey, clientIV, serverIV := block[:16], block[16:32], block[32:36], block[36:40]
+	if conn.Client {
+		clientKey, serverKey, clientIV, serverIV = serverKey, clientKey, serverIV, clientIV
+	}
+	if conn.readAEAD, err = gcm(clientKey); err != nil {
+		return err
+	}
+	if conn.writeAEAD, err = gcm(serverKey); err != nil {
+		return err
+	}
+	conn.readIV, conn.writeIV = clientIV, serverIV
+	return nil
+}
+
+func gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func readExtensions(r *bytes.Reader) map[uint16][]byte {
+	extensions := make(map[uint16][]byte)
+	if r.Len() == 0 {
+		return extensions
+	}
+	data := bytes.NewReader(binutil.ReadBuf(r, binutil.ReadInt(r, 2)))
+	for data.Len() > 0 {
+		typ := uint16(binutil.ReadInt(data, 2))
+		extensions[typ] = binutil.ReadBuf(data, binutil.ReadInt(data, 2))
+	}
+	return extensions
+}
+
+func writeExtension(buf *bytes.Buffer, typ uint16, data []byte) {
+	binutil.WriteInt(buf, int(typ), 2)
+	binutil.WriteInt(buf, len(data), 2)
+	binutil.WriteBuf(buf, data)
+}
+
+func srtpProfiles(data []byte) (profiles []uint16) {
+	if len(data) < 2 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	for i := 2; i+1 < 2+n && i+1 < len(data); i += 2 {
+		profiles = append(profiles, binary.BigEndian.Uint16(data[i:]))
+	}
+	return
+}
+
+func (conn *DTLSConn) serverHello(r *bytes.Reader) error {
+	binutil.ReadInt(r, 2)
+	conn.clientRandom = binutil.ReadBuf(r, 32)
+	binutil.ReadBuf(r, binutil.ReadInt(r, 1))
+	binutil.ReadBuf(r, binutil.ReadInt(r, 1))
+	suites := binutil.ReadBuf(r, binutil.ReadInt(r, 2))
+	binutil.ReadBuf(r, binutil.ReadInt(r, 1))
+	extensions := readExtensions(r)
+
+	supported := false
+	for i := 0; i+1 < len(suites); i += 2 {
+		supported = supported || binary.BigEndian.Uint16(suites[i:]) == SUITE_ECDHE_ECDSA_AES128_GCM
+	}
+	if !supported {
+		return errors.New("Client offers no supported DTLS cipher suite")
+	}
+	for _, profile := range srtpProfiles(extensions[EXT_USE_SRTP]) {
+		if profile == SRTP_AES128_CM_SHA1_80 {
+			conn.Profile = profile
+		}
+	}
+	if conn.Profile == 0 {
+		return errors.New("Client offers no supported SRTP profile")
+	}
+	_, conn.extended = extensions[EXT_EXTENDED_MASTER]
+
+	conn.serverRandom = make([]byte, 32)
+	rand.Read(conn.serverRandom)
+	ext := bytes.Buffer{}
+	writeExtension(&ext, EXT_USE_SRTP, []byte{0, 2, 0, SRTP_AES128_CM_SHA1_80, 0})
+	if conn.extended {
+		writeExtension(&ext, EXT_EXTENDED_MASTER, nil)
+	}
+	if _, ok := extensions[EXT_RENEGOTIATION_INFO]; ok {
+		writeExtension(&ext, EXT_RENEGOTIATION_INFO, []byte{0})
+	}
+	writeExtension(&ext, EXT_POINT_FORMATS, []byte{1, 0})
+	hello := bytes.Buffer{}
+	binutil.WriteInt(&hello, DTLS_VERSION, 2)
+	binutil.WriteBuf(&hello, conn.serverRandom)
+	binutil.WriteInt(&hello, 0, 1)
+	binutil.WriteInt(&hello, SUITE_ECDHE_ECDSA_AES128_GCM, 2)
+	binutil.WriteInt(&hello, 0, 1)
+	binutil.WriteInt(&hello, ext.Len(), 2)
+	binutil.WriteBuf(&hello, ext.Bytes())
+	conn.handshake(HANDSHAKE_SERVER_HELLO, hello.Bytes())
+	conn.handshake(HANDSHAKE_CERTIFICATE, conn.certificate())
+
+	var err error
+	if conn.ecdhKey, err = ecdh.P256().GenerateKey(rand.Reader); err != nil {
+		return err
+	}
+	public := conn.ecdhKey.PublicKey().Bytes()
+	params := append([]byte{3, 0, CURVE_P256, byte(len(public))}, public...)
+	signature := conn.sign(append(append(append([]byte{}, conn.clientRandom...), conn.serverRandom...), params...))
+	exchange := append(append([]byte{}, params...), SIGNATURE_ECDSA_SHA256>>8, SIGNATURE_ECDSA_SHA256&0xff, byte(len(signature)>>8), byte(len(signature)))
+	conn.handshake(HANDSHAKE_SERVER_KEY_EXCHANGE, append(exchange, signature...))
+	conn.handshake(HANDSHAKE_CERTIFICATE_REQUEST, []byte{1, CERT_ECDSA_SIGN, 0, 2, SIGNATURE_ECDSA_SHA256 >> 8, SIGNATURE_ECDSA_SHA256 & 0xff, 0, 0})
+	conn.handshake(HANDSHAKE_SERVER_HELLO_DONE, nil)
+	return conn.flush()
+}
+
+func (conn *DTLSConn) certificate() []byte {
+	der := conn.Certificate.DER
+	n := len(der)
+	return append([]byte{byte((n + 3) >> 16), byte((n + 3) >> 8), byte(n + 3), byte(n >> 16), byte(n >> 8), byte(n)}, der...)
+}
+
+func (conn *DTLSConn) clientHello() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.clientRandom = make([]byte, 32)
+	rand.Read(conn.clientRandom)
+	ext := bytes.Buffer{}
+	writeExtension(&ext, EXT_USE_SRTP, []byte{0, 2, 0, SRTP_AES128_CM_SHA1_80, 0})
+	writeExtension(&ext, EXT_EXTENDED_MASTER, nil)
+	writeExtension(&ext, EXT_SUPPORTED_GROUPS, []byte{0, 2, 0, CURVE_P256})
+	writeExtension(&ext, EXT_POINT_FORMATS, []byte{1, 0})
+	writeExtension(&ext, EXT_SIGNATURE_ALGORITHMS, []byte{0, 2, SIGNATURE_ECDSA_SHA256 >> 8, SIGNATURE_ECDSA_SHA256 & 0xff})
+	hello := bytes.Buffer{}
+	binutil.WriteInt(&hello, DTLS_VERSION, 2)
+	binutil.WriteBuf(&hello, conn.clientRandom)
+	binutil.WriteInt(&hello, 0, 1)
+	binutil.WriteInt(&hello, 0, 1)
+	binutil.WriteInt(&hello, 2, 2)
+	binutil.WriteInt(&hello, SUITE_ECDHE_ECDSA_AES128_GCM, 2)
+	binutil.WriteBuf(&hello, []byte{1, 0})
+	binutil.WriteInt(&hello, ext.Len(), 2)
+	binutil.WriteBuf(&hello, ext.Bytes())
+	conn.handshake(HANDSHAKE_CLIENT_HELLO, hello.Bytes())
+	return conn.flush()
+}
+
+func (conn *DTLSConn) readServerHello(r *bytes.Reader) {
+	binutil.ReadInt(r, 2)
+	conn.serverRandom = binutil.ReadBuf(r, 32)
+	binutil.ReadBuf(r, binutil.ReadInt(r, 1))
+	if binutil.ReadInt(r, 2) != SUITE_ECDHE_ECDSA_AES128_GCM {
+		panic(errors.New("Server chose unsupported DTLS cipher suite"))
+	}
+	binutil.ReadInt(r, 1)
+	extensions := readExtensions(r)
+	if profiles := srtpProfiles(extensions[EXT_USE_SRTP]); len(profiles) == 1 {
+		conn.Profile = profiles[0]
+	}
+	_, conn.extended = extensions[EXT_EXTENDED_MASTER]
+}
+
+func (conn *DTLSConn) clientFinish() (err error) {
+	if conn.Profile != SRTP_AES128_CM_SHA1_80 || conn.peerKey == nil {
+		return errors.New("DTLS server did not negotiate SRTP key exchange")
+	}
+	conn.handshake(HANDSHAKE_CERTIFICATE, conn.certificate())
+	if conn.ecdhKey, err = ecdh.P256().GenerateKey(rand.Reader); err != nil {
+		return
+	}
+	public := conn.ecdhKey.PublicKey().Bytes()
+	conn.handshake(HANDSHAKE_CLIENT_KEY_EXCHANGE, append([]byte{byte(len(public))}, public...))
+	if err = conn.keys(); err != nil {
+		return
+	}
+	signature := conn.sign(conn.transcript.Bytes())
+	conn.handshake(HANDSHAKE_CERTIFICATE_VERIFY, append([]byte{SIGNATURE_ECDSA_SHA256 >> 8, SIGNATURE_ECDSA_SHA256 & 0xff, byte(len(signature) >> 8), byte(len(signature))}, signature...))
+	conn.changeCipherSpec()
+	conn.handshake(HANDSHAKE_FINISHED, prf(conn.master, "client finished", conn.hash(), 12))
+	return conn.flush()
+}
+
+func (conn *DTLSConn) Close() {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.done && !conn.closed {
+		conn.send(conn.record(CONTENT_ALERT, []byte{1, 0}))
+	}
+	conn.closed = true
+}
@@ -0,0 +1,198 @@
+package webrtc
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func handshakePair(t *testing.T, drop int) (client *DTLSConn, server *DTLSConn) {
+	clientCert, err := NewCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := NewCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toClient := make(chan []byte, 64)
+	toServer := make(chan []byte, 64)
+	dropped := 0
+	server = NewDTLSConn(false, serverCert, clientCert.Fingerprint, func(data []byte) error {
+		if dropped < drop {
+			dropped++
+			return nil
+		}
+		toClient <- append([]byte{}, data...)
+		return nil
+	})
+	client = NewDTLSConn(true, clientCert, serverCert.Fingerprint, func(data []byte) error {
+		toServer <- append([]byte{}, data...)
+		return nil
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Handshake(toServer)
+	}()
+	if err := client.Handshake(toClient); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestDTLSHandshake(t *testing.T) {
+	for _, drop := range []int{0, 1} {
+		client, server := handshakePair(t, drop)
+		if !bytes.Equal(client.master, server.master) || !client.extended {
+			t.Fatalf("drop %d: master secrets differ", drop)
+		}
+		if client.Profile != SRTP_AES128_CM_SHA1_80 || server.Profile != SRTP_AES128_CM_SHA1_80 {
+			t.Errorf("drop %d: SRTP profile %d/%d", drop, client.Profile, server.Profile)
+		}
+		clientSend, clientRecv, err := client.SRTPKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverSend, serverRecv, _ := server.SRTPKeys()
+		packet := []byte{0x80, 96, 0, 1, 0, 0, 0, 10, 0, 0, 0, 42, 1, 2, 3, 4}
+		protected, _ := clientSend.ProtectRTP(packet)
+		if plain, err := serverRecv.UnprotectRTP(protected); err != nil || !bytes.Equal(plain, packet) {
+			t.Errorf("drop %d: client to server SRTP: %v", drop, err)
+		}
+		protected, _ = serverSend.ProtectRTP(packet)
+		if plain, err := clientRecv.UnprotectRTP(protected); err != nil || !bytes.Equal(plain, packet) {
+			t.Errorf("drop %d: server to client SRTP: %v", drop, err)
+		}
+	}
+}
+
+func TestDTLSFingerprint(t *testing.T) {
+	clientCert, _ := NewCertificate()
+	serverCert, _ := NewCertificate()
+	toServer := make(chan []byte, 64)
+	toClient := make(chan []byte, 64)
+	server := NewDTLSConn(false, serverCert, serverCert.Fingerprint, func(data []byte) error {
+		toClient <- data
+		return nil
+	})
+	client := NewDTLSConn(true, clientCert, serverCert.Fingerprint, func(data []byte) error {
+		toServer <- data
+		return nil
+	})
+	go client.Handshake(toClient)
+	if err := server.Handshake(toServer); err == nil {
+		t.Error("handshake with wrong client fingerprint succeeded")
+	}
+	close(toClient)
+}
+
+func handshakeRecord(payload []byte) []byte {
+	record := []byte{CONTENT_HANDSHAKE, DTLS_VERSION >> 8, DTLS_VERSION & 0xff, 0, 0, 0, 0, 0, 0, 0, 0}
+	return append(binary.BigEndian.AppendUint16(record, uint16(len(payload))), payload...)
+}
+
+func fragment(seq uint16, length int, offset int, size int) []byte {
+	header := []byte{HANDSHAKE_CLIENT_HELLO, byte(length >> 16), byte(length >> 8), byte(length)}
+	header = binary.BigEndian.AppendUint16(header, seq)
+	header = append(header, byte(offset>>16), byte(offset>>8), byte(offset), byte(size>>16), byte(size>>8), byte(size))
+	return append(header, bytes.Repeat([]byte{0xaa}, size)...)
+}
+
+func TestDTLSFragments(t *testing.T) {
+	cert, _ := NewCertificate()
+	conn := NewDTLSConn(false, cert, "", func([]byte) error { return nil })
+	conn.Handle(handshakeRecord(append(fragment(0, 100, 0, 10), fragment(0, 1000, 500, 10)...)))
+	conn.Handle(handshakeRecord(fragment(0, 100, 0, 10)))
+	if msg := conn.pending[0]; msg == nil || msg.got != 10 {
+		t.Errorf("pending ClientHello %+v", msg)
+	}
+	conn.Handle(handshakeRecord(fragment(1, MAX_HANDSHAKE+1, 0, 10)))
+	if conn.pending[1] != nil {
+		t.Error("oversized handshake message accepted")
+	}
+	flood := []byte{}
+	for seq := 1; seq < 1000; seq++ {
+		flood = append(flood, fragment(uint16(seq), MAX_HANDSHAKE, 0, 0)...)
+	}
+	conn.Handle(handshakeRecord(flood))
+	if len(conn.pending) > MAX_PENDING {
+		t.Errorf("%d handshake messages pending", len(conn.pending))
+	}
+}
+
+func withoutHandshake(datagram []byte, typ uint8) []byte {
+	out := []byte{}
+	for len(datagram) >= 13 {
+		n := 13 + int(binary.BigEndian.Uint16(datagram[11:]))
+		if datagram[0] != CONTENT_HANDSHAKE || datagram[13] != typ {
+			out = append(out, datagram[:n]...)
+		}
+		datagram = datagram[n:]
+	}
+	return out
+}
+
+func TestDTLSCertificateVerify(t *testing.T) {
+	clientCert, _ := NewCertificate()
+	serverCert, _ := NewCertificate()
+	toServer := make(chan []byte, 64)
+	toClient := make(chan []byte, 64)
+	server := NewDTLSConn(false, serverCert, clientCert.Fingerprint, func(data []byte) error {
+		toClient <- append([]byte{}, data...)
+		return nil
+	})
+	client := NewDTLSConn(true, clientCert, serverCert.Fingerprint, func(data []byte) error {
+		toServer <- append([]byte{}, data...)
+		return nil
+	})
+	client.clientHello()
+	if err := server.Handle(<-toServer); err != nil {
+		t.Fatal(err)
+	}
+	for len(toClient) > 0 {
+		if err := client.Handle(withoutHandshake(<-toClient, HANDSHAKE_SERVER_HELLO_DONE)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client.append(&message{typ: HANDSHAKE_SERVER_HELLO_DONE, seq: client.recvSeq})
+
+	// a peer replaying a public certificate cannot sign CertificateVerify
+	client.handshake(HANDSHAKE_CERTIFICATE, client.certificate())
+	client.ecdhKey, _ = ecdh.P256().GenerateKey(rand.Reader)
+	public := client.ecdhKey.PublicKey().Bytes()
+	client.handshake(HANDSHAKE_CLIENT_KEY_EXCHANGE, append([]byte{byte(len(public))}, public...))
+	if err := client.keys(); err != nil {
+		t.Fatal(err)
+	}
+	client.changeCipherSpec()
+	client.handshake(HANDSHAKE_FINISHED, prf(client.master, "client finished", client.hash(), 12))
+	client.flush()
+	var err error
+	for len(toServer) > 0 && err == nil {
+		err = server.Handle(<-toServer)
+	}
+	if err == nil || !strings.Contains(err.Error(), "Unexpected handshake message 20") {
+		t.Errorf("Finished without CertificateVerify: %v", err)
+	}
+}
+
+func TestDTLSFlow(t *testing.T) {
+	cert, _ := NewCertificate()
+	for _, typ := range []uint8{HANDSHAKE_SERVER_HELLO, HANDSHAKE_SERVER_KEY_EXCHANGE, HANDSHAKE_SERVER_HELLO_DONE, HANDSHAKE_FINISHED} {
+		server := NewDTLSConn(false, cert, "", func([]byte) error { return nil })
+		if err := server.step(&message{typ: typ}); err == nil {
+			t.Errorf("server accepted handshake message %d before ClientHello", typ)
+		}
+	}
+	client := NewDTLSConn(true, cert, "", func([]byte) error { return nil })
+	if err := client.step(&message{typ: HANDSHAKE_CLIENT_HELLO}); err == nil {
+		t.Error("client accepted ClientHello")
+	}
+}
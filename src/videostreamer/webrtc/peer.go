@@ -0,0 +1,227 @@
+package webrtc
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"time"
+	"videostreamer/logger"
+)
+
+func randomString(n int) string {
+	data := make([]byte, n)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func randomUint32() uint32 {
+	data := make([]byte, 4)
+	rand.Read(data)
+	return binary.BigEndian.Uint32(data)
+}
+
+func NewPeer(host net.IP, cert *Certificate, remote *Description) (*Peer, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: host})
+	if err != nil {
+		return nil, err
+	}
+	setup := "passive"
+	if remote.Setup == "passive" {
+		setup = "active"
+	}
+	peer := &Peer{
+		Conn:   conn,
+		Remote: remote,
+		Local: &Description{
+			Ufrag:       randomString(4),
+			Pwd:         randomString(12),
+			Fingerprint: cert.Fingerprint,
+			Setup:       setup,
+			Candidates:  []*net.UDPAddr{conn.LocalAddr().(*net.UDPAddr)},
+		},
+		Connected: make(chan struct{}),
+		Done:      make(chan struct{}),
+		dtls:      make(chan []byte, 64),
+		consent:   time.Now(),
+	}
+	peer.DTLS = NewDTLSConn(setup == "active", cert, remote.Fingerprint, peer.write)
+	return peer, nil
+}
+
+func (peer *Peer) Start() {
+	go peer.run()
+}
+
+func (peer *Peer) write(data []byte) error {
+	peer.mutex.Lock()
+	addr := peer.remote
+	peer.mutex.Unlock()
+	if addr == nil {
+		return errors.New("WebRTC peer has no remote address")
+	}
+	_, err := peer.Conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (peer *Peer) WriteRTP(packet []byte) error {
+	peer.mutex.Lock()
+	context := peer.send
+	peer.mutex.Unlock()
+	if context == nil {
+		return errors.New("WebRTC peer not connected")
+	}
+	protected, err := context.ProtectRTP(packet)
+	if err != nil {
+		return err
+	}
+	return peer.write(protected)
+}
+
+func (peer *Peer) WriteRTCP(packet []byte) error {
+	peer.mutex.Lock()
+	context := peer.send
+	peer.mutex.Unlock()
+	if context == nil {
+		return errors.New("WebRTC peer not connected")
+	}
+	protected, err := context.ProtectRTCP(packet)
+	if err != nil {
+		return err
+	}
+	return peer.write(protected)
+}
+
+func (peer *Peer) Close() {
+	peer.mutex.Lock()
+	if peer.closed {
+		peer.mutex.Unlock()
+		return
+	}
+	peer.closed = true
+	peer.mutex.Unlock()
+	peer.DTLS.Close()
+	peer.Conn.Close()
+	close(peer.Done)
+}
+
+func (peer *Peer) run() {
+	defer peer.Close()
+	buf := make([]byte, 1<<16)
+	for {
+		peer.Conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := peer.Conn.ReadFromUDP(buf)
+		peer.mutex.Lock()
+		expired := time.Since(peer.consent) > CONSENT_TIMEOUT
+		peer.mutex.Unlock()
+		if expired {
+			logger.Infof("WebRTC peer %s consent expired", peer.Local.Ufrag)
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		data := append([]byte{}, buf[:n]...)
+		switch {
+		case IsStun(data):
+			peer.stun(data, addr)
+		case !peer.validated(addr):
+		case data[0] >= 20 && data[0] < 64:
+			if !peer.dtlsData(data) {
+				return
+			}
+		case data[0] >= 128 && data[0] < 192:
+			peer.rtp(data)
+		}
+	}
+}
+
+// validated reports whether addr is the remote chosen by ICE, the only source
+// DTLS and SRTP are accepted from.
+func (peer *Peer) validated(addr *net.UDPAddr) bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	return peer.remote != nil && peer.remote.IP.Equal(addr.IP) && peer.remote.Port == addr.Port
+}
+
+func (peer *Peer) stun(data []byte, addr *net.UDPAddr) {
+	msg, err := ParseStun(data)
+	if err != nil || msg.Type != STUN_BINDING_REQUEST {
+		return
+	}
+	username := string(msg.Get(ATTR_USERNAME))
+	if username != peer.Local.Ufrag+":"+peer.Remote.Ufrag || !msg.CheckIntegrity([]byte(peer.Local.Pwd)) {
+		response := NewStun(STUN_BINDING_ERROR, msg.Transaction)
+		response.Add(ATTR_ERROR_CODE, append([]byte{0, 0, 4, 1}, "Unauthorized"...))
+		peer.Conn.WriteToUDP(response.Encode(nil), addr)
+		return
+	}
+	response := NewStun(STUN_BINDING_RESPONSE, msg.Transaction)
+	response.Add(ATTR_XOR_MAPPED_ADDRESS, XorAddress(addr, msg.Transaction))
+	peer.Conn.WriteToUDP(response.Encode([]byte(peer.Local.Pwd)), addr)
+
+	peer.mutex.Lock()
+	start := peer.remote == nil
+	if start || msg.Has(ATTR_USE_CANDIDATE) {
+		peer.remote = addr
+	}
+	peer.consent = time.Now()
+	peer.mutex.Unlock()
+	if start {
+		go peer.handshake()
+	}
+}
+
+func (peer *Peer) handshake() {
+	if err := peer.DTLS.Handshake(peer.dtls); err != nil {
+		logger.Infof("WebRTC peer %s DTLS handshake failed: %v", peer.Local.Ufrag, err)
+		peer.Close()
+		return
+	}
+	send, recv, err := peer.DTLS.SRTPKeys()
+	if err != nil {
+		peer.Close()
+		return
+	}
+	peer.mutex.Lock()
+	peer.send, peer.recv, peer.connected = send, recv, true
+	peer.mutex.Unlock()
+	close(peer.Connected)
+}
+
+func (peer *Peer) dtlsData(data []byte) bool {
+	peer.mutex.Lock()
+	connected := peer.connected
+	peer.mutex.Unlock()
+	if !connected {
+		select {
+		case peer.dtls <- data:
+		default:
+		}
+		return true
+	}
+	return peer.DTLS.Handle(data) != io.EOF
+}
+
+func (peer *Peer) rtp(data []byte) {
+	peer.mutex.Lock()
+	context := peer.recv
+	peer.mutex.Unlock()
+	if context == nil || len(data) < 12 {
+		return
+	}
+	if data[1] >= 192 && data[1] <= 223 {
+		if packet, err := context.UnprotectRTCP(data); err == nil && peer.OnRTCP != nil {
+			peer.OnRTCP(packet)
+		}
+		return
+	}
+	if packet, err := context.UnprotectRTP(data); err == nil && peer.OnRTP != nil {
+		peer.OnRTP(packet)
+	}
+}
@@ -0,0 +1,185 @@
+package webrtc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func ParseDescription(sdp string) (*Description, error) {
+	desc := &Description{}
+	var media *Media
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		value := line[2:]
+		switch line[0] {
+		case 'm':
+			fields := strings.Fields(value)
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("Malformed SDP media line %q", line)
+			}
+			media = &Media{
+				Kind:      fields[0],
+				Mid:       strconv.Itoa(len(desc.Media)),
+				Direction: "sendrecv",
+				Rtpmaps:   make(map[uint8]string),
+				Fmtps:     make(map[uint8]string),
+			}
+			for _, field := range fields[3:] {
+				if pt, err := strconv.Atoi(field); err == nil && pt >= 0 && pt < 128 {
+					media.Payloads = append(media.Payloads, uint8(pt))
+				}
+			}
+			desc.Media = append(desc.Media, media)
+		case 'a':
+			name, attr, _ := strings.Cut(value, ":")
+			switch name {
+			case "ice-ufrag":
+				desc.Ufrag = attr
+			case "ice-pwd":
+				desc.Pwd = attr
+			case "setup":
+				desc.Setup = attr
+			case "fingerprint":
+				if hash, fingerprint, ok := strings.Cut(attr, " "); ok && strings.EqualFold(hash, "sha-256") {
+					desc.Fingerprint = strings.TrimSpace(fingerprint)
+				}
+			case "candidate":
+				fields := strings.Fields(attr)
+				if len(fields) >= 8 && strings.EqualFold(fields[2], "udp") && fields[7] == "host" {
+					ip := net.ParseIP(fields[4])
+					port, err := strconv.Atoi(fields[5])
+					if ip != nil && err == nil {
+						desc.Candidates = append(desc.Candidates, &net.UDPAddr{IP: ip, Port: port})
+					}
+				}
+			case "mid", "rtpmap", "fmtp", "sendrecv", "sendonly", "recvonly", "inactive", "ssrc":
+				if media == nil {
+					continue
+				}
+				switch name {
+				case "mid":
+					media.Mid = attr
+				case "rtpmap", "fmtp":
+					pt, rest, _ := strings.Cut(attr, " ")
+					n, err := strconv.Atoi(pt)
+					if err != nil || n < 0 || n > 127 {
+						continue
+					}
+					if name == "rtpmap" {
+						media.Rtpmaps[uint8(n)] = rest
+					} else {
+						media.Fmtps[uint8(n)] = rest
+					}
+				case "ssrc":
+					id, _, _ := strings.Cut(attr, " ")
+					if ssrc, err := strconv.ParseUint(id, 10, 32); err == nil && media.SSRC == 0 {
+						media.SSRC = uint32(ssrc)
+					}
+				default:
+					media.Direction = name
+				}
+			}
+		}
+	}
+	if desc.Ufrag == "" || desc.Pwd == "" {
+		return nil, errors.New("SDP lacks ICE credentials")
+	}
+	if desc.Fingerprint == "" {
+		return nil, errors.New("SDP lacks a sha-256 fingerprint")
+	}
+	return desc, nil
+}
+
+func fmtpParam(fmtp string, key string) string {
+	for _, param := range strings.Split(fmtp, ";") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(name, key) {
+			return value
+		}
+	}
+	return ""
+}
+
+func (media *Media) Select(codec string, clock int) (uint8, bool) {
+	for _, pt := range media.Payloads {
+		name, rate, _ := strings.Cut(media.Rtpmaps[pt], "/")
+		rate, _, _ = strings.Cut(rate, "/")
+		if !strings.EqualFold(name, codec) || rate != strconv.Itoa(clock) {
+			continue
+		}
+		if strings.EqualFold(codec, "H264") && fmtpParam(media.Fmtps[pt], "packetization-mode") != "1" {
+			continue
+		}
+		return pt, true
+	}
+	return 0, false
+}
+
+func (media *Media) Accept(pt uint8, direction string, ssrc uint32) *Media {
+	return &Media{
+		Kind:        media.Kind,
+		Mid:         media.Mid,
+		PayloadType: pt,
+		Codec:       media.Rtpmaps[pt],
+		Fmtp:        media.Fmtps[pt],
+		Direction:   direction,
+		SSRC:        ssrc,
+	}
+}
+
+func (media *Media) Reject() *Media {
+	return &Media{Kind: media.Kind, Mid: media.Mid, Direction: "inactive"}
+}
+
+func (desc *Description) String() string {
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "v=0\r\no=- %d 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=ice-lite\r\n", time.Now().UnixNano())
+	mids := []string{}
+	for _, media := range desc.Media {
+		if media.Codec != "" {
+			mids = append(mids, media.Mid)
+		}
+	}
+	if len(mids) > 0 {
+		fmt.Fprintf(&buf, "a=group:BUNDLE %s\r\n", strings.Join(mids, " "))
+	}
+	for _, media := range desc.Media {
+		if media.Codec == "" {
+			fmt.Fprintf(&buf, "m=%s 0 UDP/TLS/RTP/SAVPF 0\r\nc=IN IP4 0.0.0.0\r\na=mid:%s\r\na=inactive\r\n", media.Kind, media.Mid)
+			continue
+		}
+		addr := &net.UDPAddr{IP: net.IPv4zero, Port: 9}
+		if len(desc.Candidates) > 0 {
+			addr = desc.Candidates[0]
+		}
+		family := "IP4"
+		if addr.IP.To4() == nil {
+			family = "IP6"
+		}
+		fmt.Fprintf(&buf, "m=%s %d UDP/TLS/RTP/SAVPF %d\r\nc=IN %s %s\r\n", media.Kind, addr.Port, media.PayloadType, family, addr.IP)
+		fmt.Fprintf(&buf, "a=mid:%s\r\na=ice-ufrag:%s\r\na=ice-pwd:%s\r\n", media.Mid, desc.Ufrag, desc.Pwd)
+		fmt.Fprintf(&buf, "a=fingerprint:sha-256 %s\r\na=setup:%s\r\na=%s\r\na=rtcp-mux\r\n", desc.Fingerprint, desc.Setup, media.Direction)
+		fmt.Fprintf(&buf, "a=rtpmap:%d %s\r\n", media.PayloadType, media.Codec)
+		if media.Fmtp != "" {
+			fmt.Fprintf(&buf, "a=fmtp:%d %s\r\n", media.PayloadType, media.Fmtp)
+		}
+		for _, feedback := range media.Feedback {
+			fmt.Fprintf(&buf, "a=rtcp-fb:%d %s\r\n", media.PayloadType, feedback)
+		}
+		if media.SSRC != 0 {
+			fmt.Fprintf(&buf, "a=msid:videostreamer %s\r\na=ssrc:%d cname:videostreamer\r\n", media.Kind, media.SSRC)
+		}
+		for i, candidate := range desc.Candidates {
+			fmt.Fprintf(&buf, "a=candidate:%d 1 udp %d %s %d typ host\r\n", i+1, CANDIDATE_PRIORITY-i, candidate.IP, candidate.Port)
+		}
+		buf.WriteString("a=end-of-candidates\r\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,170 @@
+package webrtc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+)
+
+func deriveKey(block cipher.Block, salt []byte, label byte, n int) []byte {
+	iv := make([]byte, 16)
+	copy(iv, salt)
+	iv[7] ^= label
+	out := make([]byte, n)
+	cipher.NewCTR(block, iv).XORKeyStream(out, out)
+	return out
+}
+
+func NewSRTPContext(key []byte, salt []byte) (*SRTPContext, error) {
+	master, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	context := &SRTPContext{
+		rtpSalt:  deriveKey(master, salt, 2, SRTP_SALT_LEN),
+		rtpAuth:  deriveKey(master, salt, 1, 20),
+		rtcpSalt: deriveKey(master, salt, 5, SRTP_SALT_LEN),
+		rtcpAuth: deriveKey(master, salt, 4, 20),
+		rocs:     make(map[uint32]*rollover),
+	}
+	if context.rtpBlock, err = aes.NewCipher(deriveKey(master, salt, 0, SRTP_KEY_LEN)); err != nil {
+		return nil, err
+	}
+	if context.rtcpBlock, err = aes.NewCipher(deriveKey(master, salt, 3, SRTP_KEY_LEN)); err != nil {
+		return nil, err
+	}
+	return context, nil
+}
+
+func counter(salt []byte, ssrc uint32, index uint64) []byte {
+	iv := make([]byte, 16)
+	copy(iv, salt)
+	var word [8]byte
+	binary.BigEndian.PutUint32(word[:], ssrc)
+	for i := 0; i < 4; i++ {
+		iv[4+i] ^= word[i]
+	}
+	binary.BigEndian.PutUint64(word[:], index)
+	for i := 0; i < 8; i++ {
+		iv[6+i] ^= word[i]
+	}
+	return iv
+}
+
+func tag(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)[:SRTP_TAG_LEN]
+}
+
+func headerLength(packet []byte) (int, error) {
+	if len(packet) < 12 || packet[0]>>6 != 2 {
+		return 0, errors.New("Not an RTP packet")
+	}
+	length := 12 + 4*int(packet[0]&0x0f)
+	if packet[0]&0x10 != 0 {
+		if len(packet) < length+4 {
+			return 0, errors.New("RTP extension truncated")
+		}
+		length += 4 + 4*int(binary.BigEndian.Uint16(packet[length+2:]))
+	}
+	if length > len(packet) {
+		return 0, errors.New("RTP header truncated")
+	}
+	return length, nil
+}
+
+func (context *SRTPContext) rollover(ssrc uint32) *rollover {
+	state := context.rocs[ssrc]
+	if state == nil {
+		state = &rollover{}
+		context.rocs[ssrc] = state
+	}
+	return state
+}
+
+func (context *SRTPContext) ProtectRTP(packet []byte) ([]byte, error) {
+	header, err := headerLength(packet)
+	if err != nil {
+		return nil, err
+	}
+	ssrc := binary.BigEndian.Uint32(packet[8:])
+	seq := binary.BigEndian.Uint16(packet[2:])
+	state := context.rollover(ssrc)
+	if state.started && seq < state.last && state.last-seq > 0x8000 {
+		state.roc++
+	}
+	state.last, state.started = seq, true
+	out := append([]byte{}, packet...)
+	index := uint64(state.roc)<<16 | uint64(seq)
+	cipher.NewCTR(context.rtpBlock, counter(context.rtpSalt, ssrc, index)).XORKeyStream(out[header:], out[header:])
+	roc := binary.BigEndian.AppendUint32(nil, state.roc)
+	return append(out, tag(context.rtpAuth, out, roc)...), nil
+}
+
+func (context *SRTPContext) UnprotectRTP(packet []byte) ([]byte, error) {
+	header, err := headerLength(packet)
+	if err != nil || len(packet) < header+SRTP_TAG_LEN {
+		return nil, errors.New("SRTP packet truncated")
+	}
+	ssrc := binary.BigEndian.Uint32(packet[8:])
+	seq := binary.BigEndian.Uint16(packet[2:])
+	state := context.rollover(ssrc)
+	roc := state.roc
+	if state.started {
+		if state.last < 0x8000 {
+			if seq > state.last && seq-state.last > 0x8000 {
+				roc--
+			}
+		} else if state.last-0x8000 > seq {
+			roc++
+		}
+	}
+	body := packet[:len(packet)-SRTP_TAG_LEN]
+	if !hmac.Equal(tag(context.rtpAuth, body, binary.BigEndian.AppendUint32(nil, roc)), packet[len(body):]) {
+		return nil, errors.New("SRTP authentication failed")
+	}
+	if !state.started || roc == state.roc+1 {
+		state.roc, state.last, state.started = roc, seq, true
+	} else if roc == state.roc && seq > state.last {
+		state.last = seq
+	}
+	out := append([]byte{}, body...)
+	index := uint64(roc)<<16 | uint64(seq)
+	cipher.NewCTR(context.rtpBlock, counter(context.rtpSalt, ssrc, index)).XORKeyStream(out[header:], out[header:])
+	return out, nil
+}
+
+func (context *SRTPContext) ProtectRTCP(packet []byte) ([]byte, error) {
+	if len(packet) < 8 {
+		return nil, errors.New("RTCP packet truncated")
+	}
+	context.rtcpIndex = (context.rtcpIndex + 1) & 0x7fffffff
+	ssrc := binary.BigEndian.Uint32(packet[4:])
+	out := append([]byte{}, packet...)
+	cipher.NewCTR(context.rtcpBlock, counter(context.rtcpSalt, ssrc, uint64(context.rtcpIndex))).XORKeyStream(out[8:], out[8:])
+	out = binary.BigEndian.AppendUint32(out, 0x80000000|context.rtcpIndex)
+	return append(out, tag(context.rtcpAuth, out)...), nil
+}
+
+func (context *SRTPContext) UnprotectRTCP(packet []byte) ([]byte, error) {
+	if len(packet) < 8+4+SRTP_TAG_LEN {
+		return nil, errors.New("SRTCP packet truncated")
+	}
+	body := packet[:len(packet)-SRTP_TAG_LEN]
+	if !hmac.Equal(tag(context.rtcpAuth, body), packet[len(body):]) {
+		return nil, errors.New("SRTCP authentication failed")
+	}
+	word := binary.BigEndian.Uint32(body[len(body)-4:])
+	out := append([]byte{}, body[:len(body)-4]...)
+	if word&0x80000000 != 0 {
+		ssrc := binary.BigEndian.Uint32(out[4:])
+		cipher.NewCTR(context.rtcpBlock, counter(context.rtcpSalt, ssrc, uint64(word&0x7fffffff))).XORKeyStream(out[8:], out[8:])
+	}
+	return out, nil
+}
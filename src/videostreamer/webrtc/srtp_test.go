@@ -0,0 +1,72 @@
+package webrtc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestKeyDerivation(t *testing.T) {
+	master, _ := aes.NewCipher(unhex("E1F97A0D3E018BE0D64FA32C06DE4139"))
+	salt := unhex("0EC675AD498AFEEBB6960B3AABE6")
+	if key := deriveKey(master, salt, 0, 16); !bytes.Equal(key, unhex("C61E7A93744F39EE10734AFE3FF7A087")) {
+		t.Errorf("cipher key %x", key)
+	}
+	if key := deriveKey(master, salt, 2, 14); !bytes.Equal(key, unhex("30CBBC08863D8C85D49DB34A9AE1")) {
+		t.Errorf("cipher salt %x", key)
+	}
+	if key := deriveKey(master, salt, 1, 20); !bytes.Equal(key, unhex("CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4")) {
+		t.Errorf("auth key %x", key)
+	}
+}
+
+func TestKeystream(t *testing.T) {
+	block, _ := aes.NewCipher(unhex("2B7E151628AED2A6ABF7158809CF4F3C"))
+	iv := counter(unhex("F0F1F2F3F4F5F6F7F8F9FAFBFCFD"), 0, 0)
+	out := make([]byte, 32)
+	cipher.NewCTR(block, iv).XORKeyStream(out, out)
+	if !bytes.Equal(out, unhex("E03EAD0935C95E80E166B16DD92B4EB4D23513162B02D0F72A43A2FE4A5F97AB")) {
+		t.Errorf("keystream %x", out)
+	}
+}
+
+func TestSRTP(t *testing.T) {
+	key, salt := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 14)
+	sender, _ := NewSRTPContext(key, salt)
+	receiver, _ := NewSRTPContext(key, salt)
+	for _, seq := range []uint16{65534, 65535, 0, 1} {
+		packet := append([]byte{0x80, 96, byte(seq >> 8), byte(seq), 0, 0, 0, 1, 0xca, 0xfe, 0xba, 0xbe}, []byte("payload")...)
+		protected, err := sender.ProtectRTP(packet)
+		if err != nil || len(protected) != len(packet)+SRTP_TAG_LEN || bytes.Contains(protected, []byte("payload")) {
+			t.Fatalf("protected %x: %v", protected, err)
+		}
+		plain, err := receiver.UnprotectRTP(protected)
+		if err != nil || !bytes.Equal(plain, packet) {
+			t.Errorf("seq %d unprotected %x: %v", seq, plain, err)
+		}
+	}
+	if sender.rocs[0xcafebabe].roc != 1 || receiver.rocs[0xcafebabe].roc != 1 {
+		t.Error("rollover counter not advanced")
+	}
+	protected, _ := sender.ProtectRTP([]byte{0x80, 96, 0, 2, 0, 0, 0, 1, 0xca, 0xfe, 0xba, 0xbe, 1})
+	protected[12] ^= 1
+	if _, err := receiver.UnprotectRTP(protected); err == nil {
+		t.Error("accepted tampered packet")
+	}
+
+	report := []byte{0x80, 200, 0, 6, 0xca, 0xfe, 0xba, 0xbe, 1, 2, 3, 4, 5, 6, 7, 8}
+	protected, _ = sender.ProtectRTCP(report)
+	if plain, err := receiver.UnprotectRTCP(protected); err != nil || !bytes.Equal(plain, report) {
+		t.Errorf("unprotected RTCP %x: %v", plain, err)
+	}
+}
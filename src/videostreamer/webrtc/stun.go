@@ -0,0 +1,137 @@
+package webrtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+func IsStun(data []byte) bool {
+	return len(data) >= 20 && data[0] < 4 && binary.BigEndian.Uint32(data[4:]) == STUN_MAGIC
+}
+
+func ParseStun(data []byte) (*StunMessage, error) {
+	if !IsStun(data) || int(binary.BigEndian.Uint16(data[2:]))+20 != len(data) {
+		return nil, errors.New("Not a STUN message")
+	}
+	msg := &StunMessage{
+		Type:        binary.BigEndian.Uint16(data),
+		Transaction: data[8:20],
+		raw:         data,
+	}
+	for rest := data[20:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return nil, errors.New("STUN attribute truncated")
+		}
+		length := int(binary.BigEndian.Uint16(rest[2:]))
+		if 4+length > len(rest) {
+			return nil, errors.New("STUN attribute truncated")
+		}
+		msg.Attributes = append(msg.Attributes, StunAttribute{binary.BigEndian.Uint16(rest), rest[4 : 4+length]})
+		padded := 4 + (length+3)&^3
+		if padded > len(rest) {
+			padded = len(rest)
+		}
+		rest = rest[padded:]
+	}
+	return msg, nil
+}
+
+func NewStun(typ uint16, transaction []byte) *StunMessage {
+	return &StunMessage{Type: typ, Transaction: transaction}
+}
+
+func (msg *StunMessage) Get(typ uint16) []byte {
+	for _, attr := range msg.Attributes {
+		if attr.Type == typ {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+func (msg *StunMessage) Has(typ uint16) bool {
+	return msg.Get(typ) != nil
+}
+
+func (msg *StunMessage) Add(typ uint16, value []byte) {
+	msg.Attributes = append(msg.Attributes, StunAttribute{typ, value})
+}
+
+func (msg *StunMessage) CheckIntegrity(key []byte) bool {
+	offset := 20
+	for _, attr := range msg.Attributes {
+		if attr.Type == ATTR_MESSAGE_INTEGRITY {
+			if len(attr.Value) != 20 {
+				return false
+			}
+			head := append([]byte{}, msg.raw[:offset]...)
+			binary.BigEndian.PutUint16(head[2:], uint16(offset-20+24))
+			mac := hmac.New(sha1.New, key)
+			mac.Write(head)
+			return hmac.Equal(mac.Sum(nil), attr.Value)
+		}
+		offset += 4 + (len(attr.Value)+3)&^3
+	}
+	return false
+}
+
+func appendAttribute(buf []byte, typ uint16, value []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, typ)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func (msg *StunMessage) Encode(key []byte) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, msg.Type)
+	buf = append(buf, 0, 0)
+	buf = binary.BigEndian.AppendUint32(buf, STUN_MAGIC)
+	buf = append(buf, msg.Transaction...)
+	for _, attr := range msg.Attributes {
+		buf = appendAttribute(buf, attr.Type, attr.Value)
+	}
+	if key != nil {
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)-20+24))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(buf)
+		buf = appendAttribute(buf, ATTR_MESSAGE_INTEGRITY, mac.Sum(nil))
+	}
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)-20+8))
+	fingerprint := crc32.ChecksumIEEE(buf) ^ STUN_FINGERPRINT_XOR
+	buf = appendAttribute(buf, ATTR_FINGERPRINT, binary.BigEndian.AppendUint32(nil, fingerprint))
+	return buf
+}
+
+func XorAddress(addr *net.UDPAddr, transaction []byte) []byte {
+	ip := addr.IP.To4()
+	family := byte(1)
+	if ip == nil {
+		ip, family = addr.IP.To16(), 2
+	}
+	value := []byte{0, family}
+	value = binary.BigEndian.AppendUint16(value, uint16(addr.Port)^uint16(STUN_MAGIC>>16))
+	key := append(binary.BigEndian.AppendUint32(nil, STUN_MAGIC), transaction...)
+	for i, b := range ip {
+		value = append(value, b^key[i])
+	}
+	return value
+}
+
+func ParseXorAddress(value []byte, transaction []byte) *net.UDPAddr {
+	if len(value) < 8 {
+		return nil
+	}
+	key := append(binary.BigEndian.AppendUint32(nil, STUN_MAGIC), transaction...)
+	ip := make(net.IP, len(value)-4)
+	for i := range ip {
+		ip[i] = value[4+i] ^ key[i]
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(value[2:]) ^ uint16(STUN_MAGIC>>16))}
+}
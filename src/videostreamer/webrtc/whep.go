@@ -0,0 +1,361 @@
+package webrtc
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/check"
+	"videostreamer/core"
+	"videostreamer/logger"
+	"videostreamer/rtsp"
+)
+
+func NewConfig() *Config {
+	return &Config{}
+}
+
+func NewHandler(app *core.Application, config *Config) *Handler {
+	return &Handler{
+		App:         app,
+		Config:      config,
+		Certificate: check.Check1(NewCertificate()).(*Certificate),
+		players:     make(map[string]*Player),
+	}
+}
+
+func ParsePath(path string) (name string, id string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	if len(parts) == 3 {
+		id = parts[2]
+	}
+	return parts[1], id, true
+}
+
+func Cors(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+func ReadOffer(w http.ResponseWriter, r *http.Request) *Description {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "Offer must be application/sdp", http.StatusUnsupportedMediaType)
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MAX_OFFER))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil
+	}
+	offer, err := ParseDescription(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	return offer
+}
+
+func WriteAnswer(w http.ResponseWriter, r *http.Request, id string, answer *Description) {
+	path := strings.SplitN(r.RequestURI, "?", 2)[0]
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", strings.TrimSuffix(path, "/")+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.String())
+}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if Cors(w, r) {
+		return
+	}
+	name, id, ok := ParsePath(r.URL.Path)
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case r.Method == "POST" && id == "":
+		handler.offer(w, r, name)
+	case r.Method == "DELETE" && id != "":
+		handler.mutex.Lock()
+		player := handler.players[id]
+		handler.mutex.Unlock()
+		if player == nil || player.Stream.Name != name {
+			http.NotFound(w, r)
+			return
+		}
+		player.Peer.Close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (handler *Handler) offer(w http.ResponseWriter, r *http.Request, name string) {
+	offer := ReadOffer(w, r)
+	if offer == nil {
+		return
+	}
+	peer, err := NewPeer(handler.Config.Host, handler.Certificate, offer)
+	if err != nil {
+		logger.Warnf("WebRTC peer for %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	player := &Player{
+		ID:      randomString(8),
+		Stream:  handler.App.AcquireStream(name),
+		Peer:    peer,
+		handler: handler,
+		queue:   make(chan *frame, QUEUE_SIZE),
+	}
+	for _, media := range offer.Media {
+		var track **Track
+		var pt uint8
+		var found bool
+		switch {
+		case media.Direction != "recvonly" && media.Direction != "sendrecv":
+		case media.Kind == "video" && player.Video == nil:
+			pt, found = media.Select("H264", VIDEO_CLOCK)
+			track = &player.Video
+		case media.Kind == "audio" && player.Audio == nil:
+			pt, found = media.Select(FOURCC_OPUS, OPUS_CLOCK)
+			track = &player.Audio
+		}
+		if !found {
+			peer.Local.Media = append(peer.Local.Media, media.Reject())
+			continue
+		}
+		*track = newTrack(media.Accept(pt, "sendonly", randomUint32()))
+		peer.Local.Media = append(peer.Local.Media, (*track).Media)
+	}
+	if player.Video == nil && player.Audio == nil {
+		peer.Close()
+		http.Error(w, "No acceptable H264 or Opus media in offer", http.StatusNotAcceptable)
+		return
+	}
+	handler.mutex.Lock()
+	handler.players[player.ID] = player
+	handler.mutex.Unlock()
+	peer.Start()
+	go player.run()
+	logger.Infof("WHEP player %s for %s", player.ID, name)
+	WriteAnswer(w, r, player.ID, peer.Local)
+}
+
+func newTrack(media *Media) *Track {
+	clock := uint32(VIDEO_CLOCK)
+	if media.Kind == "audio" {
+		clock = OPUS_CLOCK
+	}
+	return &Track{
+		Media:  media,
+		SSRC:   media.SSRC,
+		Seq:    uint16(randomUint32()),
+		Offset: randomUint32(),
+		Clock:  clock,
+	}
+}
+
+func (handler *Handler) remove(player *Player) {
+	handler.mutex.Lock()
+	if handler.players[player.ID] == player {
+		delete(handler.players, player.ID)
+	}
+	handler.mutex.Unlock()
+}
+
+func (player *Player) run() {
+	defer player.close()
+	select {
+	case <-player.Peer.Connected:
+	case <-player.Peer.Done:
+		return
+	}
+	logger.Infof("WHEP player %s connected to %s", player.ID, player.Stream.Name)
+	player.mutex.Lock()
+	if _, key, _ := player.Stream.Keys(); key != nil && len(key.Data) > 5 && key.IsAVC() && key.Data[1] == 0 {
+		player.config, _ = avc.ParseConfig(key.Data[5:])
+	}
+	player.waitKey = player.Video != nil
+	player.playing = true
+	player.mutex.Unlock()
+	if player.Stream.IsPublished() {
+		player.Stream.Bootstrap(player)
+	}
+	player.Stream.Subscribe(player)
+	ticker := time.NewTicker(REPORT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case f := <-player.queue:
+			if err := player.send(f); err != nil {
+				logger.Infof("WHEP player %s of %s gone: %v", player.ID, player.Stream.Name, err)
+				return
+			}
+		case <-ticker.C:
+			player.report()
+		case <-player.Peer.Done:
+			return
+		}
+	}
+}
+
+func (player *Player) close() {
+	player.mutex.Lock()
+	if player.ended {
+		player.mutex.Unlock()
+		return
+	}
+	player.ended = true
+	player.mutex.Unlock()
+	player.Stream.Unsubscribe(player)
+	for _, track := range []*Track{player.Video, player.Audio} {
+		if track != nil && track.sent {
+			player.Peer.WriteRTCP(rtsp.Goodbye(track.SSRC))
+		}
+	}
+	player.Peer.Close()
+	player.handler.remove(player)
+	logger.Infof("WHEP player %s of %s closed", player.ID, player.Stream.Name)
+}
+
+func (player *Player) Publish() {
+	player.mutex.Lock()
+	player.waitKey = player.Video != nil
+	player.mutex.Unlock()
+}
+
+func (player *Player) Unpublish() {
+	player.mutex.Lock()
+	player.rebase = player.based
+	player.mutex.Unlock()
+}
+
+func (player *Player) ConsumeVideo(data *core.VideoData) {
+	d := data.Data
+	if len(d) < 5 || !data.IsAVC() {
+		return
+	}
+	player.mutex.Lock()
+	defer player.mutex.Unlock()
+	if !player.playing || player.ended || player.Video == nil {
+		return
+	}
+	switch d[1] {
+	case 0:
+		if config, err := avc.ParseConfig(d[5:]); err == nil && len(config.SPS) > 0 {
+			player.config = config
+		}
+	case 1:
+		if player.config == nil {
+			return
+		}
+		if player.waitKey {
+			if d[0]>>4 != 1 {
+				return
+			}
+			player.waitKey = false
+		}
+		cts := int32(uint32(d[2])<<16|uint32(d[3])<<8|uint32(d[4])) << 8 >> 8
+		player.enqueue(&frame{video: true, time: data.Time + uint32(cts), data: d[5:]})
+	}
+}
+
+func (player *Player) ConsumeAudio(data *core.AudioData) {
+	d := data.Data
+	if len(d) < 6 || d[0]>>4 != AUDIO_EX_HEADER || d[0]&0x0f != AUDIO_PACKET_CODED_FRAMES || string(d[1:5]) != FOURCC_OPUS {
+		return
+	}
+	player.mutex.Lock()
+	defer player.mutex.Unlock()
+	if !player.playing || player.ended || player.Audio == nil {
+		return
+	}
+	player.enqueue(&frame{time: data.Time, data: d[5:]})
+}
+
+func (player *Player) ConsumeMeta(data *core.MetaData) {}
+
+func (player *Player) enqueue(f *frame) {
+	select {
+	case player.queue <- f:
+	default:
+		player.Dropped++
+		player.waitKey = player.Video != nil
+	}
+}
+
+func (player *Player) send(f *frame) error {
+	player.mutex.Lock()
+	config := player.config
+	if !player.based {
+		player.based = true
+		player.base = f.time
+		player.wall = time.Now()
+	} else if player.rebase {
+		elapsed := player.last - player.base + REBASE_GAP
+		player.rebase = false
+		player.base = f.time - elapsed
+		player.wall = time.Now().Add(-time.Duration(elapsed) * time.Millisecond)
+	}
+	player.last = f.time
+	base := player.base
+	player.mutex.Unlock()
+	var track *Track
+	var payloads [][]byte
+	if f.video {
+		track = player.Video
+		nalus := [][]byte{}
+		idr, sps := false, false
+		for _, nalu := range avc.SplitNALUs(f.data, config.LengthSize) {
+			if len(nalu) == 0 || nalu[0]&0x1f == avc.NALU_AUD {
+				continue
+			}
+			idr = idr || nalu[0]&0x1f == avc.NALU_IDR
+			sps = sps || nalu[0]&0x1f == avc.NALU_SPS
+			nalus = append(nalus, nalu)
+		}
+		if idr && !sps {
+			nalus = append(append(append([][]byte{}, config.SPS...), config.PPS...), nalus...)
+		}
+		payloads = rtsp.PacketizeH264(nalus, MAX_PAYLOAD)
+	} else {
+		track = player.Audio
+		payloads = [][]byte{f.data}
+	}
+	rtp := track.Offset + uint32(int64(int32(f.time-base))*int64(track.Clock)/1000)
+	for i, payload := range payloads {
+		packet := rtsp.Packet(track.Media.PayloadType, i == len(payloads)-1, track.Seq, rtp, track.SSRC, payload)
+		if err := player.Peer.WriteRTP(packet); err != nil {
+			return err
+		}
+		track.Seq++
+		track.Packets++
+		track.Octets += uint32(len(payload))
+	}
+	track.lastTime, track.lastRTP, track.sent = f.time, rtp, true
+	return nil
+}
+
+func (player *Player) report() {
+	player.mutex.Lock()
+	base, wall := player.base, player.wall
+	player.mutex.Unlock()
+	for _, track := range []*Track{player.Video, player.Audio} {
+		if track == nil || !track.sent {
+			continue
+		}
+		at := wall.Add(time.Duration(int32(track.lastTime-base)) * time.Millisecond)
+		player.Peer.WriteRTCP(rtsp.SenderReport(track.SSRC, rtsp.NTP(at), track.lastRTP, track.Packets, track.Octets))
+	}
+}
@@ -0,0 +1,127 @@
+package webrtc
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/testutil"
+)
+
+var idr = append([]byte{0x17, 0x01, 0x00, 0x00, 0x00}, avc.JoinNALUs([][]byte{{0x65, 0x88, 0x84}})...)
+
+const (
+	videoOffer = "m=video 9 UDP/TLS/RTP/SAVPF 97 102\nc=IN IP4 0.0.0.0\na=rtpmap:97 VP8/90000\na=rtpmap:102 H264/90000\na=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
+	audioOffer = "m=audio 9 UDP/TLS/RTP/SAVPF 111 0\nc=IN IP4 0.0.0.0\na=rtpmap:111 opus/48000/2\na=rtpmap:0 PCMU/8000"
+	vp8Offer   = "m=video 9 UDP/TLS/RTP/SAVPF 97\nc=IN IP4 0.0.0.0\na=rtpmap:97 VP8/90000"
+)
+
+func post(t *testing.T, url string, contentType string, body string) *http.Response {
+	response, err := http.Post(url, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestWHEP(t *testing.T) {
+	app := core.NewApplication()
+	stream := app.AcquireStream("test")
+	stream.ReceiveVideo(core.NewVideoData(0, testutil.Seq))
+	handler := NewHandler(app, &Config{Host: net.IPv4(127, 0, 0, 1)})
+	server := httptest.NewServer(http.StripPrefix("/whep", handler))
+	defer server.Close()
+
+	client := newTestClient(t)
+	defer client.close()
+	if response := post(t, server.URL+"/whep/live/test", "text/plain", client.offer("recvonly", videoOffer)); response.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("status %d for wrong content type", response.StatusCode)
+	}
+	if response := post(t, server.URL+"/whep/live/test", "application/sdp", client.offer("recvonly", vp8Offer)); response.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("status %d for VP8 only offer", response.StatusCode)
+	}
+	response := post(t, server.URL+"/whep/live/test", "application/sdp", client.offer("recvonly", videoOffer, audioOffer))
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusCreated || response.Header.Get("Content-Type") != "application/sdp" {
+		t.Fatalf("status %d: %s", response.StatusCode, body)
+	}
+	location := response.Header.Get("Location")
+	if !strings.HasPrefix(location, "/whep/live/test/") {
+		t.Errorf("location %q", location)
+	}
+	for _, line := range []string{"a=ice-lite", "a=group:BUNDLE 0 1", "a=setup:passive", "a=sendonly", "a=rtpmap:102 H264/90000", "a=rtpmap:111 opus/48000/2", "typ host"} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("answer lacks %q:\n%s", line, body)
+		}
+	}
+	answer, err := ParseDescription(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Fingerprint != handler.Certificate.Fingerprint {
+		t.Errorf("answer fingerprint %s", answer.Fingerprint)
+	}
+	client.connect(answer)
+
+	done := make(chan struct{})
+	go func() {
+		for i := uint32(1); ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			stream.ReceiveVideo(core.NewVideoData(40*i, idr))
+			stream.ReceiveAudio(core.NewAudioData(40*i, []byte{0x91, 'O', 'p', 'u', 's', 0xfc, 0x01}))
+		}
+	}()
+	defer close(done)
+	video, audio := false, false
+	for !video || !audio {
+		packet := client.readRTP()
+		switch packet[1] & 0x7f {
+		case 102:
+			switch packet[12] & 0x1f {
+			case avc.NALU_IDR:
+				video = true
+			case avc.NALU_SPS, avc.NALU_PPS:
+			default:
+				t.Errorf("unexpected video payload %x", packet[12:])
+			}
+		case 111:
+			if !bytes.Equal(packet[12:], []byte{0xfc, 0x01}) {
+				t.Errorf("opus payload %x", packet[12:])
+			}
+			audio = true
+		default:
+			t.Fatalf("payload type %d", packet[1]&0x7f)
+		}
+	}
+
+	request, _ := http.NewRequest("DELETE", server.URL+location, nil)
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %v", err)
+	}
+	for i := 0; ; i++ {
+		handler.mutex.Lock()
+		n := len(handler.players)
+		handler.mutex.Unlock()
+		if n == 0 && stream.Subscribers() == 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("player not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	request, _ = http.NewRequest("DELETE", server.URL+location, nil)
+	if response, _ := http.DefaultClient.Do(request); response.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d deleting twice", response.StatusCode)
+	}
+}
@@ -0,0 +1,284 @@
+package webrtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/check"
+	"videostreamer/core"
+	"videostreamer/logger"
+	"videostreamer/rtsp"
+)
+
+func NewIngestHandler(app *core.Application, config *Config) *IngestHandler {
+	return &IngestHandler{
+		App:         app,
+		Config:      config,
+		Certificate: check.Check1(NewCertificate()).(*Certificate),
+		publishers:  make(map[string]*Publisher),
+	}
+}
+
+func (handler *IngestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if Cors(w, r) {
+		return
+	}
+	name, id, ok := ParsePath(r.URL.Path)
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case r.Method == "POST" && id == "":
+		handler.offer(w, r, name)
+	case r.Method == "DELETE" && id != "":
+		handler.mutex.Lock()
+		publisher := handler.publishers[id]
+		handler.mutex.Unlock()
+		if publisher == nil || publisher.Stream.Name != name {
+			http.NotFound(w, r)
+			return
+		}
+		publisher.Peer.Close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (handler *IngestHandler) claim(publisher *Publisher) bool {
+	if !publisher.Stream.Claim(publisher) {
+		return false
+	}
+	handler.mutex.Lock()
+	handler.publishers[publisher.ID] = publisher
+	handler.mutex.Unlock()
+	return true
+}
+
+func (handler *IngestHandler) remove(publisher *Publisher) {
+	handler.mutex.Lock()
+	if handler.publishers[publisher.ID] == publisher {
+		delete(handler.publishers, publisher.ID)
+	}
+	handler.mutex.Unlock()
+	publisher.Stream.Release(publisher)
+}
+
+func (handler *IngestHandler) offer(w http.ResponseWriter, r *http.Request, name string) {
+	offer := ReadOffer(w, r)
+	if offer == nil {
+		return
+	}
+	peer, err := NewPeer(handler.Config.Host, handler.Certificate, offer)
+	if err != nil {
+		logger.Warnf("WebRTC peer for %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	publisher := &Publisher{
+		ID:      randomString(8),
+		Stream:  handler.App.AcquireStream(name),
+		Peer:    peer,
+		handler: handler,
+		ssrc:    randomUint32(),
+	}
+	for _, media := range offer.Media {
+		var track **Track
+		var pt uint8
+		var found bool
+		switch {
+		case media.Direction != "sendonly" && media.Direction != "sendrecv":
+		case media.Kind == "video" && publisher.Video == nil:
+			pt, found = media.Select("H264", VIDEO_CLOCK)
+			track = &publisher.Video
+		case media.Kind == "audio" && publisher.Audio == nil:
+			pt, found = media.Select(FOURCC_OPUS, OPUS_CLOCK)
+			track = &publisher.Audio
+		}
+		if !found {
+			peer.Local.Media = append(peer.Local.Media, media.Reject())
+			continue
+		}
+		accepted := media.Accept(pt, "recvonly", 0)
+		if media.Kind == "video" {
+			accepted.Feedback = []string{"nack pli"}
+		}
+		*track = newTrack(accepted)
+		peer.Local.Media = append(peer.Local.Media, accepted)
+	}
+	if publisher.Video == nil && publisher.Audio == nil {
+		peer.Close()
+		http.Error(w, "No acceptable H264 or Opus media in offer", http.StatusNotAcceptable)
+		return
+	}
+	if !handler.claim(publisher) {
+		peer.Close()
+		http.Error(w, "Stream "+name+" is already published", http.StatusConflict)
+		return
+	}
+	publisher.waitKey = publisher.Video != nil
+	peer.OnRTP = publisher.receive
+	peer.Start()
+	go publisher.run()
+	logger.Infof("WHIP publisher %s for %s", publisher.ID, name)
+	WriteAnswer(w, r, publisher.ID, peer.Local)
+}
+
+func (publisher *Publisher) run() {
+	select {
+	case <-publisher.Peer.Connected:
+		logger.Infof("WHIP publisher %s connected to %s", publisher.ID, publisher.Stream.Name)
+		if publisher.Video == nil {
+			publisher.mutex.Lock()
+			publisher.publish()
+			publisher.mutex.Unlock()
+		}
+		<-publisher.Peer.Done
+	case <-publisher.Peer.Done:
+	}
+	publisher.mutex.Lock()
+	publisher.ended = true
+	if publisher.published && publisher.Stream.IsPublished() {
+		publisher.Stream.Unpublish()
+	}
+	publisher.mutex.Unlock()
+	publisher.handler.remove(publisher)
+	logger.Infof("WHIP publisher %s of %s closed", publisher.ID, publisher.Stream.Name)
+}
+
+func (publisher *Publisher) publish() {
+	if publisher.published {
+		return
+	}
+	publisher.published = true
+	if !publisher.Stream.IsPublished() {
+		publisher.Stream.Publish()
+	}
+	if publisher.Audio != nil {
+		channels := 2
+		if parts := strings.Split(publisher.Audio.Media.Codec, "/"); len(parts) == 3 {
+			if n, err := strconv.Atoi(parts[2]); err == nil && n > 0 {
+				channels = n
+			}
+		}
+		head := append([]byte{AUDIO_EX_HEADER<<4 | AUDIO_PACKET_SEQUENCE}, FOURCC_OPUS...)
+		head = append(head, "OpusHead"...)
+		head = append(head, 1, byte(channels))
+		head = binary.LittleEndian.AppendUint16(head, OPUS_PRE_SKIP)
+		head = binary.LittleEndian.AppendUint32(head, OPUS_CLOCK)
+		head = append(head, 0, 0, 0)
+		publisher.Stream.ReceiveAudio(core.NewAudioData(0, head))
+	}
+}
+
+func (publisher *Publisher) time(track *Track, rtp uint32) uint32 {
+	if !publisher.started {
+		publisher.started = true
+		publisher.start = time.Now()
+	}
+	if !track.received {
+		track.received = true
+		track.anchor = uint32(time.Since(publisher.start) / time.Millisecond)
+		track.lastRTP = rtp
+	}
+	track.extended += int64(int32(rtp - track.lastRTP))
+	track.lastRTP = rtp
+	return track.anchor + uint32(track.extended*1000/int64(track.Clock))
+}
+
+func (publisher *Publisher) receive(data []byte) {
+	packet, err := rtsp.ParsePacket(data)
+	if err != nil {
+		return
+	}
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	if publisher.ended {
+		return
+	}
+	switch {
+	case publisher.Video != nil && packet.PayloadType == publisher.Video.Media.PayloadType:
+		publisher.Video.SSRC = packet.SSRC
+		for _, unit := range publisher.h264.Push(packet) {
+			publisher.video(unit)
+		}
+	case publisher.Audio != nil && packet.PayloadType == publisher.Audio.Media.PayloadType:
+		if len(packet.Payload) == 0 {
+			return
+		}
+		t := publisher.time(publisher.Audio, packet.Timestamp)
+		if !publisher.published {
+			return
+		}
+		frame := append([]byte{AUDIO_EX_HEADER<<4 | AUDIO_PACKET_CODED_FRAMES}, FOURCC_OPUS...)
+		publisher.Stream.ReceiveAudio(core.NewAudioData(t, append(frame, packet.Payload...)))
+	}
+}
+
+func (publisher *Publisher) requestKey() {
+	if time.Since(publisher.lastPLI) < PLI_INTERVAL {
+		return
+	}
+	publisher.lastPLI = time.Now()
+	publisher.Peer.WriteRTCP(rtsp.PictureLoss(publisher.ssrc, publisher.Video.SSRC))
+}
+
+func (publisher *Publisher) video(unit *rtsp.AccessUnit) {
+	t := publisher.time(publisher.Video, unit.Time)
+	if unit.Damaged {
+		publisher.waitKey = true
+		publisher.requestKey()
+		return
+	}
+	nalus := [][]byte{}
+	key, changed := false, false
+	for _, nalu := range unit.NALUs {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case avc.NALU_SPS:
+			changed = changed || !bytes.Equal(nalu, publisher.sps)
+			publisher.sps = nalu
+		case avc.NALU_PPS:
+			changed = changed || !bytes.Equal(nalu, publisher.pps)
+			publisher.pps = nalu
+		case avc.NALU_AUD:
+		case avc.NALU_IDR:
+			key = true
+			nalus = append(nalus, nalu)
+		default:
+			nalus = append(nalus, nalu)
+		}
+	}
+	if publisher.sps == nil || publisher.pps == nil {
+		publisher.requestKey()
+		return
+	}
+	if changed {
+		config := avc.MakeConfig([][]byte{publisher.sps}, [][]byte{publisher.pps})
+		publisher.Stream.ReceiveVideo(core.NewVideoData(t, append([]byte{0x17, 0, 0, 0, 0}, config...)))
+		publisher.publish()
+		if info, err := avc.ParseSPS(publisher.sps); err == nil {
+			publisher.Stream.ReceiveMeta(core.NewMetaData(info.Width, info.Height, 0))
+		}
+	}
+	if publisher.waitKey {
+		if !key {
+			publisher.requestKey()
+			return
+		}
+		publisher.waitKey = false
+	}
+	if len(nalus) == 0 {
+		return
+	}
+	header := byte(0x27)
+	if key {
+		header = 0x17
+	}
+	publisher.Stream.ReceiveVideo(core.NewVideoData(t, append([]byte{header, 1, 0, 0, 0}, avc.JoinNALUs(nalus)...)))
+}
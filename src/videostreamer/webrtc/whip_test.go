@@ -0,0 +1,133 @@
+package webrtc
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"videostreamer/avc"
+	"videostreamer/core"
+	"videostreamer/rtsp"
+	"videostreamer/testutil"
+)
+
+func TestWHIP(t *testing.T) {
+	app := core.NewApplication()
+	stream := app.AcquireStream("test")
+	record := testutil.NewRecorder()
+	stream.Subscribe(record)
+	handler := NewIngestHandler(app, &Config{Host: net.IPv4(127, 0, 0, 1)})
+	server := httptest.NewServer(http.StripPrefix("/whip", handler))
+	defer server.Close()
+
+	client := newTestClient(t)
+	defer client.close()
+	if response := post(t, server.URL+"/whip/live/test", "application/sdp", client.offer("recvonly", videoOffer)); response.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("status %d for recvonly offer", response.StatusCode)
+	}
+	response := post(t, server.URL+"/whip/live/test", "application/sdp", client.offer("sendonly", videoOffer, audioOffer))
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.StatusCode, body)
+	}
+	for _, line := range []string{"a=recvonly", "a=rtcp-fb:102 nack pli", "a=rtpmap:111 opus/48000/2"} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("answer lacks %q:\n%s", line, body)
+		}
+	}
+	if response := post(t, server.URL+"/whip/live/test", "application/sdp", client.offer("sendonly", videoOffer)); response.StatusCode != http.StatusConflict {
+		t.Errorf("status %d for second publisher", response.StatusCode)
+	}
+	answer, err := ParseDescription(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.connect(answer)
+
+	seq := uint16(100)
+	send := func(pt uint8, ts uint32, payloads [][]byte) {
+		for i, payload := range payloads {
+			client.writeRTP(rtsp.Packet(pt, i == len(payloads)-1, seq, ts, 0x1234, payload))
+			seq++
+		}
+	}
+	send(102, 1000, [][]byte{{0x41, 0x9a}})
+	select {
+	case data := <-client.rtcp:
+		packet, err := client.recv.UnprotectRTCP(data)
+		if err != nil || packet[1] != rtsp.RTCP_PSFB || packet[0]&0x1f != 1 {
+			t.Errorf("expected PLI, got %x: %v", packet, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no PLI before first keyframe")
+	}
+	frame := append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 3000)...)
+	stap := []byte{rtsp.NALU_STAP_A, 0, byte(len(testutil.SPS))}
+	stap = append(append(stap, testutil.SPS...), 0, byte(len(testutil.PPS)))
+	stap = append(stap, testutil.PPS...)
+	send(102, 4000, append([][]byte{stap}, rtsp.PacketizeH264([][]byte{frame}, 1200)...))
+	send(102, 7600, [][]byte{{0x41, 0x9b}})
+	send(111, 50000, [][]byte{{0xfc, 0x01}})
+	send(111, 50960, [][]byte{{0xfc, 0x02}})
+
+	read := func() *core.VideoData {
+		select {
+		case data := <-record.Video:
+			return data
+		case <-time.After(5 * time.Second):
+			t.Fatal("no video published")
+		}
+		return nil
+	}
+	if published := <-record.State; !published {
+		t.Fatal("stream not published")
+	}
+	header := read()
+	config, err := avc.ParseConfig(header.Data[5:])
+	if header.Data[0] != 0x17 || header.Data[1] != 0 || err != nil || !bytes.Equal(config.SPS[0], testutil.SPS) || !bytes.Equal(config.PPS[0], testutil.PPS) {
+		t.Fatalf("sequence header %x: %v", header.Data, err)
+	}
+	key := read()
+	for key.Data[1] == 0 {
+		key = read()
+	}
+	if key.Data[0] != 0x17 || key.Data[1] != 1 || !bytes.Equal(key.Data[5:], avc.JoinNALUs([][]byte{frame})) {
+		t.Errorf("keyframe %x", key.Data[:16])
+	}
+	inter := read()
+	if inter.Data[0] != 0x27 || inter.Time-key.Time != 40 {
+		t.Errorf("inter frame %x at %d after %d", inter.Data, inter.Time, key.Time)
+	}
+	select {
+	case meta := <-record.Meta:
+		if meta.Width != 640 || meta.Height != 480 {
+			t.Errorf("metadata %dx%d", meta.Width, meta.Height)
+		}
+	default:
+		t.Error("no metadata published")
+	}
+	audio := []*core.AudioData{<-record.Audio, <-record.Audio, <-record.Audio}
+	if !bytes.Equal(audio[0].Data[:13], append([]byte{0x90, 'O', 'p', 'u', 's'}, "OpusHead"...)) || audio[0].Data[14] != 2 {
+		t.Errorf("opus sequence start %x", audio[0].Data)
+	}
+	if !bytes.Equal(audio[1].Data, []byte{0x91, 'O', 'p', 'u', 's', 0xfc, 0x01}) || audio[2].Time-audio[1].Time != 20 {
+		t.Errorf("opus frames %x at %d, %d", audio[1].Data, audio[1].Time, audio[2].Time)
+	}
+
+	request, _ := http.NewRequest("DELETE", server.URL+response.Header.Get("Location"), nil)
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %v", err)
+	}
+	select {
+	case published := <-record.State:
+		if published {
+			t.Error("stream published again")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still published")
+	}
+}
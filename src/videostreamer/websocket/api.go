@@ -0,0 +1,30 @@
+package websocket
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	OP_CONTINUATION = 0
+	OP_TEXT         = 1
+	OP_BINARY       = 2
+	OP_CLOSE        = 8
+	OP_PING         = 9
+	OP_PONG         = 10
+)
+
+const MAX_MESSAGE = 16 << 20
+
+const GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+type Conn struct {
+	Conn         net.Conn
+	WriteTimeout time.Duration
+	rw           *bufio.ReadWriter
+	client       bool
+	closed       bool
+	mutex        sync.Mutex
+}
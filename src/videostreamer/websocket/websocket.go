@@ -0,0 +1,224 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func IsUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+func accept(key string) string {
+	sum := sha1.Sum([]byte(key + GUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !IsUpgrade(r) || key == "" {
+		http.Error(w, "Expected WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("Not a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("Unsupported WebSocket version")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("Response does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept(key))
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{Conn: conn, rw: rw}, nil
+}
+
+func Dial(rawurl string) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("Unsupported scheme %s", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":80"
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	fmt.Fprintf(rw, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", u.RequestURI(), u.Host, key)
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(rw.Reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != accept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake failed: %s", resp.Status)
+	}
+	return &Conn{Conn: conn, rw: rw, client: true}, nil
+}
+
+func (conn *Conn) WriteMessage(op uint8, data []byte) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.writeFrame(op, data)
+}
+
+func (conn *Conn) writeFrame(op uint8, data []byte) error {
+	if conn.closed {
+		return io.ErrClosedPipe
+	}
+	if conn.WriteTimeout > 0 {
+		conn.Conn.SetWriteDeadline(time.Now().Add(conn.WriteTimeout))
+	}
+	header := []byte{0x80 | op, 0}
+	switch {
+	case len(data) < 126:
+		header[1] = byte(len(data))
+	case len(data) < 65536:
+		header[1] = 126
+		header = append(header, byte(len(data)>>8), byte(len(data)))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(data)))
+	}
+	if conn.client {
+		header[1] |= 0x80
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		header = append(header, mask...)
+		masked := make([]byte, len(data))
+		for i, b := range data {
+			masked[i] = b ^ mask[i%4]
+		}
+		data = masked
+	}
+	conn.rw.Write(header)
+	conn.rw.Write(data)
+	return conn.rw.Flush()
+}
+
+func (conn *Conn) readFrame() (fin bool, op uint8, data []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn.rw, header); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	op = header[0] & 0x0f
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(conn.rw, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(conn.rw, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > MAX_MESSAGE {
+		err = errors.New("WebSocket frame too large")
+		return
+	}
+	var mask []byte
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err = io.ReadFull(conn.rw, mask); err != nil {
+			return
+		}
+	}
+	data = make([]byte, length)
+	if _, err = io.ReadFull(conn.rw, data); err != nil {
+		return
+	}
+	for i := range mask {
+		for j := i; j < len(data); j += 4 {
+			data[j] ^= mask[i]
+		}
+	}
+	return
+}
+
+func (conn *Conn) ReadMessage() (op uint8, data []byte, err error) {
+	for {
+		fin, frameOp, payload, err := conn.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOp {
+		case OP_PING:
+			conn.WriteMessage(OP_PONG, payload)
+			continue
+		case OP_PONG:
+			continue
+		case OP_CLOSE:
+			conn.mutex.Lock()
+			conn.writeFrame(OP_CLOSE, payload)
+			conn.closed = true
+			conn.mutex.Unlock()
+			return OP_CLOSE, payload, io.EOF
+		case OP_CONTINUATION:
+			if op == 0 {
+				return 0, nil, errors.New("Unexpected WebSocket continuation")
+			}
+		default:
+			op = frameOp
+			data = nil
+		}
+		data = append(data, payload...)
+		if len(data) > MAX_MESSAGE {
+			return 0, nil, errors.New("WebSocket message too large")
+		}
+		if fin {
+			return op, data, nil
+		}
+	}
+}
+
+func (conn *Conn) Close() error {
+	conn.mutex.Lock()
+	if !conn.closed {
+		conn.writeFrame(OP_CLOSE, []byte{0x03, 0xe8})
+		conn.closed = true
+	}
+	conn.mutex.Unlock()
+	return conn.Conn.Close()
+}
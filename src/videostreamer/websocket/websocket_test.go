@@ -0,0 +1,62 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccept(t *testing.T) {
+	if got := accept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("accept %s", got)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			op, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(op, data)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(server.URL, "http") + "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, size := range []int{5, 200, 70000} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		if err = conn.WriteMessage(OP_BINARY, msg); err != nil {
+			t.Fatal(err)
+		}
+		op, data, err := conn.ReadMessage()
+		if err != nil || op != OP_BINARY || !bytes.Equal(data, msg) {
+			t.Errorf("echo of %d bytes: op %d len %d %v", size, op, len(data), err)
+		}
+	}
+	conn.WriteMessage(OP_PING, []byte("hi"))
+	conn.WriteMessage(OP_CLOSE, nil)
+	if _, _, err = conn.ReadMessage(); err != io.EOF {
+		t.Errorf("%v instead of EOF after close", err)
+	}
+}
+
+func TestRejectPlainRequest(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if _, err := Upgrade(rec, httptest.NewRequest("GET", "/", nil)); err == nil || rec.Code != http.StatusBadRequest {
+		t.Errorf("plain request upgraded: %d %v", rec.Code, err)
+	}
+}